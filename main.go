@@ -1,24 +1,362 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/nikochiko/dns-server/server"
 )
 
 func main() {
+	seed := flag.Int64("seed", 0, "seed for answer rotation and ID randomness (0 picks a random seed)")
+	forward := flag.String("forward", "", "comma separated upstream resolvers to forward non-authoritative queries to, tls://host for DNS over TLS, or sdns:// DNS stamps")
+	udpSize := flag.Uint("udp-size", 1232, "largest UDP response to send to EDNS(0) clients")
+	udpBatch := flag.Int("udp-batch", 32, "UDP datagrams to read and write per system call on Linux, 1 turns batching off")
+	recordsFile := flag.String("records", "", "zone file in master file format to serve records from")
+	nsid := flag.String("nsid", "", "identifier of this instance returned to clients asking with the NSID EDNS option")
+	strict := flag.Bool("strict", false, "answer out of spec queries with FORMERR instead of making what sense of them can be made")
+	logLevel := flag.String("log-level", "info", "minimum level of log messages: debug, info, warn or error")
+	acmeAddr := flag.String("acme-addr", "", "address to serve the ACME DNS-01 endpoint on, API key is read from $ACME_API_KEY")
+	acmeUser := flag.String("acme-user", "acme", "username for the ACME DNS-01 endpoint")
+	acmeZone := flag.String("acme-zone", "", "zone that acme-dns style updates create records in")
+	adminAddr := flag.String("admin-addr", "", "address to serve the admin API on, e.g. 127.0.0.1:8080")
+	auditLog := flag.String("audit-log", "", "file to append a JSON line to for every change to the records")
+	adminTokens := flag.String("admin-tokens", "", "JSON file of bearer tokens the admin API requires, optionally scoped to zones")
+	httpBackend := flag.String("http-backend", "", "HTTP endpoint serving records as JSON for the zones in -http-backend-zones")
+	httpBackendZones := flag.String("http-backend-zones", "", "comma separated zones answered from -http-backend")
+	policyFile := flag.String("policy", "", "file of policy rules deciding what to do with queries")
+	snapshots := flag.Int("snapshots", 10, "number of versions of the records kept for rollbacks through the admin API")
+	kubernetes := flag.String("kubernetes", "", "serve the cluster domain from the Kubernetes API at this URL, or \"in-cluster\" to use the pod's service account")
+	kubernetesDomain := flag.String("kubernetes-domain", "cluster.local", "cluster domain services and pods are served under")
+	dhcpLeases := flag.String("dhcp-leases", "", "lease file of dnsmasq, ISC dhcpd or Kea to publish hostnames from")
+	dhcpDomain := flag.String("dhcp-domain", "lan", "domain hostnames from -dhcp-leases are published under")
+	forwardOutstanding := flag.Int("forward-max-outstanding", server.DefaultRetryBudget().MaxOutstanding, "most queries a forwarder has outstanding upstream at once, 0 for no limit")
+	forwardPerClient := flag.Int("forward-max-per-client", server.DefaultRetryBudget().MaxOutstandingPerClient, "most queries of a single client a forwarder has outstanding upstream at once, 0 for no limit")
+	forwardRetryRatio := flag.Float64("forward-retry-ratio", server.DefaultRetryBudget().RetryRatio, "share of forwarded queries that may be retried on another upstream after a failure")
+	namedConf := flag.String("named-conf", "", "BIND named.conf to load master zones and take forwarders from, -forward takes precedence")
+	drainDelay := flag.Duration("drain-delay", 30*time.Second, "how long a server draining on SIGUSR1 keeps answering queries while it reports not ready")
+	tlsAddr := flag.String("tls-addr", "", "address to serve DNS over TLS on, port 853 by default")
+	tlsCert := flag.String("tls-cert", "", "certificate file in PEM format for -tls-addr")
+	tlsKey := flag.String("tls-key", "", "private key file in PEM format for -tls-addr")
+	tlsPadding := flag.Int("tls-padding", server.DefaultPaddingBlockSize, "block size to pad DNS over TLS responses to, 0 turns padding off")
+	healthAddr := flag.String("health-addr", "", "address to serve the /healthz and /readyz probes on")
+	selfTestName := flag.String("selftest-name", "", "name queried by readiness probes and the selftest command, defaults to the first zone's SOA")
+	selfTestType := flag.String("selftest-type", "A", "record type queried by readiness probes and the selftest command")
+	selfTestExpect := flag.String("selftest-expect", "", "data one of the answers to the self-test query must have, in zone file syntax")
+	chaos := flag.String("chaos", "", "for testing only: faults to inject into responses, e.g. latency=50ms,jitter=20ms,drop=0.1,truncate=0.05,seed=1")
+	forwardChaos := flag.String("forward-chaos", "", "for testing only: faults to inject into upstream queries, in the syntax of -chaos")
+	checkConfig := flag.Bool("check-config", false, "load and validate the configuration, zones, certificates and listen addresses, report every problem found and exit without serving")
+	flag.Parse()
+
+	// with -check-config every problem is reported before exiting, without
+	// it the first one is fatal
+	var problems []string
+	fail := func(what string, err error) {
+		if !*checkConfig {
+			panic(err)
+		}
+
+		problems = append(problems, fmt.Sprintf("%s: %v", what, err))
+	}
+
+	level, err := server.ParseLogLevel(*logLevel)
+	if err != nil {
+		fail("log level", err)
+		level = server.LevelInfo
+	}
+	logger := server.NewLogger(os.Stderr, level)
+
 	// default listen address
 	laddr := "127.0.0.1:1053"
 
-	if len(os.Args) > 1 {
-		laddr = os.Args[1]
+	var selfTest *server.SelfTest
+	if *selfTestName != "" {
+		qtype, err := server.ParseQType(*selfTestType)
+		if err != nil {
+			fail("self-test type", err)
+		} else {
+			selfTest = &server.SelfTest{Name: *selfTestName, Type: qtype, Expect: *selfTestExpect}
+		}
+	}
+
+	// "selftest [addr]" checks a running server, e.g. as an exec probe
+	if flag.Arg(0) == "selftest" {
+		if flag.NArg() > 1 {
+			laddr = flag.Arg(1)
+		}
+
+		os.Exit(runSelfTest(laddr, selfTest))
+	}
+
+	// "dumpzone [zone]" writes the records of a running server if -admin-addr
+	// is given, with the token in $ADMIN_TOKEN if any, otherwise those of
+	// -records, as a master file
+	if flag.Arg(0) == "dumpzone" {
+		os.Exit(runDumpZone(*adminAddr, *recordsFile, flag.Arg(1)))
+	}
+
+	// "diffzone <old> <new>" writes the RRsets that differ between two zone
+	// files, "diffzone <new>" those between the server at -admin-addr and
+	// a zone file, before it's loaded
+	if flag.Arg(0) == "diffzone" {
+		os.Exit(runDiffZone(*adminAddr, flag.Arg(1), flag.Arg(2)))
+	}
+
+	if flag.NArg() > 0 {
+		laddr = flag.Arg(0)
+	}
+
+	budget := server.DefaultRetryBudget()
+	budget.MaxOutstanding = *forwardOutstanding
+	budget.MaxOutstandingPerClient = *forwardPerClient
+	budget.RetryRatio = *forwardRetryRatio
+	forwarderOpts := []server.ForwarderOption{
+		server.WithForwarderLogger(logger),
+		server.WithRetryBudget(budget),
+	}
+
+	opts := []server.Option{
+		server.WithLogger(logger),
+		server.WithMaxUDPSize(uint16(*udpSize)),
+		server.WithUDPBatchSize(*udpBatch),
+		server.WithSnapshotHistory(*snapshots),
+	}
+
+	if *chaos != "" {
+		c, err := server.ParseChaos(*chaos)
+		if err != nil {
+			fail("-chaos", err)
+		} else {
+			logger.Warnf("injecting faults into responses: %s", *chaos)
+			opts = append(opts, server.WithChaos(c))
+		}
+	}
+
+	if *forwardChaos != "" {
+		c, err := server.ParseChaos(*forwardChaos)
+		if err != nil {
+			fail("-forward-chaos", err)
+		} else {
+			logger.Warnf("injecting faults into upstream queries: %s", *forwardChaos)
+			forwarderOpts = append(forwarderOpts, server.WithForwarderChaos(c))
+		}
+	}
+
+	if *namedConf != "" {
+		conf, err := server.LoadNamedConf(*namedConf)
+		if err != nil {
+			fail("-named-conf", err)
+		} else {
+			for _, warning := range conf.Warnings {
+				logger.Warnf("%s: %s", *namedConf, warning)
+			}
+
+			confOpts, err := conf.Options(forwarderOpts...)
+			if err != nil {
+				fail("-named-conf", err)
+			}
+
+			opts = append(opts, confOpts...)
+		}
+	}
+	if *seed != 0 {
+		opts = append(opts, server.WithSeed(*seed))
+	}
+
+	if *auditLog != "" {
+		if *checkConfig {
+			// a dry run doesn't create the audit log
+			if err := checkWritable(*auditLog); err != nil {
+				fail("-audit-log", err)
+			}
+		} else {
+			f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				panic(err)
+			}
+			defer f.Close()
+
+			opts = append(opts, server.WithAuditLog(f))
+		}
+	}
+
+	if *strict {
+		opts = append(opts, server.WithParseMode(server.ParseStrict))
+	}
+
+	if *nsid != "" {
+		opts = append(opts, server.WithNSID([]byte(*nsid)))
+	}
+
+	if *forward != "" {
+		forwarder, err := server.NewForwarder(strings.Split(*forward, ","), forwarderOpts...)
+		if err != nil {
+			fail("-forward", err)
+		} else {
+			opts = append(opts, server.WithForwarder(forwarder))
+		}
 	}
 
-	srv, err := server.NewDNSServer(laddr, "")
+	if *policyFile != "" {
+		policy, err := server.LoadPolicyFile(*policyFile, forwarderOpts...)
+		if err != nil {
+			fail("-policy", err)
+		} else {
+			opts = append(opts, server.WithPolicy(policy))
+		}
+	}
+
+	if *httpBackend != "" {
+		var zones []string
+		if *httpBackendZones != "" {
+			zones = strings.Split(*httpBackendZones, ",")
+		}
+
+		backend, err := server.NewHTTPBackend(*httpBackend, zones, server.WithHTTPBackendLogger(logger))
+		if err != nil {
+			fail("-http-backend", err)
+		} else {
+			opts = append(opts, server.WithBackend(backend))
+		}
+	}
+
+	if *kubernetes != "" {
+		kubeOpts := []server.KubernetesOption{
+			server.WithKubernetesClusterDomain(*kubernetesDomain),
+			server.WithKubernetesLogger(logger),
+		}
+
+		var backend *server.KubernetesBackend
+		if *kubernetes == "in-cluster" {
+			backend, err = server.NewInClusterKubernetesBackend(kubeOpts...)
+		} else {
+			backend, err = server.NewKubernetesBackend(*kubernetes, kubeOpts...)
+		}
+		if err != nil {
+			fail("-kubernetes", err)
+		} else {
+			opts = append(opts, server.WithBackend(backend))
+		}
+	}
+
+	if *dhcpLeases != "" {
+		backend, err := server.NewDHCPBackend(*dhcpLeases, *dhcpDomain, server.WithDHCPLogger(logger))
+		if err != nil {
+			fail("-dhcp-leases", err)
+		} else {
+			opts = append(opts, server.WithBackend(backend))
+		}
+	}
+
+	if selfTest != nil {
+		opts = append(opts, server.WithSelfTest(*selfTest))
+	}
+
+	if *tlsAddr != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fail("-tls-cert and -tls-key", err)
+		} else {
+			opts = append(opts, server.WithTLSListener(server.TLSListener{
+				Addr:             *tlsAddr,
+				Config:           &tls.Config{Certificates: []tls.Certificate{cert}},
+				PaddingBlockSize: *tlsPadding,
+			}))
+		}
+	}
+
+	var adminOpts []server.AdminOption
+	if *adminTokens != "" {
+		tokens, err := server.LoadAPITokens(*adminTokens)
+		if err != nil {
+			fail("-admin-tokens", err)
+		} else {
+			adminOpts = append(adminOpts, server.WithAPITokens(tokens))
+		}
+	}
+
+	acmeConfig := server.ACMEConfig{
+		Username: *acmeUser,
+		APIKey:   os.Getenv("ACME_API_KEY"),
+		Zone:     *acmeZone,
+	}
+
+	srv, err := server.NewDNSServer(laddr, *recordsFile, opts...)
 	if err != nil {
-		panic(err)
+		fail("server", err)
 	}
 
+	if *checkConfig {
+		if srv != nil {
+			if err := srv.CheckListen(); err != nil {
+				fail("listen address", err)
+			}
+
+			if *acmeAddr != "" {
+				if _, err := server.NewACMEHandler(srv, acmeConfig); err != nil {
+					fail("-acme-addr", err)
+				}
+			}
+		}
+
+		for flagName, addr := range map[string]string{"-health-addr": *healthAddr, "-admin-addr": *adminAddr, "-acme-addr": *acmeAddr} {
+			if addr == "" {
+				continue
+			}
+
+			if err := checkBindable(addr); err != nil {
+				fail(flagName, err)
+			}
+		}
+
+		os.Exit(reportCheck(problems))
+	}
+
+	if *healthAddr != "" {
+		go func() {
+			panic(http.ListenAndServe(*healthAddr, server.NewHealthHandler(srv)))
+		}()
+	}
+
+	if *adminAddr != "" {
+		go func() {
+			panic(http.ListenAndServe(*adminAddr, server.NewAdminHandler(srv, adminOpts...)))
+		}()
+	}
+
+	if *acmeAddr != "" {
+		acme, err := server.NewACMEHandler(srv, acmeConfig)
+		if err != nil {
+			panic(err)
+		}
+
+		go func() {
+			panic(http.ListenAndServe(*acmeAddr, acme))
+		}()
+	}
+
+	// SIGUSR1 takes the server out of rotation before it's stopped
+	drain := make(chan os.Signal, 1)
+	signal.Notify(drain, syscall.SIGUSR1)
+	go func() {
+		for range drain {
+			srv.Drain(*drainDelay)
+		}
+	}()
+
 	err = srv.Listen()
 	if err != nil {
 		panic(err)
@@ -52,3 +390,206 @@ func main() {
 	// 	}
 	// }
 }
+
+// reportCheck reports the outcome of -check-config, returning the exit code
+func reportCheck(problems []string) int {
+	if len(problems) == 0 {
+		fmt.Println("config ok")
+		return 0
+	}
+
+	sort.Strings(problems)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "config error: %s\n", problem)
+	}
+
+	return 1
+}
+
+// checkBindable checks that a TCP listener can be opened on addr
+func checkBindable(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return l.Close()
+}
+
+// checkWritable checks that the file at path can be appended to, or created
+// if it doesn't exist yet, without creating it
+func checkWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err == nil {
+		return f.Close()
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	if !dir.IsDir() {
+		return fmt.Errorf("%s is not a directory", filepath.Dir(path))
+	}
+
+	return nil
+}
+
+// runSelfTest checks the server at addr answers, and answers the self-test
+// query as expected if one is given, returning the exit code
+func runSelfTest(addr string, selfTest *server.SelfTest) int {
+	err := server.Ping(addr, 0)
+	if err == nil && selfTest != nil {
+		err = selfTest.Run(addr)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "selftest failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Println("ok")
+	return 0
+}
+
+// runDumpZone writes zone to stdout, returning the exit code
+func runDumpZone(adminAddr, recordsFile, zone string) int {
+	if adminAddr == "" {
+		srv, err := server.NewDNSServer("", recordsFile, server.WithLogger(server.NewLogger(os.Stderr, server.LevelWarn)))
+		if err == nil {
+			err = srv.DumpZone(os.Stdout, zone)
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "dumpzone failed: %v\n", err)
+			return 1
+		}
+
+		return 0
+	}
+
+	dump, err := fetchZone(adminAddr, zone)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dumpzone failed: %v\n", err)
+		return 1
+	}
+
+	os.Stdout.Write(dump)
+	return 0
+}
+
+// fetchZone returns the records of zone, or of all zones if it's empty, of
+// the server whose admin API is at adminAddr as a master file
+func fetchZone(adminAddr, zone string) ([]byte, error) {
+	if strings.HasPrefix(adminAddr, ":") {
+		adminAddr = "127.0.0.1" + adminAddr
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+adminAddr+"/zone?"+url.Values{"name": {zone}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// an admin API with tokens needs one, see -admin-tokens
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+// runDiffZone writes the RRsets that differ between the zone files at
+// oldPath and newPath, or if newPath is empty, between the zones of the
+// server whose admin API is at adminAddr and those of the file at oldPath.
+// Like diff(1), it returns 0 if nothing differs, 1 if something does and 2
+// if the zones couldn't be compared
+func runDiffZone(adminAddr, oldPath, newPath string) int {
+	if oldPath == "" || (newPath == "" && adminAddr == "") {
+		fmt.Fprintln(os.Stderr, "usage: diffzone <old file> <new file>, or -admin-addr <addr> diffzone <new file>")
+		return 2
+	}
+
+	var oldRecords, newRecords []*server.ResourceRecord
+	var err error
+	if newPath != "" {
+		oldRecords, err = server.LoadZoneFile(oldPath)
+		if err == nil {
+			newRecords, err = server.LoadZoneFile(newPath)
+		}
+	} else {
+		newRecords, err = server.LoadZoneFile(oldPath)
+		if err == nil {
+			oldRecords, err = fetchZonesOf(adminAddr, newRecords)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "diffzone failed: %v\n", err)
+		return 2
+	}
+
+	diffs := server.DiffRecords(oldRecords, newRecords)
+	if err := server.WriteZoneDiff(os.Stdout, diffs); err != nil {
+		fmt.Fprintf(os.Stderr, "diffzone failed: %v\n", err)
+		return 2
+	}
+
+	if len(diffs) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// fetchZonesOf returns the records the server whose admin API is at adminAddr
+// serves for the zones records have SOA records for, or all of them if there
+// are none
+func fetchZonesOf(adminAddr string, records []*server.ResourceRecord) ([]*server.ResourceRecord, error) {
+	zones := []string{}
+	for _, rr := range records {
+		if rr.Type == &server.TypeSOA {
+			zones = append(zones, rr.Name)
+		}
+	}
+
+	if len(zones) == 0 {
+		zones = append(zones, "")
+	}
+
+	live := []*server.ResourceRecord{}
+	for _, zone := range zones {
+		dump, err := fetchZone(adminAddr, zone)
+		if err != nil {
+			return nil, err
+		}
+
+		zoneRecords, err := server.ParseZoneFile(bytes.NewReader(dump), "")
+		if err != nil {
+			return nil, fmt.Errorf("error while parsing records of the server: %v", err)
+		}
+
+		live = append(live, zoneRecords...)
+	}
+
+	return live, nil
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultChallengeLifetime is how long challenge records are served when
+	// they aren't cleaned up by the client
+	defaultChallengeLifetime = time.Hour
+
+	// challengeTTL is kept short so that resolvers pick up new tokens quickly
+	challengeTTL = 60
+
+	acmeChallengeLabel = "_acme-challenge"
+
+	// maxACMERequestSize caps request bodies, which only carry a name and a
+	// token
+	maxACMERequestSize = 4 << 10
+)
+
+// ACMEConfig configures the ACME DNS-01 endpoint
+type ACMEConfig struct {
+	Username string
+	APIKey   string
+
+	// Zone is where acme-dns style /update requests put their records, as
+	// <subdomain>.<Zone>. Domains being validated CNAME their _acme-challenge
+	// name to that record
+	Zone string
+
+	// Lifetime is how long challenge records are served if they are never
+	// cleaned up. Defaults to an hour
+	Lifetime time.Duration
+}
+
+// ACMEHandler is an HTTP endpoint that lets ACME clients create and clean up
+// the TXT records of DNS-01 challenges in zones served by the server. It
+// speaks two protocols:
+//
+// lego's httpreq protocol, also easy to call from certbot's manual hooks, with
+// HTTP basic auth:
+//
+//	POST /present {"fqdn": "_acme-challenge.example.com.", "value": "<token>"}
+//	POST /cleanup {"fqdn": "_acme-challenge.example.com.", "value": "<token>"}
+//
+// and acme-dns' update call, with X-Api-User and X-Api-Key headers:
+//
+//	POST /update {"subdomain": "<subdomain>", "txt": "<token>"}
+type ACMEHandler struct {
+	srv    *DNSServer
+	config ACMEConfig
+	mux    *http.ServeMux
+}
+
+// NewACMEHandler returns an ACME DNS-01 endpoint for srv
+func NewACMEHandler(srv *DNSServer, config ACMEConfig) (*ACMEHandler, error) {
+	if config.Username == "" || config.APIKey == "" {
+		return nil, errors.New("ACME endpoint needs a username and API key")
+	}
+
+	if config.Lifetime == 0 {
+		config.Lifetime = defaultChallengeLifetime
+	}
+	config.Zone = strings.ToLower(strings.TrimSuffix(config.Zone, "."))
+
+	h := ACMEHandler{
+		srv:    srv,
+		config: config,
+		mux:    http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/present", h.handlePresent)
+	h.mux.HandleFunc("/cleanup", h.handleCleanup)
+	h.mux.HandleFunc("/update", h.handleUpdate)
+
+	return &h, nil
+}
+
+func (h *ACMEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *ACMEHandler) authorized(username, key string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(username), []byte(h.config.Username)) == 1
+	keyOK := subtle.ConstantTimeCompare([]byte(key), []byte(h.config.APIKey)) == 1
+
+	return userOK && keyOK
+}
+
+type httpreqRequest struct {
+	FQDN  string `json:"fqdn"`
+	Value string `json:"value"`
+}
+
+// readHTTPReq authenticates and decodes a present or cleanup request, and
+// returns the challenge record it refers to
+func (h *ACMEHandler) readHTTPReq(w http.ResponseWriter, r *http.Request) (*ResourceRecord, bool) {
+	username, key, ok := r.BasicAuth()
+	if !ok || !h.authorized(username, key) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="acme"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	req := httpreqRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxACMERequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return nil, false
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(req.FQDN, "."))
+	if !strings.HasPrefix(name, acmeChallengeLabel+".") {
+		http.Error(w, "fqdn must be an _acme-challenge name", http.StatusBadRequest)
+		return nil, false
+	}
+
+	rr, err := h.challengeRecord(name, req.Value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	return rr, true
+}
+
+func (h *ACMEHandler) challengeRecord(name, token string) (*ResourceRecord, error) {
+	if token == "" || len(token) > 255 {
+		return nil, errors.New("challenge token must be between 1 and 255 characters")
+	}
+
+	if !h.srv.isAuthoritativeFor(name) {
+		return nil, fmt.Errorf("%s is not in a zone served here", name)
+	}
+
+	rr, err := NewTXT(name, challengeTTL, token)
+	if err != nil {
+		return nil, err
+	}
+	rr.ExpiresAt = time.Now().Add(h.config.Lifetime)
+
+	return rr, nil
+}
+
+// change describes a change to the records made by an ACME client
+func (h *ACMEHandler) change(reason string) recordChange {
+	return recordChange{source: ChangeSourceACME, actor: h.config.Username, reason: reason}
+}
+
+func (h *ACMEHandler) handlePresent(w http.ResponseWriter, r *http.Request) {
+	rr, ok := h.readHTTPReq(w, r)
+	if !ok {
+		return
+	}
+
+	// presenting the same token twice must not serve it twice, so an earlier
+	// record of the token is swapped for the new one in the same version of
+	// the records, and the token is served throughout
+	h.srv.updateRecords(h.change("added ACME challenge for "+rr.Name), func(u *recordUpdate) bool {
+		for _, existing := range u.recordsNamed(rr.Name) {
+			if existing.Type == rr.Type && string(existing.Value) == string(rr.Value) {
+				u.remove(existing)
+			}
+		}
+
+		u.add(rr)
+		return true
+	})
+
+	h.srv.log.Infof("added ACME challenge record for %s", rr.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *ACMEHandler) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	rr, ok := h.readHTTPReq(w, r)
+	if !ok {
+		return
+	}
+
+	removed := h.srv.removeRecordsFor(rr.Name, rr.Type, rr.Value, h.change("removed ACME challenge for "+rr.Name))
+
+	h.srv.log.Infof("removed %d ACME challenge records for %s", removed, rr.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+type acmeDNSUpdate struct {
+	Subdomain string `json:"subdomain"`
+	TXT       string `json:"txt"`
+}
+
+// handleUpdate implements acme-dns' update call. Like acme-dns, the two most
+// recent tokens of a subdomain are served, so that a certificate for both a
+// domain and its wildcard can be validated at once
+func (h *ACMEHandler) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r.Header.Get("X-Api-User"), r.Header.Get("X-Api-Key")) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if h.config.Zone == "" {
+		http.Error(w, "no zone configured for updates", http.StatusNotFound)
+		return
+	}
+
+	update := acmeDNSUpdate{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxACMERequestSize)).Decode(&update); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	subdomain := strings.ToLower(update.Subdomain)
+	if subdomain == "" || strings.Contains(subdomain, ".") {
+		http.Error(w, "subdomain must be a single label", http.StatusBadRequest)
+		return
+	}
+
+	rr, err := h.challengeRecord(subdomain+"."+h.config.Zone, update.TXT)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// keep only the most recently added of the existing tokens, swapping in
+	// the new one in the same version of the records
+	h.srv.updateRecords(h.change("updated ACME challenge for "+rr.Name), func(u *recordUpdate) bool {
+		var newest *ResourceRecord
+		for _, existing := range u.recordsNamed(rr.Name) {
+			if existing.Type != rr.Type || existing.Name != rr.Name {
+				continue
+			}
+
+			if string(existing.Value) != string(rr.Value) {
+				if newest != nil {
+					u.remove(newest)
+				}
+				newest = existing
+			} else {
+				u.remove(existing)
+			}
+		}
+
+		u.add(rr)
+		return true
+	})
+
+	h.srv.log.Infof("updated ACME challenge record for %s", rr.Name)
+
+	writeJSON(w, http.StatusOK, map[string]string{"txt": update.TXT})
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestACMEHandler(t *testing.T) (*DNSServer, *ACMEHandler) {
+	t.Helper()
+
+	srv, _ := NewDNSServer("", "")
+	h, err := NewACMEHandler(srv, ACMEConfig{Username: "certbot", APIKey: "secret", Zone: "auth.kausm.in"})
+	if err != nil {
+		t.Fatalf("error while creating handler: %v", err)
+	}
+
+	return srv, h
+}
+
+func TestACMEPresentAndCleanup(t *testing.T) {
+	srv, h := newTestACMEHandler(t)
+
+	body := `{"fqdn": "_acme-challenge.www.kausm.in.", "value": "token-1"}`
+
+	req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(body))
+	req.SetBasicAuth("certbot", "wrong")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized with a wrong key, got %d", resp.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(body))
+	req.SetBasicAuth("certbot", "secret")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected present to succeed, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	answers := srv.lookupAllRecords(&TypeTXT, &ClassIN, "_acme-challenge.www.kausm.in")
+	if len(answers) != 1 || string(answers[0].Value) != "\x07token-1" {
+		t.Fatalf("expected the challenge record to be served, got %v", answers)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/cleanup", strings.NewReader(body))
+	req.SetBasicAuth("certbot", "secret")
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected cleanup to succeed, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	if answers := srv.lookupAllRecords(&TypeTXT, &ClassIN, "_acme-challenge.www.kausm.in"); len(answers) != 0 {
+		t.Errorf("challenge record still served after cleanup")
+	}
+}
+
+func TestACMEPresentTwiceIsOneVersion(t *testing.T) {
+	srv, h := newTestACMEHandler(t)
+
+	present := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(body))
+		req.SetBasicAuth("certbot", "secret")
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+
+		return resp.Code
+	}
+
+	body := `{"fqdn": "_acme-challenge.www.kausm.in.", "value": "token-1"}`
+	for i := 0; i < 2; i++ {
+		versions := len(srv.Snapshots())
+		if code := present(body); code != http.StatusOK {
+			t.Fatalf("expected present to succeed, got %d", code)
+		}
+
+		// the token is never missing from a version of the records
+		if n := len(srv.Snapshots()) - versions; n != 1 {
+			t.Errorf("present %d made %d versions of the records, expected 1", i+1, n)
+		}
+	}
+
+	if answers := srv.lookupAllRecords(&TypeTXT, &ClassIN, "_acme-challenge.www.kausm.in"); len(answers) != 1 {
+		t.Errorf("expected the token to be served once, got %d records", len(answers))
+	}
+
+	large := `{"fqdn": "_acme-challenge.www.kausm.in.", "value": "` + strings.Repeat("x", maxACMERequestSize) + `"}`
+	if code := present(large); code != http.StatusBadRequest {
+		t.Errorf("expected bad request for an oversized body, got %d", code)
+	}
+}
+
+func TestACMEPresentOutsideZones(t *testing.T) {
+	_, h := newTestACMEHandler(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/present", strings.NewReader(`{"fqdn": "_acme-challenge.example.com.", "value": "token"}`))
+	req.SetBasicAuth("certbot", "secret")
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request for a name outside the served zones, got %d", resp.Code)
+	}
+}
+
+func TestACMEDNSUpdateKeepsTwoTokens(t *testing.T) {
+	srv, h := newTestACMEHandler(t)
+
+	for _, token := range []string{"first", "second", "third"} {
+		req := httptest.NewRequest(http.MethodPost, "/update", strings.NewReader(`{"subdomain": "d420c923", "txt": "`+token+`"}`))
+		req.Header.Set("X-Api-User", "certbot")
+		req.Header.Set("X-Api-Key", "secret")
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected update to succeed, got %d: %s", resp.Code, resp.Body.String())
+		}
+	}
+
+	answers := srv.lookupAllRecords(&TypeTXT, &ClassIN, "d420c923.auth.kausm.in")
+	if len(answers) != 2 {
+		t.Fatalf("expected the two latest tokens, got %d records", len(answers))
+	}
+
+	values := map[string]bool{}
+	for _, rr := range answers {
+		values[string(rr.Value[1:])] = true
+	}
+
+	if !values["second"] || !values["third"] {
+		t.Errorf("expected tokens second and third, got %v", values)
+	}
+}
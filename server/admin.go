@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxAdminRequestSize caps the bodies of admin requests, which carry a
+	// single record at most, as the admin API may be open to anyone who can
+	// reach it
+	maxAdminRequestSize = 64 << 10
+
+	// maxRRsetRequestSize caps the bodies of RRset replacements, which carry
+	// all records of the RRset
+	maxRRsetRequestSize = 1 << 20
+)
+
+// AdminHandler serves the admin API of a server as JSON over HTTP:
+//
+//	GET  /zones               per zone query counts, response codes and SOA serials
+//	GET  /zone?name=<zone>    the records of a zone, or of all zones without name, as a master file
+//	GET  /records?zone=<zone> the records of a zone, or of all zones without zone
+//	POST /records             {"name": ..., "type": ..., "ttl": ..., "data": ..., "comment": ..., "meta": {...}}
+//	                          adds a record, comment and meta being optional annotations
+//	PUT  /records             {"name": ..., "type": ..., "records": [{"ttl": ..., "data": ..., ...}]}
+//	                          replaces the records of a name and type at once, or removes them without records
+//	DELETE /records?name=<name>&type=<type>[&data=<data>]
+//	                          removes the records of a name and type, or only those with data
+//	GET  /audit?zone=<zone>&after=<version>&limit=<n>
+//	                          changes to the records, optionally of a zone, after a version, or only the latest n
+//	GET  /snapshots           the versions of the records kept for rollbacks
+//	POST /snapshots/rollback  {"version": <n>} makes version n current again
+//	GET  /forwarder           the retry budget of the forwarder, how often its limits were hit and failing upstreams
+//	GET  /drain               whether the server is draining
+//	POST /drain               {"delay": "30s"} starts draining, refusing queries after the delay
+//	DELETE /drain             stops draining
+//
+// Requests need a bearer token when the API has tokens, see APIToken.
+// Changes to records are logged as the "audit" component
+type AdminHandler struct {
+	srv *DNSServer
+	mux *http.ServeMux
+
+	tokens []APIToken
+	audit  Logger
+}
+
+// NewAdminHandler returns the admin API of srv. Without API tokens it has no
+// authentication of its own, so it should only be served on a trusted address
+func NewAdminHandler(srv *DNSServer, opts ...AdminOption) *AdminHandler {
+	h := AdminHandler{
+		srv:   srv,
+		mux:   http.NewServeMux(),
+		audit: scopeLogger(srv.logger, "audit"),
+	}
+
+	for _, opt := range opts {
+		opt(&h)
+	}
+
+	h.mux.HandleFunc("/zones", h.handleZones)
+	h.mux.HandleFunc("/zone", h.handleDumpZone)
+	h.mux.HandleFunc("/records", h.handleRecords)
+	h.mux.HandleFunc("/audit", h.handleAudit)
+	h.mux.HandleFunc("/snapshots", operatorOnly(h.handleSnapshots))
+	h.mux.HandleFunc("/snapshots/rollback", operatorOnly(h.handleRollback))
+	h.mux.HandleFunc("/forwarder", operatorOnly(h.handleForwarder))
+	h.mux.HandleFunc("/drain", operatorOnly(h.handleDrain))
+
+	return &h
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t, err := h.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	h.mux.ServeHTTP(w, withRequestToken(r, t))
+}
+
+func (h *AdminHandler) handleZones(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	t := requestToken(r)
+
+	stats := []ZoneStats{}
+	for _, zs := range h.srv.ZoneStats() {
+		if t.ownsZone(zs.Zone) {
+			stats = append(stats, zs)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *AdminHandler) handleDumpZone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	zone := r.URL.Query().Get("name")
+	if !h.mayReadZone(r, zone) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// records are dumped to a buffer first, so a missing zone can still be
+	// answered with an error status
+	buf := bytes.Buffer{}
+	if err := h.srv.DumpZone(&buf, zone); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/dns")
+	buf.WriteTo(w)
+}
+
+// mayReadZone reports whether the request may read the records of zone, or
+// of all zones if it's empty
+func (h *AdminHandler) mayReadZone(r *http.Request, zone string) bool {
+	t := requestToken(r)
+	if zone == "" {
+		return t.operator()
+	}
+
+	return t.ownsZone(zone)
+}
+
+func (h *AdminHandler) handleRecords(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.handleListRecords(w, r)
+	case http.MethodPost:
+		h.handleAddRecord(w, r)
+	case http.MethodPut:
+		h.handleReplaceRRset(w, r)
+	case http.MethodDelete:
+		h.handleRemoveRecords(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// originFor returns what names in the data of records of name that aren't
+// fully qualified are relative to: the zone of name, or name itself if it's
+// in no zone served
+func (h *AdminHandler) originFor(name string) string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if zone, ok := h.srv.zoneFor(name); ok {
+		return zone
+	}
+
+	return name
+}
+
+func (h *AdminHandler) handleListRecords(w http.ResponseWriter, r *http.Request) {
+	zone := r.URL.Query().Get("zone")
+	if !h.mayReadZone(r, zone) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	records, err := h.srv.zoneRecords(zone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	listed := make([]jsonRecord, 0, len(records))
+	for _, rr := range records {
+		listed = append(listed, newJSONRecord(rr))
+	}
+
+	writeJSON(w, http.StatusOK, listed)
+}
+
+func (h *AdminHandler) handleAddRecord(w http.ResponseWriter, r *http.Request) {
+	req := jsonRecord{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" {
+		http.Error(w, "record needs a name", http.StatusBadRequest)
+		return
+	}
+
+	rr, err := req.toResourceRecord("", []string{h.originFor(req.Name)})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid record: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !requestToken(r).ownsRecord(h.srv, rr) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	reason := fmt.Sprintf("%s added %s record for %s", actor(r), rr.Type, rr.Name)
+	if err := h.srv.addRecord(rr, recordChange{source: ChangeSourceAPI, actor: actor(r), reason: reason}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.audit.Infof("%s: %s", reason, rdataString(rr.Type, rr.Value))
+
+	writeJSON(w, http.StatusCreated, newJSONRecord(rr))
+}
+
+type replaceRRsetRequest struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"`
+	Records []jsonRecord `json:"records"`
+}
+
+type replaceRRsetResponse struct {
+	Replaced int          `json:"replaced"`
+	Records  []jsonRecord `json:"records"`
+}
+
+func (h *AdminHandler) handleReplaceRRset(w http.ResponseWriter, r *http.Request) {
+	req := replaceRRsetRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRRsetRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(req.Name, "."))
+	qtype, err := ParseQType(req.Type)
+	if name == "" || err != nil {
+		http.Error(w, "name and type of the RRset are needed", http.StatusBadRequest)
+		return
+	}
+
+	if !requestToken(r).ownsRecord(h.srv, &ResourceRecord{Name: name, Type: qtype}) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// records of the RRset may leave out its name and type
+	origin := h.originFor(name)
+	rrset := make([]*ResourceRecord, 0, len(req.Records))
+	for _, record := range req.Records {
+		if record.Name == "" {
+			record.Name = name
+		}
+		if record.Type == "" {
+			record.Type = qtype.Type
+		}
+
+		rr, err := record.toResourceRecord("", []string{origin})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid record: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		rrset = append(rrset, rr)
+	}
+
+	reason := fmt.Sprintf("%s replaced %s records for %s", actor(r), qtype, name)
+	replaced, err := h.srv.replaceRRset(name, qtype, rrset, recordChange{source: ChangeSourceAPI, actor: actor(r), reason: reason})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.audit.Infof("%s: %d replaced by %d", reason, replaced, len(rrset))
+
+	resp := replaceRRsetResponse{Replaced: replaced, Records: make([]jsonRecord, 0, len(rrset))}
+	for _, rr := range rrset {
+		resp.Records = append(resp.Records, newJSONRecord(rr))
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type removeRecordsResponse struct {
+	Removed int `json:"removed"`
+}
+
+func (h *AdminHandler) handleRemoveRecords(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := strings.ToLower(strings.TrimSuffix(query.Get("name"), "."))
+
+	qtype, err := ParseQType(query.Get("type"))
+	if name == "" || err != nil {
+		http.Error(w, "name and type of the records are needed", http.StatusBadRequest)
+		return
+	}
+
+	var value []byte
+	if data := query.Get("data"); data != "" {
+		rr, err := (&jsonRecord{Name: name, Type: qtype.Type, Data: data}).toResourceRecord("", []string{h.originFor(name)})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid data: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		value = rr.Value
+	}
+
+	if !requestToken(r).ownsRecord(h.srv, &ResourceRecord{Name: name, Type: qtype}) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	reason := fmt.Sprintf("%s removed %s records for %s", actor(r), qtype, name)
+	removed := h.srv.removeRecordsFor(name, qtype, value, recordChange{source: ChangeSourceAPI, actor: actor(r), reason: reason})
+	if removed > 0 {
+		h.audit.Infof("%s: %d removed", reason, removed)
+	}
+
+	writeJSON(w, http.StatusOK, removeRecordsResponse{Removed: removed})
+}
+
+func (h *AdminHandler) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	q := AuditQuery{Zone: strings.ToLower(strings.TrimSuffix(params.Get("zone"), "."))}
+
+	if after := params.Get("after"); after != "" {
+		version, err := strconv.ParseUint(after, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid version %q", after), http.StatusBadRequest)
+			return
+		}
+
+		q.AfterVersion = version
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid limit %q", limit), http.StatusBadRequest)
+			return
+		}
+
+		q.Limit = n
+	}
+
+	t := requestToken(r)
+	if q.Zone != "" && !t.ownsZone(q.Zone) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// zone scoped tokens only see changes that were all in their zones, the
+	// latest of which are kept after filtering
+	limit := q.Limit
+	q.Limit = 0
+
+	entries := []AuditEntry{}
+	for _, entry := range h.srv.AuditLog(q) {
+		owned := true
+		for _, zone := range entry.Zones {
+			owned = owned && t.ownsZone(zone)
+		}
+
+		if owned && (t.operator() || len(entry.Zones) > 0) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *AdminHandler) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.srv.Snapshots())
+}
+
+type rollbackRequest struct {
+	Version uint64 `json:"version"`
+}
+
+func (h *AdminHandler) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := rollbackRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	info, err := h.srv.rollback(req.Version, actor(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (h *AdminHandler) handleForwarder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.srv.forwarder == nil {
+		http.Error(w, "no forwarder", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.srv.forwarder.Stats())
+}
+
+type drainRequest struct {
+	Delay string `json:"delay"`
+}
+
+func (h *AdminHandler) handleDrain(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		req := drainRequest{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminRequestSize)).Decode(&req); err != nil && err != io.EOF {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		delay := time.Duration(0)
+		if req.Delay != "" {
+			var err error
+			if delay, err = time.ParseDuration(req.Delay); err != nil {
+				http.Error(w, fmt.Sprintf("invalid delay: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		h.srv.Drain(delay)
+	case http.MethodDelete:
+		h.srv.Undrain()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, h.srv.DrainStatus())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
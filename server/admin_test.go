@@ -0,0 +1,261 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminZoneStats(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	for _, name := range []string{"test.kausm.in", "test.kausm.in", "missing.kausm.in", "example.com"} {
+		q := Question{Name: name, Type: &TypeA, Class: &ClassIN}
+		if _, err := srv.handleQuery(encodeTestQuery(t, 1, &q), nil, true); err != nil {
+			t.Fatalf("error while handling query: %v", err)
+		}
+	}
+
+	resp := httptest.NewRecorder()
+	NewAdminHandler(srv).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/zones", nil))
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d", resp.Code)
+	}
+
+	stats := []ZoneStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if len(stats) != 1 {
+		t.Fatalf("expected stats for 1 zone, got %d", len(stats))
+	}
+
+	zs := stats[0]
+	if zs.Zone != "kausm.in" || zs.Serial != 1 || zs.Records != 2 || zs.Queries != 3 {
+		t.Errorf("unexpected zone stats %+v", zs)
+	}
+
+	if zs.RCodes["NOERROR"] != 2 || zs.RCodes["NXDOMAIN"] != 1 {
+		t.Errorf("unexpected response codes %v", zs.RCodes)
+	}
+}
+
+func TestZoneStatsCountEveryAnswer(t *testing.T) {
+	backend := &staticBackend{zones: []string{"corp.example."}, records: map[string][]*ResourceRecord{}}
+	srv, _ := NewDNSServer("", "", WithBackend(backend))
+
+	query := func(name string) {
+		q := Question{Name: name, Type: &TypeA, Class: &ClassIN}
+		if _, err := srv.handleQuery(encodeTestQuery(t, 1, &q), nil, true); err != nil {
+			t.Fatalf("error while handling query: %v", err)
+		}
+	}
+
+	query("test.kausm.in")
+	query("db.corp.example")
+
+	// queries refused while draining are counted too
+	srv.Drain(0)
+	query("test.kausm.in")
+
+	stats := map[string]ZoneStats{}
+	for _, zs := range srv.ZoneStats() {
+		stats[zs.Zone] = zs
+	}
+
+	if zs := stats["kausm.in"]; zs.Queries != 2 || zs.RCodes["NOERROR"] != 1 || zs.RCodes["REFUSED"] != 1 {
+		t.Errorf("unexpected stats of kausm.in %+v", zs)
+	}
+
+	if zs := stats["corp.example"]; !zs.Backend || zs.Queries != 1 || zs.RCodes["NXDOMAIN"] != 1 {
+		t.Errorf("unexpected stats of the backend's zone %+v", zs)
+	}
+}
+
+func TestAdminRollback(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	srv.RemoveRecords("test.kausm.in", &TypeA, nil)
+
+	h := NewAdminHandler(srv)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/snapshots/rollback", strings.NewReader(`{"version": 1}`)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d: %s", resp.Code, resp.Body)
+	}
+
+	if srv.LookupRecords(&TypeA, &ClassIN, "test.kausm.in") == nil {
+		t.Errorf("expected the removed record to be back")
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/snapshots", nil))
+
+	snapshots := []SnapshotInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(&snapshots); err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if len(snapshots) != 3 || snapshots[2].Reason != "rollback to version 1" {
+		t.Errorf("unexpected snapshots %+v", snapshots)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/snapshots/rollback", strings.NewReader(`{"version": 42}`)))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected not found for an unknown version, got %d", resp.Code)
+	}
+}
+
+func TestAdminDumpZone(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	h := NewAdminHandler(srv)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/zone?name=kausm.in", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d: %s", resp.Code, resp.Body)
+	}
+
+	expected := "kausm.in.\t600\tIN\tSOA\tkausm.in. kaustubh.kausm.in. 1 600 600 600 600\ntest.kausm.in.\t600\tIN\tA\t134.209.148.50\n"
+	if resp.Body.String() != expected {
+		t.Errorf("unexpected dump:\n%s", resp.Body)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/zone?name=example.com", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a zone that isn't served, got %d", resp.Code)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	h := NewAdminHandler(srv)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/drain", strings.NewReader(`{"delay": "10s"}`)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d: %s", resp.Code, resp.Body)
+	}
+
+	status := DrainStatus{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if !status.Draining || status.RefusingAt.Sub(status.Since) != 10*time.Second {
+		t.Errorf("unexpected drain status %+v", status)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodDelete, "/drain", nil))
+	if srv.DrainStatus().Draining {
+		t.Errorf("expected the server to stop draining")
+	}
+}
+
+func TestAdminForwarderStats(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	h := NewAdminHandler(srv)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/forwarder", nil))
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected not found without a forwarder, got %d", resp.Code)
+	}
+
+	f, err := NewForwarder([]string{"192.0.2.53"})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	defer f.Close()
+
+	srv, _ = NewDNSServer("", "", WithForwarder(f))
+	h = NewAdminHandler(srv)
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/forwarder", nil))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d", resp.Code)
+	}
+
+	stats := ForwarderStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if stats.Budget != DefaultRetryBudget() || len(stats.Upstreams) != 1 || stats.Upstreams[0].Upstream != "192.0.2.53:53" {
+		t.Errorf("unexpected forwarder stats %+v", stats)
+	}
+}
+
+func TestAdminReplaceRRset(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	h := NewAdminHandler(srv)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/records", strings.NewReader(`{"name": "test.kausm.in", "type": "A", "records": [
+		{"ttl": 300, "data": "192.0.2.1"},
+		{"ttl": 300, "data": "192.0.2.2", "comment": "second"}
+	]}`)))
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected OK, got %d: %s", resp.Code, resp.Body)
+	}
+
+	replaced := replaceRRsetResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&replaced); err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+	if replaced.Replaced != 1 || len(replaced.Records) != 2 {
+		t.Errorf("unexpected response %+v", replaced)
+	}
+
+	answers := srv.lookupAllRecords(&TypeA, &ClassIN, "test.kausm.in")
+	if len(answers) != 2 || answers[1].Comment != "second" {
+		t.Errorf("unexpected records after replacing the RRset: %v", answers)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/records", strings.NewReader(`{"name": "test.kausm.in", "type": "A", "records": [{"type": "TXT", "data": "hi"}]}`)))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request for a record of another type, got %d", resp.Code)
+	}
+
+	if answers := srv.lookupAllRecords(&TypeA, &ClassIN, "test.kausm.in"); len(answers) != 2 {
+		t.Errorf("rejected RRset changed the records")
+	}
+}
+
+func TestAdminCapsRequestBodies(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	h := NewAdminHandler(srv)
+
+	padding := strings.Repeat("a", maxAdminRequestSize)
+	for _, test := range []struct {
+		target string
+		body   string
+	}{
+		{"/records", `{"name": "www.kausm.in", "type": "TXT", "ttl": 60, "data": "` + padding + `"}`},
+		{"/snapshots/rollback", `{"version": 1, "padding": "` + padding + `"}`},
+		{"/drain", `{"delay": "1s", "padding": "` + padding + `"}`},
+	} {
+		if resp := serveAdmin(h, "", http.MethodPost, test.target, test.body); resp.Code != http.StatusBadRequest {
+			t.Errorf("expected an oversized body to be refused by %s, got %d", test.target, resp.Code)
+		}
+	}
+
+	if status := srv.DrainStatus(); status.Draining {
+		t.Errorf("expected the oversized drain request not to start draining")
+	}
+
+	rrset := `{"name": "www.kausm.in", "type": "TXT", "records": [{"ttl": 60, "data": "` + strings.Repeat("a", maxRRsetRequestSize) + `"}]}`
+	if resp := serveAdmin(h, "", http.MethodPut, "/records", rrset); resp.Code != http.StatusBadRequest {
+		t.Errorf("expected an oversized RRset to be refused, got %d", resp.Code)
+	}
+}
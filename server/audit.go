@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultAuditHistory is how many audit entries are kept for the admin
+	// API by default
+	defaultAuditHistory = 1000
+
+	// maxAuditRecords bounds how many of the records a change added or
+	// removed an audit entry lists, so that loading a large zone doesn't
+	// make for a huge entry. The counts are always complete
+	maxAuditRecords = 100
+)
+
+// Sources of changes to the records
+const (
+	ChangeSourceLoad     = "load"     // zone files loaded at startup
+	ChangeSourceAPI      = "api"      // the admin API
+	ChangeSourceACME     = "acme"     // the ACME DNS-01 endpoint
+	ChangeSourceExpiry   = "expiry"   // records removed once they expired
+	ChangeSourceRollback = "rollback" // a rollback to an earlier version
+	ChangeSourceLibrary  = "library"  // AddRecord and RemoveRecords
+)
+
+// recordChange says what made a new version of the records, and who
+type recordChange struct {
+	source string
+	actor  string
+	reason string
+}
+
+// AuditEntry records a change to the records the server answers from
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Version uint64    `json:"version"`
+	Source  string    `json:"source"`
+	Actor   string    `json:"actor,omitempty"`
+	Reason  string    `json:"reason"`
+
+	// Zones are the zones of the records added or removed
+	Zones []string `json:"zones,omitempty"`
+
+	// Added and Removed are the records the change added and removed, in
+	// master file format, the removed ones as they were before the change.
+	// At most 100 of each are listed
+	Added        []string `json:"added,omitempty"`
+	Removed      []string `json:"removed,omitempty"`
+	AddedCount   int      `json:"added_count"`
+	RemovedCount int      `json:"removed_count"`
+}
+
+// auditLog keeps the latest audit entries, and appends every entry to w if
+// it's set
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	history int
+	w       io.Writer
+
+	// pending are the changes queued by queueAudit, and flushMu makes their
+	// entries get recorded one flush at a time, in order
+	pending []pendingAudit
+	flushMu sync.Mutex
+}
+
+// WithAuditLog makes the server append an audit entry for every change to
+// its records to w, as a line of JSON. The latest entries are kept in
+// memory for the admin API either way
+func WithAuditLog(w io.Writer) Option {
+	return func(srv *DNSServer) {
+		srv.audit.w = w
+	}
+}
+
+// WithAuditHistory sets how many audit entries are kept in memory for the
+// admin API
+func WithAuditHistory(n int) Option {
+	return func(srv *DNSServer) {
+		srv.audit.history = n
+	}
+}
+
+// record appends entry to the log
+func (l *auditLog) record(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	history := l.history
+	if history <= 0 {
+		history = defaultAuditHistory
+	}
+
+	l.entries = append(l.entries, entry)
+	if len(l.entries) > history {
+		l.entries = append([]AuditEntry(nil), l.entries[len(l.entries)-history:]...)
+	}
+
+	if l.w == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.w.Write(append(line, '\n'))
+	return err
+}
+
+// AuditQuery selects audit entries
+type AuditQuery struct {
+	// Zone, when set, selects the entries that changed records of zone
+	Zone string
+
+	// AfterVersion selects the entries of versions after it
+	AfterVersion uint64
+
+	// Limit, when positive, keeps the latest Limit of the selected entries
+	Limit int
+}
+
+// AuditLog returns the audit entries kept in memory that q selects, oldest
+// first
+func (srv *DNSServer) AuditLog(q AuditQuery) []AuditEntry {
+	srv.audit.mu.Lock()
+	defer srv.audit.mu.Unlock()
+
+	entries := []AuditEntry{}
+	for _, entry := range srv.audit.entries {
+		if entry.Version <= q.AfterVersion {
+			continue
+		}
+
+		if q.Zone != "" && !containsString(entry.Zones, q.Zone) {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[len(entries)-q.Limit:]
+	}
+
+	return entries
+}
+
+// pendingAudit is a published change whose audit entry is yet to be made
+type pendingAudit struct {
+	entry AuditEntry
+	delta recordDelta
+
+	// zones and previousZones are the zones of the published version and
+	// of the one it replaced
+	zones, previousZones []string
+}
+
+// queueAudit queues the audit entry of the change from before to after, which
+// delta describes. Callers must hold recordsMu, and call flushAudit once they
+// released it, so that formatting the records doesn't hold up other changes
+func (srv *DNSServer) queueAudit(before, after *zoneSnapshot, delta recordDelta, change recordChange) {
+	p := pendingAudit{
+		entry: AuditEntry{
+			Time:    after.createdAt,
+			Version: after.version,
+			Source:  change.source,
+			Actor:   change.actor,
+			Reason:  change.reason,
+		},
+		delta: delta,
+		zones: after.zones,
+	}
+	if before != nil {
+		p.previousZones = before.zones
+	}
+
+	srv.audit.mu.Lock()
+	srv.audit.pending = append(srv.audit.pending, p)
+	srv.audit.mu.Unlock()
+}
+
+// flushAudit makes and records the entries of the queued changes, in the
+// order they were published
+func (srv *DNSServer) flushAudit() {
+	srv.audit.flushMu.Lock()
+	defer srv.audit.flushMu.Unlock()
+
+	srv.audit.mu.Lock()
+	pending := srv.audit.pending
+	srv.audit.pending = nil
+	srv.audit.mu.Unlock()
+
+	for _, p := range pending {
+		entry := p.complete()
+		if err := srv.audit.record(entry); err != nil {
+			srv.log.Errorf("error while writing audit entry of version %d: %v", entry.Version, err)
+		}
+	}
+}
+
+// complete returns the audit entry of the change, with the records it added
+// and removed and their zones
+func (p pendingAudit) complete() AuditEntry {
+	entry := p.entry
+
+	zones := map[string]bool{}
+	noteZone := func(rr *ResourceRecord) {
+		if zone, ok := closestZone(p.zones, rr.Name); ok {
+			zones[zone] = true
+		} else if zone, ok := closestZone(p.previousZones, rr.Name); ok {
+			zones[zone] = true
+		}
+	}
+
+	for _, rr := range p.delta.added {
+		entry.AddedCount++
+		if len(entry.Added) < maxAuditRecords {
+			entry.Added = append(entry.Added, auditRecordString(rr))
+		}
+		noteZone(rr)
+	}
+
+	for _, rr := range p.delta.removed {
+		entry.RemovedCount++
+		if len(entry.Removed) < maxAuditRecords {
+			entry.Removed = append(entry.Removed, auditRecordString(rr))
+		}
+		noteZone(rr)
+	}
+
+	for zone := range zones {
+		entry.Zones = append(entry.Zones, zone)
+	}
+	sort.Strings(entry.Zones)
+
+	return entry
+}
+
+func auditRecordString(rr *ResourceRecord) string {
+	return fmt.Sprintf("%s\t%d\t%s\t%s\t%s", presentationName(rr.Name), rr.TTL, rr.Class, rr.Type, rdataString(rr.Type, rr.Value))
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
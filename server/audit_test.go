@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAuditLogRecordsChanges(t *testing.T) {
+	out := bytes.Buffer{}
+	srv, _ := NewDNSServer("", "", WithAuditLog(&out))
+
+	rr, _ := NewA("www.kausm.in", 300, net.IPv4(192, 0, 2, 1))
+	srv.AddRecord(rr)
+	srv.RemoveRecords("test.kausm.in", &TypeA, nil)
+
+	entries := srv.AuditLog(AuditQuery{})
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", entries)
+	}
+
+	load, added, removed := entries[0], entries[1], entries[2]
+	if load.Source != ChangeSourceLoad || load.AddedCount != 2 || load.RemovedCount != 0 {
+		t.Errorf("unexpected load entry %+v", load)
+	}
+
+	if added.Source != ChangeSourceLibrary || added.Version != 2 || len(added.Added) != 1 || added.Added[0] != "www.kausm.in.\t300\tIN\tA\t192.0.2.1" {
+		t.Errorf("unexpected entry for the added record %+v", added)
+	}
+
+	if removed.RemovedCount != 1 || removed.AddedCount != 0 || !strings.HasPrefix(removed.Removed[0], "test.kausm.in.\t600\tIN\tA") {
+		t.Errorf("unexpected entry for the removed record %+v", removed)
+	}
+
+	if len(removed.Zones) != 1 || removed.Zones[0] != "kausm.in" {
+		t.Errorf("expected the change to be in kausm.in, got %v", removed.Zones)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines in the audit log, got %q", out.String())
+	}
+
+	written := AuditEntry{}
+	if err := json.Unmarshal([]byte(lines[1]), &written); err != nil || written.Version != 2 || written.AddedCount != 1 {
+		t.Errorf("unexpected audit log line %q: %v", lines[1], err)
+	}
+
+	if got := srv.AuditLog(AuditQuery{AfterVersion: 1, Limit: 1}); len(got) != 1 || got[0].Version != 3 {
+		t.Errorf("expected only the latest entry, got %+v", got)
+	}
+
+	if got := srv.AuditLog(AuditQuery{Zone: "example.com"}); len(got) != 0 {
+		t.Errorf("expected no entries for another zone, got %+v", got)
+	}
+}
+
+func TestAuditLogKeepsHistory(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithAuditHistory(2))
+
+	for i := 0; i < 3; i++ {
+		rr, _ := NewA("www.kausm.in", 300, net.IPv4(192, 0, 2, byte(i)))
+		srv.AddRecord(rr)
+	}
+
+	entries := srv.AuditLog(AuditQuery{})
+	if len(entries) != 2 || entries[0].Version != 3 || entries[1].Version != 4 {
+		t.Errorf("expected the 2 latest entries, got %+v", entries)
+	}
+}
+
+func TestAuditLogOfRollbackAndConcurrentChanges(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithSnapshotHistory(30))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			rr, _ := NewA("www.kausm.in", 300, net.IPv4(192, 0, 2, byte(i)))
+			srv.AddRecord(rr)
+		}(i)
+	}
+	wg.Wait()
+
+	entries := srv.AuditLog(AuditQuery{})
+	if len(entries) != 21 {
+		t.Fatalf("expected 21 entries, got %d", len(entries))
+	}
+
+	for i, entry := range entries {
+		if entry.Version != uint64(i+1) {
+			t.Fatalf("expected entries in the order of their versions, got version %d at %d", entry.Version, i)
+		}
+	}
+
+	if _, err := srv.Rollback(1); err != nil {
+		t.Fatalf("error while rolling back: %v", err)
+	}
+
+	entries = srv.AuditLog(AuditQuery{AfterVersion: 21})
+	if len(entries) != 1 || entries[0].AddedCount != 0 || entries[0].RemovedCount != 20 {
+		t.Errorf("expected the rollback to remove the 20 added records, got %+v", entries)
+	}
+}
+
+func TestAdminAuditIsScopedToTokens(t *testing.T) {
+	_, h := newTenantTestHandler(t)
+
+	body := `{"name": "www.a.example.com", "type": "A", "ttl": 300, "data": "192.0.2.1"}`
+	if resp := serveAdmin(h, "a-secret", http.MethodPost, "/records", body); resp.Code != http.StatusCreated {
+		t.Fatalf("expected the record to be added, got %d: %s", resp.Code, resp.Body)
+	}
+
+	audit := func(token, target string) []AuditEntry {
+		resp := serveAdmin(h, token, http.MethodGet, target, "")
+		if resp.Code != http.StatusOK {
+			t.Fatalf("expected OK for %s, got %d: %s", target, resp.Code, resp.Body)
+		}
+
+		entries := []AuditEntry{}
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatalf("error while decoding response: %v", err)
+		}
+
+		return entries
+	}
+
+	// the load and both zones being added, then the record
+	if entries := audit("ops-secret", "/audit"); len(entries) != 4 {
+		t.Errorf("expected operators to see all 4 entries, got %+v", entries)
+	}
+
+	entries := audit("a-secret", "/audit")
+	if len(entries) != 2 {
+		t.Fatalf("expected team-a to see the 2 entries of its zone, got %+v", entries)
+	}
+
+	if last := entries[1]; last.Source != ChangeSourceAPI || last.Actor != "team-a" {
+		t.Errorf("expected the change to be attributed to team-a through the API, got %+v", last)
+	}
+
+	if entries := audit("a-secret", "/audit?zone=a.example.com&limit=1"); len(entries) != 1 || entries[0].Actor != "team-a" {
+		t.Errorf("expected only the latest entry, got %+v", entries)
+	}
+
+	if resp := serveAdmin(h, "a-secret", http.MethodGet, "/audit?zone=b.example.com", ""); resp.Code != http.StatusForbidden {
+		t.Errorf("expected the audit log of another zone to be forbidden, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNameNotFound is returned by backends for names that don't exist, which
+// the server answers with NXDOMAIN
+var ErrNameNotFound = errors.New("name does not exist")
+
+// Backend is a source of records other than the server's own, such as an
+// internal API. The server answers queries for names in a backend's zones
+// from that backend alone, authoritatively
+type Backend interface {
+	// Zones returns the names the backend answers for, along with all
+	// names below them
+	Zones() []string
+
+	// Lookup returns the records for q, which may be none if the name
+	// exists without records of that type, or ErrNameNotFound if the name
+	// doesn't exist at all
+	Lookup(q *Question) ([]*ResourceRecord, error)
+}
+
+// WithBackend makes the server answer queries for the zones of b from b
+func WithBackend(b Backend) Option {
+	return func(srv *DNSServer) {
+		srv.backends = append(srv.backends, b)
+	}
+}
+
+// backendFor returns the backend with the closest zone enclosing name
+func (srv *DNSServer) backendFor(name string) (Backend, bool) {
+	b, _, ok := srv.closestBackend(name)
+	return b, ok
+}
+
+// closestBackend returns the backend with the closest zone enclosing name,
+// along with that zone
+func (srv *DNSServer) closestBackend(name string) (Backend, string, bool) {
+	var found Backend
+	closest := ""
+
+	for _, b := range srv.backends {
+		zone, ok := closestZone(normalizedZones(b.Zones()), name)
+		if ok && (found == nil || len(zone) > len(closest)) {
+			found, closest = b, zone
+		}
+	}
+
+	return found, closest, found != nil
+}
+
+func normalizedZones(zones []string) []string {
+	normalized := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(zone, ".")))
+	}
+
+	return normalized
+}
+
+// answerFromBackend answers q from backend b
+func (srv *DNSServer) answerFromBackend(b Backend, headers *DNSHeader, q *Question, edns *EDNS, maxSize int) ([]byte, error) {
+	answers, err := b.Lookup(q)
+	switch {
+	case err == ErrNameNotFound:
+		headers.IsAuthoritative = true
+		headers.ResponseCode = NameError
+	case err != nil:
+		srv.log.Warnf("error while looking up %s in backend: %v", q.String(), err)
+		headers.ResponseCode = ServerFailure
+	default:
+		headers.IsAuthoritative = true
+	}
+
+	return encodeResponse(headers, []*Question{q}, srv.rotateRecords(answers), nil, nil, edns, maxSize)
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+type staticBackend struct {
+	zones   []string
+	records map[string][]*ResourceRecord
+	err     error
+}
+
+func (b *staticBackend) Zones() []string {
+	return b.zones
+}
+
+func (b *staticBackend) Lookup(q *Question) ([]*ResourceRecord, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	records, ok := b.records[q.Name]
+	if !ok {
+		return nil, ErrNameNotFound
+	}
+
+	return records, nil
+}
+
+func TestBackendAnswersItsZones(t *testing.T) {
+	backend := staticBackend{
+		zones: []string{"corp.example."},
+		records: map[string][]*ResourceRecord{
+			"db.corp.example": {{Name: "db.corp.example", Type: &TypeA, Class: &ClassIN, TTL: 60, Value: []byte{10, 1, 2, 3}}},
+		},
+	}
+	srv, _ := NewDNSServer("", "", WithBackend(&backend))
+
+	for _, tc := range []struct {
+		name    string
+		rcode   ResponseCode
+		answers int
+	}{
+		{"db.corp.example", NoError, 1},
+		{"missing.corp.example", NameError, 0},
+		{"test.kausm.in", NoError, 1},
+	} {
+		q := Question{Name: tc.name, Type: &TypeA, Class: &ClassIN}
+		resp, err := srv.handleQuery(encodeTestQuery(t, 1, &q), nil, true)
+		if err != nil {
+			t.Fatalf("error while handling query for %s: %v", tc.name, err)
+		}
+
+		m, err := DecodeMessage(resp)
+		if err != nil {
+			t.Fatalf("error while decoding response for %s: %v", tc.name, err)
+		}
+
+		if m.Header.ResponseCode != tc.rcode || len(m.Answers) != tc.answers || !m.Header.IsAuthoritative {
+			t.Errorf("%s: expected authoritative %s with %d answers, got %s with %d answers, AA: %t",
+				tc.name, tc.rcode, tc.answers, m.Header.ResponseCode, len(m.Answers), m.Header.IsAuthoritative)
+		}
+	}
+
+	backend.err = errors.New("backend down")
+	q := Question{Name: "db.corp.example", Type: &TypeA, Class: &ClassIN}
+	resp, err := srv.handleQuery(encodeTestQuery(t, 1, &q), nil, true)
+	if err != nil {
+		t.Fatalf("error while handling query: %v", err)
+	}
+
+	if rcode := ResponseCode(resp[3] & 0x0f); rcode != ServerFailure {
+		t.Errorf("expected SERVFAIL from a failing backend, got %s", rcode)
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// maxRetryTokens bounds the retries a retry budget saves up, so a long quiet
+// spell doesn't allow a burst of retries later
+const maxRetryTokens = 100
+
+var (
+	errOutstandingLimit = errors.New("too many queries outstanding upstream")
+	errClientLimit      = errors.New("too many queries of the client outstanding upstream")
+	errUpstreamsBackoff = errors.New("all upstreams are backing off after failures")
+	errRetryBudget      = errors.New("retry budget exhausted")
+)
+
+// RetryBudget bounds the load a forwarder puts on its upstreams, so that a
+// burst of failing lookups can't amplify into a flood of upstream queries.
+// Each forwarder has a budget of its own, so forwarders of policy rules have
+// one per zone they forward
+type RetryBudget struct {
+	// MaxOutstanding bounds the queries in flight upstream at once, and
+	// MaxOutstandingPerClient those asked for by a single client. Queries
+	// over the limits fail right away. 0 means no limit
+	MaxOutstanding          int `json:"max_outstanding"`
+	MaxOutstandingPerClient int `json:"max_outstanding_per_client"`
+
+	// RetryRatio is the share of queries that may be retried on the next
+	// upstream after a failure, with MinRetriesPerSecond retries allowed
+	// regardless
+	RetryRatio          float64 `json:"retry_ratio"`
+	MinRetriesPerSecond float64 `json:"min_retries_per_second"`
+
+	// An upstream that failed BackoffAfter times in a row is skipped for
+	// InitialBackoff, doubling with every further failure up to MaxBackoff.
+	// Once its backoff is over a single query is let through to probe it.
+	// A BackoffAfter of 0 turns backing off off
+	BackoffAfter   int           `json:"backoff_after"`
+	InitialBackoff time.Duration `json:"initial_backoff"`
+	MaxBackoff     time.Duration `json:"max_backoff"`
+}
+
+// DefaultRetryBudget returns the budget forwarders have by default
+func DefaultRetryBudget() RetryBudget {
+	return RetryBudget{
+		MaxOutstanding:          1000,
+		MaxOutstandingPerClient: 100,
+		RetryRatio:              0.2,
+		MinRetriesPerSecond:     10,
+		BackoffAfter:            3,
+		InitialBackoff:          time.Second,
+		MaxBackoff:              30 * time.Second,
+	}
+}
+
+// WithRetryBudget sets the limits of the forwarder's upstream queries
+func WithRetryBudget(b RetryBudget) ForwarderOption {
+	return func(f *Forwarder) {
+		f.budget.config = b
+	}
+}
+
+// ForwarderStats reports a forwarder's limits and how often they were hit
+type ForwarderStats struct {
+	Budget RetryBudget `json:"budget"`
+
+	Outstanding    int    `json:"outstanding"`
+	Rejected       uint64 `json:"rejected"`
+	RejectedClient uint64 `json:"rejected_client"`
+	Retries        uint64 `json:"retries"`
+	RetriesDenied  uint64 `json:"retries_denied"`
+
+	Upstreams []UpstreamStats `json:"upstreams"`
+}
+
+// UpstreamStats reports the failures of an upstream
+type UpstreamStats struct {
+	Upstream     string    `json:"upstream"`
+	Failures     int       `json:"failures"`
+	BackoffUntil time.Time `json:"backoff_until"`
+}
+
+type upstreamBackoff struct {
+	failures int
+	until    time.Time
+	probing  bool
+}
+
+// retryBudget enforces a RetryBudget
+type retryBudget struct {
+	config RetryBudget
+
+	mu          sync.Mutex
+	outstanding int
+	perClient   map[string]int
+	tokens      float64
+	refilledAt  time.Time
+	backoffs    map[string]*upstreamBackoff
+
+	rejected       uint64
+	rejectedClient uint64
+	retries        uint64
+	retriesDenied  uint64
+}
+
+// admitClient counts a query of client against its limit, client may be
+// empty for queries of no client in particular
+func (b *retryBudget) admitClient(client string) bool {
+	if client == "" || b.config.MaxOutstandingPerClient <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.perClient == nil {
+		b.perClient = map[string]int{}
+	}
+
+	if b.perClient[client] >= b.config.MaxOutstandingPerClient {
+		b.rejectedClient++
+		return false
+	}
+
+	b.perClient[client]++
+	return true
+}
+
+func (b *retryBudget) releaseClient(client string) {
+	if client == "" || b.config.MaxOutstandingPerClient <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.perClient[client]--; b.perClient[client] <= 0 {
+		delete(b.perClient, client)
+	}
+}
+
+// admit counts a query going upstream against the outstanding limit
+func (b *retryBudget) admit() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.config.MaxOutstanding > 0 && b.outstanding >= b.config.MaxOutstanding {
+		b.rejected++
+		return false
+	}
+
+	b.outstanding++
+	b.tokens += b.config.RetryRatio
+	if b.tokens > maxRetryTokens {
+		b.tokens = maxRetryTokens
+	}
+
+	return true
+}
+
+func (b *retryBudget) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.outstanding--
+}
+
+// allowRetry takes a retry out of the budget if there is one left
+func (b *retryBudget) allowRetry(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.refilledAt.IsZero() {
+		b.tokens += now.Sub(b.refilledAt).Seconds() * b.config.MinRetriesPerSecond
+	} else {
+		b.tokens += b.config.MinRetriesPerSecond
+	}
+	if b.tokens > maxRetryTokens {
+		b.tokens = maxRetryTokens
+	}
+	b.refilledAt = now
+
+	if b.tokens < 1 {
+		b.retriesDenied++
+		return false
+	}
+
+	b.tokens--
+	b.retries++
+	return true
+}
+
+// allowUpstream reports whether upstream may be asked, which it may unless
+// it's backing off, or being probed by another query after backing off
+func (b *retryBudget) allowUpstream(upstream string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	backoff, ok := b.backoffs[upstream]
+	if !ok || b.config.BackoffAfter <= 0 || backoff.failures < b.config.BackoffAfter {
+		return true
+	}
+
+	if now.Before(backoff.until) || backoff.probing {
+		return false
+	}
+
+	backoff.probing = true
+	return true
+}
+
+// abandonProbe gives up the probe of upstream claimed by allowUpstream when
+// the query doesn't get to ask it, so that another query can probe it
+func (b *retryBudget) abandonProbe(upstream string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if backoff, ok := b.backoffs[upstream]; ok {
+		backoff.probing = false
+	}
+}
+
+// succeeded clears the failures of upstream
+func (b *retryBudget) succeeded(upstream string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.backoffs, upstream)
+}
+
+// failed counts a failure of upstream, making it back off once it failed
+// often enough in a row
+func (b *retryBudget) failed(upstream string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.backoffs == nil {
+		b.backoffs = map[string]*upstreamBackoff{}
+	}
+
+	backoff, ok := b.backoffs[upstream]
+	if !ok {
+		backoff = &upstreamBackoff{}
+		b.backoffs[upstream] = backoff
+	}
+
+	backoff.failures++
+	backoff.probing = false
+
+	if b.config.BackoffAfter <= 0 || backoff.failures < b.config.BackoffAfter {
+		return
+	}
+
+	delay := b.config.InitialBackoff
+	for i := b.config.BackoffAfter; i < backoff.failures && delay < b.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > b.config.MaxBackoff {
+		delay = b.config.MaxBackoff
+	}
+
+	backoff.until = now.Add(delay)
+}
+
+// Stats returns the forwarder's limits and how often they were hit
+func (f *Forwarder) Stats() ForwarderStats {
+	b := &f.budget
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := ForwarderStats{
+		Budget:         b.config,
+		Outstanding:    b.outstanding,
+		Rejected:       b.rejected,
+		RejectedClient: b.rejectedClient,
+		Retries:        b.retries,
+		RetriesDenied:  b.retriesDenied,
+	}
+
+	for _, upstream := range f.upstreams {
+		us := UpstreamStats{Upstream: upstream}
+		if backoff, ok := b.backoffs[upstream]; ok {
+			us.Failures = backoff.failures
+			us.BackoffUntil = backoff.until
+		}
+
+		stats.Upstreams = append(stats.Upstreams, us)
+	}
+
+	return stats
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetLimitsOutstandingQueries(t *testing.T) {
+	b := retryBudget{config: RetryBudget{MaxOutstanding: 2, MaxOutstandingPerClient: 1}}
+
+	if !b.admitClient("192.0.2.1") {
+		t.Fatalf("first query of client not admitted")
+	}
+	if b.admitClient("192.0.2.1") {
+		t.Errorf("second query of client admitted over its limit")
+	}
+	if !b.admitClient("192.0.2.2") {
+		t.Errorf("query of other client not admitted")
+	}
+	if !b.admitClient("") {
+		t.Errorf("query of no client counted against a client limit")
+	}
+
+	b.releaseClient("192.0.2.1")
+	if !b.admitClient("192.0.2.1") {
+		t.Errorf("query of client not admitted after its earlier one finished")
+	}
+
+	if !b.admit() || !b.admit() {
+		t.Fatalf("queries within the limit not admitted")
+	}
+	if b.admit() {
+		t.Errorf("query admitted over the outstanding limit")
+	}
+
+	b.release()
+	if !b.admit() {
+		t.Errorf("query not admitted after an outstanding one finished")
+	}
+
+	if b.rejected != 1 || b.rejectedClient != 1 {
+		t.Errorf("counted %d rejected and %d rejected for clients, expected 1 and 1", b.rejected, b.rejectedClient)
+	}
+}
+
+func TestRetryBudgetLimitsRetries(t *testing.T) {
+	b := retryBudget{config: RetryBudget{RetryRatio: 0.5, MinRetriesPerSecond: 1}}
+	now := time.Unix(1000, 0)
+
+	if !b.allowRetry(now) {
+		t.Fatalf("first retry not allowed")
+	}
+	if b.allowRetry(now) {
+		t.Errorf("retry allowed with the budget exhausted")
+	}
+
+	// every query adds half a retry to the budget
+	b.admit()
+	b.admit()
+	if !b.allowRetry(now) {
+		t.Errorf("retry not allowed after two queries")
+	}
+
+	if !b.allowRetry(now.Add(time.Second)) {
+		t.Errorf("retry not allowed a second later")
+	}
+
+	if b.retries != 3 || b.retriesDenied != 1 {
+		t.Errorf("counted %d retries and %d denied, expected 3 and 1", b.retries, b.retriesDenied)
+	}
+}
+
+func TestRetryBudgetBacksOffFailingUpstream(t *testing.T) {
+	b := retryBudget{config: RetryBudget{BackoffAfter: 2, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}}
+	now := time.Unix(1000, 0)
+	upstream := "192.0.2.53:53"
+
+	b.failed(upstream, now)
+	if !b.allowUpstream(upstream, now) {
+		t.Fatalf("upstream backing off after a single failure")
+	}
+
+	b.failed(upstream, now)
+	if b.allowUpstream(upstream, now.Add(500*time.Millisecond)) {
+		t.Fatalf("upstream not backing off after two failures")
+	}
+
+	// once the backoff is over, a single query probes the upstream
+	if !b.allowUpstream(upstream, now.Add(time.Second)) {
+		t.Fatalf("upstream still backing off after the backoff")
+	}
+	if b.allowUpstream(upstream, now.Add(time.Second)) {
+		t.Errorf("second query let through while probing")
+	}
+
+	// the probe failing doubles the backoff, up to the maximum
+	b.failed(upstream, now)
+	if b.allowUpstream(upstream, now.Add(1500*time.Millisecond)) {
+		t.Errorf("backoff not doubled after failed probe")
+	}
+
+	b.failed(upstream, now)
+	if got := b.backoffs[upstream].until.Sub(now); got != 3*time.Second {
+		t.Errorf("backing off for %s, expected the maximum of 3s", got)
+	}
+
+	b.succeeded(upstream)
+	if !b.allowUpstream(upstream, now) {
+		t.Errorf("upstream backing off after success")
+	}
+}
+
+func TestForwarderSkipsUpstreamsBackingOff(t *testing.T) {
+	// nothing listens on the discard port, so dialing it fails right away
+	dead := tlsUpstreamPrefix + "127.0.0.1:9"
+
+	budget := DefaultRetryBudget()
+	budget.BackoffAfter = 1
+	budget.InitialBackoff = time.Minute
+	budget.MaxBackoff = time.Minute
+
+	addr := startFakeUpstream(t, func(id uint16, q *Question) [][]byte {
+		return [][]byte{encodeTestResponse(t, id, q)}
+	})
+
+	f, err := NewForwarder([]string{dead, addr}, WithRetryBudget(budget))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	defer f.Close()
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	if _, err := f.ExchangeFor("192.0.2.1", &q, true); err != nil {
+		t.Fatalf("error while exchanging: %v", err)
+	}
+
+	stats := f.Stats()
+	if stats.Retries != 1 {
+		t.Errorf("counted %d retries, expected 1", stats.Retries)
+	}
+	if stats.Outstanding != 0 {
+		t.Errorf("%d queries outstanding after exchange", stats.Outstanding)
+	}
+	if got := stats.Upstreams[0]; got.Failures != 1 || got.BackoffUntil.IsZero() {
+		t.Errorf("failed upstream has %d failures and backs off until %s", got.Failures, got.BackoffUntil)
+	}
+
+	only, err := NewForwarder([]string{dead}, WithRetryBudget(budget))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	defer only.Close()
+
+	if _, err := only.Exchange(&q, true); err == nil {
+		t.Fatalf("exchange with a dead upstream succeeded")
+	}
+	if _, err := only.Exchange(&q, true); err != errUpstreamsBackoff {
+		t.Errorf("got error %v with the only upstream backing off, expected %v", err, errUpstreamsBackoff)
+	}
+}
+
+func TestForwarderAbandonsProbeWithoutRetries(t *testing.T) {
+	// nothing listens on these ports, so dialing them fails right away
+	first := tlsUpstreamPrefix + "127.0.0.1:9"
+	probed := tlsUpstreamPrefix + "127.0.0.1:7"
+
+	// no retries at all, so asking the second upstream is always refused
+	budget := RetryBudget{BackoffAfter: 1, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	f, err := NewForwarder([]string{first, probed}, WithRetryBudget(budget))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	defer f.Close()
+
+	// the second upstream's backoff is over, so the next query probes it
+	f.budget.failed(probed, time.Now().Add(-time.Second))
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	if _, err := f.Exchange(&q, true); err == nil || !strings.Contains(err.Error(), errRetryBudget.Error()) {
+		t.Fatalf("got error %v, expected the retry budget to be exhausted", err)
+	}
+
+	if !f.budget.allowUpstream(probed, time.Now()) {
+		t.Errorf("upstream still probed by a query that never asked it")
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errChaosDrop is what a forwarder's upstream query fails with when chaos
+// drops it
+var errChaosDrop = errors.New("query dropped by chaos")
+
+// Chaos injects faults into the server's listeners or its forwarder, so that
+// how clients and the server cope with slow, lossy or truncating peers can be
+// tried out locally. It's meant for testing only: never enable it on a
+// server that answers real clients.
+//
+// Faults are drawn from a random source seeded with Seed, so that a run with
+// the same seed and the same queries in the same order injects the same
+// faults
+type Chaos struct {
+	// Latency delays every response, or upstream query, by Latency plus a
+	// random duration of up to Jitter
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// DropRate is the share of responses that are never sent, or of upstream
+	// queries that fail right away, as they would after a timeout but
+	// without waiting for it
+	DropRate float64
+
+	// TruncateRate is the share of UDP responses, or upstream responses over
+	// UDP, that are cut down to their question with the TC bit set, so that
+	// they're retried over TCP
+	TruncateRate float64
+
+	Seed int64
+}
+
+// ParseChaos parses a comma separated list of chaos settings, e.g.
+// "latency=50ms,jitter=20ms,drop=0.1,truncate=0.05,seed=1"
+func ParseChaos(s string) (Chaos, error) {
+	c := Chaos{}
+	for _, setting := range strings.Split(s, ",") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(setting, "=", 2)
+		if len(parts) != 2 {
+			return Chaos{}, fmt.Errorf("invalid chaos setting %q, expected key=value", setting)
+		}
+
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		var err error
+		switch key {
+		case "latency":
+			c.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			c.Jitter, err = time.ParseDuration(value)
+		case "drop":
+			c.DropRate, err = parseRate(value)
+		case "truncate":
+			c.TruncateRate, err = parseRate(value)
+		case "seed":
+			c.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return Chaos{}, fmt.Errorf("unknown chaos setting %q", key)
+		}
+
+		if err != nil {
+			return Chaos{}, fmt.Errorf("invalid chaos %s %q: %v", key, value, err)
+		}
+	}
+
+	return c, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if rate < 0 || rate > 1 {
+		return 0, errors.New("rate must be between 0 and 1")
+	}
+
+	return rate, nil
+}
+
+// WithChaos makes the server inject the faults of c into its responses, over
+// UDP, TCP and TLS alike except for truncation, which only UDP responses get
+func WithChaos(c Chaos) Option {
+	return func(srv *DNSServer) {
+		srv.chaos = newChaosInjector(c)
+	}
+}
+
+// WithForwarderChaos makes the forwarder inject the faults of c into its
+// upstream queries
+func WithForwarderChaos(c Chaos) ForwarderOption {
+	return func(f *Forwarder) {
+		f.chaos = newChaosInjector(c)
+	}
+}
+
+// chaosFault is what chaos does to a message
+type chaosFault int
+
+const (
+	chaosNone chaosFault = iota
+	chaosDrop
+	chaosTruncate
+)
+
+// chaosInjector draws the faults of a Chaos. A nil injector injects none
+type chaosInjector struct {
+	config Chaos
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newChaosInjector(c Chaos) *chaosInjector {
+	return &chaosInjector{config: c, rand: rand.New(rand.NewSource(c.Seed))}
+}
+
+// draw picks the delay and the fault for the next message. Messages that
+// can't be truncated are never picked for it
+func (c *chaosInjector) draw(canTruncate bool) (time.Duration, chaosFault) {
+	if c == nil {
+		return 0, chaosNone
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delay := c.config.Latency
+	if c.config.Jitter > 0 {
+		delay += time.Duration(c.rand.Int63n(int64(c.config.Jitter) + 1))
+	}
+
+	// both are always drawn, so that the faults of a seed don't depend on
+	// which messages can be truncated
+	drop := c.rand.Float64() < c.config.DropRate
+	truncate := c.rand.Float64() < c.config.TruncateRate
+
+	switch {
+	case drop:
+		return delay, chaosDrop
+	case truncate && canTruncate:
+		return delay, chaosTruncate
+	}
+
+	return delay, chaosNone
+}
+
+// apply delays msg and returns it as chaos has it, or false if it's dropped
+func (c *chaosInjector) apply(msg []byte, canTruncate bool) ([]byte, bool) {
+	delay, fault := c.draw(canTruncate)
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	switch fault {
+	case chaosDrop:
+		return nil, false
+	case chaosTruncate:
+		if truncated, err := truncatedResponse(msg); err == nil {
+			return truncated, true
+		}
+	}
+
+	return msg, true
+}
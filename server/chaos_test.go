@@ -0,0 +1,160 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseChaos(t *testing.T) {
+	c, err := ParseChaos("latency=50ms, jitter=20ms,drop=0.1,truncate=0.05,seed=7")
+	if err != nil {
+		t.Fatalf("error while parsing chaos: %v", err)
+	}
+
+	expected := Chaos{Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, DropRate: 0.1, TruncateRate: 0.05, Seed: 7}
+	if c != expected {
+		t.Errorf("parsed %+v, expected %+v", c, expected)
+	}
+
+	for _, invalid := range []string{"latency", "latency=fast", "drop=2", "delay=1s"} {
+		if _, err := ParseChaos(invalid); err == nil {
+			t.Errorf("no error for %q", invalid)
+		}
+	}
+}
+
+func TestChaosIsDeterministic(t *testing.T) {
+	c := Chaos{Jitter: time.Second, DropRate: 0.3, TruncateRate: 0.3, Seed: 42}
+	a, b := newChaosInjector(c), newChaosInjector(c)
+
+	faults := map[chaosFault]int{}
+	for i := 0; i < 100; i++ {
+		delayA, faultA := a.draw(true)
+		delayB, faultB := b.draw(true)
+		if delayA != delayB || faultA != faultB {
+			t.Fatalf("draw %d differs between injectors of the same seed", i)
+		}
+
+		faults[faultA]++
+	}
+
+	if faults[chaosNone] == 0 || faults[chaosDrop] == 0 || faults[chaosTruncate] == 0 {
+		t.Errorf("unexpected faults %v", faults)
+	}
+
+	if delay, fault := (*chaosInjector)(nil).draw(true); delay != 0 || fault != chaosNone {
+		t.Errorf("nil injector injected %s and %d", delay, fault)
+	}
+}
+
+func TestServerChaos(t *testing.T) {
+	q := Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}
+
+	srv := startTestServer(t, WithChaos(Chaos{TruncateRate: 1}))
+	addr, _ := srv.loopbackAddr()
+
+	resp, err := exchangeTestUDPMessage(addr, encodeTestQuery(t, 1, &q), time.Second)
+	if err != nil {
+		t.Fatalf("error while exchanging: %v", err)
+	}
+	if !isTruncated(resp) {
+		t.Errorf("expected a truncated response")
+	}
+
+	srv = startTestServer(t, WithChaos(Chaos{DropRate: 1}))
+	addr, _ = srv.loopbackAddr()
+
+	if _, err := exchangeTestUDPMessage(addr, encodeTestQuery(t, 2, &q), 200*time.Millisecond); err == nil {
+		t.Errorf("expected the response to be dropped")
+	}
+}
+
+func exchangeTestUDPMessage(addr string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func TestForwarderChaos(t *testing.T) {
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+
+	addr := startFakeUpstream(t, func(id uint16, q *Question) [][]byte {
+		return [][]byte{encodeTestResponse(t, id, q)}
+	})
+
+	f, err := NewForwarder([]string{addr}, WithForwarderChaos(Chaos{Latency: 50 * time.Millisecond, DropRate: 1}))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	defer f.Close()
+
+	start := time.Now()
+	_, err = f.Exchange(&q, true)
+	if err == nil || !strings.Contains(err.Error(), errChaosDrop.Error()) {
+		t.Errorf("got error %v, expected the query to be dropped", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("dropped after %s, expected a latency of 50ms", elapsed)
+	}
+
+	// a truncated UDP response is retried over TCP
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { tcpListener.Close() })
+
+	port := tcpListener.Addr().(*net.TCPAddr).Port
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Skipf("could not bind udp on tcp port %d: %v", port, err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		rlen, from, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		headers := DNSHeader{}
+		headers.ReadFrom(buf[:rlen])
+		_, q, _ := ReadQuestionFrom(buf[12:rlen])
+		udpConn.WriteToUDP(encodeTestResponse(t, headers.ID, q), from)
+	}()
+
+	go serveFakeTCPUpstream(t, tcpListener)
+
+	f, err = NewForwarder([]string{tcpListener.Addr().String()}, WithForwarderChaos(Chaos{TruncateRate: 1}))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	defer f.Close()
+
+	resp, err := f.Exchange(&q, true)
+	if err != nil {
+		t.Fatalf("error while exchanging: %v", err)
+	}
+
+	if isTruncated(resp) {
+		t.Errorf("expected the untruncated TCP response, got a truncated one")
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseRecordComment splits the comment of a record's line into its text and
+// its metadata tags, the words of the form key=value
+func parseRecordComment(comment string) (string, map[string]string) {
+	var meta map[string]string
+	words := []string{}
+	for _, word := range strings.Fields(comment) {
+		key, value, ok := splitMetaTag(word)
+		if !ok {
+			words = append(words, word)
+			continue
+		}
+
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta[key] = value
+	}
+
+	return strings.Join(words, " "), meta
+}
+
+// splitMetaTag splits a word of the form key=value, keys being made of
+// letters, digits, '-', '_' and '.'
+func splitMetaTag(word string) (string, string, bool) {
+	i := strings.IndexByte(word, '=')
+	if i <= 0 {
+		return "", "", false
+	}
+
+	for _, c := range word[:i] {
+		if !isMetaKeyChar(c) {
+			return "", "", false
+		}
+	}
+
+	return word[:i], word[i+1:], true
+}
+
+func isMetaKeyChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+}
+
+// recordComment returns the comment rr is written with in zone files, its
+// text followed by its metadata tags sorted by key, empty if it has neither
+func recordComment(rr *ResourceRecord) string {
+	if len(rr.Meta) == 0 {
+		return rr.Comment
+	}
+
+	keys := make([]string, 0, len(rr.Meta))
+	for key := range rr.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	words := []string{}
+	if rr.Comment != "" {
+		words = append(words, rr.Comment)
+	}
+	for _, key := range keys {
+		words = append(words, key+"="+rr.Meta[key])
+	}
+
+	return strings.Join(words, " ")
+}
+
+// validateAnnotations checks that a comment and metadata tags survive being
+// written to a zone file and read back
+func validateAnnotations(comment string, meta map[string]string) error {
+	if strings.ContainsAny(comment, "\r\n") {
+		return errors.New("comment spans several lines")
+	}
+
+	if _, tags := parseRecordComment(comment); len(tags) > 0 {
+		return errors.New("comment has key=value words, which are read back as metadata tags")
+	}
+
+	for key, value := range meta {
+		if key == "" || strings.IndexFunc(key, func(c rune) bool { return !isMetaKeyChar(c) }) >= 0 {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+
+		if strings.ContainsAny(value, " \t\r\n") {
+			return fmt.Errorf("metadata value of %s has whitespace", key)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCommentZone = `$ORIGIN example.com.
+$TTL 300
+; lines of their own are dropped
+@     IN SOA ns1 hostmaster ( 1 ; serial
+                              3600 600 86400 300 )
+www   IN A   192.0.2.10  ; canary box  owner=team-a ticket=OPS-12
+      IN A   192.0.2.11  ; owner=team-b
+mail  IN MX  10 mail
+$GENERATE 1-2 host-$ A 10.0.0.$ ; generated owner=dhcp
+`
+
+func TestZoneFileCommentsAndMeta(t *testing.T) {
+	records, err := ParseZoneFile(strings.NewReader(testCommentZone), "")
+	if err != nil {
+		t.Fatalf("error while parsing zone: %v", err)
+	}
+
+	expected := []struct {
+		comment string
+		meta    map[string]string
+	}{
+		{"serial", nil},
+		{"canary box", map[string]string{"owner": "team-a", "ticket": "OPS-12"}},
+		{"", map[string]string{"owner": "team-b"}},
+		{"", nil},
+		{"generated", map[string]string{"owner": "dhcp"}},
+		{"generated", map[string]string{"owner": "dhcp"}},
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("parsed %d records, expected %d", len(records), len(expected))
+	}
+
+	for i, rr := range records {
+		if rr.Comment != expected[i].comment || !reflect.DeepEqual(rr.Meta, expected[i].meta) {
+			t.Errorf("record %d %s %s has comment %q and meta %v, expected %q and %v", i, rr.Name, rr.Type, rr.Comment, rr.Meta, expected[i].comment, expected[i].meta)
+		}
+	}
+
+	buf := bytes.Buffer{}
+	if err := WriteZone(&buf, records); err != nil {
+		t.Fatalf("error while writing zone: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "www.example.com.\t300\tIN\tA\t192.0.2.10\t; canary box owner=team-a ticket=OPS-12\n") {
+		t.Errorf("dump lacks the annotations of www:\n%s", buf.String())
+	}
+
+	// the annotations survive the dump being read back
+	reread, err := ParseZoneFile(bytes.NewReader(buf.Bytes()), "")
+	if err != nil {
+		t.Fatalf("error while parsing dump: %v", err)
+	}
+
+	again := bytes.Buffer{}
+	WriteZone(&again, reread)
+	if again.String() != buf.String() {
+		t.Errorf("dump doesn't round trip:\n%s\nexpected:\n%s", again.String(), buf.String())
+	}
+}
+
+func TestValidateAnnotations(t *testing.T) {
+	tests := []struct {
+		comment string
+		meta    map[string]string
+		valid   bool
+	}{
+		{"canary box", map[string]string{"owner": "team-a"}, true},
+		{"", nil, true},
+		{"two\nlines", nil, false},
+		{"owner=team-a", nil, false},
+		{"", map[string]string{"bad key": "x"}, false},
+		{"", map[string]string{"owner": "team a"}, false},
+	}
+
+	for _, tt := range tests {
+		if err := validateAnnotations(tt.comment, tt.meta); (err == nil) != tt.valid {
+			t.Errorf("validateAnnotations(%q, %v) = %v, expected valid %t", tt.comment, tt.meta, err, tt.valid)
+		}
+	}
+}
+
+func TestAdminRecordAnnotations(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	h := NewAdminHandler(srv)
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{"name": "canary.kausm.in", "type": "A", "ttl": 60, "data": "192.0.2.1", "comment": "rollout test", "meta": {"owner": "team-a"}}`)))
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("expected created, got %d: %s", resp.Code, resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/zone?name=kausm.in", nil))
+	if !strings.Contains(resp.Body.String(), "canary.kausm.in.\t60\tIN\tA\t192.0.2.1\t; rollout test owner=team-a\n") {
+		t.Errorf("dump lacks the annotations of the added record:\n%s", resp.Body.String())
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{"name": "bad.kausm.in", "type": "A", "ttl": 60, "data": "192.0.2.2", "comment": "two\nlines"}`)))
+	if resp.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request for a multi-line comment, got %d", resp.Code)
+	}
+}
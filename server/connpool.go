@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPoolMaxIdle is how many idle connections are kept per upstream
+	defaultPoolMaxIdle = 4
+
+	// defaultPoolMaxAge is how long a connection is used before it's
+	// replaced by a fresh one, so that long lived connections don't pin an
+	// upstream behind a load balancer
+	defaultPoolMaxAge = 5 * time.Minute
+
+	// defaultPoolIdleTimeout is how long a connection may sit unused. It is
+	// below the 10 seconds many servers, this one included, give idle clients
+	defaultPoolIdleTimeout = 8 * time.Second
+
+	// defaultPoolProbeInterval is how often idle connections are checked
+	// with a query, which also keeps them from idling out
+	defaultPoolProbeInterval = 5 * time.Second
+)
+
+// pooledConn is a connection to an upstream that can carry one query at a
+// time
+type pooledConn struct {
+	net.Conn
+	created  time.Time
+	lastUsed time.Time
+}
+
+// connPool keeps warm TCP or TLS connections to a single upstream, so that
+// queries over them don't pay for a handshake each. Connections are handed
+// out to one query at a time and are only put back after a clean exchange
+type connPool struct {
+	dial func() (net.Conn, error)
+
+	maxIdle     int
+	maxAge      time.Duration
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle []*pooledConn
+}
+
+func newConnPool(dial func() (net.Conn, error), maxIdle int, maxAge time.Duration) *connPool {
+	return &connPool{
+		dial:        dial,
+		maxIdle:     maxIdle,
+		maxAge:      maxAge,
+		idleTimeout: defaultPoolIdleTimeout,
+	}
+}
+
+// get returns an idle connection, or a new one if there are none. reused
+// tells whether the connection was used before, in which case the upstream
+// may have closed it in the meantime
+func (p *connPool) get() (conn *pooledConn, reused bool, err error) {
+	now := time.Now()
+
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		// the most recently used connection is the least likely to have
+		// been closed by the upstream
+		conn = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if p.usable(conn, now) {
+			p.mu.Unlock()
+			return conn, true, nil
+		}
+
+		conn.Close()
+	}
+	p.mu.Unlock()
+
+	c, err := p.dial()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &pooledConn{Conn: c, created: now, lastUsed: now}, false, nil
+}
+
+// put returns a connection after a successful exchange
+func (p *connPool) put(conn *pooledConn) {
+	conn.lastUsed = time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.idle) >= p.maxIdle || !p.usable(conn, conn.lastUsed) {
+		conn.Close()
+		return
+	}
+
+	p.idle = append(p.idle, conn)
+}
+
+func (p *connPool) usable(conn *pooledConn, now time.Time) bool {
+	return now.Sub(conn.created) < p.maxAge && now.Sub(conn.lastUsed) < p.idleTimeout
+}
+
+// idleCount returns how many connections are waiting to be reused
+func (p *connPool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.idle)
+}
+
+// probe takes all idle connections out of the pool, drops those that are too
+// old and those failing check, and puts the rest back
+func (p *connPool) probe(check func(conn *pooledConn) error) int {
+	now := time.Now()
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	dropped := 0
+	for _, conn := range idle {
+		if !p.usable(conn, now) || check(conn) != nil {
+			conn.Close()
+			dropped++
+			continue
+		}
+
+		p.put(conn)
+	}
+
+	return dropped
+}
+
+// close closes all idle connections
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func pipeDialer(dialed *int) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		*dialed++
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+}
+
+func TestConnPoolReusesIdleConnections(t *testing.T) {
+	dialed := 0
+	p := newConnPool(pipeDialer(&dialed), 2, time.Minute)
+
+	first, reused, err := p.get()
+	if err != nil || reused {
+		t.Fatalf("expected a new connection, got reused %t, error %v", reused, err)
+	}
+	p.put(first)
+
+	second, reused, err := p.get()
+	if err != nil || !reused || second != first {
+		t.Fatalf("expected the idle connection back, got reused %t, error %v", reused, err)
+	}
+
+	if dialed != 1 {
+		t.Errorf("expected 1 dial, got %d", dialed)
+	}
+}
+
+func TestConnPoolKeepsAtMostMaxIdle(t *testing.T) {
+	dialed := 0
+	p := newConnPool(pipeDialer(&dialed), 2, time.Minute)
+
+	conns := []*pooledConn{}
+	for i := 0; i < 3; i++ {
+		conn, _, _ := p.get()
+		conns = append(conns, conn)
+	}
+
+	for _, conn := range conns {
+		p.put(conn)
+	}
+
+	if n := p.idleCount(); n != 2 {
+		t.Errorf("expected 2 idle connections, got %d", n)
+	}
+}
+
+func TestConnPoolRecyclesOldConnections(t *testing.T) {
+	dialed := 0
+	p := newConnPool(pipeDialer(&dialed), 2, time.Minute)
+
+	conn, _, _ := p.get()
+	conn.created = time.Now().Add(-2 * time.Minute)
+	p.idle = append(p.idle, conn)
+
+	if _, reused, _ := p.get(); reused {
+		t.Errorf("expected a connection past its max age not to be reused")
+	}
+
+	if dialed != 2 {
+		t.Errorf("expected 2 dials, got %d", dialed)
+	}
+}
+
+func TestConnPoolProbeDropsFailingConnections(t *testing.T) {
+	dialed := 0
+	p := newConnPool(pipeDialer(&dialed), 4, time.Minute)
+
+	healthy, _, _ := p.get()
+	broken, _, _ := p.get()
+	p.put(healthy)
+	p.put(broken)
+
+	dropped := p.probe(func(conn *pooledConn) error {
+		if conn == broken {
+			return errors.New("no answer")
+		}
+		return nil
+	})
+
+	if dropped != 1 {
+		t.Errorf("expected 1 dropped connection, got %d", dropped)
+	}
+
+	if conn, _, _ := p.get(); conn != healthy {
+		t.Errorf("expected the healthy connection to be kept")
+	}
+}
@@ -0,0 +1,550 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultDHCPRefreshInterval is how often the lease file is checked for
+	// changes
+	defaultDHCPRefreshInterval = 10 * time.Second
+
+	defaultDHCPTTL = 60
+)
+
+// DHCPLease is an IPv4 address handed out to a host by a DHCP server
+type DHCPLease struct {
+	IP       net.IP
+	Hostname string
+
+	// Expires is when the lease ends, the zero time for leases that don't
+	Expires time.Time
+}
+
+func (l DHCPLease) activeAt(now time.Time) bool {
+	return l.Expires.IsZero() || now.Before(l.Expires)
+}
+
+// DHCPBackend is a Backend publishing the hosts with an active lease under a
+// local domain, so hosts on a home or lab network can find each other by the
+// names they asked the DHCP server for:
+//
+//	<hostname>.<domain>            A of the leased address
+//	<d>.<c>.<b>.<a>.in-addr.arpa   PTR back to <hostname>.<domain>
+//
+// The lease file of dnsmasq, ISC dhcpd or Kea (memfile CSV) is read again
+// whenever it changes. The backend answers for the reverse zone of every /24
+// network with an active lease
+type DHCPBackend struct {
+	path   string
+	domain string
+	ttl    uint32
+
+	refreshInterval time.Duration
+
+	// leases holds the []DHCPLease last read
+	leases  atomic.Value
+	modTime time.Time
+
+	done chan struct{}
+
+	log Logger
+}
+
+// DHCPBackendOption configures optional behaviour of a DHCPBackend
+type DHCPBackendOption func(*DHCPBackend)
+
+// WithDHCPRefreshInterval sets how often the lease file is checked for
+// changes
+func WithDHCPRefreshInterval(interval time.Duration) DHCPBackendOption {
+	return func(b *DHCPBackend) {
+		b.refreshInterval = interval
+	}
+}
+
+// WithDHCPTTL sets the TTL of the records served
+func WithDHCPTTL(ttl uint32) DHCPBackendOption {
+	return func(b *DHCPBackend) {
+		b.ttl = ttl
+	}
+}
+
+// WithDHCPLogger sets the logger of the backend, which logs under the "dhcp"
+// component
+func WithDHCPLogger(l Logger) DHCPBackendOption {
+	return func(b *DHCPBackend) {
+		b.log = scopeLogger(l, "dhcp")
+	}
+}
+
+// NewDHCPBackend returns a backend serving the leases in the file at path
+// under domain, and starts watching the file for changes
+func NewDHCPBackend(path, domain string, opts ...DHCPBackendOption) (*DHCPBackend, error) {
+	b := DHCPBackend{
+		path:            path,
+		domain:          strings.ToLower(strings.TrimSuffix(domain, ".")),
+		ttl:             defaultDHCPTTL,
+		refreshInterval: defaultDHCPRefreshInterval,
+		done:            make(chan struct{}),
+		log:             scopeLogger(defaultLogger(), "dhcp"),
+	}
+
+	for _, opt := range opts {
+		opt(&b)
+	}
+
+	if b.domain == "" {
+		return nil, fmt.Errorf("DHCP backend needs a domain")
+	}
+
+	if _, err := b.reload(); err != nil {
+		return nil, err
+	}
+
+	go b.refreshEvery(b.refreshInterval)
+
+	return &b, nil
+}
+
+// Close stops watching the lease file
+func (b *DHCPBackend) Close() {
+	close(b.done)
+}
+
+// reload reads the lease file if it changed since it was last read, and
+// reports whether it did
+func (b *DHCPBackend) reload() (bool, error) {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		return false, fmt.Errorf("error while reading lease file: %v", err)
+	}
+
+	if info.ModTime().Equal(b.modTime) {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(b.path)
+	if err != nil {
+		return false, fmt.Errorf("error while reading lease file: %v", err)
+	}
+
+	leases, err := ParseDHCPLeases(bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("error while parsing %s: %v", b.path, err)
+	}
+
+	b.leases.Store(leases)
+	b.modTime = info.ModTime()
+
+	return true, nil
+}
+
+func (b *DHCPBackend) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+
+		// a file that is being rewritten may fail to parse, the leases read
+		// before are kept until it parses again
+		reloaded, err := b.reload()
+		if err != nil {
+			b.log.Warnf("%v", err)
+			continue
+		}
+
+		if reloaded {
+			b.log.Debugf("read %d leases from %s", len(b.leases.Load().([]DHCPLease)), b.path)
+		}
+	}
+}
+
+// activeLeases returns the leases that haven't expired at now
+func (b *DHCPBackend) activeLeases(now time.Time) []DHCPLease {
+	active := []DHCPLease{}
+	for _, lease := range b.leases.Load().([]DHCPLease) {
+		if lease.activeAt(now) {
+			active = append(active, lease)
+		}
+	}
+
+	return active
+}
+
+// Zones returns the domain and the reverse zones of the active leases
+func (b *DHCPBackend) Zones() []string {
+	zones := []string{b.domain}
+
+	seen := map[string]bool{}
+	for _, lease := range b.activeLeases(time.Now()) {
+		zone := reverseZone24(lease.IP)
+		if !seen[zone] {
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+
+	return zones
+}
+
+// Lookup returns the A records of hosts and the PTR records of addresses
+// with an active lease
+func (b *DHCPBackend) Lookup(q *Question) ([]*ResourceRecord, error) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	leases := b.activeLeases(time.Now())
+
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		return b.lookupPTR(q, name, leases)
+	}
+
+	if name == b.domain {
+		return []*ResourceRecord{}, nil
+	}
+
+	host := strings.TrimSuffix(name, "."+b.domain)
+
+	found := false
+	answers := []*ResourceRecord{}
+	for _, lease := range leases {
+		if lease.Hostname != host {
+			continue
+		}
+		found = true
+
+		if q.Type == &TypeA || q.Type == &TypeAll {
+			answers = append(answers, &ResourceRecord{Name: name, Type: &TypeA, Class: &ClassIN, TTL: b.ttl, Value: []byte(lease.IP)})
+		}
+	}
+
+	if !found {
+		return nil, ErrNameNotFound
+	}
+
+	return answers, nil
+}
+
+func (b *DHCPBackend) lookupPTR(q *Question, name string, leases []DHCPLease) ([]*ResourceRecord, error) {
+	ip := reverseNameIP(name)
+	if ip == nil {
+		// the zone apex and names between it and the addresses exist,
+		// anything else doesn't
+		for _, lease := range leases {
+			if strings.HasSuffix(reverseName(lease.IP), "."+name) {
+				return []*ResourceRecord{}, nil
+			}
+		}
+
+		return nil, ErrNameNotFound
+	}
+
+	found := false
+	answers := []*ResourceRecord{}
+	for _, lease := range leases {
+		if !lease.IP.Equal(ip) {
+			continue
+		}
+		found = true
+
+		if q.Type != &TypePTR && q.Type != &TypeAll {
+			continue
+		}
+
+		target, err := encodeName(lease.Hostname + "." + b.domain)
+		if err != nil {
+			continue
+		}
+
+		answers = append(answers, &ResourceRecord{Name: name, Type: &TypePTR, Class: &ClassIN, TTL: b.ttl, Value: target})
+	}
+
+	if !found {
+		return nil, ErrNameNotFound
+	}
+
+	return answers, nil
+}
+
+// reverseName returns the in-addr.arpa name of an IPv4 address
+func reverseName(ip net.IP) string {
+	ip = ip.To4()
+	return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ip[3], ip[2], ip[1], ip[0])
+}
+
+// reverseZone24 returns the reverse zone of the /24 network of ip
+func reverseZone24(ip net.IP) string {
+	ip = ip.To4()
+	return fmt.Sprintf("%d.%d.%d.in-addr.arpa", ip[2], ip[1], ip[0])
+}
+
+// reverseNameIP returns the IPv4 address of a full in-addr.arpa name, or nil
+func reverseNameIP(name string) net.IP {
+	labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+	if len(labels) != 4 {
+		return nil
+	}
+
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return net.ParseIP(strings.Join(labels, ".")).To4()
+}
+
+var (
+	// hostnameLabel matches hostnames that can be used as a single label
+	hostnameLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+	iscLeaseDeclaration = regexp.MustCompile(`(?m)^\s*lease\s+\S+\s*\{`)
+)
+
+// ParseDHCPLeases reads the IPv4 leases with a hostname from a lease file of
+// dnsmasq, ISC dhcpd or Kea, whichever it looks like. Of the leases of an
+// address, the last one in the file wins
+func ParseDHCPLeases(r io.Reader) ([]DHCPLease, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []DHCPLease
+	switch {
+	case bytes.HasPrefix(data, []byte("address,")):
+		leases, err = parseKeaLeases(data)
+	case iscLeaseDeclaration.Match(data):
+		leases, err = parseISCLeases(data)
+	default:
+		leases, err = parseDnsmasqLeases(data)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	byIP := map[string]DHCPLease{}
+	order := []string{}
+	for _, lease := range leases {
+		if lease.IP.To4() == nil {
+			continue
+		}
+		lease.IP = lease.IP.To4()
+		key := lease.IP.String()
+
+		// leases without a usable hostname still supersede earlier ones
+		lease.Hostname = strings.ToLower(strings.TrimSuffix(lease.Hostname, "."))
+		if !hostnameLabel.MatchString(lease.Hostname) {
+			delete(byIP, key)
+			continue
+		}
+
+		if _, ok := byIP[key]; !ok {
+			order = append(order, key)
+		}
+		byIP[key] = lease
+	}
+
+	sort.Strings(order)
+
+	result := make([]DHCPLease, 0, len(order))
+	for _, key := range order {
+		if lease, ok := byIP[key]; ok {
+			result = append(result, lease)
+		}
+	}
+
+	return result, nil
+}
+
+// parseDnsmasqLeases reads lines of
+//
+//	<expiry> <mac> <ip> <hostname> <client id>
+//
+// where expiry is in seconds since the epoch, 0 for infinite leases, and an
+// unknown hostname is *
+func parseDnsmasqLeases(data []byte) ([]DHCPLease, error) {
+	leases := []DHCPLease{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("line %d: expected at least 4 fields, got %d", line, len(fields))
+		}
+
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", line, fields[0])
+		}
+
+		lease := DHCPLease{IP: net.ParseIP(fields[2]), Hostname: fields[3]}
+		if expiry != 0 {
+			lease.Expires = time.Unix(expiry, 0)
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, scanner.Err()
+}
+
+// parseISCLeases reads the lease declarations of dhcpd.leases:
+//
+//	lease 192.168.1.10 {
+//	  ends 4 2026/10/15 22:00:00;
+//	  binding state active;
+//	  client-hostname "laptop";
+//	}
+func parseISCLeases(data []byte) ([]DHCPLease, error) {
+	leases := []DHCPLease{}
+
+	var current *DHCPLease
+	active := true
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(strings.TrimSuffix(text, ";"))
+		if len(fields) == 0 {
+			continue
+		}
+
+		if current == nil {
+			if fields[0] == "lease" && len(fields) == 3 && fields[2] == "{" {
+				current = &DHCPLease{IP: net.ParseIP(fields[1])}
+				active = true
+			}
+			continue
+		}
+
+		switch {
+		case fields[0] == "}":
+			// a later declaration for the address supersedes earlier ones,
+			// also when it frees the address
+			if !active {
+				current.Hostname = ""
+			}
+			leases = append(leases, *current)
+			current = nil
+		case fields[0] == "ends" && len(fields) >= 2:
+			if fields[1] == "never" {
+				continue
+			}
+
+			// with db-time-format local, times are seconds since the epoch
+			if fields[1] == "epoch" && len(fields) >= 3 {
+				ends, err := strconv.ParseInt(fields[2], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid end of lease %q", line, fields[2])
+				}
+				current.Expires = time.Unix(ends, 0)
+				continue
+			}
+
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("line %d: invalid end of lease", line)
+			}
+
+			ends, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid end of lease: %v", line, err)
+			}
+			current.Expires = ends
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			current.Hostname = strings.Trim(fields[1], `"`)
+		}
+	}
+
+	if current != nil {
+		return nil, fmt.Errorf("line %d: unterminated lease of %s", line, current.IP)
+	}
+
+	return leases, scanner.Err()
+}
+
+// parseKeaLeases reads the CSV lease file of Kea's memfile backend, whose
+// first line names the columns
+func parseKeaLeases(data []byte) ([]DHCPLease, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+
+	for _, name := range []string{"address", "expire", "hostname", "state"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %s", name)
+		}
+	}
+
+	leases := []DHCPLease{}
+	for i, record := range records[1:] {
+		expire, err := strconv.ParseInt(record[columns["expire"]], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expire %q", i+2, record[columns["expire"]])
+		}
+
+		// Kea keeps the client's FQDN as its hostname, of which the host is
+		// the first label
+		hostname := strings.TrimSuffix(record[columns["hostname"]], ".")
+		if i := strings.Index(hostname, "."); i >= 0 {
+			hostname = hostname[:i]
+		}
+
+		lease := DHCPLease{
+			IP:       net.ParseIP(record[columns["address"]]),
+			Hostname: hostname,
+			Expires:  time.Unix(expire, 0),
+		}
+
+		// state 0 is a lease in use, the others are declined or expired
+		// and reclaimed
+		if record[columns["state"]] != "0" {
+			lease.Hostname = ""
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, nil
+}
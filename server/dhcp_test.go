@@ -0,0 +1,120 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func leaseStrings(leases []DHCPLease) string {
+	strs := []string{}
+	for _, lease := range leases {
+		strs = append(strs, lease.IP.String()+"="+lease.Hostname)
+	}
+
+	return strings.Join(strs, " ")
+}
+
+func TestParseDHCPLeases(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		format string
+		file   string
+		want   string
+	}{
+		{
+			"dnsmasq",
+			fmt.Sprintf("%d 00:11:22:33:44:55 192.168.1.10 laptop 01:00:11:22:33:44:55\n"+
+				"0 00:11:22:33:44:66 192.168.1.11 NAS *\n"+
+				"%d 00:11:22:33:44:77 192.168.1.12 * *\n"+
+				"duid 00:01:00:01:2c:1f:5e:3a:00:11:22:33:44:55\n"+
+				"%d 1234 fd00::10 phone *\n", future.Unix(), future.Unix(), future.Unix()),
+			"192.168.1.10=laptop 192.168.1.11=nas",
+		},
+		{
+			"isc",
+			"# The format of this file is documented in the dhcpd.leases(5) manual page.\n" +
+				"lease 192.168.1.20 {\n  starts 4 2026/10/15 10:00:00;\n  ends 4 2036/10/15 22:00:00;\n" +
+				"  binding state active;\n  client-hostname \"printer\";\n}\n" +
+				"lease 192.168.1.21 {\n  ends never;\n  binding state active;\n  client-hostname \"tv\";\n}\n" +
+				"lease 192.168.1.21 {\n  ends epoch 2107000000;\n  binding state free;\n}\n" +
+				"lease 192.168.1.22 {\n  ends never;\n  client-hostname \"bad_name\";\n}\n" +
+				"lease 192.168.1.23 {\n  ;\n}\n",
+			"192.168.1.20=printer",
+		},
+		{
+			"kea",
+			"address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context\n" +
+				fmt.Sprintf("10.0.0.5,00:11:22:33:44:55,,3600,%d,1,0,0,desktop.,0,\n", future.Unix()) +
+				fmt.Sprintf("10.0.0.6,00:11:22:33:44:66,,3600,%d,1,0,0,old,2,\n", future.Unix()) +
+				fmt.Sprintf("10.0.0.7,00:11:22:33:44:77,,3600,%d,1,1,1,phone.lan.example.com.,0,\n", future.Unix()),
+			"10.0.0.5=desktop 10.0.0.7=phone",
+		},
+	}
+
+	for _, tt := range tests {
+		leases, err := ParseDHCPLeases(strings.NewReader(tt.file))
+		if err != nil {
+			t.Errorf("error while parsing %s leases: %v", tt.format, err)
+			continue
+		}
+
+		if got := leaseStrings(leases); got != tt.want {
+			t.Errorf("expected %s leases %q, got %q", tt.format, tt.want, got)
+		}
+	}
+}
+
+func TestDHCPBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	now := time.Now()
+	leases := fmt.Sprintf("%d 00:11:22:33:44:55 192.168.1.10 laptop *\n%d 00:11:22:33:44:66 192.168.1.11 gone *\n",
+		now.Add(time.Hour).Unix(), now.Add(-time.Hour).Unix())
+	if err := ioutil.WriteFile(path, []byte(leases), 0644); err != nil {
+		t.Fatalf("error while writing leases: %v", err)
+	}
+
+	b, err := NewDHCPBackend(path, "lan.", WithDHCPRefreshInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	if zones := fmt.Sprint(b.Zones()); zones != "[lan 1.168.192.in-addr.arpa]" {
+		t.Errorf("unexpected zones %s", zones)
+	}
+
+	records, err := b.Lookup(&Question{Name: "laptop.lan", Type: &TypeA, Class: &ClassIN})
+	if err != nil || len(records) != 1 || rdataString(records[0].Type, records[0].Value) != "192.168.1.10" {
+		t.Errorf("expected the address of laptop, got %v, %v", records, err)
+	}
+
+	records, err = b.Lookup(&Question{Name: "10.1.168.192.in-addr.arpa", Type: &TypePTR, Class: &ClassIN})
+	if err != nil || len(records) != 1 || rdataString(records[0].Type, records[0].Value) != "laptop.lan." {
+		t.Errorf("expected a PTR to laptop, got %v, %v", records, err)
+	}
+
+	for _, name := range []string{"gone.lan", "11.1.168.192.in-addr.arpa", "12.1.168.192.in-addr.arpa"} {
+		if _, err := b.Lookup(&Question{Name: name, Type: &TypeA, Class: &ClassIN}); err != ErrNameNotFound {
+			t.Errorf("expected ErrNameNotFound for %s, got %v", name, err)
+		}
+	}
+
+	// new leases show up once the file changes
+	leases += fmt.Sprintf("%d 00:11:22:33:44:77 192.168.1.12 phone *\n", now.Add(time.Hour).Unix())
+	if err := ioutil.WriteFile(path, []byte(leases), 0644); err != nil {
+		t.Fatalf("error while writing leases: %v", err)
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := b.Lookup(&Question{Name: "phone.lan", Type: &TypeA, Class: &ClassIN}); err == nil {
+			return
+		}
+	}
+
+	t.Errorf("expected the new lease to show up")
+}
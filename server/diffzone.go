@@ -0,0 +1,136 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// RRsetDiff is an RRset that differs between two sets of records: added if
+// it has no old records, removed if it has no new ones, changed otherwise
+type RRsetDiff struct {
+	Name  string
+	Type  *QTYPE
+	Class *QCLASS
+
+	Old []*ResourceRecord
+	New []*ResourceRecord
+}
+
+// Change says how the RRset differs: "added", "removed" or "changed"
+func (d RRsetDiff) Change() string {
+	switch {
+	case len(d.Old) == 0:
+		return "added"
+	case len(d.New) == 0:
+		return "removed"
+	}
+
+	return "changed"
+}
+
+type rrsetKey struct {
+	name  string
+	qtype *QTYPE
+	class *QCLASS
+}
+
+// DiffRecords compares the RRsets of old and new, and returns those that
+// differ in canonical order. RRsets are compared by what is served of them,
+// so the order of their records and their comments don't count
+func DiffRecords(old, new []*ResourceRecord) []RRsetDiff {
+	sets := map[rrsetKey]*RRsetDiff{}
+	keys := []rrsetKey{}
+
+	add := func(rr *ResourceRecord, isNew bool) {
+		key := rrsetKey{name: strings.ToLower(rr.Name), qtype: rr.Type, class: rr.Class}
+		d, ok := sets[key]
+		if !ok {
+			d = &RRsetDiff{Name: rr.Name, Type: rr.Type, Class: rr.Class}
+			sets[key] = d
+			keys = append(keys, key)
+		}
+
+		if isNew {
+			d.New = append(d.New, rr)
+		} else {
+			d.Old = append(d.Old, rr)
+		}
+	}
+
+	for _, rr := range old {
+		add(rr, false)
+	}
+	for _, rr := range new {
+		add(rr, true)
+	}
+
+	diffs := []RRsetDiff{}
+	for _, key := range keys {
+		d := sets[key]
+		if !sameRRset(d.Old, d.New) {
+			diffs = append(diffs, *d)
+		}
+	}
+
+	sort.SliceStable(diffs, func(i, j int) bool {
+		a, b := diffs[i], diffs[j]
+		return canonicalRecordLess(&ResourceRecord{Name: a.Name, Type: a.Type}, &ResourceRecord{Name: b.Name, Type: b.Type})
+	})
+
+	return diffs
+}
+
+// sameRRset reports whether a and b hold the same records, in any order
+func sameRRset(a, b []*ResourceRecord) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := map[string]int{}
+	for _, rr := range a {
+		counts[auditRecordString(rr)]++
+	}
+
+	for _, rr := range b {
+		s := auditRecordString(rr)
+		if counts[s] == 0 {
+			return false
+		}
+		counts[s]--
+	}
+
+	return true
+}
+
+// WriteZoneDiff writes diffs in master file format, every RRset after a
+// comment saying how it changed, with its old records prefixed by "-" and its
+// new ones by "+":
+//
+//	; changed www.example.com. A
+//	-www.example.com.	300	IN	A	192.0.2.1
+//	+www.example.com.	300	IN	A	192.0.2.2
+func WriteZoneDiff(w io.Writer, diffs []RRsetDiff) error {
+	bw := bufio.NewWriter(w)
+	for _, d := range diffs {
+		fmt.Fprintf(bw, "; %s %s %s\n", d.Change(), presentationName(d.Name), d.Type)
+
+		for _, group := range []struct {
+			prefix  string
+			records []*ResourceRecord
+		}{{"-", d.Old}, {"+", d.New}} {
+			sorted := append([]*ResourceRecord(nil), group.records...)
+			sort.SliceStable(sorted, func(i, j int) bool {
+				return canonicalRecordLess(sorted[i], sorted[j])
+			})
+
+			for _, rr := range sorted {
+				fmt.Fprintf(bw, "%s%s\n", group.prefix, zoneLine(rr))
+			}
+		}
+	}
+
+	return bw.Flush()
+}
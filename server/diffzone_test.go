@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDiffRecords(t *testing.T) {
+	old, err := ParseZoneFile(strings.NewReader(`$ORIGIN example.com.
+@     300 IN SOA ns hostmaster 1 3600 600 86400 300
+www   300 IN A   192.0.2.1
+www   300 IN A   192.0.2.2
+old   300 IN A   192.0.2.9
+mx    300 IN MX  10 mail
+`), "")
+	if err != nil {
+		t.Fatalf("error while parsing old zone: %v", err)
+	}
+
+	// the order of records and their comments don't count, TTLs do
+	new, err := ParseZoneFile(strings.NewReader(`$ORIGIN example.com.
+@     300 IN SOA ns hostmaster 1 3600 600 86400 300
+www   300 IN A   192.0.2.2 ; second
+www   300 IN A   192.0.2.1
+new   300 IN A   192.0.2.3
+mx    600 IN MX  10 mail
+`), "")
+	if err != nil {
+		t.Fatalf("error while parsing new zone: %v", err)
+	}
+
+	diffs := DiffRecords(old, new)
+
+	buf := bytes.Buffer{}
+	if err := WriteZoneDiff(&buf, diffs); err != nil {
+		t.Fatalf("error while writing diff: %v", err)
+	}
+
+	expected := `; changed mx.example.com. MX
+-mx.example.com.	300	IN	MX	10 mail.example.com.
++mx.example.com.	600	IN	MX	10 mail.example.com.
+; added new.example.com. A
++new.example.com.	300	IN	A	192.0.2.3
+; removed old.example.com. A
+-old.example.com.	300	IN	A	192.0.2.9
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected diff:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	changes := []string{}
+	for _, d := range diffs {
+		changes = append(changes, d.Change())
+	}
+	if strings.Join(changes, " ") != "changed added removed" {
+		t.Errorf("unexpected changes %v", changes)
+	}
+
+	if diffs := DiffRecords(old, old); len(diffs) != 0 {
+		t.Errorf("records differ from themselves: %v", diffs)
+	}
+}
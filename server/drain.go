@@ -0,0 +1,106 @@
+package server
+
+import (
+	"strings"
+	"time"
+)
+
+// DrainStatus tells whether the server is being taken out of rotation
+type DrainStatus struct {
+	Draining bool `json:"draining"`
+
+	// Since is when draining started, and RefusingAt when the server
+	// started or starts refusing queries
+	Since      time.Time `json:"since,omitempty"`
+	RefusingAt time.Time `json:"refusing_at,omitempty"`
+
+	// Instance is the server's NSID, if it has one
+	Instance string `json:"instance,omitempty"`
+}
+
+// Drain takes the server out of rotation: readiness checks fail right away,
+// so load balancers and anycast health checkers stop sending it queries, and
+// after delay, once they had time to notice, new queries are refused. Queries
+// that are being answered when that happens are answered as usual
+func (srv *DNSServer) Drain(delay time.Duration) {
+	srv.drainMu.Lock()
+	defer srv.drainMu.Unlock()
+
+	if !srv.drainStatus.Draining {
+		now := time.Now()
+		srv.drainStatus = DrainStatus{Draining: true, Since: now, RefusingAt: now.Add(delay)}
+		srv.refuseAt.Store(srv.drainStatus.RefusingAt)
+
+		srv.log.Infof("draining, refusing queries from %s on", srv.drainStatus.RefusingAt.Format(time.RFC3339))
+	}
+}
+
+// Undrain puts a draining server back into rotation
+func (srv *DNSServer) Undrain() {
+	srv.drainMu.Lock()
+	defer srv.drainMu.Unlock()
+
+	if srv.drainStatus.Draining {
+		srv.drainStatus = DrainStatus{}
+		srv.refuseAt.Store(time.Time{})
+
+		srv.log.Infof("no longer draining")
+	}
+}
+
+// DrainStatus returns whether the server is draining
+func (srv *DNSServer) DrainStatus() DrainStatus {
+	srv.drainMu.Lock()
+	defer srv.drainMu.Unlock()
+
+	status := srv.drainStatus
+	status.Instance = string(srv.nsid)
+
+	return status
+}
+
+// refusingQueries reports whether the server drained long enough to refuse
+// new queries
+func (srv *DNSServer) refusingQueries(now time.Time) bool {
+	refuseAt, _ := srv.refuseAt.Load().(time.Time)
+	return !refuseAt.IsZero() && !now.Before(refuseAt)
+}
+
+// chaosIdentityNames are the CHAOS TXT names a server answers with its
+// identity, see RFC 4892
+var chaosIdentityNames = map[string]bool{
+	"id.server":     true,
+	"hostname.bind": true,
+}
+
+// answerChaos answers CHAOS class queries for the server's identity with its
+// NSID, so instances behind an anycast address can be told apart with
+//
+//	dig @<address> CH TXT id.server
+//
+// Other CHAOS queries, and all of them if the server has no NSID, are refused
+func (srv *DNSServer) answerChaos(headers *DNSHeader, q *Question, edns *EDNS, maxSize int) ([]byte, error) {
+	name := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if srv.nsid == nil || !chaosIdentityNames[name] || (q.Type != &TypeTXT && q.Type != &TypeAll) {
+		headers.ResponseCode = Refused
+		return encodeResponse(headers, []*Question{q}, nil, nil, nil, edns, maxSize)
+	}
+
+	value := []byte{}
+	for rest := srv.nsid; len(rest) > 0; {
+		// TXT strings are at most 255 bytes long
+		n := len(rest)
+		if n > 255 {
+			n = 255
+		}
+
+		value = append(value, byte(n))
+		value = append(value, rest[:n]...)
+		rest = rest[n:]
+	}
+
+	identity := ResourceRecord{Name: q.Name, Type: &TypeTXT, Class: &ClassCH, Value: value}
+
+	headers.IsAuthoritative = true
+	return encodeResponse(headers, []*Question{q}, []*ResourceRecord{&identity}, nil, nil, edns, maxSize)
+}
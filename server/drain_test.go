@@ -0,0 +1,97 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrainRefusesQueriesAfterDelay(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	q := Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}
+
+	rcode := func() ResponseCode {
+		resp, err := srv.handleQuery(encodeTestQuery(t, 1, &q), nil, true)
+		if err != nil {
+			t.Fatalf("error while handling query: %v", err)
+		}
+
+		msg, err := DecodeMessage(resp)
+		if err != nil {
+			t.Fatalf("error while decoding response: %v", err)
+		}
+
+		return msg.Header.ResponseCode
+	}
+
+	srv.Drain(time.Hour)
+	if !srv.DrainStatus().Draining {
+		t.Fatalf("expected the server to be draining")
+	}
+
+	if got := rcode(); got != NoError {
+		t.Errorf("expected queries to be answered during the delay, got %s", got)
+	}
+
+	// draining again doesn't move the deadline
+	srv.Drain(0)
+	if got := rcode(); got != NoError {
+		t.Errorf("expected queries to be answered during the delay, got %s", got)
+	}
+
+	srv.Undrain()
+	srv.Drain(0)
+	if got := rcode(); got != Refused {
+		t.Errorf("expected queries to be refused after the delay, got %s", got)
+	}
+
+	srv.Undrain()
+	if got := rcode(); got != NoError {
+		t.Errorf("expected queries to be answered after undraining, got %s", got)
+	}
+}
+
+func TestDrainFailsReadiness(t *testing.T) {
+	srv := startTestServer(t)
+
+	srv.Drain(time.Hour)
+	if err := srv.Ready(); err == nil {
+		t.Errorf("expected a draining server not to be ready")
+	}
+
+	if err := srv.Alive(); err != nil {
+		t.Errorf("expected a draining server to stay alive, got %v", err)
+	}
+}
+
+func TestChaosIdentity(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithNSID([]byte("fra1")))
+
+	for _, tt := range []struct {
+		name  string
+		rcode ResponseCode
+	}{
+		{"id.server", NoError},
+		{"HOSTNAME.BIND", NoError},
+		{"version.bind", Refused},
+	} {
+		q := Question{Name: tt.name, Type: &TypeTXT, Class: &ClassCH}
+		resp, err := srv.handleQuery(encodeTestQuery(t, 1, &q), nil, true)
+		if err != nil {
+			t.Fatalf("error while handling query: %v", err)
+		}
+
+		msg, err := DecodeMessage(resp)
+		if err != nil {
+			t.Fatalf("error while decoding response: %v", err)
+		}
+
+		if msg.Header.ResponseCode != tt.rcode {
+			t.Errorf("expected %s for %s, got %s", tt.rcode, tt.name, msg.Header.ResponseCode)
+			continue
+		}
+
+		if tt.rcode == NoError && (len(msg.Answers) != 1 || rdataString(msg.Answers[0].Type, msg.Answers[0].Value) != `"fra1"`) {
+			t.Errorf("expected the NSID as answer for %s, got %v", tt.name, msg.Answers)
+		}
+	}
+}
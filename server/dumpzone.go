@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WriteZone writes records in master file format, one record per line with
+// fully qualified names, and the comment and metadata tags of a record after
+// it on its line. Records are sorted in the canonical order of RFC 4034
+// section 6, except that an SOA record comes first among the records of its
+// name, so a zone's dump starts with its SOA record as BIND expects
+func WriteZone(w io.Writer, records []*ResourceRecord) error {
+	sorted := append([]*ResourceRecord(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return canonicalRecordLess(sorted[i], sorted[j])
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, rr := range sorted {
+		fmt.Fprintln(bw, zoneLine(rr))
+	}
+
+	return bw.Flush()
+}
+
+// zoneLine returns the line of rr in a master file, without a newline
+func zoneLine(rr *ResourceRecord) string {
+	line := fmt.Sprintf("%s\t%d\t%s\t%s\t%s", presentationName(rr.Name), rr.TTL, rr.Class, rr.Type, rdataString(rr.Type, rr.Value))
+	if comment := recordComment(rr); comment != "" {
+		line += "\t; " + comment
+	}
+
+	return line
+}
+
+// DumpZone writes the records the server answers from for zone, or all of
+// them if zone is empty, with WriteZone. Records added with an expiry are
+// dumped with their TTL capped to it, and left out once they expired
+func (srv *DNSServer) DumpZone(w io.Writer, zone string) error {
+	records, err := srv.zoneRecords(zone)
+	if err != nil {
+		return err
+	}
+
+	return WriteZone(w, records)
+}
+
+// zoneRecords returns the records of zone as DumpZone dumps them
+func (srv *DNSServer) zoneRecords(zone string) ([]*ResourceRecord, error) {
+	snapshot := srv.snapshot()
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	if zone != "" {
+		found := false
+		for _, z := range snapshot.zones {
+			found = found || z == zone
+		}
+
+		if !found {
+			return nil, fmt.Errorf("zone %s is not served", zone)
+		}
+	}
+
+	// a subzone's NS records and their glue also belong to the zone it's
+	// delegated from, which needs them to refer to the subzone
+	all := snapshot.records()
+	delegated := map[string]bool{}
+	glue := map[string]bool{}
+	if zone != "" {
+		for _, rr := range all {
+			if rr.Type == &TypeNS && isDelegation(snapshot.zones, zone, rr.Name) {
+				delegated[strings.ToLower(rr.Name)] = true
+				if target, _, err := readName(rr.Value, 0); err == nil {
+					glue[strings.ToLower(target)] = true
+				}
+			}
+		}
+	}
+
+	now := time.Now()
+	records := []*ResourceRecord{}
+	for _, rr := range all {
+		if rr.expired(now) {
+			continue
+		}
+
+		if zone != "" {
+			// records below the zone may belong to a subzone of their own
+			if z, ok := closestZone(snapshot.zones, rr.Name); !ok || z != zone {
+				name := strings.ToLower(rr.Name)
+				isCut := rr.Type == &TypeNS && delegated[name]
+				isGlue := (rr.Type == &TypeA || rr.Type == &TypeAAAA) && glue[name] && inZone(name, zone)
+				if !isCut && !isGlue {
+					continue
+				}
+			}
+		}
+
+		records = append(records, rr.cappedToExpiry(now))
+	}
+
+	return records, nil
+}
+
+// isDelegation reports whether name is the apex of a subzone delegated from
+// zone, rather than from a subzone in between
+func isDelegation(zones []string, zone, name string) bool {
+	name = strings.ToLower(name)
+	if name == zone || !inZone(name, zone) {
+		return false
+	}
+
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return false
+	}
+
+	parent, ok := closestZone(zones, name[i+1:])
+	return ok && parent == zone
+}
+
+// inZone reports whether the lowercased name is zone or below it
+func inZone(name, zone string) bool {
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// canonicalRecordLess orders records by name, then type with SOA first, then
+// RDATA
+func canonicalRecordLess(a, b *ResourceRecord) bool {
+	if c := compareCanonicalNames(a.Name, b.Name); c != 0 {
+		return c < 0
+	}
+
+	if a.Type != b.Type {
+		if a.Type == &TypeSOA || b.Type == &TypeSOA {
+			return a.Type == &TypeSOA
+		}
+
+		return binary.BigEndian.Uint16(a.Type.Value) < binary.BigEndian.Uint16(b.Type.Value)
+	}
+
+	return bytes.Compare(a.Value, b.Value) < 0
+}
+
+// compareCanonicalNames compares names label by label starting from the
+// root, ignoring case, so that a name sorts right before the names below it
+func compareCanonicalNames(a, b string) int {
+	la := splitLabels(strings.ToLower(strings.TrimSuffix(a, ".")))
+	lb := splitLabels(strings.ToLower(strings.TrimSuffix(b, ".")))
+
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+
+	return len(la) - len(lb)
+}
+
+func splitLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+
+	return strings.Split(name, ".")
+}
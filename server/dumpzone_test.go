@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDumpZone = `$ORIGIN example.com.
+$TTL 300
+b           IN A     10.0.0.2
+@           IN NS    ns1
+@           IN SOA   ns1 hostmaster 2026101601 3600 600 86400 300
+Z           IN TXT   "tab\009and \"quotes\""
+a           IN MX    10 mail
+a           IN A     10.0.0.1
+*.a         IN A     10.0.0.3
+mail        IN AAAA  2001:db8::25
+_sip._tcp   IN SRV   0 5 5060 sip
+sub         IN NS    ns.sub
+svc         IN TYPE65 \# 3 000100
+$ORIGIN sub.example.com.
+@           IN SOA   ns hostmaster 1 3600 600 86400 300
+host        IN A     10.1.0.1
+ns          IN A     10.1.0.53
+`
+
+func TestWriteZoneCanonicalOrder(t *testing.T) {
+	records, err := ParseZoneFile(strings.NewReader(testDumpZone), "")
+	if err != nil {
+		t.Fatalf("error while parsing zone: %v", err)
+	}
+
+	buf := bytes.Buffer{}
+	if err := WriteZone(&buf, records); err != nil {
+		t.Fatalf("error while writing zone: %v", err)
+	}
+
+	expected := `example.com.	300	IN	SOA	ns1.example.com. hostmaster.example.com. 2026101601 3600 600 86400 300
+example.com.	300	IN	NS	ns1.example.com.
+_sip._tcp.example.com.	300	IN	SRV	0 5 5060 sip.example.com.
+a.example.com.	300	IN	A	10.0.0.1
+a.example.com.	300	IN	MX	10 mail.example.com.
+*.a.example.com.	300	IN	A	10.0.0.3
+b.example.com.	300	IN	A	10.0.0.2
+mail.example.com.	300	IN	AAAA	2001:db8::25
+sub.example.com.	300	IN	SOA	ns.sub.example.com. hostmaster.sub.example.com. 1 3600 600 86400 300
+sub.example.com.	300	IN	NS	ns.sub.example.com.
+host.sub.example.com.	300	IN	A	10.1.0.1
+ns.sub.example.com.	300	IN	A	10.1.0.53
+svc.example.com.	300	IN	TYPE65	\# 3 000100
+Z.example.com.	300	IN	TXT	"tab\009and \"quotes\""
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected dump:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	// the dump reads back as the same records
+	reread, err := ParseZoneFile(bytes.NewReader(buf.Bytes()), "")
+	if err != nil {
+		t.Fatalf("error while parsing dump: %v", err)
+	}
+
+	again := bytes.Buffer{}
+	WriteZone(&again, reread)
+	if again.String() != buf.String() {
+		t.Errorf("dump doesn't round trip:\n%s", again.String())
+	}
+}
+
+func TestDumpZone(t *testing.T) {
+	records, err := ParseZoneFile(strings.NewReader(testDumpZone), "")
+	if err != nil {
+		t.Fatalf("error while parsing zone: %v", err)
+	}
+
+	srv, _ := NewDNSServer("", "")
+	srv.updateRecords(recordChange{reason: "test records"}, func(u *recordUpdate) bool {
+		for _, rr := range u.current.records() {
+			u.remove(rr)
+		}
+		for _, rr := range records {
+			u.add(rr)
+		}
+
+		return true
+	})
+
+	srv.AddRecord(&ResourceRecord{Name: "_acme-challenge.example.com", Type: &TypeTXT, Class: &ClassIN, TTL: 300,
+		Value: []byte("\x05token"), ExpiresAt: time.Now().Add(time.Minute)})
+
+	buf := bytes.Buffer{}
+	if err := srv.DumpZone(&buf, "sub.example.com."); err != nil {
+		t.Fatalf("error while dumping zone: %v", err)
+	}
+
+	if lines := strings.Count(buf.String(), "\n"); lines != 4 {
+		t.Errorf("expected the 4 records of the subzone, got:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	srv.DumpZone(&buf, "example.com")
+
+	dump := buf.String()
+	if strings.Contains(dump, "host.sub.example.com.") || strings.Contains(dump, "sub.example.com.\t300\tIN\tSOA") {
+		t.Errorf("expected records of the subzone to be left out:\n%s", dump)
+	}
+
+	// but the delegation to it stays, with its glue
+	if !strings.Contains(dump, "sub.example.com.\t300\tIN\tNS\tns.sub.example.com.\n") ||
+		!strings.Contains(dump, "ns.sub.example.com.\t300\tIN\tA\t10.1.0.53\n") {
+		t.Errorf("expected the delegation to the subzone and its glue:\n%s", dump)
+	}
+
+	if !strings.Contains(dump, "_acme-challenge.example.com.\t60\tIN\tTXT\t\"token\"") &&
+		!strings.Contains(dump, "_acme-challenge.example.com.\t59\tIN\tTXT\t\"token\"") {
+		t.Errorf("expected the added record with its TTL capped to its expiry:\n%s", dump)
+	}
+
+	if err := srv.DumpZone(&buf, "missing.example"); err == nil {
+		t.Errorf("expected an error for a zone that isn't served")
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// maxUDPMessageSize is the size of a DNS message over UDP without EDNS(0)
+	maxUDPMessageSize = 512
+
+	// defaultMaxUDPSize is the largest UDP response the server sends by
+	// default, as recommended by DNS flag day 2020 to avoid IP fragmentation
+	defaultMaxUDPSize = 1232
+
+	// maxDatagramSize is the largest payload a UDP datagram can carry
+	maxDatagramSize = 65535
+)
+
+// EDNS option codes
+const (
+	EDNSOptionNSID    uint16 = 3  // name server identifier, see RFC 5001
+	EDNSOptionPadding uint16 = 12 // padding, see RFC 7830
+)
+
+// DefaultPaddingBlockSize is the block size RFC 8467 recommends padding
+// responses to
+const DefaultPaddingBlockSize = 468
+
+// TypeOPT is the EDNS(0) pseudo RR type, see RFC 6891
+var TypeOPT = QTYPE{
+	Type:    "OPT",
+	Value:   []byte("\x00\x29"),
+	Meaning: "EDNS(0) options",
+}
+
+// EDNSOption is a single option carried in the RDATA of an OPT RR
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// EDNS holds the contents of an OPT pseudo RR
+type EDNS struct {
+	UDPSize       uint16 // requestor's UDP payload size, carried in the CLASS field
+	ExtendedRCode uint8  // upper 8 bits of the extended response code
+	Version       uint8
+	DNSSECOK      bool // DO bit
+	Options       []EDNSOption
+}
+
+// Len returns the size of e as an OPT RR in wire format
+func (e *EDNS) Len() int {
+	return 11 + e.optionsLen()
+}
+
+func (e *EDNS) optionsLen() int {
+	n := 0
+	for _, opt := range e.Options {
+		n += 4 + len(opt.Data)
+	}
+
+	return n
+}
+
+// Encode writes e as an OPT RR into buf
+func (e *EDNS) Encode(buf []byte) (int, error) {
+	rdlen := e.optionsLen()
+
+	if len(buf) < 11+rdlen {
+		return 0, errors.New("buffer too small")
+	}
+
+	// owner name is always the root
+	buf[0] = 0
+	nWritten := 1
+
+	nWritten += copy(buf[nWritten:], TypeOPT.Value)
+
+	binary.BigEndian.PutUint16(buf[nWritten:], e.UDPSize)
+	nWritten += 2
+
+	ttl := uint32(e.ExtendedRCode)<<24 | uint32(e.Version)<<16
+	if e.DNSSECOK {
+		ttl |= uint32(1) << 15
+	}
+	binary.BigEndian.PutUint32(buf[nWritten:], ttl)
+	nWritten += 4
+
+	binary.BigEndian.PutUint16(buf[nWritten:], uint16(rdlen))
+	nWritten += 2
+
+	for _, opt := range e.Options {
+		binary.BigEndian.PutUint16(buf[nWritten:], opt.Code)
+		binary.BigEndian.PutUint16(buf[nWritten+2:], uint16(len(opt.Data)))
+		nWritten += 4
+
+		nWritten += copy(buf[nWritten:], opt.Data)
+	}
+
+	return nWritten, nil
+}
+
+// HasOption reports whether e carries an option with the given code
+func (e *EDNS) HasOption(code uint16) bool {
+	for _, opt := range e.Options {
+		if opt.Code == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readRRHeaderFrom reads the fixed part of a resource record and returns the
+// number of bytes read, the record type code, class, TTL and RDATA
+func readRRHeaderFrom(buf []byte) (int, uint16, uint16, uint32, []byte, error) {
+	bytesRead, _, err := DecodeDomainName(buf)
+	if err != nil {
+		return bytesRead, 0, 0, 0, nil, err
+	}
+
+	if len(buf) < bytesRead+10 {
+		return bytesRead, 0, 0, 0, nil, errors.New("resource record runs past end of buffer")
+	}
+
+	rrType := binary.BigEndian.Uint16(buf[bytesRead:])
+	rrClass := binary.BigEndian.Uint16(buf[bytesRead+2:])
+	ttl := binary.BigEndian.Uint32(buf[bytesRead+4:])
+	rdlen := int(binary.BigEndian.Uint16(buf[bytesRead+8:]))
+	bytesRead += 10
+
+	if len(buf) < bytesRead+rdlen {
+		return bytesRead, 0, 0, 0, nil, errors.New("rdata runs past end of buffer")
+	}
+
+	rdata := buf[bytesRead : bytesRead+rdlen]
+	bytesRead += rdlen
+
+	return bytesRead, rrType, rrClass, ttl, rdata, nil
+}
+
+// ReadEDNSFrom looks for an OPT RR among the count records at the start of buf
+// and returns it, or nil if there is none
+func ReadEDNSFrom(buf []byte, count int) (*EDNS, error) {
+	rlen := 0
+	for i := 0; i < count; i++ {
+		bytesRead, rrType, rrClass, ttl, rdata, err := readRRHeaderFrom(buf[rlen:])
+		if err != nil {
+			return nil, fmt.Errorf("error while reading record %d: %v", i+1, err)
+		}
+		rlen += bytesRead
+
+		if rrType != binary.BigEndian.Uint16(TypeOPT.Value) {
+			continue
+		}
+
+		e := EDNS{
+			UDPSize:       rrClass,
+			ExtendedRCode: uint8(ttl >> 24),
+			Version:       uint8(ttl >> 16),
+			DNSSECOK:      ttl&(uint32(1)<<15) != 0,
+		}
+
+		for len(rdata) > 0 {
+			if len(rdata) < 4 {
+				return nil, errors.New("EDNS option runs past end of rdata")
+			}
+
+			code := binary.BigEndian.Uint16(rdata)
+			optlen := int(binary.BigEndian.Uint16(rdata[2:]))
+			if len(rdata) < 4+optlen {
+				return nil, errors.New("EDNS option runs past end of rdata")
+			}
+
+			e.Options = append(e.Options, EDNSOption{Code: code, Data: rdata[4 : 4+optlen]})
+			rdata = rdata[4+optlen:]
+		}
+
+		return &e, nil
+	}
+
+	return nil, nil
+}
+
+// WithMaxUDPSize sets the largest UDP response the server will send, and the
+// payload size it advertises to EDNS(0) clients
+func WithMaxUDPSize(size uint16) Option {
+	return func(srv *DNSServer) {
+		if size < maxUDPMessageSize {
+			size = maxUDPMessageSize
+		}
+
+		srv.maxUDPSize = size
+	}
+}
+
+// WithNSID sets the identifier returned to clients that ask for it with the
+// NSID EDNS option (RFC 5001), so that operators of anycast or load balanced
+// deployments can tell which instance answered a query
+func WithNSID(nsid []byte) Option {
+	return func(srv *DNSServer) {
+		srv.nsid = nsid
+	}
+}
+
+// responseEDNS returns the OPT record to send in response to a query with the
+// given OPT record
+func (srv *DNSServer) responseEDNS(req *EDNS) *EDNS {
+	resp := EDNS{UDPSize: srv.maxUDPSize}
+
+	// an empty NSID option in the query asks for the server's identifier
+	if srv.nsid != nil && req.HasOption(EDNSOptionNSID) {
+		resp.Options = append(resp.Options, EDNSOption{Code: EDNSOptionNSID, Data: srv.nsid})
+	}
+
+	return &resp
+}
+
+// padResponse pads an encoded response to a multiple of block octets with
+// the EDNS padding option (RFC 7830), so that its size says little about what
+// it answers. Only responses whose last record is an OPT record without
+// padding are padded: EDNS options may only be sent to clients that use EDNS
+func padResponse(msg []byte, block int) []byte {
+	if block <= 1 || len(msg) < 12 {
+		return msg
+	}
+
+	headers := DNSHeader{}
+	if err := headers.ReadFrom(msg); err != nil {
+		return msg
+	}
+
+	off := 12
+	for qi := uint16(0); qi < headers.QuestionsCount; qi++ {
+		_, end, err := readName(msg, off)
+		if err != nil || end+4 > len(msg) {
+			return msg
+		}
+		off = end + 4
+	}
+
+	// optOff is where the type of the last record is, if it's an OPT record
+	optOff := -1
+	records := int(headers.AnswersCount) + int(headers.NameserversCount) + int(headers.AdditionalRecordsCount)
+	for i := 0; i < records; i++ {
+		_, end, err := readName(msg, off)
+		if err != nil || end+10 > len(msg) {
+			return msg
+		}
+
+		optOff = -1
+		if binary.BigEndian.Uint16(msg[end:]) == binary.BigEndian.Uint16(TypeOPT.Value) {
+			optOff = end
+		}
+
+		off = end + 10 + int(binary.BigEndian.Uint16(msg[end+8:]))
+	}
+
+	if optOff < 0 || off != len(msg) {
+		return msg
+	}
+
+	opt := EDNS{}
+	if e, err := ReadEDNSFrom(append([]byte{0}, msg[optOff:]...), 1); err == nil && e != nil {
+		opt = *e
+	}
+
+	if opt.HasOption(EDNSOptionPadding) {
+		return msg
+	}
+
+	// the option's code and length take 4 octets of their own
+	padding := (block - (len(msg)+4)%block) % block
+	rdlen := int(binary.BigEndian.Uint16(msg[optOff+8:])) + 4 + padding
+	if len(msg)+4+padding > maxDatagramSize || rdlen > 0xffff {
+		return msg
+	}
+
+	padded := make([]byte, len(msg)+4+padding)
+	copy(padded, msg)
+	binary.BigEndian.PutUint16(padded[optOff+8:], uint16(rdlen))
+	binary.BigEndian.PutUint16(padded[len(msg):], EDNSOptionPadding)
+	binary.BigEndian.PutUint16(padded[len(msg)+2:], uint16(padding))
+
+	return padded
+}
+
+// udpResponseSize returns how large a UDP response to a client with the given
+// EDNS(0) record may be
+func (srv *DNSServer) udpResponseSize(edns *EDNS) int {
+	if edns == nil || edns.UDPSize <= maxUDPMessageSize {
+		return maxUDPMessageSize
+	}
+
+	if edns.UDPSize < srv.maxUDPSize {
+		return int(edns.UDPSize)
+	}
+
+	return int(srv.maxUDPSize)
+}
+
+// truncateResponse cuts a raw response that is larger than maxSize down to its
+// header and question section, and sets the TC bit so that the client retries
+// over TCP
+func truncateResponse(resp []byte, maxSize int) ([]byte, error) {
+	if len(resp) <= maxSize {
+		return resp, nil
+	}
+
+	truncated, err := truncatedResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(truncated) > maxSize {
+		return nil, errors.New("question section does not fit in response")
+	}
+
+	return truncated, nil
+}
+
+// truncatedResponse returns resp cut down to its header and question section,
+// with the TC bit set
+func truncatedResponse(resp []byte) ([]byte, error) {
+	headers := DNSHeader{}
+	if err := headers.ReadFrom(resp); err != nil {
+		return nil, err
+	}
+
+	rlen := 12
+	for qi := uint16(0); qi < headers.QuestionsCount; qi++ {
+		bytesRead, _, err := ReadQuestionFrom(resp[rlen:])
+		if err != nil {
+			return nil, err
+		}
+		rlen += bytesRead
+	}
+
+	headers.IsTruncated = true
+	headers.AnswersCount = 0
+	headers.NameserversCount = 0
+	headers.AdditionalRecordsCount = 0
+
+	truncated := make([]byte, rlen)
+	headers.Encode(truncated)
+	copy(truncated[12:], resp[12:rlen])
+
+	return truncated, nil
+}
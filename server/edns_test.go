@@ -0,0 +1,170 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestEDNSEncodeAndRead(t *testing.T) {
+	e := EDNS{
+		UDPSize:  4096,
+		DNSSECOK: true,
+		Options:  []EDNSOption{{Code: 10, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}},
+	}
+
+	buf := make([]byte, 512)
+	n, err := e.Encode(buf)
+	if err != nil {
+		t.Fatalf("error while encoding EDNS: %v", err)
+	}
+
+	expected := []byte("\x00\x00\x29\x10\x00\x00\x00\x80\x00\x00\x0c\x00\x0a\x00\x08\x01\x02\x03\x04\x05\x06\x07\x08")
+	if string(buf[:n]) != string(expected) {
+		t.Fatalf("gotten (%q) not equal to expected (%q)", buf[:n], expected)
+	}
+
+	gotten, err := ReadEDNSFrom(buf[:n], 1)
+	if err != nil {
+		t.Fatalf("error while reading EDNS: %v", err)
+	}
+
+	if gotten == nil || gotten.UDPSize != 4096 || !gotten.DNSSECOK || len(gotten.Options) != 1 || gotten.Options[0].Code != 10 {
+		t.Errorf("gotten EDNS %+v does not match encoded %+v", gotten, e)
+	}
+}
+
+func TestUDPResponseSize(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithMaxUDPSize(1232))
+
+	cases := []struct {
+		edns     *EDNS
+		expected int
+	}{
+		{nil, 512},
+		{&EDNS{UDPSize: 0}, 512},
+		{&EDNS{UDPSize: 1000}, 1000},
+		{&EDNS{UDPSize: 4096}, 1232},
+	}
+
+	for _, c := range cases {
+		if gotten := srv.udpResponseSize(c.edns); gotten != c.expected {
+			t.Errorf("udpResponseSize(%+v) = %d, expected %d", c.edns, gotten, c.expected)
+		}
+	}
+}
+
+func TestEncodeResponseTruncates(t *testing.T) {
+	q := Question{Name: "big.kausm.in", Type: &TypeA, Class: &ClassIN}
+
+	answers := []*ResourceRecord{}
+	for i := 0; i < 40; i++ {
+		answers = append(answers, &ResourceRecord{Name: "big.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 60, Value: []byte{10, 0, 0, byte(i)}})
+	}
+
+	headers := DNSHeader{ID: 42}
+	msg, err := encodeResponse(&headers, []*Question{&q}, answers, nil, nil, nil, 512)
+	if err != nil {
+		t.Fatalf("error while encoding response: %v", err)
+	}
+
+	if len(msg) > 512 || !isTruncated(msg) || headers.AnswersCount != 0 {
+		t.Errorf("expected a truncated response of at most 512 bytes, got %d bytes, TC: %t, answers: %d", len(msg), isTruncated(msg), headers.AnswersCount)
+	}
+
+	headers = DNSHeader{ID: 42}
+	msg, err = encodeResponse(&headers, []*Question{&q}, answers, nil, nil, &EDNS{UDPSize: 1232}, 1232)
+	if err != nil {
+		t.Fatalf("error while encoding response: %v", err)
+	}
+
+	if isTruncated(msg) || headers.AnswersCount != 40 {
+		t.Errorf("expected the full response to fit in 1232 bytes, got %d bytes", len(msg))
+	}
+
+	truncated, err := truncateResponse(msg, 512)
+	if err != nil {
+		t.Fatalf("error while truncating response: %v", err)
+	}
+
+	if !isTruncated(truncated) || len(truncated) != 12+len("\x03big\x05kausm\x02in\x00")+4 {
+		t.Errorf("expected header and question only with TC set, got %q", truncated)
+	}
+}
+
+func TestResponseEDNSIncludesNSIDWhenAsked(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithNSID([]byte("fra-1")))
+
+	resp := srv.responseEDNS(&EDNS{UDPSize: 4096, Options: []EDNSOption{{Code: EDNSOptionNSID}}})
+	if len(resp.Options) != 1 || resp.Options[0].Code != EDNSOptionNSID || string(resp.Options[0].Data) != "fra-1" {
+		t.Errorf("expected NSID option with the server identifier, got %+v", resp.Options)
+	}
+
+	resp = srv.responseEDNS(&EDNS{UDPSize: 4096})
+	if len(resp.Options) != 0 {
+		t.Errorf("expected no options when NSID wasn't asked for, got %+v", resp.Options)
+	}
+
+	srv, _ = NewDNSServer("", "")
+	resp = srv.responseEDNS(&EDNS{UDPSize: 4096, Options: []EDNSOption{{Code: EDNSOptionNSID}}})
+	if len(resp.Options) != 0 {
+		t.Errorf("expected no options when no NSID is configured, got %+v", resp.Options)
+	}
+}
+
+func TestEncodeResponseDropsAdditionalsFirst(t *testing.T) {
+	q := Question{Name: "kausm.in", Type: &TypeMX, Class: &ClassIN}
+
+	mx, _ := encodeRData(&TypeMX, []string{"10", "mail.kausm.in."}, "kausm.in")
+	answers := []*ResourceRecord{{Name: "kausm.in", Type: &TypeMX, Class: &ClassIN, TTL: 60, Value: mx}}
+
+	additionals := []*ResourceRecord{}
+	for i := 0; i < 40; i++ {
+		additionals = append(additionals, &ResourceRecord{Name: "mail.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 60, Value: []byte{10, 0, 0, byte(i)}})
+	}
+
+	headers := DNSHeader{ID: 42}
+	msg, err := encodeResponse(&headers, []*Question{&q}, answers, nil, additionals, &EDNS{UDPSize: 1232}, 512)
+	if err != nil {
+		t.Fatalf("error while encoding response: %v", err)
+	}
+
+	if isTruncated(msg) || headers.AnswersCount != 1 || headers.AdditionalRecordsCount != 1 {
+		t.Errorf("expected the answer and OPT record without TC, got TC: %t, answers: %d, additionals: %d",
+			isTruncated(msg), headers.AnswersCount, headers.AdditionalRecordsCount)
+	}
+}
+
+func TestPadResponse(t *testing.T) {
+	headers := DNSHeader{ID: 1}
+	q := Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}
+	answer := ResourceRecord{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 60, Value: []byte{127, 0, 0, 1}}
+
+	resp, err := encodeMessage(&headers, []*Question{&q}, []*ResourceRecord{&answer}, nil, nil, &EDNS{UDPSize: 1232})
+	if err != nil {
+		t.Fatalf("error while encoding response: %v", err)
+	}
+
+	padded := padResponse(resp, DefaultPaddingBlockSize)
+	if len(padded) != DefaultPaddingBlockSize {
+		t.Fatalf("expected the response to be padded to %d bytes, got %d", DefaultPaddingBlockSize, len(padded))
+	}
+
+	msg, err := DecodeMessage(padded)
+	if err != nil {
+		t.Fatalf("error while decoding padded response: %v", err)
+	}
+
+	if len(msg.Answers) != 1 || msg.EDNS == nil || !msg.EDNS.HasOption(EDNSOptionPadding) {
+		t.Errorf("expected the answer and a padding option, got %s", msg)
+	}
+
+	// padding again leaves the response alone
+	if again := padResponse(padded, DefaultPaddingBlockSize); len(again) != len(padded) {
+		t.Errorf("expected a padded response not to be padded again, got %d bytes", len(again))
+	}
+
+	// clients that don't use EDNS can't be sent the option
+	plain, _ := encodeMessage(&headers, []*Question{&q}, []*ResourceRecord{&answer}, nil, nil, nil)
+	if got := padResponse(plain, DefaultPaddingBlockSize); len(got) != len(plain) {
+		t.Errorf("expected a response without EDNS not to be padded, got %d bytes", len(got))
+	}
+}
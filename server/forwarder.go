@@ -0,0 +1,701 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultForwardTimeout = 2 * time.Second
+
+	// source ports are picked from the non-privileged range
+	minSourcePort = 1024
+	maxSourcePort = 65535
+
+	// how many random ports to try before letting the OS pick one
+	sourcePortAttempts = 10
+
+	// defaultFallbackDelay is how long a connection attempt to the preferred
+	// address family gets before one to the other family is raced against it,
+	// the "Connection Attempt Delay" recommended by RFC 8305
+	defaultFallbackDelay = 250 * time.Millisecond
+
+	// tlsUpstreamPrefix marks upstreams spoken to over DNS over TLS
+	tlsUpstreamPrefix = "tls://"
+)
+
+// Forwarder relays queries that the server is not authoritative for to
+// upstream resolvers.
+//
+// Every outgoing query gets a fresh crypto-grade random ID and is sent from
+// a freshly randomized source port, and responses are only accepted if they
+// come from the upstream that was asked and echo both the ID and the question.
+// This makes it much harder to spoof answers into the forwarder (Kaminsky-style
+// cache poisoning).
+type Forwarder struct {
+	upstreams []string
+	timeout   time.Duration
+
+	// randReader is the source for query IDs and source ports
+	randReader io.Reader
+
+	// inflight coalesces identical queries from concurrent clients
+	inflight inflightGroup
+
+	// budget bounds the queries and retries sent upstream
+	budget retryBudget
+
+	// chaos, when set, injects faults into upstream queries for testing
+	chaos *chaosInjector
+
+	// dialer is used for connections to upstreams. Upstreams given by a
+	// hostname with both A and AAAA addresses are dialed over IPv4 and IPv6
+	// in parallel (Happy Eyeballs), so a broken IPv6 path doesn't add latency
+	dialer net.Dialer
+
+	// lookupIPAddr resolves the hostnames of UDP upstreams, whose queries
+	// fall back to the other address family the same way
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	// tlsConfig is used for DNS over TLS upstreams
+	tlsConfig *tls.Config
+
+	// stampTLS holds the server names and pins of DNS over TLS upstreams
+	// given by DNS stamps
+	stampTLS map[string]stampTLS
+
+	// pools keep connections to upstreams for queries over TCP and TLS
+	pools         map[string]*connPool
+	poolMaxIdle   int
+	poolMaxAge    time.Duration
+	probeInterval time.Duration
+
+	proberOnce sync.Once
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	log Logger
+}
+
+// ForwarderOption configures optional behaviour of a Forwarder
+type ForwarderOption func(*Forwarder)
+
+// WithFallbackDelay sets how long the preferred address family of an upstream
+// given by a hostname gets, before the other family is tried alongside it: a
+// TCP or TLS connection attempt is started, and a UDP query is sent again to
+// the other address. A negative delay disables the fallback
+func WithFallbackDelay(delay time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.dialer.FallbackDelay = delay
+	}
+}
+
+// WithConnPool sets how many idle TCP or TLS connections are kept per
+// upstream, and how long a connection is used before it's replaced. A maxIdle
+// of 0 closes connections after every query
+func WithConnPool(maxIdle int, maxAge time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.poolMaxIdle = maxIdle
+		f.poolMaxAge = maxAge
+	}
+}
+
+// WithProbeInterval sets how often idle pooled connections are checked with a
+// query to the upstream
+func WithProbeInterval(interval time.Duration) ForwarderOption {
+	return func(f *Forwarder) {
+		f.probeInterval = interval
+	}
+}
+
+// WithForwarderTLSConfig sets the TLS configuration for DNS over TLS
+// upstreams, e.g. to trust a private CA. The server name defaults to the
+// upstream's host
+func WithForwarderTLSConfig(config *tls.Config) ForwarderOption {
+	return func(f *Forwarder) {
+		f.tlsConfig = config
+	}
+}
+
+// WithForwarderLogger makes the forwarder log through l
+func WithForwarderLogger(l Logger) ForwarderOption {
+	return func(f *Forwarder) {
+		f.log = scopeLogger(l, "forwarder")
+	}
+}
+
+// NewForwarder returns a forwarder which tries upstreams in order. Upstreams
+// may be given as IP addresses or hostnames, and default to port 53. Upstreams
+// prefixed with tls:// are spoken to over DNS over TLS (RFC 7858), on port 853
+// by default. Upstreams may also be given as sdns:// DNS stamps of plain DNS or
+// DNS over TLS servers, whose certificates are then checked against the host
+// name and pins of the stamp
+func NewForwarder(upstreams []string, opts ...ForwarderOption) (*Forwarder, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("forwarder needs at least one upstream")
+	}
+
+	addrs := make([]string, 0, len(upstreams))
+	stamps := map[string]stampTLS{}
+	for _, upstream := range upstreams {
+		upstream = strings.TrimSpace(upstream)
+		if strings.HasPrefix(upstream, stampPrefix) {
+			stamp, err := ParseStamp(upstream)
+			if err != nil {
+				return nil, err
+			}
+
+			addr, config, err := stamp.upstream()
+			if err != nil {
+				return nil, fmt.Errorf("error while reading DNS stamp %s: %v", upstream, err)
+			}
+
+			addrs = append(addrs, addr)
+			stamps[addr] = config
+			continue
+		}
+
+		if strings.HasPrefix(upstream, tlsUpstreamPrefix) {
+			addrs = append(addrs, tlsUpstreamPrefix+withDefaultPort(strings.TrimPrefix(upstream, tlsUpstreamPrefix), "853"))
+			continue
+		}
+
+		addrs = append(addrs, withDefaultPort(upstream, "53"))
+	}
+
+	f := Forwarder{
+		upstreams:  addrs,
+		timeout:    defaultForwardTimeout,
+		randReader: rand.Reader,
+		dialer: net.Dialer{
+			Timeout:       defaultForwardTimeout,
+			FallbackDelay: defaultFallbackDelay,
+		},
+		lookupIPAddr:  net.DefaultResolver.LookupIPAddr,
+		tlsConfig:     &tls.Config{},
+		stampTLS:      stamps,
+		pools:         map[string]*connPool{},
+		poolMaxIdle:   defaultPoolMaxIdle,
+		poolMaxAge:    defaultPoolMaxAge,
+		probeInterval: defaultPoolProbeInterval,
+		budget:        retryBudget{config: DefaultRetryBudget()},
+		done:          make(chan struct{}),
+		log:           scopeLogger(defaultLogger(), "forwarder"),
+	}
+
+	for _, opt := range opts {
+		opt(&f)
+	}
+
+	for _, upstream := range addrs {
+		upstream := upstream
+		f.pools[upstream] = newConnPool(func() (net.Conn, error) {
+			return f.dialStream(upstream)
+		}, f.poolMaxIdle, f.poolMaxAge)
+	}
+
+	return &f, nil
+}
+
+// Close closes the forwarder's pooled connections and stops probing them
+func (f *Forwarder) Close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+
+		for _, pool := range f.pools {
+			pool.close()
+		}
+	})
+}
+
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
+
+// WithForwarder makes the server forward queries outside its zones to f
+func WithForwarder(f *Forwarder) Option {
+	return func(srv *DNSServer) {
+		srv.forwarder = f
+	}
+}
+
+func (f *Forwarder) randomUint16() (uint16, error) {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(f.randReader, b); err != nil {
+		return 0, fmt.Errorf("error while reading random bytes: %v", err)
+	}
+
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// Exchange sends q to the upstreams in order and returns the raw response of
+// the first one to answer. Concurrent calls for the same question share a
+// single upstream query
+func (f *Forwarder) Exchange(q *Question, recursionDesired bool) ([]byte, error) {
+	return f.ExchangeFor("", q, recursionDesired)
+}
+
+// ExchangeFor is like Exchange for a query asked by client, which counts
+// against the client's share of the forwarder's retry budget
+func (f *Forwarder) ExchangeFor(client string, q *Question, recursionDesired bool) ([]byte, error) {
+	if !f.budget.admitClient(client) {
+		return nil, errClientLimit
+	}
+	defer f.budget.releaseClient(client)
+
+	key := fmt.Sprintf("%s/%s/%s/%t", strings.ToLower(q.Name), q.Type, q.Class, recursionDesired)
+
+	return f.inflight.do(key, func() ([]byte, error) {
+		if !f.budget.admit() {
+			return nil, errOutstandingLimit
+		}
+		defer f.budget.release()
+
+		return f.exchange(q, recursionDesired)
+	})
+}
+
+// exchange tries the upstreams in order, skipping those backing off after
+// failures. Asking another upstream after one failed takes a retry out of
+// the budget, and once it's exhausted the query fails instead
+func (f *Forwarder) exchange(q *Question, recursionDesired bool) ([]byte, error) {
+	var lastErr error
+	attempts := 0
+	for _, upstream := range f.upstreams {
+		now := time.Now()
+		if !f.budget.allowUpstream(upstream, now) {
+			continue
+		}
+
+		if attempts > 0 && !f.budget.allowRetry(now) {
+			f.budget.abandonProbe(upstream)
+			f.log.Debugf("not retrying %s on %s: %v", q.String(), upstream, errRetryBudget)
+			return nil, fmt.Errorf("%v: %v", errRetryBudget, lastErr)
+		}
+		attempts++
+
+		resp, err := f.exchangeUpstream(upstream, q, recursionDesired)
+		if err == nil {
+			f.budget.succeeded(upstream)
+			return resp, nil
+		}
+
+		f.budget.failed(upstream, time.Now())
+		lastErr = fmt.Errorf("upstream %s: %v", upstream, err)
+	}
+
+	if attempts == 0 {
+		return nil, errUpstreamsBackoff
+	}
+
+	return nil, lastErr
+}
+
+// exchangeUpstream sends q to a single upstream
+func (f *Forwarder) exchangeUpstream(upstream string, q *Question, recursionDesired bool) ([]byte, error) {
+	if strings.HasPrefix(upstream, tlsUpstreamPrefix) {
+		return f.injectChaos(f.exchangeStream(upstream, q, recursionDesired))
+	}
+
+	resp, err := f.exchangeUDP(upstream, q, recursionDesired)
+	if err == nil && f.chaos != nil {
+		var ok bool
+		if resp, ok = f.chaos.apply(resp, true); !ok {
+			return nil, errChaosDrop
+		}
+	}
+
+	if err == nil && isTruncated(resp) {
+		// the full answer didn't fit in a datagram, ask again over TCP
+		// instead of passing truncated data along
+		f.log.Debugf("truncated response from %s for %s, retrying over tcp", upstream, q.String())
+		return f.injectChaos(f.exchangeStream(upstream, q, recursionDesired))
+	}
+
+	return resp, err
+}
+
+// injectChaos applies the forwarder's chaos to a response over TCP or TLS
+func (f *Forwarder) injectChaos(resp []byte, err error) ([]byte, error) {
+	if err != nil || f.chaos == nil {
+		return resp, err
+	}
+
+	resp, ok := f.chaos.apply(resp, false)
+	if !ok {
+		return nil, errChaosDrop
+	}
+
+	return resp, nil
+}
+
+func (f *Forwarder) buildQuery(q *Question, recursionDesired bool) (uint16, []byte, error) {
+	id, err := f.randomUint16()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	headers := DNSHeader{
+		ID:               id,
+		Type:             QRQuery,
+		OpCode:           QueryOp,
+		RecursionDesired: recursionDesired,
+		QuestionsCount:   1,
+	}
+
+	buf := make([]byte, 512)
+
+	bytesWritten, err := headers.Encode(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, err := q.Encode(buf[bytesWritten:])
+	if err != nil {
+		return 0, nil, err
+	}
+	bytesWritten += n
+
+	return id, buf[:bytesWritten], nil
+}
+
+// listenRandomPort opens a UDP socket on a random source port, falling back to
+// an OS picked port if no random port could be bound
+func (f *Forwarder) listenRandomPort() (*net.UDPConn, error) {
+	for i := 0; i < sourcePortAttempts; i++ {
+		n, err := f.randomUint16()
+		if err != nil {
+			return nil, err
+		}
+
+		port := minSourcePort + int(n)%(maxSourcePort-minSourcePort+1)
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return net.ListenUDP("udp", &net.UDPAddr{})
+}
+
+func (f *Forwarder) exchangeUDP(upstream string, q *Question, recursionDesired bool) ([]byte, error) {
+	primary, fallback, err := f.resolveUDPUpstream(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("error while resolving upstream addr: %v", err)
+	}
+
+	id, query, err := f.buildQuery(q, recursionDesired)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := f.listenRandomPort()
+	if err != nil {
+		return nil, fmt.Errorf("error while opening source port: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(f.timeout)
+	asked := []*net.UDPAddr{primary}
+
+	// the query goes to the other address family as well if the preferred
+	// one doesn't answer within the fallback delay, or can't be sent to at all
+	readDeadline := deadline
+	if fallback != nil {
+		readDeadline = time.Now().Add(f.fallbackDelay())
+		if readDeadline.After(deadline) {
+			readDeadline = deadline
+		}
+	}
+
+	if _, err := conn.WriteToUDP(query, primary); err != nil {
+		if fallback == nil {
+			return nil, fmt.Errorf("error while writing query: %v", err)
+		}
+		readDeadline = time.Now()
+	}
+
+	for {
+		if err := conn.SetReadDeadline(readDeadline); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 512)
+		rlen, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && fallback != nil && time.Now().Before(deadline) {
+				f.log.Debugf("no response from %s of %s yet, asking %s too", primary, upstream, fallback)
+				if _, err := conn.WriteToUDP(query, fallback); err != nil {
+					return nil, fmt.Errorf("error while writing query: %v", err)
+				}
+
+				asked = append(asked, fallback)
+				fallback, readDeadline = nil, deadline
+				continue
+			}
+
+			return nil, fmt.Errorf("error while reading response: %v", err)
+		}
+
+		// anything that doesn't match the query is dropped, and we keep
+		// waiting for the real response until the deadline
+		if !udpAddrIn(from, asked) {
+			f.log.Warnf("dropped response from unexpected address %s while waiting for %s", from.String(), upstream)
+			continue
+		}
+
+		if err := validateResponse(buf[:rlen], id, q); err != nil {
+			f.log.Warnf("dropped response from %s: %v", upstream, err)
+			continue
+		}
+
+		return buf[:rlen], nil
+	}
+}
+
+// resolveUDPUpstream returns the address to send queries for upstream to, and
+// for upstreams given by a hostname with both IPv4 and IPv6 addresses, the
+// first address of the other family to fall back to
+func (f *Forwarder) resolveUDPUpstream(upstream string) (*net.UDPAddr, *net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	port, err := net.LookupPort("udp", service)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	addrs, err := f.lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, fmt.Errorf("no addresses for %s", host)
+	}
+
+	// the resolver orders addresses by preference, and the first one's
+	// family is the preferred one, as net.Dialer has it
+	primary := &net.UDPAddr{IP: addrs[0].IP, Port: port, Zone: addrs[0].Zone}
+	if f.dialer.FallbackDelay < 0 {
+		return primary, nil, nil
+	}
+
+	isIPv4 := addrs[0].IP.To4() != nil
+	for _, addr := range addrs[1:] {
+		if (addr.IP.To4() != nil) != isIPv4 {
+			return primary, &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}, nil
+		}
+	}
+
+	return primary, nil, nil
+}
+
+// fallbackDelay is how long the preferred address family of an upstream gets
+// to answer before the other one is asked as well. Like net.Dialer, a delay
+// of zero means the default
+func (f *Forwarder) fallbackDelay() time.Duration {
+	if f.dialer.FallbackDelay == 0 {
+		return defaultFallbackDelay
+	}
+
+	return f.dialer.FallbackDelay
+}
+
+// udpAddrIn reports whether addr is one of addrs
+func udpAddrIn(addr *net.UDPAddr, addrs []*net.UDPAddr) bool {
+	for _, a := range addrs {
+		if addr.IP.Equal(a.IP) && addr.Port == a.Port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dialStream opens a TCP connection to upstream, or a TLS one for DNS over
+// TLS upstreams
+func (f *Forwarder) dialStream(upstream string) (net.Conn, error) {
+	if !strings.HasPrefix(upstream, tlsUpstreamPrefix) {
+		return f.dialer.Dial("tcp", upstream)
+	}
+
+	addr := strings.TrimPrefix(upstream, tlsUpstreamPrefix)
+
+	config := f.tlsConfig.Clone()
+	if config.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		config.ServerName = host
+	}
+
+	f.stampTLS[upstream].apply(config)
+
+	dialer := tls.Dialer{NetDialer: &f.dialer, Config: config}
+	return dialer.Dial("tcp", addr)
+}
+
+// exchangeStream sends q to upstream over a pooled TCP or TLS connection. A
+// reused connection may have been closed by the upstream since it was last
+// used, so if that fails the query is retried once on a fresh connection
+func (f *Forwarder) exchangeStream(upstream string, q *Question, recursionDesired bool) ([]byte, error) {
+	pool := f.pools[upstream]
+
+	for {
+		conn, reused, err := pool.get()
+		if err != nil {
+			return nil, fmt.Errorf("error while dialing upstream: %v", err)
+		}
+
+		resp, err := f.exchangeOnConn(conn, q, recursionDesired)
+		if err != nil {
+			conn.Close()
+
+			if reused {
+				f.log.Debugf("pooled connection to %s failed, retrying on a new one: %v", upstream, err)
+				continue
+			}
+
+			return nil, err
+		}
+
+		pool.put(conn)
+		f.proberOnce.Do(func() {
+			go f.probeEvery(f.probeInterval)
+		})
+
+		return resp, nil
+	}
+}
+
+// exchangeOnConn sends q over a stream connection and reads the response
+func (f *Forwarder) exchangeOnConn(conn net.Conn, q *Question, recursionDesired bool) ([]byte, error) {
+	id, query, err := f.buildQuery(q, recursionDesired)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(f.timeout)); err != nil {
+		return nil, err
+	}
+
+	// messages over TCP are prefixed with their two byte length
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("error while writing query: %v", err)
+	}
+
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, fmt.Errorf("error while reading response length: %v", err)
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, fmt.Errorf("error while reading response: %v", err)
+	}
+
+	if err := validateResponse(resp, id, q); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// probeQuestion is sent to check pooled connections, its answer is small and
+// every resolver has it at hand
+var probeQuestion = Question{Name: "", Type: &TypeNS, Class: &ClassIN}
+
+// probeEvery checks the idle pooled connections until the forwarder is
+// closed, dropping those the upstream no longer answers on
+func (f *Forwarder) probeEvery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-ticker.C:
+		}
+
+		for upstream, pool := range f.pools {
+			dropped := pool.probe(func(conn *pooledConn) error {
+				_, err := f.exchangeOnConn(conn, &probeQuestion, false)
+				return err
+			})
+
+			if dropped > 0 {
+				f.log.Debugf("dropped %d pooled connections to %s", dropped, upstream)
+			}
+		}
+	}
+}
+
+// isTruncated reports whether the TC bit is set in the message in buf
+func isTruncated(buf []byte) bool {
+	return len(buf) >= 4 && parseTC(binary.BigEndian.Uint16(buf[2:4]))
+}
+
+// validateResponse checks that resp is a response to the query with the given
+// ID and question
+func validateResponse(resp []byte, id uint16, q *Question) error {
+	if len(resp) < 12 {
+		return errors.New("response shorter than header")
+	}
+
+	headers := DNSHeader{}
+	if err := headers.ReadFrom(resp); err != nil {
+		return err
+	}
+
+	if headers.Type != QRResponse {
+		return errors.New("not a response")
+	}
+
+	if headers.ID != id {
+		return fmt.Errorf("response ID %d does not match query ID %d", headers.ID, id)
+	}
+
+	if headers.QuestionsCount != 1 {
+		return fmt.Errorf("response has %d questions", headers.QuestionsCount)
+	}
+
+	_, respQuestion, err := ReadQuestionFrom(resp[12:])
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(respQuestion.Name, q.Name) || respQuestion.Type != q.Type || respQuestion.Class != q.Class {
+		return fmt.Errorf("response question %s does not match query question %s", respQuestion, q)
+	}
+
+	return nil
+}
@@ -0,0 +1,430 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodeTestResponse(t *testing.T, id uint16, q *Question) []byte {
+	t.Helper()
+
+	headers := DNSHeader{
+		ID:             id,
+		Type:           QRResponse,
+		OpCode:         QueryOp,
+		QuestionsCount: 1,
+	}
+
+	buf := make([]byte, 512)
+	n, _ := headers.Encode(buf)
+	qlen, err := q.Encode(buf[n:])
+	if err != nil {
+		t.Fatalf("error while encoding question: %v", err)
+	}
+
+	return buf[:n+qlen]
+}
+
+// startFakeUpstream answers the first query it gets with the given responses,
+// in order. respond gets the query ID and question
+func startFakeUpstream(t *testing.T, respond func(id uint16, q *Question) [][]byte) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		rlen, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		headers := DNSHeader{}
+		headers.ReadFrom(buf[:rlen])
+		_, q, err := ReadQuestionFrom(buf[12:rlen])
+		if err != nil {
+			return
+		}
+
+		for _, resp := range respond(headers.ID, q) {
+			conn.WriteToUDP(resp, from)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// serveFakeTCPUpstream answers a single query on the first connection
+// accepted from l
+func serveFakeTCPUpstream(t *testing.T, l net.Listener) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	lenBuf := make([]byte, 2)
+	io.ReadFull(conn, lenBuf)
+	query := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	io.ReadFull(conn, query)
+
+	headers := DNSHeader{}
+	headers.ReadFrom(query)
+	_, q, _ := ReadQuestionFrom(query[12:])
+
+	resp := encodeTestResponse(t, headers.ID, q)
+	binary.BigEndian.PutUint16(lenBuf, uint16(len(resp)))
+	conn.Write(append(lenBuf, resp...))
+}
+
+func TestServerForwardsUnknownTypes(t *testing.T) {
+	addr := startFakeUpstream(t, func(id uint16, q *Question) [][]byte {
+		return [][]byte{encodeTestResponse(t, id, q)}
+	})
+
+	f, err := NewForwarder([]string{addr})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	t.Cleanup(f.Close)
+
+	srv, _ := NewDNSServer("", "", WithForwarder(f))
+
+	// HTTPS records, type 65, are asked for by browsers all the time
+	https := qtypeForCode(65)
+	for _, test := range []struct {
+		name  string
+		rcode ResponseCode
+	}{
+		{"example.com", NoError},
+		{"test.kausm.in", NotImplemented},
+	} {
+		q := Question{Name: test.name, Type: https, Class: &ClassIN}
+		resp, err := srv.handleQuery(encodeTestQuery(t, 42, &q), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, true)
+		if err != nil {
+			t.Fatalf("error while handling TYPE65 query for %s: %v", test.name, err)
+		}
+
+		msg, err := DecodeMessage(resp)
+		if err != nil {
+			t.Fatalf("error while decoding response: %v", err)
+		}
+
+		if msg.Header.ResponseCode != test.rcode || len(msg.Questions) != 1 || msg.Questions[0].Type != https {
+			t.Errorf("%s: got %s response to %s, expected %s", test.name, msg.Header.ResponseCode, msg.Questions, test.rcode)
+		}
+	}
+}
+
+func TestForwarderDropsMismatchedResponses(t *testing.T) {
+	other := Question{Name: "evil.example", Type: &TypeA, Class: &ClassIN}
+
+	addr := startFakeUpstream(t, func(id uint16, q *Question) [][]byte {
+		return [][]byte{
+			encodeTestResponse(t, id+1, q),
+			encodeTestResponse(t, id, &other),
+			encodeTestResponse(t, id, q),
+		}
+	})
+
+	f, err := NewForwarder([]string{addr})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	resp, err := f.Exchange(&q, true)
+	if err != nil {
+		t.Fatalf("error while exchanging: %v", err)
+	}
+
+	_, gotten, err := ReadQuestionFrom(resp[12:])
+	if err != nil {
+		t.Fatalf("error while reading response question: %v", err)
+	}
+
+	if gotten.Name != q.Name {
+		t.Errorf("accepted response for %q, expected %q", gotten.Name, q.Name)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+
+	if err := validateResponse(encodeTestResponse(t, 42, &q), 42, &q); err != nil {
+		t.Errorf("expected matching response to validate, got %v", err)
+	}
+
+	if err := validateResponse(encodeTestResponse(t, 43, &q), 42, &q); err == nil {
+		t.Errorf("expected response with wrong ID to be rejected")
+	}
+
+	mx := Question{Name: "example.com", Type: &TypeMX, Class: &ClassIN}
+	if err := validateResponse(encodeTestResponse(t, 42, &mx), 42, &q); err == nil {
+		t.Errorf("expected response with wrong question to be rejected")
+	}
+}
+
+func TestForwarderRetriesTruncatedResponseOverTCP(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { tcpListener.Close() })
+
+	port := tcpListener.Addr().(*net.TCPAddr).Port
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Skipf("could not bind udp on tcp port %d: %v", port, err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		rlen, from, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		headers := DNSHeader{}
+		headers.ReadFrom(buf[:rlen])
+		_, q, _ := ReadQuestionFrom(buf[12:rlen])
+
+		resp := encodeTestResponse(t, headers.ID, q)
+		resp[2] |= 1 << 1 // TC
+		udpConn.WriteToUDP(resp, from)
+	}()
+
+	go serveFakeTCPUpstream(t, tcpListener)
+
+	f, err := NewForwarder([]string{tcpListener.Addr().String()})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+
+	q := Question{Name: "example.com", Type: &TypeTXT, Class: &ClassIN}
+	resp, err := f.Exchange(&q, true)
+	if err != nil {
+		t.Fatalf("error while exchanging: %v", err)
+	}
+
+	if isTruncated(resp) {
+		t.Errorf("expected the untruncated TCP response, got a truncated one")
+	}
+}
+
+func TestForwarderDialsHostnameUpstreamOverTCP(t *testing.T) {
+	// localhost usually resolves to both ::1 and 127.0.0.1, but the upstream
+	// only listens on IPv4
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go serveFakeTCPUpstream(t, l)
+
+	port := l.Addr().(*net.TCPAddr).Port
+	upstream := net.JoinHostPort("localhost", strconv.Itoa(port))
+
+	f, err := NewForwarder([]string{upstream}, WithFallbackDelay(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	if _, err := f.exchangeStream(f.upstreams[0], &q, true); err != nil {
+		t.Fatalf("error while exchanging with %s: %v", upstream, err)
+	}
+}
+
+func TestForwarderFallsBackToIPv4OverUDP(t *testing.T) {
+	v4 := startFakeUpstream(t, func(id uint16, q *Question) [][]byte {
+		return [][]byte{encodeTestResponse(t, id, q)}
+	})
+	_, port, _ := net.SplitHostPort(v4)
+
+	// the IPv6 address takes queries on the same port but never answers them
+	silent, err := net.ListenPacket("udp", net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Skipf("no IPv6 loopback to listen on: %v", err)
+	}
+	t.Cleanup(func() { silent.Close() })
+
+	asked := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 512)
+		if _, _, err := silent.ReadFrom(buf); err == nil {
+			asked <- struct{}{}
+		}
+	}()
+
+	upstream := net.JoinHostPort("dual.example.com", port)
+	f, err := NewForwarder([]string{upstream}, WithFallbackDelay(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	t.Cleanup(f.Close)
+
+	f.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return []net.IPAddr{{IP: net.IPv6loopback}, {IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+
+	start := time.Now()
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	if _, err := f.exchangeUDP(f.upstreams[0], &q, true); err != nil {
+		t.Fatalf("error while exchanging with %s: %v", upstream, err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= f.timeout/2 {
+		t.Errorf("falling back to IPv4 took %v, expected about the fallback delay", elapsed)
+	}
+
+	select {
+	case <-asked:
+	case <-time.After(time.Second):
+		t.Errorf("the preferred IPv6 address was never asked")
+	}
+}
+
+// serveFakeStreamUpstream answers every query on every connection accepted
+// from l, and counts the connections on accepted
+func serveFakeStreamUpstream(t *testing.T, l net.Listener, accepted *int32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(accepted, 1)
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				lenBuf := make([]byte, 2)
+				if _, err := io.ReadFull(conn, lenBuf); err != nil {
+					return
+				}
+
+				query := make([]byte, binary.BigEndian.Uint16(lenBuf))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+
+				headers := DNSHeader{}
+				headers.ReadFrom(query)
+				_, q, _ := ReadQuestionFrom(query[12:])
+
+				resp := encodeTestResponse(t, headers.ID, q)
+				binary.BigEndian.PutUint16(lenBuf, uint16(len(resp)))
+				conn.Write(append(lenBuf, resp...))
+			}
+		}()
+	}
+}
+
+func TestForwarderReusesPooledConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var accepted int32
+	go serveFakeStreamUpstream(t, l, &accepted)
+
+	f, err := NewForwarder([]string{l.Addr().String()})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	t.Cleanup(f.Close)
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	for i := 0; i < 5; i++ {
+		if _, err := f.exchangeStream(f.upstreams[0], &q, true); err != nil {
+			t.Fatalf("error while exchanging: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("expected 1 connection for 5 queries, got %d", n)
+	}
+}
+
+func TestForwarderRetriesClosedPooledConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	// the first connection is closed by the upstream after one answer
+	go func() {
+		serveFakeTCPUpstream(t, l)
+
+		var accepted int32
+		serveFakeStreamUpstream(t, l, &accepted)
+	}()
+
+	f, err := NewForwarder([]string{l.Addr().String()})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	t.Cleanup(f.Close)
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	for i := 0; i < 2; i++ {
+		if _, err := f.exchangeStream(f.upstreams[0], &q, true); err != nil {
+			t.Fatalf("error while exchanging query %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestForwarderOverTLS(t *testing.T) {
+	// borrow httptest's certificate, which is valid for 127.0.0.1
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var accepted int32
+	go serveFakeStreamUpstream(t, l, &accepted)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	f, err := NewForwarder([]string{"tls://" + l.Addr().String()}, WithForwarderTLSConfig(&tls.Config{RootCAs: roots}))
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	t.Cleanup(f.Close)
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	for i := 0; i < 3; i++ {
+		if _, err := f.Exchange(&q, true); err != nil {
+			t.Fatalf("error while exchanging: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("expected 1 connection for 3 queries, got %d", n)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+)
+
+// HealthHandler serves probes for orchestrators like Kubernetes:
+//
+//	GET /healthz  200 if the server's listeners answer a loopback query
+//	GET /readyz   200 if the server answers its self-test query as expected
+//
+// Both answer 503 with the reason otherwise
+type HealthHandler struct {
+	srv *DNSServer
+	mux *http.ServeMux
+}
+
+// NewHealthHandler returns the probe endpoints of srv
+func NewHealthHandler(srv *DNSServer) *HealthHandler {
+	h := HealthHandler{
+		srv: srv,
+		mux: http.NewServeMux(),
+	}
+
+	h.mux.HandleFunc("/healthz", h.probe(srv.Alive))
+	h.mux.HandleFunc("/readyz", h.probe(srv.Ready))
+
+	return &h
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *HealthHandler) probe(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := check(); err != nil {
+			h.srv.log.Warnf("%s failed: %v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	srv := startTestServer(t)
+	h := NewHealthHandler(srv)
+
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if resp.Code != http.StatusOK {
+			t.Errorf("expected OK from %s, got %d: %s", path, resp.Code, resp.Body)
+		}
+	}
+}
+
+func TestHealthHandlerNotListening(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	resp := httptest.NewRecorder()
+	NewHealthHandler(srv).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", resp.Code)
+	}
+}
@@ -0,0 +1,528 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHTTPBackendTimeout bounds a single request to the endpoint
+	defaultHTTPBackendTimeout = 2 * time.Second
+
+	// defaultHTTPBackendNegativeTTL is how long answers without records are
+	// cached
+	defaultHTTPBackendNegativeTTL = 60 * time.Second
+
+	// defaultHTTPBackendMaxTTL caps how long any answer is cached
+	defaultHTTPBackendMaxTTL = 5 * time.Minute
+
+	// defaultHTTPBackendCacheSize is how many answers are cached at most
+	defaultHTTPBackendCacheSize = 10000
+
+	// defaultHTTPBackendMaxStale is how long after they expire answers are
+	// served while the endpoint fails
+	defaultHTTPBackendMaxStale = time.Hour
+
+	// httpBackendStaleTTL is the TTL of stale answers, as recommended by
+	// RFC 8767, so that resolvers ask again soon
+	httpBackendStaleTTL = 30
+
+	// the circuit opens after breakerFailures failed requests in a row and
+	// lets a request through again after breakerCooldown
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+
+	// maxHTTPBackendResponseSize limits how much of a response is read
+	maxHTTPBackendResponseSize = 1 << 20
+)
+
+// errCircuitOpen is returned while the endpoint is considered down
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// HTTPBackend is a Backend that reads records from an HTTP endpoint serving
+// JSON, so that records can come from an existing inventory or internal API.
+// For a query, the endpoint is sent
+//
+//	GET <endpoint>?qname=host.example.com&qtype=A
+//
+// and answers with 200 and the records, with RDATA in zone file syntax:
+//
+//	{"records": [{"name": "host.example.com", "type": "A", "ttl": 300, "data": "10.0.0.1"}]}
+//
+// or with 404 for names that don't exist. Answers are cached for the
+// smallest TTL of their records, and stale answers are served for a while
+// when the endpoint fails. Concurrent lookups of a name that isn't cached
+// share a single request. After a run of failed requests the endpoint is left alone
+// for a while, so that a struggling endpoint isn't hammered with a request
+// per query
+type HTTPBackend struct {
+	endpoint string
+	zones    []string
+	client   *http.Client
+
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+	maxStale    time.Duration
+	cacheSize   int
+
+	breakerFailures int
+	breakerCooldown time.Duration
+
+	cacheMu sync.Mutex
+	cache   map[string]*httpBackendEntry
+
+	// inflight merges requests for the same name and type
+	inflight inflightGroup
+
+	breakerMu sync.Mutex
+	failures  int
+	openedAt  time.Time
+	isOpen    bool
+	probing   bool
+
+	log Logger
+}
+
+type httpBackendEntry struct {
+	records  []*ResourceRecord
+	notFound bool
+	fetched  time.Time
+	expires  time.Time
+}
+
+// HTTPBackendOption configures optional behaviour of an HTTPBackend
+type HTTPBackendOption func(*HTTPBackend)
+
+// WithHTTPBackendClient sets the client requests are made with, e.g. to add
+// authentication or TLS settings. The client's timeout is left alone
+func WithHTTPBackendClient(client *http.Client) HTTPBackendOption {
+	return func(b *HTTPBackend) {
+		b.client = client
+	}
+}
+
+// WithHTTPBackendCache sets how long answers without records are cached, the
+// longest any answer is cached and how many answers are cached at most
+func WithHTTPBackendCache(negativeTTL, maxTTL time.Duration, size int) HTTPBackendOption {
+	return func(b *HTTPBackend) {
+		b.negativeTTL = negativeTTL
+		b.maxTTL = maxTTL
+		b.cacheSize = size
+	}
+}
+
+// WithHTTPBackendMaxStale sets how long after they expire cached answers are
+// served while the endpoint fails, 0 serving none
+func WithHTTPBackendMaxStale(maxStale time.Duration) HTTPBackendOption {
+	return func(b *HTTPBackend) {
+		b.maxStale = maxStale
+	}
+}
+
+// WithCircuitBreaker sets after how many failed requests in a row the
+// endpoint is left alone, and for how long
+func WithCircuitBreaker(failures int, cooldown time.Duration) HTTPBackendOption {
+	return func(b *HTTPBackend) {
+		if failures < 1 {
+			failures = 1
+		}
+
+		b.breakerFailures = failures
+		b.breakerCooldown = cooldown
+	}
+}
+
+// WithHTTPBackendLogger sets the logger of the backend, which logs under the
+// "http-backend" component
+func WithHTTPBackendLogger(l Logger) HTTPBackendOption {
+	return func(b *HTTPBackend) {
+		b.log = scopeLogger(l, "http-backend")
+	}
+}
+
+// NewHTTPBackend returns a backend answering queries for zones from endpoint
+func NewHTTPBackend(endpoint string, zones []string, opts ...HTTPBackendOption) (*HTTPBackend, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing endpoint: %v", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("endpoint %s is not an http or https URL", endpoint)
+	}
+
+	if len(zones) == 0 {
+		return nil, errors.New("HTTP backend needs at least one zone")
+	}
+
+	b := HTTPBackend{
+		endpoint:        endpoint,
+		zones:           normalizedZones(zones),
+		client:          &http.Client{Timeout: defaultHTTPBackendTimeout},
+		negativeTTL:     defaultHTTPBackendNegativeTTL,
+		maxTTL:          defaultHTTPBackendMaxTTL,
+		maxStale:        defaultHTTPBackendMaxStale,
+		cacheSize:       defaultHTTPBackendCacheSize,
+		breakerFailures: defaultBreakerFailures,
+		breakerCooldown: defaultBreakerCooldown,
+		cache:           map[string]*httpBackendEntry{},
+		log:             scopeLogger(defaultLogger(), "http-backend"),
+	}
+
+	for _, opt := range opts {
+		opt(&b)
+	}
+
+	return &b, nil
+}
+
+// Zones returns the zones the backend answers for
+func (b *HTTPBackend) Zones() []string {
+	return b.zones
+}
+
+// Lookup returns the records for q, from the cache if it has a fresh answer
+func (b *HTTPBackend) Lookup(q *Question) ([]*ResourceRecord, error) {
+	key := strings.ToLower(q.Name) + "/" + q.Type.Type
+	now := time.Now()
+
+	entry, cached := b.cached(key)
+	if cached && now.Before(entry.expires) {
+		return entry.result(now)
+	}
+
+	// of concurrent lookups, only the first requests the answer and caches
+	// it, the others take it from the cache
+	var fresh *httpBackendEntry
+	_, err := b.inflight.do(key, func() ([]byte, error) {
+		e, err := b.fetch(q)
+		if err != nil {
+			return nil, err
+		}
+
+		b.store(key, e)
+		fresh = e
+		return nil, nil
+	})
+
+	if err == nil && fresh == nil {
+		var ok bool
+		if fresh, ok = b.cached(key); !ok {
+			// evicted already, which only a tiny cache does
+			fresh, err = b.fetch(q)
+		}
+	}
+
+	if err != nil {
+		if cached && now.Before(entry.expires.Add(b.maxStale)) {
+			b.log.Warnf("serving stale answer for %s: %v", q.String(), err)
+			return entry.staleResult()
+		}
+
+		return nil, err
+	}
+
+	return fresh.result(time.Now())
+}
+
+func (b *HTTPBackend) cached(key string) (*httpBackendEntry, bool) {
+	b.cacheMu.Lock()
+	defer b.cacheMu.Unlock()
+
+	entry, ok := b.cache[key]
+	return entry, ok
+}
+
+// result returns the answer as of now, the TTLs of its records reduced by the
+// time it has been cached
+func (e *httpBackendEntry) result(now time.Time) ([]*ResourceRecord, error) {
+	elapsed := uint32(now.Sub(e.fetched) / time.Second)
+
+	return e.withTTLs(func(ttl uint32) uint32 {
+		if ttl < elapsed {
+			return 0
+		}
+
+		return ttl - elapsed
+	})
+}
+
+// staleResult returns the answer after it expired, with the short TTL of
+// stale answers
+func (e *httpBackendEntry) staleResult() ([]*ResourceRecord, error) {
+	return e.withTTLs(func(ttl uint32) uint32 {
+		if ttl < httpBackendStaleTTL {
+			return ttl
+		}
+
+		return httpBackendStaleTTL
+	})
+}
+
+// withTTLs returns copies of the records with their TTLs changed by ttl, as
+// the cached records are shared between lookups
+func (e *httpBackendEntry) withTTLs(ttl func(uint32) uint32) ([]*ResourceRecord, error) {
+	if e.notFound {
+		return nil, ErrNameNotFound
+	}
+
+	records := make([]*ResourceRecord, 0, len(e.records))
+	for _, rr := range e.records {
+		adjusted := *rr
+		adjusted.TTL = ttl(rr.TTL)
+		records = append(records, &adjusted)
+	}
+
+	return records, nil
+}
+
+func (b *HTTPBackend) store(key string, entry *httpBackendEntry) {
+	b.cacheMu.Lock()
+	defer b.cacheMu.Unlock()
+
+	if _, ok := b.cache[key]; !ok && len(b.cache) >= b.cacheSize {
+		// make room by dropping an arbitrary answer, preferably one that is
+		// no longer fresh
+		now := time.Now()
+		var victim string
+		for k, e := range b.cache {
+			victim = k
+			if now.After(e.expires) {
+				break
+			}
+		}
+		delete(b.cache, victim)
+	}
+
+	b.cache[key] = entry
+}
+
+// jsonRecord is a record as the HTTP backend's endpoints and the admin API
+// write it, with its data in zone file syntax
+type jsonRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+
+	Comment string            `json:"comment,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+}
+
+func newJSONRecord(rr *ResourceRecord) jsonRecord {
+	return jsonRecord{
+		Name:    rr.Name,
+		Type:    rr.Type.Type,
+		TTL:     rr.TTL,
+		Data:    rdataString(rr.Type, rr.Value),
+		Comment: rr.Comment,
+		Meta:    rr.Meta,
+	}
+}
+
+type httpBackendResponse struct {
+	Records []jsonRecord `json:"records"`
+}
+
+// fetch asks the endpoint about q, through the circuit breaker
+func (b *HTTPBackend) fetch(q *Question) (*httpBackendEntry, error) {
+	if !b.allowRequest() {
+		return nil, errCircuitOpen
+	}
+
+	entry, err := b.request(q)
+	b.recordResult(err)
+
+	return entry, err
+}
+
+func (b *HTTPBackend) request(q *Question) (*httpBackendEntry, error) {
+	params := url.Values{}
+	params.Set("qname", q.Name)
+	params.Set("qtype", q.Type.Type)
+
+	u := b.endpoint
+	if strings.Contains(u, "?") {
+		u += "&" + params.Encode()
+	} else {
+		u += "?" + params.Encode()
+	}
+
+	resp, err := b.client.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("error while requesting records: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body := io.LimitReader(resp.Body, maxHTTPBackendResponseSize)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		io.Copy(ioutil.Discard, body)
+		now := time.Now()
+		return &httpBackendEntry{notFound: true, fetched: now, expires: now.Add(b.negativeTTL)}, nil
+	default:
+		io.Copy(ioutil.Discard, body)
+		return nil, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+
+	decoded := httpBackendResponse{}
+	if err := json.NewDecoder(body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("error while decoding records: %v", err)
+	}
+
+	entry := httpBackendEntry{}
+	ttl := b.negativeTTL
+	for i, r := range decoded.Records {
+		rr, err := r.toResourceRecord(q.Name, b.zones)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading record %d: %v", i+1, err)
+		}
+
+		// records are cached as the answer to q, so those that don't
+		// answer it must not be served as if they did
+		if !answersQuestion(rr, q) {
+			b.log.Warnf("dropped %s record for %s the endpoint returned for %s", rr.Type, rr.Name, q.String())
+			continue
+		}
+
+		if len(entry.records) == 0 || time.Duration(rr.TTL)*time.Second < ttl {
+			ttl = time.Duration(rr.TTL) * time.Second
+		}
+
+		entry.records = append(entry.records, rr)
+	}
+
+	if ttl > b.maxTTL {
+		ttl = b.maxTTL
+	}
+	entry.fetched = time.Now()
+	entry.expires = entry.fetched.Add(ttl)
+
+	return &entry, nil
+}
+
+// answersQuestion reports whether rr answers q: it's owned by q's name, or
+// by a wildcard that matches it, in which case rr is made to be owned by q's
+// name, and it's of q's type, or a CNAME record
+func answersQuestion(rr *ResourceRecord, q *Question) bool {
+	if rr.Type != q.Type && rr.Type != &TypeCNAME && q.Type != &TypeAll {
+		return false
+	}
+
+	qname := strings.ToLower(strings.TrimSuffix(q.Name, "."))
+	if rr.Name == qname {
+		return true
+	}
+
+	if strings.HasPrefix(rr.Name, "*.") && strings.HasSuffix(qname, rr.Name[1:]) {
+		rr.Name = qname
+		return true
+	}
+
+	return false
+}
+
+// toResourceRecord parses r, whose name defaults to qname. Names in the data
+// that are not fully qualified are relative to the closest of zones
+func (r *jsonRecord) toResourceRecord(qname string, zones []string) (*ResourceRecord, error) {
+	name := strings.TrimSuffix(r.Name, ".")
+	if name == "" {
+		name = qname
+	}
+
+	origin, ok := closestZone(zones, name)
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the backend's zones", name)
+	}
+
+	qtype, ok := nameToQtypeMap[strings.ToUpper(r.Type)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported record type %q", r.Type)
+	}
+
+	rdata, _, depth, err := tokenizeZoneLine(r.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	if depth != 0 {
+		return nil, errors.New("unbalanced parentheses in data")
+	}
+
+	value, err := encodeRData(qtype, rdata, origin)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAnnotations(r.Comment, r.Meta); err != nil {
+		return nil, err
+	}
+
+	rr := ResourceRecord{
+		Name:    strings.ToLower(name),
+		Type:    qtype,
+		Class:   &ClassIN,
+		TTL:     r.TTL,
+		Value:   value,
+		Comment: strings.Join(strings.Fields(r.Comment), " "),
+		Meta:    r.Meta,
+	}
+
+	return &rr, nil
+}
+
+// allowRequest reports whether a request may be made. Once the cooldown of
+// an open circuit is over, a single request is let through to probe whether
+// the endpoint is back
+func (b *HTTPBackend) allowRequest() bool {
+	b.breakerMu.Lock()
+	defer b.breakerMu.Unlock()
+
+	if !b.isOpen {
+		return true
+	}
+
+	if b.probing || time.Since(b.openedAt) < b.breakerCooldown {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+func (b *HTTPBackend) recordResult(err error) {
+	b.breakerMu.Lock()
+	defer b.breakerMu.Unlock()
+
+	b.probing = false
+
+	if err == nil {
+		if b.isOpen {
+			b.log.Infof("endpoint is back, closing circuit")
+		}
+
+		b.failures = 0
+		b.isOpen = false
+		return
+	}
+
+	b.failures++
+	if b.isOpen || b.failures >= b.breakerFailures {
+		if !b.isOpen {
+			b.log.Warnf("opening circuit after %d failed requests: %v", b.failures, err)
+		}
+
+		b.isOpen = true
+		b.openedAt = time.Now()
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPBackendLookup(t *testing.T) {
+	var requests int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+
+		switch r.URL.Query().Get("qname") + "/" + r.URL.Query().Get("qtype") {
+		case "db.corp.example/A":
+			w.Write([]byte(`{"records": [{"type": "A", "ttl": 60, "data": "10.1.2.3"}, {"type": "A", "ttl": 30, "data": "10.1.2.4"}]}`))
+		case "db.corp.example/MX":
+			w.Write([]byte(`{"records": [{"name": "db.corp.example.", "type": "MX", "ttl": 60, "data": "10 mail"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(endpoint.Close)
+
+	b, err := NewHTTPBackend(endpoint.URL, []string{"corp.example"})
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+
+	q := Question{Name: "db.corp.example", Type: &TypeA, Class: &ClassIN}
+	for i := 0; i < 2; i++ {
+		records, err := b.Lookup(&q)
+		if err != nil {
+			t.Fatalf("error while looking up: %v", err)
+		}
+
+		if len(records) != 2 || string(records[1].Value) != "\x0a\x01\x02\x04" || records[0].Name != q.Name {
+			t.Fatalf("unexpected records %v", records)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected the second lookup to be cached, endpoint got %d requests", n)
+	}
+
+	mx := Question{Name: "db.corp.example", Type: &TypeMX, Class: &ClassIN}
+	records, err := b.Lookup(&mx)
+	if err != nil {
+		t.Fatalf("error while looking up: %v", err)
+	}
+
+	if len(records) != 1 || string(records[0].Value) != "\x00\x0a\x04mail\x04corp\x07example\x00" {
+		t.Errorf("expected the MX target to be relative to the record's zone, got %q", records[0].Value)
+	}
+
+	missing := Question{Name: "missing.corp.example", Type: &TypeA, Class: &ClassIN}
+	if _, err := b.Lookup(&missing); err != ErrNameNotFound {
+		t.Errorf("expected ErrNameNotFound for a 404, got %v", err)
+	}
+}
+
+func TestHTTPBackendDropsRecordsNotAnswering(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("qname") + "/" + r.URL.Query().Get("qtype") {
+		case "www.corp.example/A":
+			w.Write([]byte(`{"records": [
+				{"name": "other.corp.example", "type": "A", "ttl": 60, "data": "10.0.0.9"},
+				{"type": "AAAA", "ttl": 60, "data": "2001:db8::1"},
+				{"type": "A", "ttl": 60, "data": "10.0.0.1"},
+				{"name": "*.corp.example", "type": "A", "ttl": 60, "data": "10.0.0.2"}
+			]}`))
+		case "www.corp.example/AAAA":
+			w.Write([]byte(`{"records": [{"type": "A", "ttl": 60, "data": "10.0.0.1"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(endpoint.Close)
+
+	b, err := NewHTTPBackend(endpoint.URL, []string{"corp.example"})
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+
+	q := Question{Name: "www.corp.example", Type: &TypeA, Class: &ClassIN}
+	records, err := b.Lookup(&q)
+	if err != nil {
+		t.Fatalf("error while looking up: %v", err)
+	}
+
+	// the wildcard matches, and answers as www
+	if len(records) != 2 || string(records[0].Value) != "\x0a\x00\x00\x01" || string(records[1].Value) != "\x0a\x00\x00\x02" {
+		t.Fatalf("expected the 2 A records of www, got %v", records)
+	}
+	for _, rr := range records {
+		if rr.Name != q.Name || rr.Type != &TypeA {
+			t.Errorf("served %s record of %s for %s", rr.Type, rr.Name, q.String())
+		}
+	}
+
+	aaaa := Question{Name: "www.corp.example", Type: &TypeAAAA, Class: &ClassIN}
+	if records, err := b.Lookup(&aaaa); err != nil || len(records) != 0 {
+		t.Errorf("expected no AAAA records, got %v, %v", records, err)
+	}
+}
+
+func TestHTTPBackendCircuitBreaker(t *testing.T) {
+	var requests int32
+	var healthy int32
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+
+		w.Write([]byte(`{"records": []}`))
+	}))
+	t.Cleanup(endpoint.Close)
+
+	b, err := NewHTTPBackend(endpoint.URL, []string{"corp.example"}, WithCircuitBreaker(2, 50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+
+	q := Question{Name: "db.corp.example", Type: &TypeA, Class: &ClassIN}
+	for i := 0; i < 5; i++ {
+		if _, err := b.Lookup(&q); err == nil {
+			t.Fatalf("expected lookup %d to fail", i+1)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("expected the circuit to open after 2 failures, endpoint got %d requests", n)
+	}
+
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(60 * time.Millisecond)
+
+	if _, err := b.Lookup(&q); err != nil {
+		t.Errorf("expected the probe after the cooldown to succeed, got %v", err)
+	}
+}
+
+func TestHTTPBackendCacheAges(t *testing.T) {
+	var requests int32
+	var healthy int32 = 1
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+
+		// slow enough for concurrent lookups to overlap
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"records": [{"type": "A", "ttl": 120, "data": "10.1.2.3"}]}`))
+	}))
+	t.Cleanup(endpoint.Close)
+
+	b, err := NewHTTPBackend(endpoint.URL, []string{"corp.example"}, WithHTTPBackendMaxStale(time.Minute))
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+
+	q := Question{Name: "db.corp.example", Type: &TypeA, Class: &ClassIN}
+
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := b.Lookup(&q)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("error while looking up: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected concurrent lookups to share a request, endpoint got %d", n)
+	}
+
+	// as the answer ages in the cache its TTL goes down
+	entry, _ := b.cached("db.corp.example/A")
+	entry.fetched = entry.fetched.Add(-100 * time.Second)
+
+	records, err := b.Lookup(&q)
+	if err != nil {
+		t.Fatalf("error while looking up: %v", err)
+	}
+	if records[0].TTL > 20 {
+		t.Errorf("expected the TTL to be reduced by the 100s cached, got %d", records[0].TTL)
+	}
+	if entry.records[0].TTL != 120 {
+		t.Errorf("reducing the TTL changed the cached record")
+	}
+
+	// expired answers are served stale with a short TTL while the endpoint
+	// fails, but only up to the maximum staleness
+	atomic.StoreInt32(&healthy, 0)
+	entry.expires = time.Now().Add(-30 * time.Second)
+
+	records, err = b.Lookup(&q)
+	if err != nil {
+		t.Fatalf("expected a stale answer, got %v", err)
+	}
+	if records[0].TTL != httpBackendStaleTTL {
+		t.Errorf("expected stale TTL %d, got %d", httpBackendStaleTTL, records[0].TTL)
+	}
+
+	entry.expires = time.Now().Add(-2 * time.Minute)
+	if _, err := b.Lookup(&q); err == nil {
+		t.Errorf("expected no answer past the maximum staleness")
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import "strings"
+
+const (
+	// backgroundIndexThreshold is how many records the loaded records need
+	// for their index to be built in the background, so that loading large
+	// zones at startup doesn't wait for the index
+	backgroundIndexThreshold = 10000
+
+	// indexShards is how many shards the names of an index are spread over,
+	// so that a change copies only the shards of the names it touches
+	indexShards = 4096
+)
+
+// recordIndex maps the lowercased names of a version's records to the records
+// of each name, and is where a version keeps its records. Only the loaded
+// records are indexed from scratch: the index of every later version is
+// derived from the one before it and the change, so a name's records are in
+// the order they were added in
+type recordIndex struct {
+	// ready is closed once shards is built
+	ready chan struct{}
+
+	// shards are nil while empty, and shared by versions whose changes
+	// didn't touch them
+	shards [indexShards]*recordShard
+}
+
+// recordShard holds the records of the names of an index that hash to it
+type recordShard struct {
+	names map[string][]*ResourceRecord
+}
+
+// newRecordIndex returns the index of records, which is built before it's
+// returned unless background is set
+func newRecordIndex(records []*ResourceRecord, background bool) *recordIndex {
+	ix := recordIndex{ready: make(chan struct{})}
+	if background {
+		go ix.build(records)
+	} else {
+		ix.build(records)
+	}
+
+	return &ix
+}
+
+func (ix *recordIndex) build(records []*ResourceRecord) {
+	for _, rr := range records {
+		name := strings.ToLower(rr.Name)
+		i := indexShard(name)
+		if ix.shards[i] == nil {
+			ix.shards[i] = &recordShard{names: make(map[string][]*ResourceRecord, len(records)/indexShards)}
+		}
+
+		ix.shards[i].names[name] = append(ix.shards[i].names[name], rr)
+	}
+
+	close(ix.ready)
+}
+
+// apply returns the index of the records delta makes of ix's. It shares the
+// shards delta doesn't touch with ix, which is left as it is, and waits for
+// ix to be built first
+func (ix *recordIndex) apply(delta recordDelta) *recordIndex {
+	<-ix.ready
+
+	next := recordIndex{ready: make(chan struct{}), shards: ix.shards}
+	copied := [indexShards]bool{}
+	shardOf := func(name string) map[string][]*ResourceRecord {
+		i := indexShard(name)
+		if !copied[i] {
+			shard := recordShard{names: map[string][]*ResourceRecord{}}
+			if next.shards[i] != nil {
+				shard.names = make(map[string][]*ResourceRecord, len(next.shards[i].names))
+				for name, records := range next.shards[i].names {
+					shard.names[name] = records
+				}
+			}
+
+			next.shards[i], copied[i] = &shard, true
+		}
+
+		return next.shards[i].names
+	}
+
+	// the lists of names are shared with ix too, so they are copied rather
+	// than changed in place
+	for _, rr := range delta.removed {
+		name := strings.ToLower(rr.Name)
+		shard := shardOf(name)
+
+		named := shard[name]
+		for i, existing := range named {
+			if existing != rr {
+				continue
+			}
+
+			if len(named) == 1 {
+				delete(shard, name)
+			} else {
+				shard[name] = append(append(make([]*ResourceRecord, 0, len(named)-1), named[:i]...), named[i+1:]...)
+			}
+			break
+		}
+	}
+
+	for _, rr := range delta.added {
+		name := strings.ToLower(rr.Name)
+		shard := shardOf(name)
+
+		named := shard[name]
+		shard[name] = append(named[:len(named):len(named)], rr)
+	}
+
+	close(next.ready)
+	return &next
+}
+
+// diff returns the records going from ix to target adds and removes. Only the
+// shards the two don't share are compared, and records are told apart by
+// identity, without comparing their contents
+func (ix *recordIndex) diff(target *recordIndex) recordDelta {
+	<-ix.ready
+	<-target.ready
+
+	delta := recordDelta{}
+	for i := range ix.shards {
+		from, to := ix.shards[i], target.shards[i]
+		if from == to {
+			continue
+		}
+
+		names := map[string]bool{}
+		if from != nil {
+			for name := range from.names {
+				names[name] = true
+			}
+		}
+		if to != nil {
+			for name := range to.names {
+				names[name] = true
+			}
+		}
+
+		for name := range names {
+			var current, wanted []*ResourceRecord
+			if from != nil {
+				current = from.names[name]
+			}
+			if to != nil {
+				wanted = to.names[name]
+			}
+
+			added, removed := diffRecords(current, wanted)
+			delta.added = append(delta.added, added...)
+			delta.removed = append(delta.removed, removed...)
+		}
+	}
+
+	return delta
+}
+
+// diffRecords returns the records of target that aren't in current, and those
+// of current that aren't in target
+func diffRecords(current, target []*ResourceRecord) (added, removed []*ResourceRecord) {
+	counts := make(map[*ResourceRecord]int, len(current))
+	for _, rr := range current {
+		counts[rr]++
+	}
+
+	for _, rr := range target {
+		if counts[rr] > 0 {
+			counts[rr]--
+			continue
+		}
+
+		added = append(added, rr)
+	}
+
+	// what is left in counts is only in current
+	for _, rr := range current {
+		if counts[rr] > 0 {
+			counts[rr]--
+			removed = append(removed, rr)
+		}
+	}
+
+	return added, removed
+}
+
+// each calls fn with every record of ix, waiting for ix to be built first
+func (ix *recordIndex) each(fn func(*ResourceRecord)) {
+	<-ix.ready
+
+	for _, shard := range ix.shards {
+		if shard == nil {
+			continue
+		}
+
+		for _, records := range shard.names {
+			for _, rr := range records {
+				fn(rr)
+			}
+		}
+	}
+}
+
+// indexShard returns the shard of the lowercased name, by its FNV-1a hash
+func indexShard(name string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+
+	return int(h % indexShards)
+}
+
+// recordsNamed returns the records of name. Lookups wait for the index of the
+// loaded records if it's still being built, which takes about as long as a
+// few scans of all records would
+func (s *zoneSnapshot) recordsNamed(name string) []*ResourceRecord {
+	name = strings.ToLower(name)
+	<-s.index.ready
+
+	shard := s.index.shards[indexShard(name)]
+	if shard == nil {
+		return nil
+	}
+
+	return shard.names[name]
+}
+
+// zonesAfter returns the zones of the records delta makes of s's, with an
+// apex for every SOA record as zonesOf has them
+func (s *zoneSnapshot) zonesAfter(delta recordDelta) []string {
+	zones := append([]string(nil), s.zones...)
+	for _, rr := range delta.removed {
+		if rr.Type != &TypeSOA {
+			continue
+		}
+
+		apex := strings.ToLower(rr.Name)
+		for i, zone := range zones {
+			if zone == apex {
+				zones = append(zones[:i], zones[i+1:]...)
+				break
+			}
+		}
+	}
+
+	for _, rr := range delta.added {
+		if rr.Type == &TypeSOA {
+			zones = append(zones, strings.ToLower(rr.Name))
+		}
+	}
+
+	return zones
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestRecordIndex(t *testing.T) {
+	records := []*ResourceRecord{}
+	for i := 0; i < 100; i++ {
+		rr, _ := NewA(fmt.Sprintf("host-%d.Example.com", i), 300, net.IPv4(192, 0, 2, byte(i)))
+		records = append(records, rr)
+	}
+	txt := &ResourceRecord{Name: "host-7.example.com", Type: &TypeTXT, Class: &ClassIN, TTL: 300, Value: []byte("\x02hi")}
+	records = append(records, txt)
+
+	for _, background := range []bool{false, true} {
+		snap := zoneSnapshot{count: len(records), index: newRecordIndex(records, background)}
+
+		// lookups wait for the index if it's built in the background
+		named := snap.recordsNamed("HOST-7.example.com")
+		if len(named) != 2 || named[0].Type != &TypeA || named[1] != txt {
+			t.Errorf("background %v: unexpected records %v", background, named)
+		}
+
+		<-snap.index.ready
+
+		named = snap.recordsNamed("host-7.example.com")
+		if len(named) != 2 || named[0].Type != &TypeA || named[1] != txt {
+			t.Errorf("background %v: unexpected indexed records %v", background, named)
+		}
+
+		if named := snap.recordsNamed("missing.example.com"); len(named) != 0 {
+			t.Errorf("background %v: unexpected records of a missing name %v", background, named)
+		}
+	}
+}
+
+func TestRecordIndexApply(t *testing.T) {
+	www, _ := NewA("www.example.com", 300, net.IPv4(192, 0, 2, 1))
+	mail, _ := NewA("mail.example.com", 300, net.IPv4(192, 0, 2, 25))
+	soa, _ := NewSOA("example.com", 300, "ns.example.com", "hostmaster.example.com", 1, 3600, 600, 86400, 300)
+
+	records := []*ResourceRecord{soa, www, mail}
+	snap := zoneSnapshot{count: len(records), zones: zonesOf(records), index: newRecordIndex(records, false)}
+
+	www2, _ := NewA("WWW.example.com", 300, net.IPv4(192, 0, 2, 2))
+	sub, _ := NewSOA("sub.example.com", 300, "ns.example.com", "hostmaster.example.com", 1, 3600, 600, 86400, 300)
+	delta := recordDelta{added: []*ResourceRecord{www2, sub}, removed: []*ResourceRecord{mail}}
+
+	next := zoneSnapshot{index: snap.index.apply(delta), zones: snap.zonesAfter(delta)}
+
+	if named := next.recordsNamed("www.example.com"); len(named) != 2 || named[0] != www || named[1] != www2 {
+		t.Errorf("unexpected records of www %v", named)
+	}
+	if named := next.recordsNamed("mail.example.com"); len(named) != 0 {
+		t.Errorf("expected the removed record to be gone, got %v", named)
+	}
+	if len(next.zones) != 2 || next.zones[1] != "sub.example.com" {
+		t.Errorf("unexpected zones %v", next.zones)
+	}
+
+	// the earlier version is left as it was
+	if named := snap.recordsNamed("www.example.com"); len(named) != 1 || named[0] != www {
+		t.Errorf("applying a change changed the earlier index to %v", named)
+	}
+	if named := snap.recordsNamed("mail.example.com"); len(named) != 1 {
+		t.Errorf("applying a change removed %v from the earlier index", mail)
+	}
+
+	after := zoneSnapshot{zones: next.zonesAfter(recordDelta{removed: []*ResourceRecord{soa}})}
+	if len(after.zones) != 1 || after.zones[0] != "sub.example.com" {
+		t.Errorf("unexpected zones after removing an SOA record %v", after.zones)
+	}
+}
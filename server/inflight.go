@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"sync"
+)
+
+// errInflightPanicked is what callers waiting on a call get when the call
+// panicked
+var errInflightPanicked = errors.New("coalesced query failed")
+
+// inflightCall is a query that one or more callers are waiting on
+type inflightCall struct {
+	wg   sync.WaitGroup
+	resp []byte
+	err  error
+
+	// dups counts the callers that joined the call instead of making their own
+	dups int
+}
+
+// inflightGroup coalesces concurrent identical queries, upstream queries or
+// retransmissions of clients, so that only one of them is worked on and the
+// rest share its answer
+type inflightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+// do runs fn for key unless a call for key is already in flight, in which case
+// it waits for that call instead. Every caller gets its own copy of the
+// response, as callers rewrite the message ID in place
+func (g *inflightGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*inflightCall{}
+	}
+
+	if call, ok := g.calls[key]; ok {
+		call.dups++
+		g.mu.Unlock()
+		call.wg.Wait()
+
+		return copyResponse(call.resp, call.err)
+	}
+
+	call := &inflightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	returned := false
+	defer func() {
+		if !returned {
+			// fn panicked, fail the waiting callers rather than leave them
+			// hanging, and let the panic go on up to the query's handler
+			call.err = errInflightPanicked
+		}
+
+		call.wg.Done()
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+	}()
+
+	call.resp, call.err = fn()
+	returned = true
+
+	return copyResponse(call.resp, call.err)
+}
+
+func copyResponse(resp []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(nil), resp...), nil
+}
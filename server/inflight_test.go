@@ -0,0 +1,115 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInflightGroupCoalescesConcurrentCalls(t *testing.T) {
+	g := inflightGroup{}
+
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	fn := func() ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+
+		return []byte{0, 42}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 5)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = g.do("example.com/A", fn)
+	}()
+	<-started
+
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = g.do("example.com/A", fn)
+		}(i)
+	}
+
+	// wait for all the waiters to join the in-flight call
+	for {
+		g.mu.Lock()
+		dups := g.calls["example.com/A"].dups
+		g.mu.Unlock()
+		if dups == len(results)-1 {
+			break
+		}
+	}
+
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected a single upstream call, got %d", n)
+	}
+
+	for i, resp := range results {
+		if len(resp) != 2 || resp[1] != 42 {
+			t.Fatalf("waiter %d got unexpected response %v", i, resp)
+		}
+	}
+
+	// every waiter has its own copy
+	results[0][1] = 0
+	if results[1][1] != 42 {
+		t.Errorf("waiters share the same response buffer")
+	}
+}
+
+func TestInflightGroupReleasesWaitersOnPanic(t *testing.T) {
+	g := inflightGroup{}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected the panic to reach the caller")
+			}
+		}()
+
+		g.do("example.com/A", func() ([]byte, error) {
+			close(started)
+			<-release
+			panic("buggy upstream")
+		})
+	}()
+
+	<-started
+	waited := make(chan error)
+	go func() {
+		_, err := g.do("example.com/A", func() ([]byte, error) {
+			return []byte{0, 42}, nil
+		})
+		waited <- err
+	}()
+
+	close(release)
+	<-done
+
+	// the waiter either joined the call that panicked, or made its own once
+	// the call was gone
+	if err := <-waited; err != nil && err != errInflightPanicked {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if _, ok := g.calls["example.com/A"]; ok {
+		t.Errorf("expected the call to be forgotten after it panicked")
+	}
+}
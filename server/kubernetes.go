@@ -0,0 +1,627 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultKubernetesDomain = "cluster.local"
+
+	// defaultKubernetesTTL is short, as services and pods come and go
+	defaultKubernetesTTL = 5
+
+	// kubernetesListTimeout bounds listing all objects of a resource
+	kubernetesListTimeout = 30 * time.Second
+
+	// kubernetesWatchTimeout is how long the API server keeps a watch open
+	// before it is renewed
+	kubernetesWatchTimeout = 5 * time.Minute
+
+	// kubernetesRetryDelay is how long to wait before listing again after a
+	// failed list or watch
+	kubernetesRetryDelay = 5 * time.Second
+
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// kubernetesResources are the resources watched, both are namespaced and
+// their objects keyed by namespace/name
+var kubernetesResources = []string{"services", "endpoints"}
+
+var (
+	errKubernetesNotSynced = errors.New("services and endpoints are not listed yet")
+
+	// errWatchExpired is returned when the version a watch started from is
+	// too old for the API server, and everything has to be listed again
+	errWatchExpired = errors.New("watch expired")
+)
+
+// KubernetesBackend is a Backend answering for the cluster domain of a
+// Kubernetes cluster, like cluster DNS does, from the services and endpoints
+// it watches through the Kubernetes API:
+//
+//	<service>.<ns>.svc.<domain>                  A/AAAA of the cluster IP, or of every ready endpoint of headless services
+//	<hostname>.<service>.<ns>.svc.<domain>       A/AAAA of an endpoint of a headless service
+//	_<port>._<proto>.<service>.<ns>.svc.<domain> SRV for every named port
+//	<a-b-c-d>.<ns>.pod.<domain>                  A/AAAA of a pod, if it is an endpoint of some service
+//
+// ExternalName services are answered with a CNAME to their external name.
+// Endpoints without a hostname are named after their dashed IP address
+type KubernetesBackend struct {
+	apiURL string
+	domain string
+	ttl    uint32
+	client *http.Client
+
+	// token is sent as bearer token, unless tokenFile is set, which is read
+	// for every request as the kubelet rotates it
+	token     string
+	tokenFile string
+
+	// objects holds the decoded objects per resource, keyed by namespace/name
+	mu      sync.Mutex
+	objects map[string]map[string]interface{}
+	listed  map[string]bool
+
+	// names holds the map[string][]*ResourceRecord queries are answered
+	// from, rebuilt on every change. Names that exist without records map
+	// to an empty slice
+	names atomic.Value
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	log Logger
+}
+
+// KubernetesOption configures optional behaviour of a KubernetesBackend
+type KubernetesOption func(*KubernetesBackend)
+
+// WithKubernetesClusterDomain sets the domain services and pods are named
+// under, cluster.local by default
+func WithKubernetesClusterDomain(domain string) KubernetesOption {
+	return func(b *KubernetesBackend) {
+		b.domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	}
+}
+
+// WithKubernetesTTL sets the TTL of the records served
+func WithKubernetesTTL(ttl uint32) KubernetesOption {
+	return func(b *KubernetesBackend) {
+		b.ttl = ttl
+	}
+}
+
+// WithKubernetesClient sets the client requests to the API server are made
+// with, e.g. for its TLS settings. The client must not have a timeout, since
+// watches are long running requests
+func WithKubernetesClient(client *http.Client) KubernetesOption {
+	return func(b *KubernetesBackend) {
+		b.client = client
+	}
+}
+
+// WithKubernetesToken sets the bearer token requests are authenticated with
+func WithKubernetesToken(token string) KubernetesOption {
+	return func(b *KubernetesBackend) {
+		b.token = token
+		b.tokenFile = ""
+	}
+}
+
+// WithKubernetesTokenFile makes requests authenticate with the bearer token
+// in the file at path, which is read again for every request
+func WithKubernetesTokenFile(path string) KubernetesOption {
+	return func(b *KubernetesBackend) {
+		b.tokenFile = path
+	}
+}
+
+// WithKubernetesLogger sets the logger of the backend, which logs under the
+// "kubernetes" component
+func WithKubernetesLogger(l Logger) KubernetesOption {
+	return func(b *KubernetesBackend) {
+		b.log = scopeLogger(l, "kubernetes")
+	}
+}
+
+// NewKubernetesBackend returns a backend serving the services and endpoints
+// of the API server at apiURL, and starts watching them. Queries are
+// answered with SERVFAIL until both are listed
+func NewKubernetesBackend(apiURL string, opts ...KubernetesOption) (*KubernetesBackend, error) {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing API server URL: %v", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("API server URL %s is not an http or https URL", apiURL)
+	}
+
+	b := KubernetesBackend{
+		apiURL:  strings.TrimSuffix(apiURL, "/"),
+		domain:  defaultKubernetesDomain,
+		ttl:     defaultKubernetesTTL,
+		client:  &http.Client{},
+		objects: map[string]map[string]interface{}{},
+		listed:  map[string]bool{},
+		log:     scopeLogger(defaultLogger(), "kubernetes"),
+	}
+
+	for _, opt := range opts {
+		opt(&b)
+	}
+
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+
+	for _, resource := range kubernetesResources {
+		go b.watch(resource)
+	}
+
+	return &b, nil
+}
+
+// NewInClusterKubernetesBackend returns a backend for the cluster it runs in,
+// talking to the API server with the pod's service account
+func NewInClusterKubernetesBackend(opts ...KubernetesOption) (*KubernetesBackend, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	ca, err := ioutil.ReadFile(inClusterCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading cluster CA: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", inClusterCAFile)
+	}
+
+	client := http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		},
+	}
+
+	opts = append([]KubernetesOption{WithKubernetesClient(&client), WithKubernetesTokenFile(inClusterTokenFile)}, opts...)
+
+	return NewKubernetesBackend("https://"+net.JoinHostPort(host, port), opts...)
+}
+
+// Close stops watching the API server
+func (b *KubernetesBackend) Close() {
+	b.cancel()
+}
+
+// Zones returns the cluster domain
+func (b *KubernetesBackend) Zones() []string {
+	return []string{b.domain}
+}
+
+// Lookup returns the records for q. Names with a CNAME record are answered
+// with it for queries of other types
+func (b *KubernetesBackend) Lookup(q *Question) ([]*ResourceRecord, error) {
+	names, ok := b.names.Load().(map[string][]*ResourceRecord)
+	if !ok {
+		return nil, errKubernetesNotSynced
+	}
+
+	records, ok := names[strings.ToLower(strings.TrimSuffix(q.Name, "."))]
+	if !ok {
+		return nil, ErrNameNotFound
+	}
+
+	answers := []*ResourceRecord{}
+	for _, rr := range records {
+		if rr.Type == q.Type || q.Type == &TypeAll {
+			answers = append(answers, rr)
+		}
+	}
+
+	if len(answers) == 0 && q.Type != &TypeCNAME {
+		for _, rr := range records {
+			if rr.Type == &TypeCNAME {
+				answers = append(answers, rr)
+			}
+		}
+	}
+
+	return answers, nil
+}
+
+type kubeMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type kubePort struct {
+	Name     string `json:"name"`
+	Port     uint16 `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+type kubeService struct {
+	Metadata kubeMeta `json:"metadata"`
+	Spec     struct {
+		Type         string     `json:"type"`
+		ClusterIP    string     `json:"clusterIP"`
+		ExternalName string     `json:"externalName"`
+		Ports        []kubePort `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubeEndpoints struct {
+	Metadata kubeMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses []struct {
+			IP       string `json:"ip"`
+			Hostname string `json:"hostname"`
+		} `json:"addresses"`
+		Ports []kubePort `json:"ports"`
+	} `json:"subsets"`
+}
+
+type kubeList struct {
+	Metadata kubeMeta          `json:"metadata"`
+	Items    []json.RawMessage `json:"items"`
+}
+
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// decodeObject decodes an object of resource and returns it with its key
+func decodeObject(resource string, raw json.RawMessage) (string, interface{}, kubeMeta, error) {
+	var obj interface{}
+	var meta kubeMeta
+
+	switch resource {
+	case "services":
+		svc := kubeService{}
+		if err := json.Unmarshal(raw, &svc); err != nil {
+			return "", nil, meta, err
+		}
+		obj, meta = &svc, svc.Metadata
+	default:
+		ep := kubeEndpoints{}
+		if err := json.Unmarshal(raw, &ep); err != nil {
+			return "", nil, meta, err
+		}
+		obj, meta = &ep, ep.Metadata
+	}
+
+	return meta.Namespace + "/" + meta.Name, obj, meta, nil
+}
+
+// watch keeps the objects of resource up to date until the backend is
+// closed, listing them and then watching for changes from there on
+func (b *KubernetesBackend) watch(resource string) {
+	for {
+		version, err := b.list(resource)
+		for err == nil {
+			version, err = b.watchFrom(resource, version)
+		}
+
+		if b.ctx.Err() != nil {
+			return
+		}
+
+		if err == errWatchExpired {
+			b.log.Debugf("watch of %s expired, listing again", resource)
+			continue
+		}
+
+		b.log.Warnf("error while watching %s: %v", resource, err)
+
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-time.After(kubernetesRetryDelay):
+		}
+	}
+}
+
+// get requests path below /api/v1 with params
+func (b *KubernetesBackend) get(ctx context.Context, path string, params url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.apiURL+"/api/v1/"+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	token := b.token
+	if b.tokenFile != "" {
+		contents, err := ioutil.ReadFile(b.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading token: %v", err)
+		}
+		token = strings.TrimSpace(string(contents))
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxHTTPBackendResponseSize))
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusGone {
+			return nil, errWatchExpired
+		}
+
+		return nil, fmt.Errorf("API server returned %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// list replaces the objects of resource with those listed, and returns the
+// version to watch for changes from
+func (b *KubernetesBackend) list(resource string) (string, error) {
+	ctx, cancel := context.WithTimeout(b.ctx, kubernetesListTimeout)
+	defer cancel()
+
+	resp, err := b.get(ctx, resource, url.Values{})
+	if err != nil {
+		return "", fmt.Errorf("error while listing: %v", err)
+	}
+	defer resp.Body.Close()
+
+	list := kubeList{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", fmt.Errorf("error while decoding list: %v", err)
+	}
+
+	objects := map[string]interface{}{}
+	for _, raw := range list.Items {
+		key, obj, _, err := decodeObject(resource, raw)
+		if err != nil {
+			return "", fmt.Errorf("error while decoding %s: %v", resource, err)
+		}
+
+		objects[key] = obj
+	}
+
+	b.mu.Lock()
+	b.objects[resource] = objects
+	b.listed[resource] = true
+	b.rebuildLocked()
+	b.mu.Unlock()
+
+	b.log.Debugf("listed %d %s at version %s", len(objects), resource, list.Metadata.ResourceVersion)
+
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watchFrom applies the changes to resource after version until the API
+// server ends the watch, and returns the version it got to
+func (b *KubernetesBackend) watchFrom(resource, version string) (string, error) {
+	params := url.Values{}
+	params.Set("watch", "1")
+	params.Set("resourceVersion", version)
+	params.Set("allowWatchBookmarks", "true")
+	params.Set("timeoutSeconds", fmt.Sprint(int(kubernetesWatchTimeout/time.Second)))
+
+	resp, err := b.get(b.ctx, resource, params)
+	if err != nil {
+		return version, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := kubeEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return version, nil
+			}
+
+			return version, fmt.Errorf("error while reading watch event: %v", err)
+		}
+
+		if event.Type == "ERROR" {
+			status := kubeStatus{}
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errWatchExpired
+			}
+
+			return version, fmt.Errorf("watch failed: %s", status.Message)
+		}
+
+		key, obj, meta, err := decodeObject(resource, event.Object)
+		if err != nil {
+			return version, fmt.Errorf("error while decoding %s: %v", resource, err)
+		}
+		version = meta.ResourceVersion
+
+		if event.Type == "BOOKMARK" {
+			continue
+		}
+
+		b.mu.Lock()
+		if event.Type == "DELETED" {
+			delete(b.objects[resource], key)
+		} else {
+			b.objects[resource][key] = obj
+		}
+		b.rebuildLocked()
+		b.mu.Unlock()
+	}
+}
+
+// rebuildLocked recomputes the records served from the objects, once all
+// resources have been listed
+func (b *KubernetesBackend) rebuildLocked() {
+	for _, resource := range kubernetesResources {
+		if !b.listed[resource] {
+			return
+		}
+	}
+
+	names := map[string][]*ResourceRecord{}
+
+	add := func(name string, qtype *QTYPE, value []byte) {
+		name = strings.ToLower(name)
+		for _, rr := range names[name] {
+			if rr.Type == qtype && bytes.Equal(rr.Value, value) {
+				return
+			}
+		}
+
+		names[name] = append(names[name], &ResourceRecord{Name: name, Type: qtype, Class: &ClassIN, TTL: b.ttl, Value: value})
+
+		// names between the record and the domain exist too, without
+		// records of their own
+		for parent := name; parent != b.domain; {
+			i := strings.IndexByte(parent, '.')
+			if i < 0 {
+				break
+			}
+
+			parent = parent[i+1:]
+			if _, ok := names[parent]; !ok {
+				names[parent] = []*ResourceRecord{}
+			}
+		}
+	}
+
+	addAddress := func(name string, ip net.IP) {
+		if ip4 := ip.To4(); ip4 != nil {
+			add(name, &TypeA, ip4)
+		} else if ip != nil {
+			add(name, &TypeAAAA, ip.To16())
+		}
+	}
+
+	// all targets of a service get the same priority and weight
+	addSRV := func(name string, port uint16, target string) {
+		value := make([]byte, 6)
+		binary.BigEndian.PutUint16(value[2:], 10)
+		binary.BigEndian.PutUint16(value[4:], port)
+
+		encoded, err := encodeName(target)
+		if err != nil {
+			b.log.Warnf("error while encoding SRV target %s: %v", target, err)
+			return
+		}
+
+		add(name, &TypeSRV, append(value, encoded...))
+	}
+
+	for key, obj := range b.objects["services"] {
+		svc := obj.(*kubeService)
+		name := svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc." + b.domain
+
+		switch {
+		case svc.Spec.Type == "ExternalName":
+			target, err := encodeName(strings.TrimSuffix(svc.Spec.ExternalName, "."))
+			if err != nil {
+				b.log.Warnf("error while encoding external name of %s: %v", key, err)
+				continue
+			}
+
+			add(name, &TypeCNAME, target)
+		case svc.Spec.ClusterIP != "" && svc.Spec.ClusterIP != "None":
+			addAddress(name, net.ParseIP(svc.Spec.ClusterIP))
+
+			for _, port := range svc.Spec.Ports {
+				if port.Name != "" {
+					addSRV(srvName(port, name), port.Port, name)
+				}
+			}
+		default:
+			// headless services are answered with their endpoints
+			if _, ok := names[name]; !ok {
+				names[name] = []*ResourceRecord{}
+			}
+
+			ep, ok := b.objects["endpoints"][key].(*kubeEndpoints)
+			if !ok {
+				continue
+			}
+
+			for _, subset := range ep.Subsets {
+				for _, addr := range subset.Addresses {
+					ip := net.ParseIP(addr.IP)
+					hostname := addr.Hostname
+					if hostname == "" {
+						hostname = dashedIP(ip)
+					}
+					target := hostname + "." + name
+
+					addAddress(name, ip)
+					addAddress(target, ip)
+
+					for _, port := range subset.Ports {
+						if port.Name != "" {
+							addSRV(srvName(port, name), port.Port, target)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, obj := range b.objects["endpoints"] {
+		ep := obj.(*kubeEndpoints)
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				ip := net.ParseIP(addr.IP)
+				addAddress(dashedIP(ip)+"."+ep.Metadata.Namespace+".pod."+b.domain, ip)
+			}
+		}
+	}
+
+	b.names.Store(names)
+}
+
+// srvName returns the SRV name of a named port of the service called name
+func srvName(port kubePort, name string) string {
+	protocol := port.Protocol
+	if protocol == "" {
+		protocol = "TCP"
+	}
+
+	return "_" + port.Name + "._" + strings.ToLower(protocol) + "." + name
+}
+
+// dashedIP returns ip with its separators replaced by dashes, as pod
+// names have them
+func dashedIP(ip net.IP) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+}
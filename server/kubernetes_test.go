@@ -0,0 +1,159 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testKubeServices = `{"metadata": {"resourceVersion": "10"}, "items": [
+	{"metadata": {"name": "web", "namespace": "default"}, "spec": {"type": "ClusterIP", "clusterIP": "10.96.0.10", "ports": [{"name": "http", "port": 80, "protocol": "TCP"}]}},
+	{"metadata": {"name": "db", "namespace": "default"}, "spec": {"clusterIP": "None", "ports": [{"name": "pg", "port": 5432}]}},
+	{"metadata": {"name": "ext", "namespace": "default"}, "spec": {"type": "ExternalName", "externalName": "example.com"}}
+]}`
+
+const testKubeEndpoints = `{"metadata": {"resourceVersion": "11"}, "items": [
+	{"metadata": {"name": "db", "namespace": "default"}, "subsets": [{
+		"addresses": [{"ip": "10.0.0.1", "hostname": "db-0"}, {"ip": "10.0.0.2"}],
+		"ports": [{"name": "pg", "port": 5432, "protocol": "TCP"}]
+	}]}
+]}`
+
+const testKubeServiceAdded = `{"type": "ADDED", "object": {"metadata": {"name": "cache", "namespace": "apps", "resourceVersion": "12"}, "spec": {"clusterIP": "10.96.0.20"}}}`
+
+// startFakeKubernetes serves the lists above, and a watch of services that
+// adds a service once the test says so
+func startFakeKubernetes(t *testing.T, addService chan struct{}) string {
+	t.Helper()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "" {
+			switch r.URL.Path {
+			case "/api/v1/services":
+				fmt.Fprint(w, testKubeServices)
+			case "/api/v1/endpoints":
+				fmt.Fprint(w, testKubeEndpoints)
+			default:
+				http.NotFound(w, r)
+			}
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		if r.URL.Path == "/api/v1/services" {
+			select {
+			case <-addService:
+				fmt.Fprintln(w, testKubeServiceAdded)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		<-r.Context().Done()
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts.URL
+}
+
+func waitForKubernetesSync(t *testing.T, b *KubernetesBackend, name string) {
+	t.Helper()
+
+	q := Question{Name: name, Type: &TypeA, Class: &ClassIN}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := b.Lookup(&q); err == nil {
+			return
+		}
+	}
+
+	t.Fatalf("%s didn't show up", name)
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	b, err := NewKubernetesBackend(startFakeKubernetes(t, make(chan struct{})))
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	waitForKubernetesSync(t, b, "web.default.svc.cluster.local")
+
+	tests := []struct {
+		name  string
+		qtype *QTYPE
+		want  []string
+	}{
+		{"web.default.svc.cluster.local", &TypeA, []string{"10.96.0.10"}},
+		{"_http._tcp.web.default.svc.cluster.local", &TypeSRV, []string{"0 10 80 web.default.svc.cluster.local."}},
+		{"db.default.svc.cluster.local", &TypeA, []string{"10.0.0.1", "10.0.0.2"}},
+		{"db-0.db.default.svc.cluster.local", &TypeA, []string{"10.0.0.1"}},
+		{"10-0-0-2.db.default.svc.cluster.local", &TypeA, []string{"10.0.0.2"}},
+		{"_pg._tcp.db.default.svc.cluster.local", &TypeSRV, []string{
+			"0 10 5432 db-0.db.default.svc.cluster.local.",
+			"0 10 5432 10-0-0-2.db.default.svc.cluster.local.",
+		}},
+		{"10-0-0-1.default.pod.cluster.local", &TypeA, []string{"10.0.0.1"}},
+		{"ext.default.svc.cluster.local", &TypeA, []string{"example.com."}},
+		{"default.svc.cluster.local", &TypeA, []string{}},
+		{"web.default.svc.cluster.local", &TypeAAAA, []string{}},
+	}
+
+	for _, tt := range tests {
+		records, err := b.Lookup(&Question{Name: tt.name, Type: tt.qtype, Class: &ClassIN})
+		if err != nil {
+			t.Errorf("error while looking up %s %s: %v", tt.name, tt.qtype, err)
+			continue
+		}
+
+		got := []string{}
+		for _, rr := range records {
+			got = append(got, rdataString(rr.Type, rr.Value))
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("expected %v for %s %s, got %v", tt.want, tt.name, tt.qtype, got)
+		}
+	}
+
+	_, err = b.Lookup(&Question{Name: "missing.default.svc.cluster.local", Type: &TypeA, Class: &ClassIN})
+	if err != ErrNameNotFound {
+		t.Errorf("expected ErrNameNotFound for a missing service, got %v", err)
+	}
+}
+
+func TestKubernetesBackendWatch(t *testing.T) {
+	addService := make(chan struct{})
+	b, err := NewKubernetesBackend(startFakeKubernetes(t, addService), WithKubernetesClusterDomain("k8s.example."))
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	waitForKubernetesSync(t, b, "web.default.svc.k8s.example")
+
+	close(addService)
+	waitForKubernetesSync(t, b, "cache.apps.svc.k8s.example")
+}
+
+func TestKubernetesBackendNotSynced(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	t.Cleanup(ts.Close)
+
+	b, err := NewKubernetesBackend(ts.URL, WithKubernetesLogger(NewLogger(ioutil.Discard, LevelError)))
+	if err != nil {
+		t.Fatalf("error while creating backend: %v", err)
+	}
+	t.Cleanup(b.Close)
+
+	if _, err := b.Lookup(&Question{Name: "web.default.svc.cluster.local", Type: &TypeA, Class: &ClassIN}); err == nil || err == ErrNameNotFound {
+		t.Errorf("expected an error before services are listed, got %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+// LogLevel is the severity of a log message
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l LogLevel) String() string {
+	name, ok := logLevelNames[l]
+	if !ok {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+
+	return name
+}
+
+// ParseLogLevel parses a level name such as "debug" or "warn"
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("invalid log level %q", s)
+}
+
+// Logger is what the server reports through. Implementations can scope
+// themselves to a component by also implementing ScopedLogger
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// ScopedLogger is a Logger that can hand out loggers for components of the
+// server, such as "server", "forwarder" or "zone"
+type ScopedLogger interface {
+	Logger
+	Scope(component string) Logger
+}
+
+// scopeLogger returns l scoped to component, if l supports scopes
+func scopeLogger(l Logger, component string) Logger {
+	if scoped, ok := l.(ScopedLogger); ok {
+		return scoped.Scope(component)
+	}
+
+	return l
+}
+
+// LevelLogger is a leveled Logger on top of the standard library's log
+// package, with per-component levels
+type LevelLogger struct {
+	out       *log.Logger
+	component string
+
+	// config is shared between a logger and its scopes
+	config *levelConfig
+}
+
+type levelConfig struct {
+	mu              sync.RWMutex
+	level           LogLevel
+	componentLevels map[string]LogLevel
+}
+
+// NewLogger returns a logger writing messages of level and above to w
+func NewLogger(w io.Writer, level LogLevel) *LevelLogger {
+	return &LevelLogger{
+		out: log.New(w, "", log.LstdFlags),
+		config: &levelConfig{
+			level:           level,
+			componentLevels: map[string]LogLevel{},
+		},
+	}
+}
+
+// defaultLogger is used when no logger is given to the server
+func defaultLogger() *LevelLogger {
+	return NewLogger(os.Stderr, LevelInfo)
+}
+
+// SetLevel sets the level below which messages are dropped
+func (l *LevelLogger) SetLevel(level LogLevel) {
+	l.config.mu.Lock()
+	defer l.config.mu.Unlock()
+
+	l.config.level = level
+}
+
+// SetComponentLevel overrides the level for a single component, e.g. to
+// silence per-query messages of the "server" component in production
+func (l *LevelLogger) SetComponentLevel(component string, level LogLevel) {
+	l.config.mu.Lock()
+	defer l.config.mu.Unlock()
+
+	l.config.componentLevels[component] = level
+}
+
+// Scope returns a logger for component, sharing l's output and levels
+func (l *LevelLogger) Scope(component string) Logger {
+	return &LevelLogger{
+		out:       l.out,
+		component: component,
+		config:    l.config,
+	}
+}
+
+func (l *LevelLogger) enabled(level LogLevel) bool {
+	l.config.mu.RLock()
+	defer l.config.mu.RUnlock()
+
+	min, ok := l.config.componentLevels[l.component]
+	if !ok {
+		min = l.config.level
+	}
+
+	return level >= min
+}
+
+func (l *LevelLogger) logf(level LogLevel, format string, v ...interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	prefix := level.String() + " "
+	if l.component != "" {
+		prefix += l.component + ": "
+	}
+
+	l.out.Output(3, prefix+fmt.Sprintf(format, v...))
+}
+
+func (l *LevelLogger) Debugf(format string, v ...interface{}) {
+	l.logf(LevelDebug, format, v...)
+}
+
+func (l *LevelLogger) Infof(format string, v ...interface{}) {
+	l.logf(LevelInfo, format, v...)
+}
+
+func (l *LevelLogger) Warnf(format string, v ...interface{}) {
+	l.logf(LevelWarn, format, v...)
+}
+
+func (l *LevelLogger) Errorf(format string, v ...interface{}) {
+	l.logf(LevelError, format, v...)
+}
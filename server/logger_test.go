@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLevelLoggerLevels(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := NewLogger(&buf, LevelInfo)
+
+	l.Debugf("debug message")
+	l.Infof("info message")
+	l.Errorf("error message")
+
+	out := buf.String()
+	if strings.Contains(out, "debug message") {
+		t.Errorf("debug message logged at info level: %q", out)
+	}
+
+	if !strings.Contains(out, "INFO info message") || !strings.Contains(out, "ERROR error message") {
+		t.Errorf("expected info and error messages, got %q", out)
+	}
+}
+
+func TestLevelLoggerComponentLevels(t *testing.T) {
+	buf := bytes.Buffer{}
+	l := NewLogger(&buf, LevelDebug)
+	l.SetComponentLevel("server", LevelWarn)
+
+	srvLog := l.Scope("server")
+	fwdLog := l.Scope("forwarder")
+
+	srvLog.Infof("got packet")
+	srvLog.Warnf("error while responding")
+	fwdLog.Debugf("retrying over tcp")
+
+	out := buf.String()
+	if strings.Contains(out, "got packet") {
+		t.Errorf("silenced server component still logged info: %q", out)
+	}
+
+	if !strings.Contains(out, "WARN server: error while responding") {
+		t.Errorf("expected scoped warning, got %q", out)
+	}
+
+	if !strings.Contains(out, "DEBUG forwarder: retrying over tcp") {
+		t.Errorf("expected forwarder debug message, got %q", out)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, err := ParseLogLevel("warn")
+	if err != nil || level != LevelWarn {
+		t.Errorf("ParseLogLevel(\"warn\") = %v, %v", level, err)
+	}
+
+	if _, err := ParseLogLevel("loud"); err == nil {
+		t.Errorf("expected error for unknown level")
+	}
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// checkForwardingLoops returns an error if a forwarder of the server, its own
+// or one of a FORWARD policy rule, has an upstream that is the server itself.
+// Every query it forwarded would come back to be forwarded again, until the
+// upstream query times out
+func (srv *DNSServer) checkForwardingLoops() error {
+	if srv.forwarder != nil {
+		if err := srv.checkForwarderLoops(srv.forwarder, "forwarder"); err != nil {
+			return err
+		}
+	}
+
+	if srv.policy != nil {
+		for _, rule := range srv.policy.rules {
+			if rule.decision.forwarder == nil {
+				continue
+			}
+
+			if err := srv.checkForwarderLoops(rule.decision.forwarder, fmt.Sprintf("FORWARD rule on line %d", rule.line)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (srv *DNSServer) checkForwarderLoops(f *Forwarder, what string) error {
+	tlsAddrs := make([]string, 0, len(srv.tlsListeners))
+	for _, tl := range srv.tlsListeners {
+		tlsAddrs = append(tlsAddrs, withDefaultPort(tl.Addr, "853"))
+	}
+
+	for _, upstream := range f.upstreams {
+		// plain upstreams are asked over UDP and TCP, which the server
+		// listens for on its listen address, DNS over TLS ones could
+		// reach its TLS listeners
+		listenAddrs := []string{srv.laddr}
+		addr := upstream
+		if strings.HasPrefix(upstream, tlsUpstreamPrefix) {
+			listenAddrs = tlsAddrs
+			addr = strings.TrimPrefix(upstream, tlsUpstreamPrefix)
+		}
+
+		for _, listenAddr := range listenAddrs {
+			if loopsBack(addr, listenAddr) {
+				return fmt.Errorf("%s upstream %s is the server's own address %s, queries forwarded to it would loop back", what, upstream, listenAddr)
+			}
+		}
+	}
+
+	return nil
+}
+
+// loopsBack reports whether a query sent to upstream would reach a server
+// listening on listenAddr
+func loopsBack(upstream, listenAddr string) bool {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return false
+	}
+
+	listenHost, listenPort, err := net.SplitHostPort(listenAddr)
+	if err != nil || listenPort == "0" || port != listenPort {
+		return false
+	}
+
+	upstreamIPs := hostIPs(host)
+
+	// a server listening on all addresses is reached through the loopback
+	// addresses and those of every interface
+	if listenHost == "" || net.ParseIP(listenHost).IsUnspecified() {
+		for _, ip := range upstreamIPs {
+			if ip.IsLoopback() || ip.IsUnspecified() || isLocalIP(ip) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for _, ip := range upstreamIPs {
+		// queries to the unspecified address go to the local host
+		if ip.IsUnspecified() {
+			return true
+		}
+
+		for _, listenIP := range hostIPs(listenHost) {
+			if ip.Equal(listenIP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hostIPs returns the addresses of host, which may be an IP address or a
+// hostname. localhost and its subdomains always stand for the loopback
+// addresses (RFC 6761), whatever the resolver says
+func hostIPs(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+
+	// hostnames that don't resolve now can't be told apart from the server
+	ips, _ := net.LookupIP(host)
+	return ips
+}
+
+// isLocalIP reports whether ip is an address of one of the host's interfaces
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkCNAMEChains returns an error describing a cycle of CNAME records in
+// records, if there is one. Resolving any name of a cycle never ends, so
+// they're refused instead of being served
+func checkCNAMEChains(records []*ResourceRecord) error {
+	targets := map[string]string{}
+	for _, rr := range records {
+		if rr.Type != &TypeCNAME {
+			continue
+		}
+
+		target, _, err := readName(rr.Value, 0)
+		if err != nil {
+			return fmt.Errorf("invalid CNAME record for %s: %v", rr.Name, err)
+		}
+
+		targets[strings.ToLower(rr.Name)] = strings.ToLower(target)
+	}
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// state tracks the names of the chain being followed, and those whose
+	// chains were followed to their end without a cycle
+	const (
+		following = 1
+		done      = 2
+	)
+	state := map[string]int{}
+
+	for _, name := range names {
+		chain := []string{}
+		for current := name; ; {
+			if state[current] == done {
+				break
+			}
+
+			if state[current] == following {
+				// the chain from name runs into a cycle, which starts at
+				// the first occurrence of current in it
+				for i, n := range chain {
+					if n == current {
+						chain = append(chain[i:], current)
+						break
+					}
+				}
+
+				return fmt.Errorf("CNAME records loop: %s", strings.Join(chain, " -> "))
+			}
+
+			target, ok := targets[current]
+			if !ok {
+				break
+			}
+
+			state[current] = following
+			chain = append(chain, current)
+			current = target
+		}
+
+		for _, n := range chain {
+			state[n] = done
+		}
+	}
+
+	return nil
+}
+
+// checkCNAMEChainFrom returns an error describing a cycle of CNAME records
+// through name, if there is one. A cycle made by a change runs through the
+// names it gave CNAME records, so those are the only chains it needs to
+// follow, with recordsNamed finding the records of each name on the way
+func checkCNAMEChainFrom(name string, recordsNamed func(string) []*ResourceRecord) error {
+	chain := []string{}
+	seen := map[string]int{}
+	for current := strings.ToLower(name); ; {
+		if i, ok := seen[current]; ok {
+			return fmt.Errorf("CNAME records loop: %s", strings.Join(append(chain[i:], current), " -> "))
+		}
+
+		// like the records of a whole zone, a name with several CNAME
+		// records is followed to the target of the last one
+		target := ""
+		for _, rr := range recordsNamed(current) {
+			if rr.Type != &TypeCNAME {
+				continue
+			}
+
+			t, _, err := readName(rr.Value, 0)
+			if err != nil {
+				return fmt.Errorf("invalid CNAME record for %s: %v", rr.Name, err)
+			}
+			target = strings.ToLower(t)
+		}
+
+		if target == "" {
+			return nil
+		}
+
+		seen[current] = len(chain)
+		chain = append(chain, current)
+		current = target
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoopsBack(t *testing.T) {
+	tests := []struct {
+		upstream string
+		listen   string
+		loops    bool
+	}{
+		{"127.0.0.1:53", "127.0.0.1:53", true},
+		{"localhost:53", "127.0.0.1:53", true},
+		{"[::1]:53", "localhost:53", true},
+		{"0.0.0.0:53", "192.0.2.1:53", true},
+		{"127.0.0.1:53", ":53", true},
+		{"[::1]:53", "0.0.0.0:53", true},
+		{"127.0.0.1:5353", "127.0.0.1:53", false},
+		{"127.0.0.2:53", "127.0.0.1:53", false},
+		{"192.0.2.53:53", ":53", false},
+		{"127.0.0.1:0", "127.0.0.1:0", false},
+	}
+
+	for _, tt := range tests {
+		if got := loopsBack(tt.upstream, tt.listen); got != tt.loops {
+			t.Errorf("loopsBack(%q, %q) = %t, expected %t", tt.upstream, tt.listen, got, tt.loops)
+		}
+	}
+}
+
+func TestNewDNSServerRefusesForwardingToItself(t *testing.T) {
+	f, err := NewForwarder([]string{"192.0.2.53", "localhost:1053"})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	defer f.Close()
+
+	_, err = NewDNSServer("127.0.0.1:1053", "", WithForwarder(f))
+	if err == nil || !strings.Contains(err.Error(), "localhost:1053") {
+		t.Errorf("got error %v, expected forwarding loop through localhost:1053", err)
+	}
+
+	policy, err := ParsePolicy(strings.NewReader(`indomain(qname, "corp") => FORWARD 127.0.0.1:1053`))
+	if err != nil {
+		t.Fatalf("error while parsing policy: %v", err)
+	}
+
+	_, err = NewDNSServer(":1053", "", WithPolicy(policy))
+	if err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("got error %v, expected forwarding loop of the rule on line 1", err)
+	}
+
+	if _, err := NewDNSServer("127.0.0.1:1054", "", WithForwarder(f)); err != nil {
+		t.Errorf("error while creating server forwarding elsewhere: %v", err)
+	}
+}
+
+func TestCheckCNAMEChains(t *testing.T) {
+	cname := func(name, target string) *ResourceRecord {
+		rr, err := NewCNAME(name, 300, target)
+		if err != nil {
+			t.Fatalf("error while creating CNAME record: %v", err)
+		}
+
+		return rr
+	}
+
+	chain := []*ResourceRecord{
+		cname("a.example.com", "b.example.com"),
+		cname("b.example.com", "c.example.com"),
+		cname("d.example.com", "b.example.com"),
+	}
+	if err := checkCNAMEChains(chain); err != nil {
+		t.Errorf("error for records without cycle: %v", err)
+	}
+
+	cyclic := append(chain, cname("C.example.com", "a.example.com"))
+	err := checkCNAMEChains(cyclic)
+	if err == nil || !strings.Contains(err.Error(), "a.example.com -> b.example.com -> c.example.com -> a.example.com") {
+		t.Errorf("got error %v, expected the cycle through a, b and c", err)
+	}
+
+	if err := checkCNAMEChains([]*ResourceRecord{cname("self.example.com", "self.example.com")}); err == nil {
+		t.Errorf("no error for a CNAME to itself")
+	}
+
+	// a change's chains are followed from the names it changed only
+	snap := zoneSnapshot{index: newRecordIndex(cyclic, false)}
+	err = checkCNAMEChainFrom("C.example.com", snap.recordsNamed)
+	if err == nil || !strings.Contains(err.Error(), "c.example.com -> a.example.com -> b.example.com -> c.example.com") {
+		t.Errorf("got error %v, expected the cycle from c through a and b", err)
+	}
+
+	snap = zoneSnapshot{index: newRecordIndex(chain, false)}
+	if err := checkCNAMEChainFrom("d.example.com", snap.recordsNamed); err != nil {
+		t.Errorf("error for a chain without cycle: %v", err)
+	}
+}
+
+func TestAddRecordRefusesCNAMECycle(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	first, _ := NewCNAME("a.kausm.in", 300, "b.kausm.in")
+	if err := srv.AddRecord(first); err != nil {
+		t.Fatalf("error while adding record: %v", err)
+	}
+
+	version := srv.snapshot().version
+
+	second, _ := NewCNAME("b.kausm.in", 300, "a.kausm.in")
+	if err := srv.AddRecord(second); err == nil {
+		t.Errorf("added CNAME record closing a cycle")
+	}
+
+	if srv.snapshot().version != version {
+		t.Errorf("records changed by a refused record")
+	}
+}
@@ -0,0 +1,785 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// maxCompressionPointers bounds how many pointers a single name may
+	// follow, so that pointer loops can't keep the decoder busy
+	maxCompressionPointers = 126
+
+	// maxCompressionOffset is the largest offset a compression pointer can
+	// hold in its 14 bits
+	maxCompressionOffset = 0x3fff
+)
+
+// Message is a complete DNS message. Unlike the server's own encoding, it
+// understands name compression, keeps the case of names as sent and carries
+// records of any type, so it can take apart and put back together messages
+// from any resolver or client
+type Message struct {
+	Header      DNSHeader
+	Questions   []*Question
+	Answers     []*ResourceRecord
+	Nameservers []*ResourceRecord
+	Additionals []*ResourceRecord
+
+	// EDNS is the message's OPT record, which is kept out of Additionals
+	EDNS *EDNS
+}
+
+// ParseMode is how strictly messages are parsed
+type ParseMode int
+
+const (
+	// ParsePermissive accepts what real-world clients and servers send as
+	// long as it can be made sense of: bytes left over after the last record
+	// are ignored, and of several OPT records the first is used
+	ParsePermissive ParseMode = iota
+
+	// ParseStrict rejects messages that are out of spec: trailing bytes,
+	// more than one OPT record, and names with labels that aren't printable
+	// ASCII or that contain dots, which can't be told apart from label
+	// separators once decoded. Bad label lengths and names longer than 255
+	// octets are rejected in both modes
+	ParseStrict
+)
+
+func (m ParseMode) String() string {
+	if m == ParseStrict {
+		return "strict"
+	}
+
+	return "permissive"
+}
+
+// DecodeMessage parses a DNS message in wire format strictly, see
+// DecodeMessageMode
+func DecodeMessage(buf []byte) (*Message, error) {
+	return DecodeMessageMode(buf, ParseStrict)
+}
+
+// DecodeMessageMode parses a DNS message in wire format with the given
+// parse mode. Compressed names, also inside the RDATA of the RFC 1035 types
+// that allow it, are expanded, so the records' Values are in the same
+// uncompressed form the rest of the server uses
+func DecodeMessageMode(buf []byte, mode ParseMode) (*Message, error) {
+	if len(buf) < 12 {
+		return nil, errors.New("message shorter than its header")
+	}
+
+	m := Message{}
+	if err := m.Header.ReadFrom(buf); err != nil {
+		return nil, fmt.Errorf("error while reading header: %v", err)
+	}
+
+	questions, off, err := readQuestions(buf, 12, int(m.Header.QuestionsCount), mode)
+	if err != nil {
+		return nil, err
+	}
+	m.Questions = questions
+
+	sections := []struct {
+		count   uint16
+		records *[]*ResourceRecord
+	}{
+		{m.Header.AnswersCount, &m.Answers},
+		{m.Header.NameserversCount, &m.Nameservers},
+		{m.Header.AdditionalRecordsCount, &m.Additionals},
+	}
+
+	for _, section := range sections {
+		for i := 0; i < int(section.count); i++ {
+			if mode == ParseStrict {
+				labels, _, err := readLabels(buf, off)
+				if err == nil {
+					err = checkStrictLabels(labels)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("error while reading record: %v", err)
+				}
+			}
+
+			rr, edns, n, err := readRecord(buf, off)
+			if err != nil {
+				return nil, fmt.Errorf("error while reading record: %v", err)
+			}
+			off = n
+
+			if edns != nil {
+				if m.EDNS != nil {
+					if mode == ParseStrict {
+						return nil, errors.New("message has more than one OPT record")
+					}
+
+					continue
+				}
+
+				m.EDNS = edns
+				continue
+			}
+
+			*section.records = append(*section.records, rr)
+		}
+	}
+
+	if off != len(buf) && mode == ParseStrict {
+		return nil, fmt.Errorf("%d bytes left over after the last record", len(buf)-off)
+	}
+
+	return &m, nil
+}
+
+// readQuestions reads count questions starting at off in msg with the given
+// parse mode, and returns them along with the offset right after them. Types
+// and classes without a definition get made up QTYPEs and QCLASSes, as they
+// are valid in either mode
+func readQuestions(msg []byte, off, count int, mode ParseMode) ([]*Question, int, error) {
+	questions := make([]*Question, 0, count)
+	for i := 0; i < count; i++ {
+		labels, n, err := readLabels(msg, off)
+		if err == nil && mode == ParseStrict {
+			err = checkStrictLabels(labels)
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("error while reading question %d: %v", i+1, err)
+		}
+
+		if len(msg) < n+4 {
+			return nil, 0, fmt.Errorf("error while reading question %d: question runs past end of buffer", i+1)
+		}
+
+		questions = append(questions, &Question{
+			Name:  strings.Join(labels, "."),
+			Type:  qtypeForCode(binary.BigEndian.Uint16(msg[n:])),
+			Class: qclassForCode(binary.BigEndian.Uint16(msg[n+2:])),
+		})
+		off = n + 4
+	}
+
+	return questions, off, nil
+}
+
+// checkStrictLabels checks that labels only hold printable ASCII other than
+// dots
+func checkStrictLabels(labels []string) error {
+	for _, label := range labels {
+		for i := 0; i < len(label); i++ {
+			if c := label[i]; c <= ' ' || c >= 0x7f || c == '.' {
+				return fmt.Errorf("label %q has out of spec character 0x%02x", label, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// readName reads a possibly compressed name starting at off in msg, and
+// returns it along with the offset right after it
+func readName(msg []byte, off int) (string, int, error) {
+	labels, end, err := readLabels(msg, off)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return strings.Join(labels, "."), end, nil
+}
+
+// readLabels reads the labels of a possibly compressed name starting at off
+// in msg, and returns them along with the offset right after the name
+func readLabels(msg []byte, off int) ([]string, int, error) {
+	labels := []string{}
+	end := -1
+	pointers := 0
+	nameLen := 0
+
+	for {
+		if off >= len(msg) {
+			return nil, 0, errors.New("name runs past end of buffer")
+		}
+
+		labelLen := int(msg[off])
+		switch labelLen & 0xc0 {
+		case 0x00:
+			if labelLen == 0 {
+				if end < 0 {
+					end = off + 1
+				}
+
+				return labels, end, nil
+			}
+
+			if off+1+labelLen > len(msg) {
+				return nil, 0, errors.New("label runs past end of buffer")
+			}
+
+			nameLen += labelLen + 1
+			if nameLen > 255 {
+				return nil, 0, errors.New("name longer than 255 octets")
+			}
+
+			labels = append(labels, string(msg[off+1:off+1+labelLen]))
+			off += 1 + labelLen
+		case 0xc0:
+			if off+2 > len(msg) {
+				return nil, 0, errors.New("compression pointer runs past end of buffer")
+			}
+
+			if end < 0 {
+				end = off + 2
+			}
+
+			pointers++
+			if pointers > maxCompressionPointers {
+				return nil, 0, errors.New("too many compression pointers")
+			}
+
+			target := int(binary.BigEndian.Uint16(msg[off:]) & maxCompressionOffset)
+			if target >= off {
+				// only pointing backwards rules out loops
+				return nil, 0, errors.New("compression pointer does not point backwards")
+			}
+			off = target
+		default:
+			return nil, 0, fmt.Errorf("unsupported label type 0x%02x", labelLen&0xc0)
+		}
+	}
+}
+
+// readRecord reads the record at off in msg. OPT records are returned as EDNS
+// instead of a ResourceRecord
+func readRecord(msg []byte, off int) (*ResourceRecord, *EDNS, int, error) {
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	if len(msg) < off+10 {
+		return nil, nil, 0, errors.New("resource record runs past end of buffer")
+	}
+
+	qtype := qtypeForCode(binary.BigEndian.Uint16(msg[off:]))
+	class := binary.BigEndian.Uint16(msg[off+2:])
+	ttl := binary.BigEndian.Uint32(msg[off+4:])
+	rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+
+	if len(msg) < off+rdlen {
+		return nil, nil, 0, errors.New("rdata runs past end of buffer")
+	}
+
+	if qtype == &TypeOPT {
+		// reuse the OPT parsing of the server, which only needs the fixed
+		// part of the record
+		rr := append([]byte{0}, msg[off-10:off+rdlen]...)
+		edns, err := ReadEDNSFrom(rr, 1)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		return nil, edns, off + rdlen, nil
+	}
+
+	value, err := expandRData(qtype, msg, off, rdlen)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("error while reading %s rdata of %s: %v", qtype, name, err)
+	}
+
+	rr := ResourceRecord{
+		Name:  name,
+		Type:  qtype,
+		Class: qclassForCode(class),
+		TTL:   ttl,
+		Value: value,
+	}
+
+	return &rr, nil, off + rdlen, nil
+}
+
+// rdataLayout describes the RDATA of the types whose names may be
+// compressed, see RFC 3597 section 4: nameCount names followed by
+// fixed-length fields, with prefixLen octets before the first name
+type rdataLayout struct {
+	prefixLen int
+	nameCount int
+}
+
+var compressibleRData = map[*QTYPE]rdataLayout{
+	&TypeNS:    {nameCount: 1},
+	&TypeMD:    {nameCount: 1},
+	&TypeMF:    {nameCount: 1},
+	&TypeCNAME: {nameCount: 1},
+	&TypePTR:   {nameCount: 1},
+	&TypeSOA:   {nameCount: 2},
+	&TypeMINFO: {nameCount: 2},
+	&TypeMX:    {prefixLen: 2, nameCount: 1},
+}
+
+// expandRData returns a copy of the rdlen octets of RDATA at off in msg, with
+// compressed names expanded
+func expandRData(qtype *QTYPE, msg []byte, off, rdlen int) ([]byte, error) {
+	end := off + rdlen
+
+	layout, ok := compressibleRData[qtype]
+	if !ok {
+		return append([]byte{}, msg[off:end]...), nil
+	}
+
+	if rdlen < layout.prefixLen {
+		return nil, errors.New("rdata too short")
+	}
+
+	value := append([]byte{}, msg[off:off+layout.prefixLen]...)
+	off += layout.prefixLen
+
+	for i := 0; i < layout.nameCount; i++ {
+		name, n, err := readName(msg[:end], off)
+		if err != nil {
+			return nil, err
+		}
+		off = n
+
+		value = appendName(value, name, nil)
+	}
+
+	return append(value, msg[off:end]...), nil
+}
+
+// appendName appends name to buf. When compression is non-nil, the name is
+// compressed against the names seen so far, and its own suffixes are
+// remembered for the names that follow. Like most servers, only identical
+// suffixes are compressed, so a message decodes and re-encodes to the same
+// bytes
+func appendName(buf []byte, name string, compression map[string]int) []byte {
+	name = strings.TrimSuffix(name, ".")
+
+	for name != "" {
+		if compression != nil {
+			if ptr, ok := compression[name]; ok {
+				return append(buf, byte(0xc0|ptr>>8), byte(ptr))
+			}
+
+			if len(buf) <= maxCompressionOffset {
+				compression[name] = len(buf)
+			}
+		}
+
+		label := name
+		name = ""
+		if i := strings.IndexByte(label, '.'); i >= 0 {
+			label, name = label[:i], label[i+1:]
+		}
+
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+
+	return append(buf, 0)
+}
+
+// validateName checks that name fits in the wire format
+func validateName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > 253 {
+		return errors.New("domain name cannot be longer than 255 octets")
+	}
+
+	if name == "" {
+		return nil
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("empty label in %q", name)
+		}
+
+		if len(label) > 63 {
+			return errors.New("label cannot be longer than 63 characters")
+		}
+	}
+
+	return nil
+}
+
+// EstimateSize returns the size of m in wire format, with names compressed
+// the way Encode does it or written out in full the way the server encodes
+// its responses, without encoding the message
+func (m *Message) EstimateSize(compress bool) int {
+	var compression map[string]int
+	if compress {
+		compression = map[string]int{}
+	}
+
+	size := 12
+
+	for _, q := range m.Questions {
+		size += compressedNameLen(q.Name, compression, size) + 4
+	}
+
+	for _, section := range [][]*ResourceRecord{m.Answers, m.Nameservers, m.Additionals} {
+		for _, rr := range section {
+			size += compressedRecordLen(rr, compression, size)
+		}
+	}
+
+	if m.EDNS != nil {
+		size += m.EDNS.Len()
+	}
+
+	return size
+}
+
+// compressedNameLen returns how many octets appendName writes for name at
+// offset off, and like appendName remembers its suffixes in compression
+func compressedNameLen(name string, compression map[string]int, off int) int {
+	name = strings.TrimSuffix(name, ".")
+
+	n := 0
+	for name != "" {
+		if compression != nil {
+			if _, ok := compression[name]; ok {
+				return n + 2
+			}
+
+			if off+n <= maxCompressionOffset {
+				compression[name] = off + n
+			}
+		}
+
+		label := name
+		name = ""
+		if i := strings.IndexByte(label, '.'); i >= 0 {
+			label, name = label[:i], label[i+1:]
+		}
+
+		n += 1 + len(label)
+	}
+
+	return n + 1
+}
+
+// compressedRecordLen returns how many octets appendRecord writes for rr at
+// offset off
+func compressedRecordLen(rr *ResourceRecord, compression map[string]int, off int) int {
+	if compression == nil {
+		return rr.Len()
+	}
+
+	n := compressedNameLen(rr.Name, compression, off) + 10
+
+	layout, ok := compressibleRData[rr.Type]
+	if !ok || len(rr.Value) < layout.prefixLen {
+		return n + len(rr.Value)
+	}
+
+	n += layout.prefixLen
+	valueOff := layout.prefixLen
+
+	for i := 0; i < layout.nameCount; i++ {
+		name, next, err := readName(rr.Value, valueOff)
+		if err != nil {
+			// Encode fails on these, the estimate can only be rough
+			return n + len(rr.Value) - valueOff
+		}
+		valueOff = next
+
+		n += compressedNameLen(name, compression, off+n)
+	}
+
+	return n + len(rr.Value) - valueOff
+}
+
+// Encode returns m in wire format with names compressed. The section counts
+// in the header are taken from the sections themselves
+func (m *Message) Encode() ([]byte, error) {
+	headers := m.Header
+	headers.QuestionsCount = uint16(len(m.Questions))
+	headers.AnswersCount = uint16(len(m.Answers))
+	headers.NameserversCount = uint16(len(m.Nameservers))
+	headers.AdditionalRecordsCount = uint16(len(m.Additionals))
+	if m.EDNS != nil {
+		headers.AdditionalRecordsCount++
+	}
+
+	buf := make([]byte, 12, maxUDPMessageSize)
+	headers.Encode(buf)
+
+	compression := map[string]int{}
+
+	for _, q := range m.Questions {
+		if err := validateName(q.Name); err != nil {
+			return nil, fmt.Errorf("error while encoding question: %v", err)
+		}
+
+		buf = appendName(buf, q.Name, compression)
+		buf = append(buf, q.Type.Value...)
+		buf = append(buf, q.Class.Value...)
+	}
+
+	for _, section := range [][]*ResourceRecord{m.Answers, m.Nameservers, m.Additionals} {
+		for _, rr := range section {
+			var err error
+			buf, err = appendRecord(buf, rr, compression)
+			if err != nil {
+				return nil, fmt.Errorf("error while encoding %s record of %s: %v", rr.Type, rr.Name, err)
+			}
+		}
+	}
+
+	if m.EDNS != nil {
+		opt := make([]byte, m.EDNS.Len())
+		if _, err := m.EDNS.Encode(opt); err != nil {
+			return nil, fmt.Errorf("error while encoding OPT record: %v", err)
+		}
+
+		buf = append(buf, opt...)
+	}
+
+	if len(buf) > maxDatagramSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", len(buf))
+	}
+
+	return buf, nil
+}
+
+func appendRecord(buf []byte, rr *ResourceRecord, compression map[string]int) ([]byte, error) {
+	if err := validateName(rr.Name); err != nil {
+		return nil, err
+	}
+
+	buf = appendName(buf, rr.Name, compression)
+	buf = append(buf, rr.Type.Value...)
+	buf = append(buf, rr.Class.Value...)
+	buf = append(buf, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[len(buf)-6:], rr.TTL)
+
+	start := len(buf)
+
+	layout, ok := compressibleRData[rr.Type]
+	if !ok {
+		buf = append(buf, rr.Value...)
+	} else {
+		if len(rr.Value) < layout.prefixLen {
+			return nil, errors.New("rdata too short")
+		}
+
+		buf = append(buf, rr.Value[:layout.prefixLen]...)
+		off := layout.prefixLen
+
+		for i := 0; i < layout.nameCount; i++ {
+			name, n, err := readName(rr.Value, off)
+			if err != nil {
+				return nil, err
+			}
+			off = n
+
+			buf = appendName(buf, name, compression)
+		}
+
+		buf = append(buf, rr.Value[off:]...)
+	}
+
+	rdlen := len(buf) - start
+	if rdlen > 0xffff {
+		return nil, errors.New("rdata longer than 65535 octets")
+	}
+	binary.BigEndian.PutUint16(buf[start-2:], uint16(rdlen))
+
+	return buf, nil
+}
+
+var opCodeNames = map[OpCode]string{
+	QueryOp:  "QUERY",
+	IQueryOp: "IQUERY",
+	StatusOp: "STATUS",
+}
+
+func (o OpCode) String() string {
+	name, ok := opCodeNames[o]
+	if !ok {
+		return fmt.Sprintf("OPCODE%d", uint8(o))
+	}
+
+	return name
+}
+
+// String formats m the way dig prints messages
+func (m *Message) String() string {
+	h := m.Header
+	sb := strings.Builder{}
+
+	fmt.Fprintf(&sb, ";; opcode: %s, status: %s, id: %d\n", h.OpCode, h.ResponseCode, h.ID)
+
+	flags := []string{}
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{
+		{h.Type == QRResponse, "qr"},
+		{h.IsAuthoritative, "aa"},
+		{h.IsTruncated, "tc"},
+		{h.RecursionDesired, "rd"},
+		{h.RecursionAvailable, "ra"},
+		{h.AuthenticData, "ad"},
+		{h.CheckingDisabled, "cd"},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+
+	additionals := len(m.Additionals)
+	if m.EDNS != nil {
+		additionals++
+	}
+
+	fmt.Fprintf(&sb, ";; flags: %s; QUERY: %d, ANSWER: %d, AUTHORITY: %d, ADDITIONAL: %d\n",
+		strings.Join(flags, " "), len(m.Questions), len(m.Answers), len(m.Nameservers), additionals)
+
+	if e := m.EDNS; e != nil {
+		sb.WriteString("\n;; OPT PSEUDOSECTION:\n")
+
+		ednsFlags := ""
+		if e.DNSSECOK {
+			ednsFlags = " do"
+		}
+		fmt.Fprintf(&sb, "; EDNS: version: %d, flags:%s; udp: %d\n", e.Version, ednsFlags, e.UDPSize)
+
+		for _, opt := range e.Options {
+			fmt.Fprintf(&sb, "; OPT=%d: %s\n", opt.Code, hex.EncodeToString(opt.Data))
+		}
+	}
+
+	if len(m.Questions) > 0 {
+		sb.WriteString("\n;; QUESTION SECTION:\n")
+		for _, q := range m.Questions {
+			fmt.Fprintf(&sb, ";%s\t%s\t%s\n", presentationName(q.Name), q.Class, q.Type)
+		}
+	}
+
+	for _, section := range []struct {
+		title   string
+		records []*ResourceRecord
+	}{
+		{"ANSWER", m.Answers},
+		{"AUTHORITY", m.Nameservers},
+		{"ADDITIONAL", m.Additionals},
+	} {
+		if len(section.records) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&sb, "\n;; %s SECTION:\n", section.title)
+		for _, rr := range section.records {
+			fmt.Fprintf(&sb, "%s\t%d\t%s\t%s\t%s\n", presentationName(rr.Name), rr.TTL, rr.Class, rr.Type, rdataString(rr.Type, rr.Value))
+		}
+	}
+
+	return sb.String()
+}
+
+func presentationName(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// rdataString formats RDATA in zone file syntax, falling back to the generic
+// syntax of RFC 3597 for types it doesn't know and malformed RDATA
+func rdataString(qtype *QTYPE, value []byte) string {
+	generic := fmt.Sprintf("\\# %d %s", len(value), hex.EncodeToString(value))
+
+	switch qtype {
+	case &TypeA:
+		if len(value) == net.IPv4len {
+			return net.IP(value).String()
+		}
+	case &TypeAAAA:
+		if len(value) == net.IPv6len {
+			return net.IP(value).String()
+		}
+	case &TypeNS, &TypeMD, &TypeMF, &TypeCNAME, &TypePTR:
+		name, n, err := readName(value, 0)
+		if err == nil && n == len(value) {
+			return presentationName(name)
+		}
+	case &TypeMX:
+		if len(value) < 3 {
+			return generic
+		}
+
+		name, n, err := readName(value, 2)
+		if err == nil && n == len(value) {
+			return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(value), presentationName(name))
+		}
+	case &TypeSRV:
+		if len(value) < 7 {
+			return generic
+		}
+
+		target, n, err := readName(value, 6)
+		if err == nil && n == len(value) {
+			return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(value), binary.BigEndian.Uint16(value[2:]),
+				binary.BigEndian.Uint16(value[4:]), presentationName(target))
+		}
+	case &TypeSOA:
+		mname, n, err := readName(value, 0)
+		if err != nil {
+			return generic
+		}
+
+		rname, n, err := readName(value, n)
+		if err != nil || len(value)-n != 20 {
+			return generic
+		}
+
+		fields := value[n:]
+		return fmt.Sprintf("%s %s %d %d %d %d %d", presentationName(mname), presentationName(rname),
+			binary.BigEndian.Uint32(fields), binary.BigEndian.Uint32(fields[4:]), binary.BigEndian.Uint32(fields[8:]),
+			binary.BigEndian.Uint32(fields[12:]), binary.BigEndian.Uint32(fields[16:]))
+	case &TypeTXT:
+		strs := []string{}
+		for rest := value; len(rest) > 0; {
+			strLen := int(rest[0])
+			if 1+strLen > len(rest) {
+				return generic
+			}
+
+			strs = append(strs, quoteCharacterString(rest[1:1+strLen]))
+			rest = rest[1+strLen:]
+		}
+
+		if len(strs) > 0 {
+			return strings.Join(strs, " ")
+		}
+	}
+
+	return generic
+}
+
+// quoteCharacterString formats a <character-string> as a quoted zone file
+// string
+func quoteCharacterString(s []byte) string {
+	sb := strings.Builder{}
+	sb.WriteByte('"')
+
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&sb, "\\%03d", c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	sb.WriteByte('"')
+
+	return sb.String()
+}
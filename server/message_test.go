@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// readHexPacket reads a packet written as hex, ignoring whitespace and lines
+// starting with #
+func readHexPacket(t *testing.T, path string) []byte {
+	t.Helper()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error while reading %s: %v", path, err)
+	}
+
+	digits := strings.Builder{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		digits.WriteString(strings.Join(strings.Fields(line), ""))
+	}
+
+	packet, err := hex.DecodeString(digits.String())
+	if err != nil {
+		t.Fatalf("error while decoding %s: %v", path, err)
+	}
+
+	return packet
+}
+
+func TestWireCorpus(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "wire", "*.hex"))
+	if err != nil {
+		t.Fatalf("error while listing corpus: %v", err)
+	}
+
+	if len(paths) == 0 {
+		t.Fatalf("no packets in testdata/wire")
+	}
+
+	for _, path := range paths {
+		path := path
+		name := strings.TrimSuffix(filepath.Base(path), ".hex")
+
+		t.Run(name, func(t *testing.T) {
+			packet := readHexPacket(t, path)
+
+			m, err := DecodeMessage(packet)
+			if err != nil {
+				t.Fatalf("error while decoding: %v", err)
+			}
+
+			goldenPath := strings.TrimSuffix(path, ".hex") + ".golden"
+			if *updateGolden {
+				if err := ioutil.WriteFile(goldenPath, []byte(m.String()), 0644); err != nil {
+					t.Fatalf("error while writing %s: %v", goldenPath, err)
+				}
+			}
+
+			golden, err := ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("error while reading golden file: %v", err)
+			}
+
+			if got := m.String(); got != string(golden) {
+				t.Errorf("decoded message differs from %s\ngot:\n%s\nexpected:\n%s", goldenPath, got, golden)
+			}
+
+			if size := m.EstimateSize(true); size != len(packet) {
+				t.Errorf("estimated %d bytes with compression, message has %d", size, len(packet))
+			}
+
+			headers := m.Header
+			uncompressed, err := encodeMessage(&headers, m.Questions, m.Answers, m.Nameservers, m.Additionals, m.EDNS)
+			if err != nil {
+				t.Fatalf("error while encoding without compression: %v", err)
+			}
+
+			if size := m.EstimateSize(false); size != len(uncompressed) {
+				t.Errorf("estimated %d bytes without compression, encoded %d", size, len(uncompressed))
+			}
+
+			encoded, err := m.Encode()
+			if err != nil {
+				t.Fatalf("error while encoding: %v", err)
+			}
+
+			if !bytes.Equal(encoded, packet) {
+				t.Errorf("re-encoded message differs from the original\ngot:      %x\nexpected: %x", encoded, packet)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageRejectsPointerLoops(t *testing.T) {
+	packet := []byte{
+		0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// a name that points at itself
+		0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01,
+	}
+
+	if _, err := DecodeMessage(packet); err == nil {
+		t.Errorf("expected a self referencing name to be rejected")
+	}
+
+	// a pointer to a later pointer back to the first
+	packet = append(packet[:12:12], 0xc0, 0x0e, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01)
+	if _, err := DecodeMessage(packet); err == nil {
+		t.Errorf("expected a pointer loop to be rejected")
+	}
+}
+
+func TestDecodeMessageKeepsServerRecords(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	q := Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}
+	resp, err := srv.handleQuery(encodeTestQuery(t, 7, &q), nil, true)
+	if err != nil {
+		t.Fatalf("error while handling query: %v", err)
+	}
+
+	m, err := DecodeMessage(resp)
+	if err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if len(m.Answers) != 1 || m.Answers[0].Type != &TypeA || m.Answers[0].Name != q.Name {
+		t.Fatalf("expected the A record of %s, got %v", q.Name, m.Answers)
+	}
+
+	// compressing the server's uncompressed response only makes it smaller
+	encoded, err := m.Encode()
+	if err != nil {
+		t.Fatalf("error while encoding: %v", err)
+	}
+
+	if len(encoded) >= len(resp) {
+		t.Errorf("expected compression to shrink the response, got %d bytes from %d", len(encoded), len(resp))
+	}
+}
+
+func TestDecodeMessageModes(t *testing.T) {
+	header := []byte{0x00, 0x01, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	question := []byte{0x04, 't', 'e', 's', 't', 0x00, 0x00, 0x01, 0x00, 0x01}
+	opt := []byte{0x00, 0x00, 0x29, 0x04, 0xd0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+	withAdditionals := func(n byte, rest ...[]byte) []byte {
+		packet := append([]byte(nil), header...)
+		packet[11] = n
+		for _, part := range rest {
+			packet = append(packet, part...)
+		}
+
+		return packet
+	}
+
+	for _, tc := range []struct {
+		name       string
+		packet     []byte
+		permissive bool
+	}{
+		{"trailing bytes", withAdditionals(0, question, []byte{0xde, 0xad}), true},
+		{"two OPT records", withAdditionals(2, question, opt, opt), true},
+		{"dot in a label", withAdditionals(0, []byte{0x03, 'a', '.', 'b', 0x00, 0x00, 0x01, 0x00, 0x01}), true},
+		{"control character in a label", withAdditionals(0, []byte{0x02, 'a', 0x07, 0x00, 0x00, 0x01, 0x00, 0x01}), true},
+		{"bad label length", withAdditionals(0, []byte{0x44, 'a', 0x00, 0x00, 0x01, 0x00, 0x01}), false},
+	} {
+		if _, err := DecodeMessageMode(tc.packet, ParseStrict); err == nil {
+			t.Errorf("%s: expected strict parsing to fail", tc.name)
+		}
+
+		_, err := DecodeMessageMode(tc.packet, ParsePermissive)
+		if tc.permissive && err != nil {
+			t.Errorf("%s: expected permissive parsing to succeed, got %v", tc.name, err)
+		}
+		if !tc.permissive && err == nil {
+			t.Errorf("%s: expected permissive parsing to fail", tc.name)
+		}
+	}
+
+	m, err := DecodeMessageMode(withAdditionals(0, question), ParseStrict)
+	if err != nil || len(m.Questions) != 1 || m.Questions[0].Name != "test" {
+		t.Errorf("expected a well formed query to parse strictly, got %v, %v", m, err)
+	}
+}
+
+func TestStrictServerAnswersFormatError(t *testing.T) {
+	q := Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}
+	query := append(encodeTestQuery(t, 7, &q), 0xde, 0xad)
+
+	for _, tc := range []struct {
+		mode  ParseMode
+		rcode ResponseCode
+	}{
+		{ParsePermissive, NoError},
+		{ParseStrict, FormatError},
+	} {
+		srv, _ := NewDNSServer("", "", WithParseMode(tc.mode))
+
+		resp, err := srv.handleQuery(query, nil, true)
+		if err != nil {
+			t.Fatalf("%s: error while handling query: %v", tc.mode, err)
+		}
+
+		headers := DNSHeader{}
+		if err := headers.ReadFrom(resp); err != nil {
+			t.Fatalf("%s: error while reading response header: %v", tc.mode, err)
+		}
+
+		if headers.ID != 7 || headers.ResponseCode != tc.rcode {
+			t.Errorf("%s: expected %s for query 7, got %s for query %d", tc.mode, tc.rcode, headers.ResponseCode, headers.ID)
+		}
+	}
+}
+
+func TestServerDecodesQuestionsInEitherMode(t *testing.T) {
+	unknown := Question{Name: "www.example.com", Type: qtypeForCode(257), Class: qclassForCode(42)}
+	malformed := append(encodeTestQuery(t, 9, &Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN})[:12], 0x44, 'a', 0x00, 0x00, 0x01, 0x00, 0x01)
+
+	for _, mode := range []ParseMode{ParsePermissive, ParseStrict} {
+		srv, _ := NewDNSServer("", "", WithParseMode(mode))
+
+		for _, tc := range []struct {
+			name  string
+			query []byte
+			rcode ResponseCode
+		}{
+			// a CAA question of an unknown class is in spec, and is answered
+			{"unknown type and class", encodeTestQuery(t, 9, &unknown), NoError},
+			{"bad label length", malformed, FormatError},
+		} {
+			resp, err := srv.handleQuery(tc.query, nil, true)
+			if err != nil {
+				t.Fatalf("%s, %s: error while handling query: %v", mode, tc.name, err)
+			}
+
+			headers := DNSHeader{}
+			if err := headers.ReadFrom(resp); err != nil {
+				t.Fatalf("%s, %s: error while reading response header: %v", mode, tc.name, err)
+			}
+
+			if headers.ID != 9 || headers.ResponseCode != tc.rcode {
+				t.Errorf("%s, %s: expected %s, got %s", mode, tc.name, tc.rcode, headers.ResponseCode)
+			}
+		}
+	}
+}
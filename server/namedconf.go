@@ -0,0 +1,385 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// maxNamedConfIncludes bounds how deeply include statements may nest, so
+// that a file including itself doesn't recurse forever
+const maxNamedConfIncludes = 16
+
+// NamedConfig is what this server understands of a BIND named.conf, to ease
+// migrating from BIND:
+//
+//	options {
+//	    directory "/var/named";
+//	    forwarders { 192.0.2.53; 192.0.2.54 port 5353; };
+//	};
+//
+//	zone "example.com" {
+//	    type master;
+//	    file "db.example.com";
+//	    allow-transfer { 192.0.2.2; };
+//	};
+//
+// Master (primary) zones are loaded from their files, and the global
+// forwarders become the server's forwarder. Slave (secondary) zones and
+// allow-transfer lists are read but have no counterpart, since the server
+// doesn't do zone transfers; they are reported in Warnings. Everything else
+// is skipped
+type NamedConfig struct {
+	// Directory is what relative zone file paths are relative to, the
+	// directory of named.conf by default. A relative directory is taken to
+	// be relative to named.conf too
+	Directory string
+
+	Forwarders []string
+	Zones      []NamedZone
+
+	// Warnings are the parts of the configuration that were not carried
+	// over
+	Warnings []string
+}
+
+// NamedZone is a zone declaration of named.conf
+type NamedZone struct {
+	Name string
+
+	// Type is master or slave, the newer primary and secondary are read as
+	// these
+	Type string
+
+	File          string
+	Masters       []string
+	AllowTransfer []string
+}
+
+// namedStatement is a statement of named.conf: a keyword, its arguments and
+// optionally a block of statements, like
+//
+//	zone "example.com" IN { type master; };
+type namedStatement struct {
+	line    int
+	keyword string
+	args    []string
+	block   []*namedStatement
+}
+
+// LoadNamedConf reads the named.conf at path, following its includes
+func LoadNamedConf(path string) (*NamedConfig, error) {
+	statements, err := readNamedConf(path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	c := NamedConfig{}
+	for _, stmt := range statements {
+		switch stmt.keyword {
+		case "options":
+			c.readOptions(stmt)
+		case "zone":
+			if err := c.readZone(stmt); err != nil {
+				return nil, fmt.Errorf("line %d: %v", stmt.line, err)
+			}
+		default:
+			c.warnf("line %d: %s statement skipped", stmt.line, stmt.keyword)
+		}
+	}
+
+	if !filepath.IsAbs(c.Directory) {
+		// an empty directory joins to the directory of named.conf
+		c.Directory = filepath.Join(filepath.Dir(path), c.Directory)
+	}
+
+	for i, zone := range c.Zones {
+		if zone.File != "" && !filepath.IsAbs(zone.File) {
+			c.Zones[i].File = filepath.Join(c.Directory, zone.File)
+		}
+	}
+
+	return &c, nil
+}
+
+func readNamedConf(path string, depth int) ([]*namedStatement, error) {
+	if depth > maxNamedConfIncludes {
+		return nil, fmt.Errorf("includes nested more than %d deep", maxNamedConfIncludes)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading named.conf: %v", err)
+	}
+
+	tokens, err := tokenizeNamedConf(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	statements, rest, err := parseNamedStatements(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%s: line %d: unexpected }", path, rest[0].line)
+	}
+
+	expanded := []*namedStatement{}
+	for _, stmt := range statements {
+		if stmt.keyword != "include" {
+			expanded = append(expanded, stmt)
+			continue
+		}
+
+		if len(stmt.args) != 1 {
+			return nil, fmt.Errorf("%s: line %d: include takes a file", path, stmt.line)
+		}
+
+		included := stmt.args[0]
+		if !filepath.IsAbs(included) {
+			included = filepath.Join(filepath.Dir(path), included)
+		}
+
+		includedStatements, err := readNamedConf(included, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		expanded = append(expanded, includedStatements...)
+	}
+
+	return expanded, nil
+}
+
+func (c *NamedConfig) warnf(format string, args ...interface{}) {
+	c.Warnings = append(c.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (c *NamedConfig) readOptions(options *namedStatement) {
+	for _, stmt := range options.block {
+		switch stmt.keyword {
+		case "directory":
+			if len(stmt.args) == 1 {
+				c.Directory = stmt.args[0]
+			}
+		case "forwarders":
+			c.Forwarders = namedAddresses(stmt)
+		case "allow-transfer":
+			c.warnf("line %d: allow-transfer ignored, zone transfers are not supported", stmt.line)
+		default:
+			c.warnf("line %d: option %s skipped", stmt.line, stmt.keyword)
+		}
+	}
+}
+
+func (c *NamedConfig) readZone(stmt *namedStatement) error {
+	if len(stmt.args) == 0 {
+		return errors.New("zone without a name")
+	}
+
+	if len(stmt.args) > 1 && !strings.EqualFold(stmt.args[1], ClassIN.Class) {
+		c.warnf("line %d: zone %s of class %s skipped", stmt.line, stmt.args[0], stmt.args[1])
+		return nil
+	}
+
+	name := stmt.args[0]
+	zone := NamedZone{Name: strings.ToLower(strings.TrimSuffix(name, "."))}
+	for _, sub := range stmt.block {
+		switch sub.keyword {
+		case "type":
+			if len(sub.args) == 1 {
+				zone.Type = strings.ToLower(sub.args[0])
+			}
+		case "file":
+			if len(sub.args) == 1 {
+				zone.File = sub.args[0]
+			}
+		case "masters", "primaries":
+			zone.Masters = namedAddresses(sub)
+		case "allow-transfer":
+			zone.AllowTransfer = namedAddresses(sub)
+		}
+	}
+
+	switch zone.Type {
+	case "primary":
+		zone.Type = "master"
+	case "secondary":
+		zone.Type = "slave"
+	}
+
+	switch zone.Type {
+	case "master":
+		if zone.File == "" {
+			return fmt.Errorf("master zone %s has no file", name)
+		}
+	case "slave":
+		c.warnf("line %d: slave zone %s skipped, zone transfers are not supported", stmt.line, name)
+	default:
+		c.warnf("line %d: zone %s of type %q skipped", stmt.line, name, zone.Type)
+	}
+
+	if len(zone.AllowTransfer) > 0 {
+		c.warnf("line %d: allow-transfer of zone %s ignored, zone transfers are not supported", stmt.line, name)
+	}
+
+	c.Zones = append(c.Zones, zone)
+
+	return nil
+}
+
+// namedAddresses returns the addresses of an address list like
+//
+//	forwarders { 192.0.2.53; 192.0.2.54 port 5353; };
+//
+// as host:port, leaving the port off when none is given
+func namedAddresses(list *namedStatement) []string {
+	addrs := []string{}
+	for _, stmt := range list.block {
+		addr := stmt.keyword
+		if len(stmt.args) == 2 && stmt.args[0] == "port" {
+			addr = withDefaultPort(addr, stmt.args[1])
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	return addrs
+}
+
+// Options returns the server options of the configuration: a zone file for
+// every master zone and the forwarder, if there are forwarders. Forwarder
+// options are passed to the forwarder
+func (c *NamedConfig) Options(opts ...ForwarderOption) ([]Option, error) {
+	options := []Option{}
+
+	for _, zone := range c.Zones {
+		if zone.Type == "master" {
+			options = append(options, WithZoneFile(zone.Name, zone.File))
+		}
+	}
+
+	if len(c.Forwarders) > 0 {
+		f, err := NewForwarder(c.Forwarders, opts...)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, WithForwarder(f))
+	}
+
+	return options, nil
+}
+
+type namedToken struct {
+	line  int
+	text  string
+	punct bool // one of { } ;
+}
+
+// tokenizeNamedConf splits named.conf into words, quoted strings and
+// punctuation, dropping C, C++ and shell style comments
+func tokenizeNamedConf(text string) ([]namedToken, error) {
+	tokens := []namedToken{}
+	line := 1
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		switch {
+		case c == '\n':
+			line++
+		case c == ' ' || c == '\t' || c == '\r':
+		case c == '#' || (c == '/' && strings.HasPrefix(text[i:], "//")):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+			line++
+		case c == '/' && strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+
+			line += strings.Count(text[i:i+2+end], "\n")
+			i += end + 3
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, namedToken{line: line, text: string(c), punct: true})
+		case c == '"':
+			end := strings.IndexByte(text[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+
+			tokens = append(tokens, namedToken{line: line, text: text[i+1 : i+1+end]})
+			i += end + 1
+		default:
+			start := i
+			for i < len(text) && !strings.ContainsRune(" \t\r\n{};\"", rune(text[i])) {
+				i++
+			}
+
+			tokens = append(tokens, namedToken{line: line, text: text[start:i]})
+			i--
+		}
+	}
+
+	return tokens, nil
+}
+
+// parseNamedStatements parses statements up to a closing brace, and returns
+// the tokens from that brace on
+func parseNamedStatements(tokens []namedToken) ([]*namedStatement, []namedToken, error) {
+	statements := []*namedStatement{}
+
+	for len(tokens) > 0 {
+		tok := tokens[0]
+		if tok.punct && tok.text == "}" {
+			return statements, tokens, nil
+		}
+
+		if tok.punct && tok.text == ";" {
+			tokens = tokens[1:]
+			continue
+		}
+
+		if tok.punct {
+			return nil, nil, fmt.Errorf("line %d: unexpected %s", tok.line, tok.text)
+		}
+
+		stmt := namedStatement{line: tok.line, keyword: strings.ToLower(tok.text)}
+		tokens = tokens[1:]
+
+		for len(tokens) > 0 && !tokens[0].punct {
+			stmt.args = append(stmt.args, tokens[0].text)
+			tokens = tokens[1:]
+		}
+
+		if len(tokens) > 0 && tokens[0].text == "{" {
+			block, rest, err := parseNamedStatements(tokens[1:])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if len(rest) == 0 {
+				return nil, nil, fmt.Errorf("line %d: unterminated block of %s", stmt.line, stmt.keyword)
+			}
+
+			stmt.block = block
+			tokens = rest[1:]
+		}
+
+		if len(tokens) == 0 || tokens[0].text != ";" {
+			return nil, nil, fmt.Errorf("line %d: missing ; after %s", stmt.line, stmt.keyword)
+		}
+		tokens = tokens[1:]
+
+		statements = append(statements, &stmt)
+	}
+
+	return statements, nil, nil
+}
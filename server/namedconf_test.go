@@ -0,0 +1,134 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testNamedConf = `// BIND configuration
+options {
+	directory "zones";
+	forwarders { 192.0.2.53; 192.0.2.54 port 5353; };
+	recursion yes;
+};
+
+/* zones
+   of this server */
+include "named.conf.local";
+
+zone "." IN { type hint; file "/usr/share/dns/root.hints"; };
+`
+
+const testNamedConfLocal = `zone "example.com" IN {
+	type master;
+	file "db.example.com";   # relative to the directory option
+	allow-transfer { 192.0.2.2; };
+};
+
+zone "example.net" { type slave; masters { 192.0.2.1; }; file "db.example.net"; };
+`
+
+const testNamedZoneFile = `$TTL 300
+@    IN SOA ns1 hostmaster 1 3600 600 86400 300
+@    IN NS  ns1
+ns1  IN A   192.0.2.10
+www  IN A   192.0.2.80
+`
+
+func writeNamedConfFiles(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "zones"), 0755); err != nil {
+		t.Fatalf("error while creating zones directory: %v", err)
+	}
+
+	files := map[string]string{
+		"named.conf":           testNamedConf,
+		"named.conf.local":     testNamedConfLocal,
+		"zones/db.example.com": testNamedZoneFile,
+	}
+
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("error while writing %s: %v", name, err)
+		}
+	}
+
+	return filepath.Join(dir, "named.conf")
+}
+
+func TestLoadNamedConf(t *testing.T) {
+	path := writeNamedConfFiles(t)
+
+	c, err := LoadNamedConf(path)
+	if err != nil {
+		t.Fatalf("error while loading named.conf: %v", err)
+	}
+
+	if fmt.Sprint(c.Forwarders) != "[192.0.2.53 192.0.2.54:5353]" {
+		t.Errorf("unexpected forwarders %v", c.Forwarders)
+	}
+
+	if len(c.Zones) != 3 {
+		t.Fatalf("expected 3 zones, got %+v", c.Zones)
+	}
+
+	zone := c.Zones[0]
+	if zone.Name != "example.com" || zone.Type != "master" || zone.File != filepath.Join(filepath.Dir(path), "zones", "db.example.com") ||
+		fmt.Sprint(zone.AllowTransfer) != "[192.0.2.2]" {
+		t.Errorf("unexpected zone %+v", zone)
+	}
+
+	if zone := c.Zones[1]; zone.Type != "slave" || fmt.Sprint(zone.Masters) != "[192.0.2.1]" {
+		t.Errorf("unexpected zone %+v", zone)
+	}
+
+	warnings := strings.Join(c.Warnings, "\n")
+	for _, expected := range []string{"option recursion skipped", "allow-transfer of zone example.com", "slave zone example.net", "zone . of type \"hint\""} {
+		if !strings.Contains(warnings, expected) {
+			t.Errorf("expected a warning about %q, got:\n%s", expected, warnings)
+		}
+	}
+}
+
+func TestNamedConfOptions(t *testing.T) {
+	c, err := LoadNamedConf(writeNamedConfFiles(t))
+	if err != nil {
+		t.Fatalf("error while loading named.conf: %v", err)
+	}
+
+	opts, err := c.Options()
+	if err != nil {
+		t.Fatalf("error while mapping named.conf: %v", err)
+	}
+
+	srv, err := NewDNSServer("", "", opts...)
+	if err != nil {
+		t.Fatalf("error while creating server: %v", err)
+	}
+
+	if rr := srv.LookupRecords(&TypeA, &ClassIN, "www.example.com"); rr == nil {
+		t.Errorf("expected the records of the master zone to be loaded")
+	}
+
+	if srv.forwarder == nil || fmt.Sprint(srv.forwarder.upstreams) != "[192.0.2.53:53 192.0.2.54:5353]" {
+		t.Errorf("expected a forwarder to the forwarders")
+	}
+}
+
+func TestTokenizeNamedConfErrors(t *testing.T) {
+	for _, text := range []string{`zone "example.com`, `/* never closed`, `options { directory "x"; }`, `zone "x" { type master }; }`} {
+		tokens, err := tokenizeNamedConf(text)
+		if err == nil {
+			_, rest, perr := parseNamedStatements(tokens)
+			if perr == nil && len(rest) == 0 {
+				t.Errorf("expected an error for %q", text)
+			}
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// PolicyAction is what a policy rule does with a query it matches
+type PolicyAction int
+
+const (
+	// PolicyAllow answers the query as usual, skipping the rules after it
+	PolicyAllow PolicyAction = iota
+
+	// PolicyBlock answers with NXDOMAIN, or the response code given
+	PolicyBlock
+
+	// PolicyRewrite answers with the records of another name
+	PolicyRewrite
+
+	// PolicyForward relays the query to the upstreams given
+	PolicyForward
+)
+
+var policyActionNames = map[PolicyAction]string{
+	PolicyAllow:   "ALLOW",
+	PolicyBlock:   "BLOCK",
+	PolicyRewrite: "REWRITE",
+	PolicyForward: "FORWARD",
+}
+
+func (a PolicyAction) String() string {
+	name, ok := policyActionNames[a]
+	if !ok {
+		return fmt.Sprintf("PolicyAction(%d)", int(a))
+	}
+
+	return name
+}
+
+// PolicyDecision is the outcome of the rule that matched a query
+type PolicyDecision struct {
+	Action PolicyAction
+
+	// RCode is the response code of BLOCK decisions
+	RCode ResponseCode
+
+	// Target is the name REWRITE decisions answer with
+	Target string
+
+	// Line is the line of the rule in the policy file
+	Line int
+
+	forwarder *Forwarder
+}
+
+// PolicyQuery is what policy rules get to look at
+type PolicyQuery struct {
+	Question *Question
+	Client   net.IP
+	Proto    string
+	Time     time.Time
+}
+
+type policyRule struct {
+	line     int
+	cond     policyExpr
+	decision PolicyDecision
+}
+
+// Policy is a list of rules evaluated in order for every query, the first
+// matching rule deciding what happens to the query. A rule is a condition
+// and an action, one per line:
+//
+//	# comments start with #
+//	indomain(qname, "ads.example") => BLOCK
+//	qtype == "ANY" => BLOCK REFUSED
+//	incidr(client, "10.0.0.0/8") && indomain(qname, "corp") => FORWARD 10.0.0.53:53,10.0.1.53:53
+//	qname == "intranet.example" && (hour < 8 || hour >= 18) => REWRITE maintenance.example
+//	match(qname, "*.internal.example") => ALLOW
+//
+// Conditions can use qname, qtype, qclass, client, proto (all strings) and
+// hour, minute, weekday (ints), compare them with == != < <= > >=, combine
+// them with && || ! and parentheses, and call indomain, match, contains and
+// incidr, all taking two strings
+type Policy struct {
+	rules []*policyRule
+	log   Logger
+}
+
+// LoadPolicyFile reads the policy at path. Options are passed to the
+// forwarders of FORWARD rules
+func LoadPolicyFile(path string, opts ...ForwarderOption) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while opening policy file: %v", err)
+	}
+	defer f.Close()
+
+	return ParsePolicy(f, opts...)
+}
+
+// ParsePolicy reads policy rules from r. Options are passed to the
+// forwarders of FORWARD rules
+func ParsePolicy(r io.Reader, opts ...ForwarderOption) (*Policy, error) {
+	p := Policy{log: scopeLogger(defaultLogger(), "policy")}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		rule, err := parsePolicyRule(text, opts)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		rule.line = line
+		rule.decision.Line = line
+		p.rules = append(p.rules, rule)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error while reading policy: %v", err)
+	}
+
+	return &p, nil
+}
+
+// splitPolicyRule splits a rule at the => outside of strings
+func splitPolicyRule(text string) (string, string, bool) {
+	inString := false
+	for i := 0; i < len(text)-1; i++ {
+		switch {
+		case inString && text[i] == '\\':
+			i++
+		case text[i] == '"':
+			inString = !inString
+		case !inString && text[i] == '=' && text[i+1] == '>':
+			return text[:i], text[i+2:], true
+		}
+	}
+
+	return "", "", false
+}
+
+func parsePolicyRule(text string, opts []ForwarderOption) (*policyRule, error) {
+	condText, actionText, ok := splitPolicyRule(text)
+	if !ok {
+		return nil, fmt.Errorf("expected <condition> => <action>")
+	}
+
+	tokens, err := tokenizePolicy(condText)
+	if err != nil {
+		return nil, err
+	}
+
+	cond, err := compilePolicyExpr(tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(actionText)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("missing action")
+	}
+
+	rule := policyRule{cond: cond}
+	args := fields[1:]
+
+	switch strings.ToUpper(fields[0]) {
+	case "ALLOW":
+		rule.decision.Action = PolicyAllow
+		if len(args) != 0 {
+			return nil, fmt.Errorf("ALLOW takes no arguments")
+		}
+	case "BLOCK":
+		rule.decision.Action = PolicyBlock
+		rule.decision.RCode = NameError
+
+		if len(args) > 1 {
+			return nil, fmt.Errorf("BLOCK takes at most a response code")
+		}
+
+		if len(args) == 1 {
+			rcode, ok := parseResponseCode(args[0])
+			if !ok {
+				return nil, fmt.Errorf("unknown response code %q", args[0])
+			}
+			rule.decision.RCode = rcode
+		}
+	case "REWRITE":
+		rule.decision.Action = PolicyRewrite
+		if len(args) != 1 {
+			return nil, fmt.Errorf("REWRITE takes a name")
+		}
+		rule.decision.Target = strings.ToLower(strings.TrimSuffix(args[0], "."))
+	case "FORWARD":
+		rule.decision.Action = PolicyForward
+		if len(args) != 1 {
+			return nil, fmt.Errorf("FORWARD takes comma separated upstreams")
+		}
+
+		f, err := NewForwarder(strings.Split(args[0], ","), opts...)
+		if err != nil {
+			return nil, err
+		}
+		rule.decision.forwarder = f
+	default:
+		return nil, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	return &rule, nil
+}
+
+func parseResponseCode(s string) (ResponseCode, bool) {
+	for rcode, name := range responseCodeNames {
+		if strings.EqualFold(s, name) {
+			return rcode, true
+		}
+	}
+
+	return 0, false
+}
+
+// Decide returns the decision of the first rule matching q, if any. Rules
+// whose condition fails to evaluate are skipped
+func (p *Policy) Decide(q PolicyQuery) (PolicyDecision, bool) {
+	client := ""
+	if q.Client != nil {
+		client = q.Client.String()
+	}
+
+	qtype := q.Question.Type.Type
+	if q.Question.Type == &TypeAll {
+		// the name zone files and dig use for "*"
+		qtype = "ANY"
+	}
+
+	env := policyEnv{
+		strings: map[string]string{
+			"qname":  strings.ToLower(strings.TrimSuffix(q.Question.Name, ".")),
+			"qtype":  qtype,
+			"qclass": q.Question.Class.Class,
+			"client": client,
+			"proto":  q.Proto,
+		},
+		ints: map[string]int64{
+			"hour":    int64(q.Time.Hour()),
+			"minute":  int64(q.Time.Minute()),
+			"weekday": int64(q.Time.Weekday()),
+		},
+	}
+
+	for _, rule := range p.rules {
+		matched, err := rule.cond.eval(&env)
+		if err != nil {
+			p.log.Warnf("error in rule on line %d: %v", rule.line, err)
+			continue
+		}
+
+		if matched.(bool) {
+			return rule.decision, true
+		}
+	}
+
+	return PolicyDecision{}, false
+}
+
+// WithPolicy makes the server decide what to do with queries by policy p
+func WithPolicy(p *Policy) Option {
+	return func(srv *DNSServer) {
+		srv.policy = p
+	}
+}
+
+// addrIP returns the IP address of addr, or nil if it has none
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+
+	return nil
+}
+
+// applyPolicy answers q as the server's policy decides. It returns false if
+// the query should be answered as usual
+func (srv *DNSServer) applyPolicy(headers *DNSHeader, q *Question, from net.Addr, overUDP bool, edns *EDNS, maxSize int) ([]byte, bool, error) {
+	proto := "tcp"
+	if overUDP {
+		proto = "udp"
+	}
+
+	decision, ok := srv.policy.Decide(PolicyQuery{Question: q, Client: addrIP(from), Proto: proto, Time: time.Now()})
+	if !ok || decision.Action == PolicyAllow {
+		return nil, false, nil
+	}
+
+	srv.log.Debugf("policy rule on line %d: %s %s", decision.Line, decision.Action, q.String())
+
+	switch decision.Action {
+	case PolicyBlock:
+		headers.ResponseCode = decision.RCode
+		resp, err := encodeResponse(headers, []*Question{q}, nil, nil, nil, edns, maxSize)
+		return resp, true, err
+	case PolicyForward:
+		resp, err := srv.forward(decision.forwarder, headers, q, from, maxSize)
+		return resp, true, err
+	default:
+		answers := []*ResourceRecord{}
+		for _, rr := range srv.lookupAllRecords(q.Type, q.Class, decision.Target) {
+			renamed := *rr
+			renamed.Name = q.Name
+			answers = append(answers, &renamed)
+		}
+
+		headers.IsAuthoritative = true
+		resp, err := encodeResponse(headers, []*Question{q}, srv.rotateRecords(answers), nil, nil, edns, maxSize)
+		return resp, true, err
+	}
+}
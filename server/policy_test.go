@@ -0,0 +1,108 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+# block trackers, except for the office
+indomain(qname, "tracker.example") && incidr(client, "10.0.0.0/8") => ALLOW
+indomain(qname, "tracker.example") => BLOCK
+qtype == "ANY" => BLOCK refused
+qname == "www.kausm.in" && (hour < 8 || hour >= 18) => REWRITE test.kausm.in.
+`
+
+func TestPolicyDecide(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatalf("error while parsing policy: %v", err)
+	}
+
+	evening := time.Date(2021, 6, 15, 20, 0, 0, 0, time.Local)
+	noon := time.Date(2021, 6, 15, 12, 0, 0, 0, time.Local)
+
+	for _, tc := range []struct {
+		name    string
+		qtype   *QTYPE
+		client  string
+		at      time.Time
+		matched bool
+		action  PolicyAction
+		line    int
+	}{
+		{"ads.tracker.example", &TypeA, "10.1.1.1", noon, true, PolicyAllow, 3},
+		{"ads.tracker.example", &TypeA, "192.0.2.1", noon, true, PolicyBlock, 4},
+		{"www.kausm.in", &TypeAll, "192.0.2.1", noon, true, PolicyBlock, 5},
+		{"www.kausm.in", &TypeA, "192.0.2.1", evening, true, PolicyRewrite, 6},
+		{"www.kausm.in", &TypeA, "192.0.2.1", noon, false, 0, 0},
+	} {
+		q := Question{Name: tc.name, Type: tc.qtype, Class: &ClassIN}
+		decision, matched := p.Decide(PolicyQuery{Question: &q, Client: net.ParseIP(tc.client), Proto: "udp", Time: tc.at})
+
+		if matched != tc.matched || decision.Action != tc.action || decision.Line != tc.line {
+			t.Errorf("%s %s from %s: expected %t %s on line %d, got %t %s on line %d",
+				tc.name, tc.qtype, tc.client, tc.matched, tc.action, tc.line, matched, decision.Action, decision.Line)
+		}
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	for _, rule := range []string{
+		`qtype == "A"`,
+		`qtype == "A" =>`,
+		`qtype == "A" => DROP`,
+		`qtype == "A" => BLOCK NOSUCHCODE`,
+		`qtype == "A" => REWRITE`,
+		`qtype == "A" => FORWARD`,
+		`qtype == 1 => ALLOW`,
+	} {
+		if _, err := ParsePolicy(strings.NewReader(rule)); err == nil {
+			t.Errorf("expected %q to be rejected", rule)
+		}
+	}
+
+	// => in a string doesn't split the rule
+	if _, err := ParsePolicy(strings.NewReader(`qname == "=>" => ALLOW`)); err != nil {
+		t.Errorf("expected => in a string to be accepted, got %v", err)
+	}
+}
+
+func TestServerAppliesPolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(`
+qname == "blocked.kausm.in" => BLOCK REFUSED
+qname == "alias.kausm.in" => REWRITE test.kausm.in
+`))
+	if err != nil {
+		t.Fatalf("error while parsing policy: %v", err)
+	}
+
+	srv, _ := NewDNSServer("", "", WithPolicy(p))
+
+	q := Question{Name: "blocked.kausm.in", Type: &TypeA, Class: &ClassIN}
+	resp, err := srv.handleQuery(encodeTestQuery(t, 1, &q), nil, true)
+	if err != nil {
+		t.Fatalf("error while handling query: %v", err)
+	}
+
+	if rcode := ResponseCode(resp[3] & 0x0f); rcode != Refused {
+		t.Errorf("expected REFUSED for a blocked name, got %s", rcode)
+	}
+
+	q = Question{Name: "alias.kausm.in", Type: &TypeA, Class: &ClassIN}
+	resp, err = srv.handleQuery(encodeTestQuery(t, 2, &q), nil, true)
+	if err != nil {
+		t.Fatalf("error while handling query: %v", err)
+	}
+
+	m, err := DecodeMessage(resp)
+	if err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if len(m.Answers) != 1 || m.Answers[0].Name != "alias.kausm.in" || string(m.Answers[0].Value) != "\x86\xd1\x94\x32" {
+		t.Errorf("expected the A record of test.kausm.in under the queried name, got %v", m.Answers)
+	}
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// policyType is the static type of a policy expression
+type policyType int
+
+const (
+	policyString policyType = iota
+	policyInt
+	policyBool
+)
+
+var policyTypeNames = map[policyType]string{
+	policyString: "string",
+	policyInt:    "int",
+	policyBool:   "bool",
+}
+
+func (t policyType) String() string {
+	return policyTypeNames[t]
+}
+
+// policyEnv holds what policy expressions can refer to
+type policyEnv struct {
+	strings map[string]string
+	ints    map[string]int64
+}
+
+// policyVariables are the names expressions can use, with their types
+var policyVariables = map[string]policyType{
+	"qname":   policyString, // lower case, without the trailing dot
+	"qtype":   policyString, // e.g. "A" or "TYPE65"
+	"qclass":  policyString,
+	"client":  policyString, // client IP address, empty if unknown
+	"proto":   policyString, // "udp" or "tcp"
+	"hour":    policyInt,    // 0-23, local time
+	"minute":  policyInt,
+	"weekday": policyInt, // 0 is Sunday
+}
+
+// policyExpr is a compiled, type checked expression
+type policyExpr interface {
+	typ() policyType
+	eval(env *policyEnv) (interface{}, error)
+}
+
+type policyLiteral struct {
+	t     policyType
+	value interface{}
+}
+
+func (e *policyLiteral) typ() policyType { return e.t }
+
+func (e *policyLiteral) eval(env *policyEnv) (interface{}, error) { return e.value, nil }
+
+type policyVariable struct {
+	name string
+	t    policyType
+}
+
+func (e *policyVariable) typ() policyType { return e.t }
+
+func (e *policyVariable) eval(env *policyEnv) (interface{}, error) {
+	if e.t == policyInt {
+		return env.ints[e.name], nil
+	}
+
+	return env.strings[e.name], nil
+}
+
+type policyNot struct {
+	operand policyExpr
+}
+
+func (e *policyNot) typ() policyType { return policyBool }
+
+func (e *policyNot) eval(env *policyEnv) (interface{}, error) {
+	v, err := e.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	return !v.(bool), nil
+}
+
+type policyBinary struct {
+	op          string
+	left, right policyExpr
+}
+
+func (e *policyBinary) typ() policyType { return policyBool }
+
+func (e *policyBinary) eval(env *policyEnv) (interface{}, error) {
+	left, err := e.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit
+	switch e.op {
+	case "&&":
+		if !left.(bool) {
+			return false, nil
+		}
+		return e.right.eval(env)
+	case "||":
+		if left.(bool) {
+			return true, nil
+		}
+		return e.right.eval(env)
+	}
+
+	right, err := e.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	cmp := 0
+	switch l := left.(type) {
+	case string:
+		cmp = strings.Compare(l, right.(string))
+	case int64:
+		r := right.(int64)
+		if l < r {
+			cmp = -1
+		} else if l > r {
+			cmp = 1
+		}
+	case bool:
+		if l != right.(bool) {
+			cmp = 1
+		}
+	}
+
+	switch e.op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// policyFunction is a function expressions can call. All of them take
+// strings and return a bool
+type policyFunction struct {
+	args int
+
+	// check validates the last argument when the expression is compiled,
+	// if it's a literal
+	check func(arg string) error
+
+	call func(args []string) (bool, error)
+}
+
+var policyFunctions = map[string]policyFunction{
+	// indomain(name, domain) is true if name is domain or below it
+	"indomain": {
+		args: 2,
+		call: func(args []string) (bool, error) {
+			name, domain := args[0], strings.ToLower(strings.TrimSuffix(args[1], "."))
+			return domain == "" || name == domain || strings.HasSuffix(name, "."+domain), nil
+		},
+	},
+	// match(s, pattern) matches s against a shell pattern, see path.Match
+	"match": {
+		args: 2,
+		check: func(pattern string) error {
+			_, err := path.Match(pattern, "")
+			return err
+		},
+		call: func(args []string) (bool, error) {
+			return path.Match(args[1], args[0])
+		},
+	},
+	// contains(s, substr)
+	"contains": {
+		args: 2,
+		call: func(args []string) (bool, error) {
+			return strings.Contains(args[0], args[1]), nil
+		},
+	},
+	// incidr(ip, cidr) is true if ip is in the network cidr
+	"incidr": {
+		args: 2,
+		check: func(cidr string) error {
+			_, _, err := net.ParseCIDR(cidr)
+			return err
+		},
+		call: func(args []string) (bool, error) {
+			_, network, err := net.ParseCIDR(args[1])
+			if err != nil {
+				return false, err
+			}
+
+			ip := net.ParseIP(args[0])
+			return ip != nil && network.Contains(ip), nil
+		},
+	},
+}
+
+type policyCall struct {
+	name string
+	fn   policyFunction
+	args []policyExpr
+}
+
+func (e *policyCall) typ() policyType { return policyBool }
+
+func (e *policyCall) eval(env *policyEnv) (interface{}, error) {
+	args := make([]string, len(e.args))
+	for i, arg := range e.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v.(string)
+	}
+
+	result, err := e.fn.call(args)
+	if err != nil {
+		return nil, fmt.Errorf("error in %s: %v", e.name, err)
+	}
+
+	return result, nil
+}
+
+// policyToken is a token of the expression language. Strings are kept
+// quoted, so that they can't be mistaken for operators
+type policyToken struct {
+	text string
+	pos  int
+}
+
+// tokenizePolicy splits an expression into identifiers, numbers, quoted
+// strings and operators
+func tokenizePolicy(s string) ([]policyToken, error) {
+	tokens := []policyToken{}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(s) && s[end] != '"' {
+				if s[end] == '\\' {
+					end++
+				}
+				end++
+			}
+
+			if end >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %d", i+1)
+			}
+
+			tokens = append(tokens, policyToken{s[i : end+1], i})
+			i = end + 1
+		case isPolicyIdentChar(c):
+			end := i
+			for end < len(s) && isPolicyIdentChar(s[end]) {
+				end++
+			}
+
+			tokens = append(tokens, policyToken{s[i:end], i})
+			i = end
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "=>", "<", ">", "!", "(", ")", ","} {
+				if strings.HasPrefix(s[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i+1)
+			}
+
+			tokens = append(tokens, policyToken{op, i})
+			i += len(op)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isPolicyIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// policyParser is a recursive descent parser for expressions:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | comparison
+//	comparison = operand [ ("==" | "!=" | "<" | "<=" | ">" | ">=") operand ]
+//	operand    = "(" or ")" | call | variable | string | number | "true" | "false"
+type policyParser struct {
+	tokens []policyToken
+	pos    int
+}
+
+// compilePolicyExpr parses and type checks a boolean expression
+func compilePolicyExpr(tokens []policyToken) (policyExpr, error) {
+	p := policyParser{tokens: tokens}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+
+	if expr.typ() != policyBool {
+		return nil, fmt.Errorf("condition is a %s, not a bool", expr.typ())
+	}
+
+	return expr, nil
+}
+
+func (p *policyParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.pos].text
+}
+
+func (p *policyParser) errorf(format string, v ...interface{}) error {
+	if p.pos >= len(p.tokens) {
+		return fmt.Errorf(format+" at end of condition", v...)
+	}
+
+	return fmt.Errorf(format+" at %d", append(v, p.tokens[p.pos].pos+1)...)
+}
+
+func (p *policyParser) parseOr() (policyExpr, error) {
+	return p.parseLogical("||", p.parseAnd)
+}
+
+func (p *policyParser) parseAnd() (policyExpr, error) {
+	return p.parseLogical("&&", p.parseUnary)
+}
+
+func (p *policyParser) parseLogical(op string, next func() (policyExpr, error)) (policyExpr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == op {
+		p.pos++
+
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		if left.typ() != policyBool || right.typ() != policyBool {
+			return nil, p.errorf("%s needs bool operands", op)
+		}
+
+		left = &policyBinary{op: op, left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *policyParser) parseUnary() (policyExpr, error) {
+	if p.peek() != "!" {
+		return p.parseComparison()
+	}
+	p.pos++
+
+	operand, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if operand.typ() != policyBool {
+		return nil, p.errorf("! needs a bool operand")
+	}
+
+	return &policyNot{operand: operand}, nil
+}
+
+func (p *policyParser) parseComparison() (policyExpr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	switch op {
+	case "==", "!=", "<", "<=", ">", ">=":
+	default:
+		return left, nil
+	}
+	p.pos++
+
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	if left.typ() != right.typ() {
+		return nil, p.errorf("cannot compare %s with %s", left.typ(), right.typ())
+	}
+
+	if left.typ() == policyBool && op != "==" && op != "!=" {
+		return nil, p.errorf("bools can only be compared with == and !=")
+	}
+
+	return &policyBinary{op: op, left: left, right: right}, nil
+}
+
+func (p *policyParser) parseOperand() (policyExpr, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, p.errorf("expected an operand")
+	}
+
+	switch {
+	case tok == "(":
+		p.pos++
+
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ")" {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+
+		return expr, nil
+	case tok[0] == '"':
+		s, err := strconv.Unquote(tok)
+		if err != nil {
+			return nil, p.errorf("invalid string %s", tok)
+		}
+		p.pos++
+
+		return &policyLiteral{t: policyString, value: s}, nil
+	case tok[0] >= '0' && tok[0] <= '9':
+		n, err := strconv.ParseInt(tok, 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok)
+		}
+		p.pos++
+
+		return &policyLiteral{t: policyInt, value: n}, nil
+	case tok == "true" || tok == "false":
+		p.pos++
+
+		return &policyLiteral{t: policyBool, value: tok == "true"}, nil
+	case isPolicyIdentChar(tok[0]):
+		if p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].text == "(" {
+			return p.parseCall()
+		}
+
+		t, ok := policyVariables[tok]
+		if !ok {
+			return nil, p.errorf("unknown variable %s", tok)
+		}
+		p.pos++
+
+		return &policyVariable{name: tok, t: t}, nil
+	}
+
+	return nil, p.errorf("unexpected %s", tok)
+}
+
+func (p *policyParser) parseCall() (policyExpr, error) {
+	name := p.peek()
+	fn, ok := policyFunctions[name]
+	if !ok {
+		return nil, p.errorf("unknown function %s", name)
+	}
+	p.pos += 2
+
+	call := policyCall{name: name, fn: fn}
+	for p.peek() != ")" {
+		if len(call.args) > 0 {
+			if p.peek() != "," {
+				return nil, p.errorf("expected , or )")
+			}
+			p.pos++
+		}
+
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if arg.typ() != policyString {
+			return nil, p.errorf("%s takes string arguments", name)
+		}
+
+		call.args = append(call.args, arg)
+	}
+	p.pos++
+
+	if len(call.args) != fn.args {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name, fn.args, len(call.args))
+	}
+
+	// the pattern or network is usually a literal, so check it early
+	if lit, ok := call.args[len(call.args)-1].(*policyLiteral); ok && fn.check != nil {
+		if err := fn.check(lit.value.(string)); err != nil {
+			return nil, fmt.Errorf("invalid argument to %s: %v", name, err)
+		}
+	}
+
+	return &call, nil
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestPolicyExpressions(t *testing.T) {
+	env := policyEnv{
+		strings: map[string]string{"qname": "ads.tracker.example", "qtype": "A", "client": "10.1.2.3", "proto": "udp"},
+		ints:    map[string]int64{"hour": 23, "minute": 5, "weekday": 6},
+	}
+
+	for _, tc := range []struct {
+		expr     string
+		expected bool
+	}{
+		{`qtype == "A"`, true},
+		{`qtype != "A"`, false},
+		{`indomain(qname, "tracker.example")`, true},
+		{`indomain(qname, "racker.example")`, false},
+		{`indomain(qname, "")`, true},
+		{`match(qname, "ads.*")`, true},
+		{`incidr(client, "10.0.0.0/8") && proto == "udp"`, true},
+		{`incidr(client, "192.168.0.0/16")`, false},
+		{`hour >= 22 || hour < 6`, true},
+		{`!(weekday == 0 || weekday == 6)`, false},
+		{`contains(qname, "track") && !contains(qname, "safe")`, true},
+		{`qname < "b"`, true},
+		{`(hour > 1) == true`, true},
+	} {
+		tokens, err := tokenizePolicy(tc.expr)
+		if err != nil {
+			t.Fatalf("error while tokenizing %s: %v", tc.expr, err)
+		}
+
+		expr, err := compilePolicyExpr(tokens)
+		if err != nil {
+			t.Fatalf("error while compiling %s: %v", tc.expr, err)
+		}
+
+		result, err := expr.eval(&env)
+		if err != nil {
+			t.Fatalf("error while evaluating %s: %v", tc.expr, err)
+		}
+
+		if result != tc.expected {
+			t.Errorf("%s: expected %t, got %t", tc.expr, tc.expected, result)
+		}
+	}
+}
+
+func TestPolicyExpressionErrors(t *testing.T) {
+	for _, expr := range []string{
+		`qname`,
+		`qname == 1`,
+		`hour && true`,
+		`nosuchvar == "a"`,
+		`nosuchfn(qname)`,
+		`indomain(qname)`,
+		`incidr(client, "10.0.0.0/33")`,
+		`match(qname, "[")`,
+		`true == "a"`,
+		`true < false`,
+		`(qtype == "A"`,
+		`qtype == "A" qtype`,
+		`qtype == "A`,
+		`qtype @ "A"`,
+		``,
+	} {
+		tokens, err := tokenizePolicy(expr)
+		if err != nil {
+			continue
+		}
+
+		if _, err := compilePolicyExpr(tokens); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// newRecord returns a record of the IN class, with name checked and its
+// trailing dot dropped as everywhere else in the server
+func newRecord(name string, qtype *QTYPE, ttl uint32, value []byte) (*ResourceRecord, error) {
+	name = strings.TrimSuffix(name, ".")
+	if err := validateName(name); err != nil {
+		return nil, fmt.Errorf("invalid name %q: %v", name, err)
+	}
+
+	return &ResourceRecord{Name: name, Type: qtype, Class: &ClassIN, TTL: ttl, Value: value}, nil
+}
+
+// NewA returns an A record of name for the IPv4 address ip
+func NewA(name string, ttl uint32, ip net.IP) (*ResourceRecord, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+
+	return newRecord(name, &TypeA, ttl, []byte(ip4))
+}
+
+// NewAAAA returns an AAAA record of name for the IPv6 address ip
+func NewAAAA(name string, ttl uint32, ip net.IP) (*ResourceRecord, error) {
+	if ip.To4() != nil || len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("%s is not an IPv6 address", ip)
+	}
+
+	return newRecord(name, &TypeAAAA, ttl, []byte(ip))
+}
+
+// newNameRecord returns a record of name whose RDATA is the single name target
+func newNameRecord(name string, qtype *QTYPE, ttl uint32, target string) (*ResourceRecord, error) {
+	value, err := encodeName(strings.TrimSuffix(target, "."))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s target %q: %v", qtype, target, err)
+	}
+
+	return newRecord(name, qtype, ttl, value)
+}
+
+// NewCNAME returns a CNAME record making name an alias of target
+func NewCNAME(name string, ttl uint32, target string) (*ResourceRecord, error) {
+	return newNameRecord(name, &TypeCNAME, ttl, target)
+}
+
+// NewNS returns an NS record delegating name to the name server host
+func NewNS(name string, ttl uint32, host string) (*ResourceRecord, error) {
+	return newNameRecord(name, &TypeNS, ttl, host)
+}
+
+// NewPTR returns a PTR record of name pointing at target
+func NewPTR(name string, ttl uint32, target string) (*ResourceRecord, error) {
+	return newNameRecord(name, &TypePTR, ttl, target)
+}
+
+// NewMX returns an MX record of name for the mail exchange host with the
+// given preference, lower preferences being tried first
+func NewMX(name string, ttl uint32, preference uint16, host string) (*ResourceRecord, error) {
+	exchange, err := encodeName(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MX exchange %q: %v", host, err)
+	}
+
+	value := make([]byte, 2, 2+len(exchange))
+	binary.BigEndian.PutUint16(value, preference)
+
+	return newRecord(name, &TypeMX, ttl, append(value, exchange...))
+}
+
+// NewTXT returns a TXT record of name holding texts. Texts longer than the
+// 255 octets a TXT string can hold are split over several strings, which
+// clients join back together
+func NewTXT(name string, ttl uint32, texts ...string) (*ResourceRecord, error) {
+	if len(texts) == 0 {
+		texts = []string{""}
+	}
+
+	value := []byte{}
+	for _, text := range texts {
+		for {
+			n := len(text)
+			if n > 255 {
+				n = 255
+			}
+
+			value = append(value, byte(n))
+			value = append(value, text[:n]...)
+
+			text = text[n:]
+			if text == "" {
+				break
+			}
+		}
+	}
+
+	return newRecord(name, &TypeTXT, ttl, value)
+}
+
+// NewSRV returns an SRV record of name for the service at target:port, see
+// RFC 2782
+func NewSRV(name string, ttl uint32, priority, weight, port uint16, target string) (*ResourceRecord, error) {
+	encodedTarget, err := encodeName(strings.TrimSuffix(target, "."))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SRV target %q: %v", target, err)
+	}
+
+	value := make([]byte, 6, 6+len(encodedTarget))
+	binary.BigEndian.PutUint16(value, priority)
+	binary.BigEndian.PutUint16(value[2:], weight)
+	binary.BigEndian.PutUint16(value[4:], port)
+
+	return newRecord(name, &TypeSRV, ttl, append(value, encodedTarget...))
+}
+
+// NewSOA returns the SOA record of the zone name, with mname its primary name
+// server and rname the mailbox of its administrator written as a name
+func NewSOA(name string, ttl uint32, mname, rname string, serial, refresh, retry, expire, minimum uint32) (*ResourceRecord, error) {
+	value, err := EncodeSOA(strings.TrimSuffix(mname, "."), strings.TrimSuffix(rname, "."), serial, refresh, retry, expire, minimum)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOA: %v", err)
+	}
+
+	return newRecord(name, &TypeSOA, ttl, value)
+}
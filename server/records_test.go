@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRecordBuildersMatchZoneFiles(t *testing.T) {
+	mustBuild := func(rr *ResourceRecord, err error) *ResourceRecord {
+		t.Helper()
+
+		if err != nil {
+			t.Fatalf("error while building record: %v", err)
+		}
+
+		return rr
+	}
+
+	built := []*ResourceRecord{
+		mustBuild(NewSOA("example.com.", 3600, "ns1.example.com.", "hostmaster.example.com.", 7, 3600, 600, 86400, 300)),
+		mustBuild(NewA("www.example.com.", 300, net.ParseIP("192.0.2.1"))),
+		mustBuild(NewAAAA("www.example.com", 300, net.ParseIP("2001:db8::1"))),
+		mustBuild(NewCNAME("ftp.example.com", 300, "www.example.com.")),
+		mustBuild(NewNS("example.com", 3600, "ns1.example.com")),
+		mustBuild(NewPTR("1.2.0.192.in-addr.arpa", 300, "www.example.com")),
+		mustBuild(NewMX("example.com", 300, 10, "mail.example.com")),
+		mustBuild(NewTXT("example.com", 300, "v=spf1 -all", "second")),
+		mustBuild(NewSRV("_sip._tcp.example.com", 300, 0, 5, 5060, "sip.example.com")),
+	}
+
+	zone := `
+example.com.              3600 IN SOA   ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300
+www.example.com.          300  IN A     192.0.2.1
+www.example.com.          300  IN AAAA  2001:db8::1
+ftp.example.com.          300  IN CNAME www.example.com.
+example.com.              3600 IN NS    ns1.example.com.
+1.2.0.192.in-addr.arpa.   300  IN PTR   www.example.com.
+example.com.              300  IN MX    10 mail.example.com.
+example.com.              300  IN TXT   "v=spf1 -all" "second"
+_sip._tcp.example.com.    300  IN SRV   0 5 5060 sip.example.com.
+`
+	parsed, err := ParseZoneFile(strings.NewReader(zone), "")
+	if err != nil {
+		t.Fatalf("error while parsing zone: %v", err)
+	}
+
+	if len(parsed) != len(built) {
+		t.Fatalf("expected %d records, got %d", len(built), len(parsed))
+	}
+
+	for i, rr := range built {
+		expected := parsed[i]
+		if rr.Name != expected.Name || rr.Type != expected.Type || rr.Class != expected.Class || rr.TTL != expected.TTL || !bytes.Equal(rr.Value, expected.Value) {
+			t.Errorf("built %s %s %s differs from the zone file's %s %s %s", rr.Name, rr.Type, rdataString(rr.Type, rr.Value), expected.Name, expected.Type, rdataString(expected.Type, expected.Value))
+		}
+	}
+}
+
+func TestNewTXTSplitsLongTexts(t *testing.T) {
+	rr, err := NewTXT("example.com", 300, strings.Repeat("a", 300))
+	if err != nil {
+		t.Fatalf("error while building record: %v", err)
+	}
+
+	if len(rr.Value) != 302 || rr.Value[0] != 255 || rr.Value[256] != 45 {
+		t.Errorf("expected strings of 255 and 45 octets, got %q", rdataString(rr.Type, rr.Value))
+	}
+}
+
+func TestRecordBuildersRejectInvalidInput(t *testing.T) {
+	for name, build := range map[string]func() (*ResourceRecord, error){
+		"A with IPv6":       func() (*ResourceRecord, error) { return NewA("example.com", 300, net.ParseIP("2001:db8::1")) },
+		"AAAA with IPv4":    func() (*ResourceRecord, error) { return NewAAAA("example.com", 300, net.ParseIP("192.0.2.1")) },
+		"A without address": func() (*ResourceRecord, error) { return NewA("example.com", 300, nil) },
+		"long label": func() (*ResourceRecord, error) {
+			return NewA(strings.Repeat("a", 64)+".com", 300, net.IPv4(192, 0, 2, 1))
+		},
+		"empty label":  func() (*ResourceRecord, error) { return NewCNAME("a..example.com", 300, "example.com") },
+		"long MX host": func() (*ResourceRecord, error) { return NewMX("example.com", 300, 10, strings.Repeat("a", 64)) },
+	} {
+		if _, err := build(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// errUnanswerable is returned for a query that caused a panic when not even a
+// SERVFAIL response can be made for it
+var errUnanswerable = errors.New("query can't be answered")
+
+// handleQuerySafely answers a query like handleQuery, but recovers from a
+// panic while doing so, be it from a malformed message tripping up the
+// parser or from a buggy backend or policy. The panic is logged with the
+// query it happened on and the stack, and the query is answered with
+// SERVFAIL, so one query can't take the whole server down
+func (srv *DNSServer) handleQuerySafely(buf []byte, from net.Addr, overUDP bool) (msg []byte, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		atomic.AddUint64(&srv.panics, 1)
+
+		transport := "tcp"
+		if overUDP {
+			transport = "udp"
+		}
+
+		id, question := describeQuery(buf)
+		srv.log.Errorf("panic while handling query: panic=%q from=%s transport=%s id=%d question=%q\n%s", r, addrString(from), transport, id, question, debug.Stack())
+
+		msg, err = serverFailureFor(buf)
+	}()
+
+	return srv.handleQuery(buf, from, overUDP)
+}
+
+// Panics returns how many queries the server recovered from a panic on
+func (srv *DNSServer) Panics() uint64 {
+	return atomic.LoadUint64(&srv.panics)
+}
+
+// serverFailureFor returns a SERVFAIL response to the query in buf, echoing
+// its question when it can be read. What can't be read is left out, as the
+// query may well be what caused the failure
+func serverFailureFor(buf []byte) (msg []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg, err = nil, errUnanswerable
+		}
+	}()
+
+	headers := DNSHeader{}
+	if err := headers.ReadFrom(buf); err != nil {
+		return nil, errUnanswerable
+	}
+
+	headers.Type = QRResponse
+	headers.ResponseCode = ServerFailure
+	headers.IsAuthoritative = false
+	headers.IsTruncated = false
+	headers.RecursionAvailable = false
+
+	questions := []*Question{}
+	if headers.QuestionsCount == 1 {
+		if _, q, err := ReadQuestionFrom(buf[12:]); err == nil {
+			questions = append(questions, q)
+		}
+	}
+
+	return encodeResponse(&headers, questions, nil, nil, nil, nil, maxUDPMessageSize)
+}
+
+// describeQuery returns the ID and the question of the query in buf, for
+// logging, or what of them can be read
+func describeQuery(buf []byte) (id uint16, question string) {
+	defer func() {
+		recover()
+	}()
+
+	headers := DNSHeader{}
+	if err := headers.ReadFrom(buf); err != nil {
+		return 0, ""
+	}
+
+	if headers.QuestionsCount == 0 {
+		return headers.ID, ""
+	}
+
+	_, q, err := ReadQuestionFrom(buf[12:])
+	if err != nil {
+		return headers.ID, ""
+	}
+
+	return headers.ID, fmt.Sprintf("%s %s %s", q.Name, q.Class, q.Type)
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return "-"
+	}
+
+	return addr.String()
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// panickingBackend stands in for a buggy backend
+type panickingBackend struct{}
+
+func (panickingBackend) Zones() []string {
+	return []string{"buggy.example"}
+}
+
+func (panickingBackend) Lookup(q *Question) ([]*ResourceRecord, error) {
+	var records map[string][]*ResourceRecord
+	records[q.Name] = nil
+
+	return nil, nil
+}
+
+func TestPanicIsAnsweredWithServerFailure(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithBackend(panickingBackend{}), WithLogger(NewLogger(ioutil.Discard, LevelError)))
+
+	q := Question{Name: "db.buggy.example", Type: &TypeA, Class: &ClassIN}
+	resp, err := srv.handleQuerySafely(encodeTestQuery(t, 7, &q), nil, true)
+	if err != nil {
+		t.Fatalf("error while handling query: %v", err)
+	}
+
+	msg, err := DecodeMessage(resp)
+	if err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if msg.Header.ID != 7 || msg.Header.ResponseCode != ServerFailure {
+		t.Errorf("expected SERVFAIL for query 7, got %s for query %d", msg.Header.ResponseCode, msg.Header.ID)
+	}
+
+	if len(msg.Questions) != 1 || msg.Questions[0].Name != q.Name {
+		t.Errorf("expected the question to be echoed, got %v", msg.Questions)
+	}
+
+	if srv.Panics() != 1 {
+		t.Errorf("expected 1 panic to be counted, got %d", srv.Panics())
+	}
+}
+
+func TestPanicDoesntCloseTCPConnection(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithBackend(panickingBackend{}), WithLogger(NewLogger(ioutil.Discard, LevelError)))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	defer l.Close()
+
+	go srv.serveTCP(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error while dialing: %v", err)
+	}
+	defer conn.Close()
+
+	for i, tc := range []struct {
+		q     Question
+		rcode ResponseCode
+	}{
+		{Question{Name: "db.buggy.example", Type: &TypeA, Class: &ClassIN}, ServerFailure},
+		{Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}, NoError},
+	} {
+		query := encodeTestQuery(t, uint16(i+1), &tc.q)
+		lenBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBuf, uint16(len(query)))
+
+		if _, err := conn.Write(append(lenBuf, query...)); err != nil {
+			t.Fatalf("error while writing query: %v", err)
+		}
+
+		resp, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("error while reading response to %s: %v", tc.q.Name, err)
+		}
+
+		headers := DNSHeader{}
+		if err := headers.ReadFrom(resp); err != nil {
+			t.Fatalf("error while reading response header: %v", err)
+		}
+
+		if headers.ResponseCode != tc.rcode {
+			t.Errorf("expected %s for %s, got %s", tc.rcode, tc.q.Name, headers.ResponseCode)
+		}
+	}
+}
+
+func TestServerFailureForUnreadableQuery(t *testing.T) {
+	if _, err := serverFailureFor([]byte{0, 1}); err == nil {
+		t.Errorf("expected no response to a truncated header")
+	}
+}
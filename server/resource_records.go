@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 )
 
 type ResourceRecord struct {
@@ -13,6 +15,43 @@ type ResourceRecord struct {
 	Class *QCLASS
 	TTL   uint32
 	Value []byte
+
+	// ExpiresAt, if set, is when the record stops being served and is
+	// removed from the server
+	ExpiresAt time.Time
+
+	// Comment and Meta annotate the record for operators, and are never
+	// served. They're read from and written back to the comment of the
+	// record's line in zone files, Meta as key=value words
+	Comment string
+	Meta    map[string]string
+}
+
+func (rr *ResourceRecord) expired(now time.Time) bool {
+	return !rr.ExpiresAt.IsZero() && !now.Before(rr.ExpiresAt)
+}
+
+// cappedToExpiry returns rr, or a copy of it with the TTL lowered so that
+// resolvers don't cache it past its expiry
+func (rr *ResourceRecord) cappedToExpiry(now time.Time) *ResourceRecord {
+	if rr.ExpiresAt.IsZero() {
+		return rr
+	}
+
+	remaining := rr.ExpiresAt.Sub(now) / time.Second
+	if remaining >= time.Duration(rr.TTL) {
+		return rr
+	}
+
+	capped := *rr
+	capped.TTL = uint32(remaining)
+
+	return &capped
+}
+
+// Len returns the size of rr in wire format, without name compression
+func (rr *ResourceRecord) Len() int {
+	return domainNameLen(rr.Name) + 10 + len(rr.Value)
 }
 
 func (rr *ResourceRecord) Encode(buf []byte) (int, error) {
@@ -131,6 +170,20 @@ var TypeTXT = QTYPE{
 	Meaning: "text string",
 }
 
+// TypeAAAA stands for RR type AAAA - IPv6 Host Address, see RFC 3596
+var TypeAAAA = QTYPE{
+	Type:    "AAAA",
+	Value:   []byte("\x00\x1c"),
+	Meaning: "an IPv6 host address",
+}
+
+// TypeSRV stands for RR type SRV - Service Location, see RFC 2782
+var TypeSRV = QTYPE{
+	Type:    "SRV",
+	Value:   []byte("\x00\x21"),
+	Meaning: "the location of a service",
+}
+
 // TypeAll = "*" type for all records
 var TypeAll = QTYPE{
 	Type:    "*",
@@ -151,21 +204,48 @@ var uintToQtypeMap = map[uint16]*QTYPE{
 	14:  &TypeMINFO,
 	15:  &TypeMX,
 	16:  &TypeTXT,
+	28:  &TypeAAAA,
+	33:  &TypeSRV,
 	255: &TypeAll,
 }
 
-func bytesToQtype(b []byte) (*QTYPE, error) {
-	if len(b) != 2 {
-		return nil, errors.New("argument must be 2 octet long")
+// isKnownQtype reports whether qtype is one of the types with a definition,
+// rather than one made up by qtypeForCode
+func isKnownQtype(qtype *QTYPE) bool {
+	known, ok := uintToQtypeMap[binary.BigEndian.Uint16(qtype.Value)]
+	return ok && known == qtype
+}
+
+// unknownQtypes holds the QTYPEs made up for codes without a definition, so
+// that every code maps to a single *QTYPE
+var (
+	unknownQtypesMu sync.Mutex
+	unknownQtypes   = map[uint16]*QTYPE{}
+)
+
+// qtypeForCode returns the QTYPE for code, making up an RFC 3597 style
+// "TYPEnnn" one for codes without a definition
+func qtypeForCode(code uint16) *QTYPE {
+	if qtype, ok := uintToQtypeMap[code]; ok {
+		return qtype
+	}
+
+	if code == binary.BigEndian.Uint16(TypeOPT.Value) {
+		return &TypeOPT
 	}
 
-	code := binary.BigEndian.Uint16(b)
-	qtype, ok := uintToQtypeMap[code]
+	unknownQtypesMu.Lock()
+	defer unknownQtypesMu.Unlock()
+
+	qtype, ok := unknownQtypes[code]
 	if !ok {
-		return nil, fmt.Errorf("unrecognized RR type code: %d", code)
+		value := make([]byte, 2)
+		binary.BigEndian.PutUint16(value, code)
+		qtype = &QTYPE{Type: fmt.Sprintf("TYPE%d", code), Value: value, Meaning: "unknown type"}
+		unknownQtypes[code] = qtype
 	}
 
-	return qtype, nil
+	return qtype
 }
 
 type QCLASS struct {
@@ -184,18 +264,41 @@ var ClassIN = QCLASS{
 	Meaning: "The Internet!",
 }
 
-func bytesToClass(b []byte) (*QCLASS, error) {
-	if len(b) != 2 {
-		return nil, errors.New("argument must be 2 octet long")
+// ClassCH is the CHAOS class, used for queries about the server itself, see
+// RFC 4892
+var ClassCH = QCLASS{
+	Class:   "CH",
+	Value:   []byte("\x00\x03"),
+	Meaning: "the CHAOS class",
+}
+
+var (
+	unknownClassesMu sync.Mutex
+	unknownClasses   = map[uint16]*QCLASS{}
+)
+
+// qclassForCode returns the QCLASS for code, making up an RFC 3597 style
+// "CLASSnnn" one for anything but IN and CH
+func qclassForCode(code uint16) *QCLASS {
+	switch code {
+	case 1:
+		return &ClassIN
+	case 3:
+		return &ClassCH
 	}
 
-	code := binary.BigEndian.Uint16(b)
-	if code != 1 {
-		return nil, fmt.Errorf("unsupported/unrecognized RR class code: %d", code)
+	unknownClassesMu.Lock()
+	defer unknownClassesMu.Unlock()
+
+	qclass, ok := unknownClasses[code]
+	if !ok {
+		value := make([]byte, 2)
+		binary.BigEndian.PutUint16(value, code)
+		qclass = &QCLASS{Class: fmt.Sprintf("CLASS%d", code), Value: value, Meaning: "unknown class"}
+		unknownClasses[code] = qclass
 	}
 
-	// support only 1 class i.e. IN
-	return &ClassIN, nil
+	return qclass
 }
 
 // DecodeDomainName returns bytes read, domain name, error
@@ -211,6 +314,10 @@ func DecodeDomainName(buf []byte) (int, string, error) {
 		labelLen := int(buf[rlen])
 		rlen++
 
+		if rlen+labelLen > len(buf) {
+			return rlen, "", errors.New("label runs past end of buffer")
+		}
+
 		newLabel := make([]byte, labelLen)
 		copy(newLabel, buf[rlen:rlen+labelLen])
 
@@ -223,6 +330,16 @@ func DecodeDomainName(buf []byte) (int, string, error) {
 	return rlen, domainName, nil
 }
 
+// domainNameLen returns how many octets EncodeDomainName writes for name
+func domainNameLen(name string) int {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return 1
+	}
+
+	return len(name) + 2
+}
+
 func EncodeDomainName(buf []byte, name string) (int, error) {
 	if len(name) > 255 {
 		return 0, errors.New("domain name cannot be longer than 255 characters")
@@ -233,6 +350,13 @@ func EncodeDomainName(buf []byte, name string) (int, error) {
 		return 0, errors.New("buffer too small")
 	}
 
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		// the root is just the terminating zero length label
+		buf[0] = byte(0)
+		return 1, nil
+	}
+
 	labels := strings.Split(name, ".")
 
 	written := 0
@@ -293,5 +417,5 @@ func EncodeSOA(mname, rname string, serial, refresh, retry, expire, minimum uint
 	binary.BigEndian.PutUint32(buf[written:], minimum)
 	written += 4
 
-	return buf, nil
+	return buf[:written], nil
 }
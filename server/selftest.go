@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// defaultSelfTestTimeout bounds a single self-test query
+const defaultSelfTestTimeout = 2 * time.Second
+
+// SelfTest is a query sent to a running server over the loopback interface,
+// so that it goes through the full stack (listener, policy, backends, records)
+// like any client's would, and the answer expected for it
+type SelfTest struct {
+	Name string
+	Type *QTYPE
+
+	// Expect, when set, is the data one of the answers must have, in zone
+	// file syntax
+	Expect string
+
+	// Timeout bounds the query, it defaults to 2 seconds
+	Timeout time.Duration
+}
+
+// WithSelfTest sets the query the server's readiness check sends. By default
+// it asks for the SOA record of the server's first zone
+func WithSelfTest(t SelfTest) Option {
+	return func(srv *DNSServer) {
+		srv.selfTest = &t
+	}
+}
+
+// Run sends the self-test query to the server at addr over UDP and checks the
+// response answers it without a server error, and with the expected data
+func (t SelfTest) Run(addr string) error {
+	qtype := t.Type
+	if qtype == nil {
+		qtype = &TypeA
+	}
+
+	q := Question{Name: strings.TrimSuffix(t.Name, "."), Type: qtype, Class: &ClassIN}
+	resp, err := selfTestExchange(addr, DNSHeader{OpCode: QueryOp, RecursionDesired: true}, &q, t.Timeout)
+	if err != nil {
+		return err
+	}
+
+	switch resp.Header.ResponseCode {
+	case NoError, NameError:
+	default:
+		return fmt.Errorf("query for %s %s was answered with %s", q.Name, qtype, resp.Header.ResponseCode)
+	}
+
+	if t.Expect == "" {
+		return nil
+	}
+
+	expect := strings.TrimSuffix(t.Expect, ".")
+	for _, rr := range resp.Answers {
+		if rr.Type == qtype && strings.EqualFold(strings.TrimSuffix(rdataString(rr.Type, rr.Value), "."), expect) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("answers to %s %s don't include %s", q.Name, qtype, t.Expect)
+}
+
+// Ping sends the server at addr a STATUS query over UDP, which it answers
+// without looking at records, backends or upstreams, and checks that an
+// answer comes back
+func Ping(addr string, timeout time.Duration) error {
+	_, err := selfTestExchange(addr, DNSHeader{OpCode: StatusOp}, nil, timeout)
+	return err
+}
+
+// selfTestExchange sends a query with the given header and question, if any,
+// to addr and returns the matching response
+func selfTestExchange(addr string, headers DNSHeader, q *Question, timeout time.Duration) (*Message, error) {
+	if timeout <= 0 {
+		timeout = defaultSelfTestTimeout
+	}
+
+	idBuf := make([]byte, 2)
+	if _, err := rand.Read(idBuf); err != nil {
+		return nil, fmt.Errorf("error while reading random bytes: %v", err)
+	}
+	headers.ID = binary.BigEndian.Uint16(idBuf)
+
+	query := Message{Header: headers}
+	if q != nil {
+		query.Questions = []*Question{q}
+	}
+
+	buf, err := query.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("error while encoding query: %v", err)
+	}
+
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("error while dialing %s: %v", addr, err)
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(buf); err != nil {
+		return nil, fmt.Errorf("error while writing query: %v", err)
+	}
+
+	respBuf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(respBuf)
+		if err != nil {
+			return nil, fmt.Errorf("error while reading response: %v", err)
+		}
+
+		resp, err := DecodeMessage(respBuf[:n])
+		if err != nil || resp.Header.ID != headers.ID || resp.Header.Type != QRResponse {
+			// not the response to this query, keep waiting for it
+			continue
+		}
+
+		if q != nil && (len(resp.Questions) != 1 || !strings.EqualFold(resp.Questions[0].Name, q.Name) || resp.Questions[0].Type != q.Type) {
+			return nil, errors.New("response doesn't echo the question")
+		}
+
+		return resp, nil
+	}
+}
+
+// loopbackAddr returns the address the server can be reached at over the
+// loopback interface, once it listens
+func (srv *DNSServer) loopbackAddr() (string, bool) {
+	addr, ok := srv.udpAddr.Load().(*net.UDPAddr)
+	if !ok {
+		return "", false
+	}
+
+	ip := addr.IP
+	switch {
+	case ip == nil || ip.Equal(net.IPv4zero):
+		ip = net.IPv4(127, 0, 0, 1)
+	case ip.Equal(net.IPv6unspecified):
+		ip = net.IPv6loopback
+	}
+
+	return net.JoinHostPort(ip.String(), fmt.Sprint(addr.Port)), true
+}
+
+// Alive checks that the server listens and its handlers answer queries
+func (srv *DNSServer) Alive() error {
+	addr, ok := srv.loopbackAddr()
+	if !ok {
+		return errors.New("server is not listening")
+	}
+
+	return Ping(addr, defaultSelfTestTimeout)
+}
+
+// Ready checks that the server answers its self-test query as expected, and
+// isn't draining
+func (srv *DNSServer) Ready() error {
+	addr, ok := srv.loopbackAddr()
+	if !ok {
+		return errors.New("server is not listening")
+	}
+
+	if srv.DrainStatus().Draining {
+		return errors.New("server is draining")
+	}
+
+	if srv.selfTest != nil {
+		return srv.selfTest.Run(addr)
+	}
+
+	zones := srv.snapshot().zones
+	if len(zones) == 0 {
+		return Ping(addr, defaultSelfTestTimeout)
+	}
+
+	return SelfTest{Name: zones[0], Type: &TypeSOA}.Run(addr)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// startTestServer serves srv on an ephemeral loopback port and waits for it
+// to listen
+func startTestServer(t *testing.T, opts ...Option) *DNSServer {
+	t.Helper()
+
+	srv, err := NewDNSServer("127.0.0.1:0", "", opts...)
+	if err != nil {
+		t.Fatalf("error while creating server: %v", err)
+	}
+
+	go srv.Listen()
+
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := srv.loopbackAddr(); ok {
+			return srv
+		}
+	}
+
+	t.Fatalf("server didn't start listening")
+	return nil
+}
+
+func TestSelfTestBeforeListening(t *testing.T) {
+	srv, _ := NewDNSServer("127.0.0.1:0", "")
+
+	if err := srv.Alive(); err == nil {
+		t.Errorf("expected a server that doesn't listen not to be alive")
+	}
+
+	if err := srv.Ready(); err == nil {
+		t.Errorf("expected a server that doesn't listen not to be ready")
+	}
+}
+
+func TestSelfTestDefaults(t *testing.T) {
+	srv := startTestServer(t)
+
+	if err := srv.Alive(); err != nil {
+		t.Errorf("expected the server to be alive, got %v", err)
+	}
+
+	if err := srv.Ready(); err != nil {
+		t.Errorf("expected the server to be ready, got %v", err)
+	}
+}
+
+func TestSelfTestExpectedAnswer(t *testing.T) {
+	srv := startTestServer(t, WithSelfTest(SelfTest{Name: "test.kausm.in.", Type: &TypeA, Expect: "134.209.148.50"}))
+
+	if err := srv.Ready(); err != nil {
+		t.Errorf("expected the server to be ready, got %v", err)
+	}
+
+	addr, _ := srv.loopbackAddr()
+	wrong := SelfTest{Name: "test.kausm.in", Type: &TypeA, Expect: "10.0.0.1"}
+	if err := wrong.Run(addr); err == nil {
+		t.Errorf("expected a self-test with the wrong answer to fail")
+	}
+}
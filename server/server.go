@@ -2,11 +2,14 @@ package server
 
 import (
 	"encoding/binary"
-	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type (
@@ -73,6 +76,24 @@ var responseCodeMap = map[uint8]ResponseCode{
 	5: Refused,
 }
 
+var responseCodeNames = map[ResponseCode]string{
+	NoError:        "NOERROR",
+	FormatError:    "FORMERR",
+	ServerFailure:  "SERVFAIL",
+	NameError:      "NXDOMAIN",
+	NotImplemented: "NOTIMP",
+	Refused:        "REFUSED",
+}
+
+func (r ResponseCode) String() string {
+	name, ok := responseCodeNames[r]
+	if !ok {
+		return fmt.Sprintf("RCODE%d", uint8(r))
+	}
+
+	return name
+}
+
 func GetResponseCodeFromInt(n int) (ResponseCode, error) {
 	rcode, ok := responseCodeMap[uint8(n)]
 	if !ok {
@@ -88,6 +109,11 @@ type Question struct {
 	Class *QCLASS
 }
 
+// Len returns the size of q in wire format, without name compression
+func (q *Question) Len() int {
+	return domainNameLen(q.Name) + 4
+}
+
 func (q *Question) Encode(buf []byte) (int, error) {
 	wlen, err := EncodeDomainName(buf, q.Name)
 	if err != nil {
@@ -111,30 +137,140 @@ func ReadQuestionFrom(buf []byte) (int, *Question, error) {
 		return bytesRead, nil, err
 	}
 
-	qtype, err := bytesToQtype(buf[bytesRead : bytesRead+2])
-	if err != nil {
-		return bytesRead, nil, err
-	}
-	bytesRead += 2
-
-	qclass, err := bytesToClass(buf[bytesRead : bytesRead+2])
-	if err != nil {
-		return bytesRead, nil, err
+	if len(buf) < bytesRead+4 {
+		return bytesRead, nil, errors.New("question runs past end of buffer")
 	}
-	bytesRead += 2
 
+	// types and classes without a definition are still valid questions,
+	// which can be forwarded, so they get made up QTYPEs and QCLASSes
 	q := Question{
 		Name:  name,
-		Type:  qtype,
-		Class: qclass,
+		Type:  qtypeForCode(binary.BigEndian.Uint16(buf[bytesRead:])),
+		Class: qclassForCode(binary.BigEndian.Uint16(buf[bytesRead+2:])),
 	}
+	bytesRead += 4
 
 	return bytesRead, &q, nil
 }
 
 type DNSServer struct {
-	laddr   string
-	records []*ResourceRecord
+	laddr string
+
+	// current holds the *zoneSnapshot queries are answered from. It is
+	// swapped atomically, so readers take no locks
+	current atomic.Value
+
+	// recordsMu serializes changes to the records and guards history, the
+	// last snapshotHistory versions of them
+	recordsMu       sync.Mutex
+	history         []*zoneSnapshot
+	snapshotHistory int
+
+	// maxUDPSize is the largest UDP response the server will send
+	maxUDPSize uint16
+
+	// nsid identifies this instance to clients asking with the NSID option
+	nsid []byte
+
+	// forwarder, when set, answers queries outside the server's zones
+	forwarder *Forwarder
+
+	// backends answer queries for their zones instead of the records
+	backends []Backend
+
+	// policy, when set, decides what to do with queries before anything else
+	policy *Policy
+
+	// udpAddr holds the *net.UDPAddr the server listens on, once it does
+	udpAddr atomic.Value
+
+	// parseMode is how strictly queries are parsed
+	parseMode ParseMode
+
+	// tlsListeners are served along with UDP and TCP
+	tlsListeners []TLSListener
+
+	// chaos, when set, injects faults into responses for testing
+	chaos *chaosInjector
+
+	// udpBatchSize is how many datagrams are read and written per system
+	// call, see WithUDPBatchSize
+	udpBatchSize int
+
+	// selfTest, when set, is the query readiness checks send
+	selfTest *SelfTest
+
+	// zoneFiles are loaded along with the records file
+	zoneFiles []zoneFile
+
+	// drainStatus is guarded by drainMu. refuseAt holds the time.Time from
+	// which queries are refused while draining, for the query path to read
+	// without locking
+	drainMu     sync.Mutex
+	drainStatus DrainStatus
+	refuseAt    atomic.Value
+
+	// logger is the logger given to the server, log is its "server" scope
+	logger Logger
+	log    Logger
+
+	// stats counts queries per zone
+	stats zoneStatsRecorder
+
+	// retransmissions coalesces UDP queries a client sends again before
+	// the original is answered
+	retransmissions inflightGroup
+
+	// audit keeps the changes to the records
+	audit auditLog
+
+	// panics counts the queries handlers recovered from a panic on
+	panics uint64
+
+	// randMu guards rand, which is shared between packet handlers
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// Option configures optional behaviour of a DNSServer
+type Option func(*DNSServer)
+
+// WithRandSource makes the server draw all of its randomness (answer
+// rotation, ID generation) from src, so that tests can be deterministic
+func WithRandSource(src rand.Source) Option {
+	return func(srv *DNSServer) {
+		srv.rand = rand.New(src)
+	}
+}
+
+// WithLogger makes the server log through l instead of logging messages of
+// level info and above to stderr
+func WithLogger(l Logger) Option {
+	return func(srv *DNSServer) {
+		srv.logger = l
+	}
+}
+
+// WithSeed seeds the server's random source with seed
+func WithSeed(seed int64) Option {
+	return WithRandSource(rand.NewSource(seed))
+}
+
+// WithParseMode sets how strictly the server parses queries. In strict mode,
+// queries that are out of spec are answered with FORMERR. The server is
+// permissive by default
+func WithParseMode(mode ParseMode) Option {
+	return func(srv *DNSServer) {
+		srv.parseMode = mode
+	}
+}
+
+// intn returns a random int in [0, n) from the server's random source
+func (srv *DNSServer) intn(n int) int {
+	srv.randMu.Lock()
+	defer srv.randMu.Unlock()
+
+	return srv.rand.Intn(n)
 }
 
 type DNSHeader struct {
@@ -145,6 +281,8 @@ type DNSHeader struct {
 	IsTruncated            bool   // Was the message truncated?
 	RecursionDesired       bool   // is recursion desired? set in query and may be copied into response
 	RecursionAvailable     bool   // whether recursive query support is available in name server
+	AuthenticData          bool   // AD, all answer data was validated with DNSSEC, see RFC 4035
+	CheckingDisabled       bool   // CD, the client doesn't want DNSSEC validation done for it
 	ResponseCode           ResponseCode
 	QuestionsCount         uint16
 	AnswersCount           uint16
@@ -179,6 +317,14 @@ func parseRA(headerBits uint16) bool {
 	return headerBits&(uint16(1)<<7) != 0
 }
 
+func parseAD(headerBits uint16) bool {
+	return headerBits&(uint16(1)<<5) != 0
+}
+
+func parseCD(headerBits uint16) bool {
+	return headerBits&(uint16(1)<<4) != 0
+}
+
 func parseRCode(headerBits uint16) (ResponseCode, error) {
 	rcode := headerBits & ((uint16(1) << 3) | uint16(1)<<2 | uint16(1)<<1 | uint16(1))
 	return GetResponseCodeFromInt(int(rcode))
@@ -207,6 +353,10 @@ func (h *DNSHeader) ReadFrom(buf []byte) (err error) {
 
 	h.RecursionAvailable = parseRA(headerBits)
 
+	h.AuthenticData = parseAD(headerBits)
+
+	h.CheckingDisabled = parseCD(headerBits)
+
 	h.ResponseCode, err = parseRCode(headerBits)
 	if err != nil {
 		return
@@ -252,11 +402,17 @@ func (h DNSHeader) encodeHeaderBits(buf []byte) {
 		headerBits |= uint16(1) << 7
 	}
 
+	if h.AuthenticData {
+		headerBits |= uint16(1) << 5
+	}
+
+	if h.CheckingDisabled {
+		headerBits |= uint16(1) << 4
+	}
+
 	headerBits |= uint16(h.ResponseCode) & (uint16(1)<<3 | uint16(1)<<2 | uint16(1)<<1 | uint16(1))
 
 	binary.BigEndian.PutUint16(buf, headerBits)
-
-	fmt.Printf("%s\n", hex.Dump(buf[:2]))
 }
 
 func (h DNSHeader) Encode(buf []byte) (int, error) {
@@ -272,37 +428,71 @@ func (h DNSHeader) Encode(buf []byte) (int, error) {
 	return 12, nil
 }
 
-func NewDNSServer(laddr string, recordsFile string) (*DNSServer, error) {
+func NewDNSServer(laddr string, recordsFile string, opts ...Option) (*DNSServer, error) {
+	srv := DNSServer{
+		laddr:  laddr,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		logger: defaultLogger(),
+
+		maxUDPSize:      defaultMaxUDPSize,
+		snapshotHistory: defaultSnapshotHistory,
+	}
+
+	for _, opt := range opts {
+		opt(&srv)
+	}
+
+	srv.log = scopeLogger(srv.logger, "server")
+	if srv.policy != nil {
+		srv.policy.log = scopeLogger(srv.logger, "policy")
+	}
+
+	if err := srv.checkForwardingLoops(); err != nil {
+		return nil, err
+	}
+
 	records := []*ResourceRecord{}
+	reason := "default records"
 
-	// TODO: read recordsFile
-	if recordsFile == "" {
-		soa, _ := EncodeSOA("kausm.in", "kaustubh.kausm.in", 1, 600, 600, 600, 600)
-		soaRecord := ResourceRecord{
-			Type:  &TypeSOA,
-			Name:  "kausm.in",
-			Class: &ClassIN,
-			TTL:   600,
-			Value: soa,
-		}
-		record1 := ResourceRecord{
-			Type:  &TypeA,
-			Name:  "test.kausm.in",
-			Class: &ClassIN,
-			TTL:   600,
-			Value: []byte{134, 209, 148, 50},
+	if recordsFile != "" {
+		srv.zoneFiles = append([]zoneFile{{path: recordsFile}}, srv.zoneFiles...)
+	}
+
+	if len(srv.zoneFiles) > 0 {
+		loaded := []string{}
+		zoneLog := scopeLogger(srv.logger, "zone")
+		for _, zf := range srv.zoneFiles {
+			start := time.Now()
+			n, err := zf.load(zoneLog, func(rr *ResourceRecord) {
+				records = append(records, rr)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("error while loading records file: %v", err)
+			}
+
+			zoneLog.Infof("loaded %d records from %s in %s", n, zf.path, time.Since(start).Round(time.Millisecond))
+			loaded = append(loaded, zf.path)
 		}
-		records = append(records, &record1, &soaRecord)
+
+		reason = "loaded " + strings.Join(loaded, ", ")
+	} else {
+		soaRecord, _ := NewSOA("kausm.in", 600, "kausm.in", "kaustubh.kausm.in", 1, 600, 600, 600, 600)
+		record1, _ := NewA("test.kausm.in", 600, net.IPv4(134, 209, 148, 50))
+		records = append(records, record1, soaRecord)
 	}
 
-	srv := DNSServer{
-		laddr:   laddr,
-		records: records,
+	if err := checkCNAMEChains(records); err != nil {
+		return nil, fmt.Errorf("error while loading records: %v", err)
 	}
 
+	srv.publishLocked(loadedSnapshot(records), recordDelta{added: records}, recordChange{source: ChangeSourceLoad, reason: reason})
+	srv.flushAudit()
+
 	return &srv, nil
 }
 
+// Listen serves DNS over UDP and TCP on the server's listen address, and over
+// TLS on the addresses of its TLS listeners
 func (srv *DNSServer) Listen() error {
 	laddr, err := net.ResolveUDPAddr("udp", srv.laddr)
 	if err != nil {
@@ -314,79 +504,258 @@ func (srv *DNSServer) Listen() error {
 		return fmt.Errorf("error while listening for udp: %v", err)
 	}
 
-	for {
-		input := make([]byte, 512)
-		rlen, returnAddr, err := conn.ReadFromUDP(input)
-		if err != nil {
-			log.Printf("Error: %v\n", err)
+	tcpListener, err := net.Listen("tcp", srv.laddr)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error while listening for tcp: %v", err)
+	}
+
+	if err := srv.listenTLS(); err != nil {
+		conn.Close()
+		tcpListener.Close()
+		return err
+	}
+
+	srv.udpAddr.Store(conn.LocalAddr())
+
+	go srv.serveTCP(tcpListener)
+	go srv.sweepExpiredRecordsEvery(sweepInterval)
+
+	srv.serveUDP(conn)
+	return nil
+}
+
+// CheckListen checks that the server can listen on its addresses, over UDP,
+// TCP and TLS, by opening and closing them right away
+func (srv *DNSServer) CheckListen() error {
+	laddr, err := net.ResolveUDPAddr("udp", srv.laddr)
+	if err != nil {
+		return fmt.Errorf("error while resolving given listen addr: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return fmt.Errorf("error while listening for udp: %v", err)
+	}
+	defer conn.Close()
+
+	tcpListener, err := net.Listen("tcp", srv.laddr)
+	if err != nil {
+		return fmt.Errorf("error while listening for tcp: %v", err)
+	}
+	defer tcpListener.Close()
+
+	for _, tl := range srv.tlsListeners {
+		if err := tl.checkCertificate(); err != nil {
+			return err
 		}
 
-		go srv.handleUDPPacket(conn, input[:rlen], returnAddr)
+		l, err := net.Listen("tcp", withDefaultPort(tl.Addr, "853"))
+		if err != nil {
+			return fmt.Errorf("error while listening for tls: %v", err)
+		}
+		l.Close()
 	}
+
+	return nil
 }
 
 func (srv *DNSServer) LookupRecords(recordType *QTYPE, recordClass *QCLASS, name string) *ResourceRecord {
-	for _, r := range srv.records {
-		if r.Type == recordType && r.Class == recordClass && strings.ToLower(r.Name) == strings.ToLower(name) {
-			return r
+	records := srv.lookupAllRecords(recordType, recordClass, name)
+	if len(records) == 0 {
+		return nil
+	}
+
+	return records[0]
+}
+
+func (srv *DNSServer) lookupAllRecords(recordType *QTYPE, recordClass *QCLASS, name string) []*ResourceRecord {
+	now := time.Now()
+
+	var records []*ResourceRecord
+	for _, r := range srv.snapshot().recordsNamed(name) {
+		if r.Type == recordType && r.Class == recordClass && !r.expired(now) {
+			records = append(records, r.cappedToExpiry(now))
 		}
 	}
 
-	return nil
+	return records
 }
 
-func (srv DNSServer) setDefaultHeaders(h *DNSHeader) {
+// rotateRecords returns records rotated by a random offset, so that clients
+// are spread across all the addresses of a name
+func (srv *DNSServer) rotateRecords(records []*ResourceRecord) []*ResourceRecord {
+	if len(records) < 2 {
+		return records
+	}
+
+	offset := srv.intn(len(records))
+
+	rotated := make([]*ResourceRecord, 0, len(records))
+	rotated = append(rotated, records[offset:]...)
+	rotated = append(rotated, records[:offset]...)
+
+	return rotated
+}
+
+func (srv *DNSServer) setDefaultHeaders(h *DNSHeader) {
 	h.RecursionAvailable = false
 	h.IsTruncated = false
 	h.IsAuthoritative = false
+	h.AuthenticData = false
 }
 
-func (srv *DNSServer) handleUDPPacket(conn *net.UDPConn, buf []byte, returnAddr *net.UDPAddr) {
-	log.Printf("got packet from %s\n", returnAddr.String())
+func (srv *DNSServer) handleUDPPacket(respond udpResponder, buf []byte, returnAddr *net.UDPAddr) {
+	srv.log.Debugf("got packet from %s", returnAddr.String())
+
+	// a client that retransmits its query while the original is still being
+	// answered, as happens when forwarding takes longer than its timeout,
+	// gets the answer to the original rather than a computation of its own.
+	// Retransmissions are byte for byte identical, so the whole query is
+	// compared, which covers its ID and question as well as its EDNS
+	key := returnAddr.String() + "/" + string(buf)
+	msg, err := srv.retransmissions.do(key, func() ([]byte, error) {
+		return srv.handleQuerySafely(buf, returnAddr, true)
+	})
+	if err != nil {
+		srv.log.Warnf("error while handling query from %s: %v", returnAddr.String(), err)
+		return
+	}
+
+	msg, ok := srv.chaos.apply(msg, true)
+	if !ok {
+		srv.log.Debugf("chaos dropped response to %s", returnAddr.String())
+		return
+	}
+
+	err = respond(msg, returnAddr)
+	if err != nil {
+		srv.log.Warnf("error while responding: %v", err)
+	}
+}
 
+// handleQuery answers the query message in buf and returns the encoded
+// response. Responses over UDP are limited to what the client can receive,
+// responses over TCP only by the largest message size
+func (srv *DNSServer) handleQuery(buf []byte, from net.Addr, overUDP bool) (resp []byte, err error) {
 	rlen := 0
 
+	if len(buf) < 12 {
+		return nil, errors.New("message shorter than header")
+	}
+
 	headers := DNSHeader{}
-	err := headers.ReadFrom(buf)
+	err = headers.ReadFrom(buf)
 	if err != nil {
-		log.Printf("error while reading header: %v", err)
-		return
+		return nil, fmt.Errorf("error while reading header: %v", err)
 	}
 
 	rlen += 12
 
 	srv.setDefaultHeaders(&headers)
 
+	// the question section is decoded once, with the server's parse mode. In
+	// strict mode the whole query is, so that anything out of spec in it is
+	// answered with FORMERR
+	var questions []*Question
+	var strictMsg *Message
+	if srv.parseMode == ParseStrict {
+		strictMsg, err = DecodeMessageMode(buf, ParseStrict)
+		if err == nil {
+			questions = strictMsg.Questions
+		}
+	} else {
+		questions, rlen, err = readQuestions(buf, rlen, int(headers.QuestionsCount), srv.parseMode)
+	}
+	if err != nil {
+		srv.log.Debugf("malformed query from %s: %v", addrString(from), err)
+
+		headers.ResponseCode = FormatError
+		return encodeResponse(&headers, nil, nil, nil, nil, nil, maxUDPMessageSize)
+	}
+
+	// every answer to the questions counts towards the stats of their zones,
+	// whichever way it was made
+	defer func() {
+		if err == nil && len(resp) >= 4 {
+			srv.stats.recordQuery(srv, questions, ResponseCode(resp[3]&0x0f))
+		}
+	}()
+
 	if headers.Type != QRQuery || headers.OpCode != QueryOp {
-		log.Printf("not implemented")
+		srv.log.Debugf("not implemented: type %v, opcode %d", headers.Type, headers.OpCode)
 
 		// only support standard query for now
 		headers.ResponseCode = NotImplemented
 		headers.AnswersCount = 0
 
-		err := srv.RespondToUDP(conn, returnAddr, &headers, nil, nil, nil, nil)
-		if err != nil {
-			log.Printf("error while responding: %v", err)
-			return
-		}
-
-		return
+		return encodeResponse(&headers, nil, nil, nil, nil, nil, maxUDPMessageSize)
 	}
 
-	questions := []*Question{}
 	answers := []*ResourceRecord{}
 	nameservers := []*ResourceRecord{}
 	additionals := []*ResourceRecord{}
 
-	for qi := uint16(0); qi < headers.QuestionsCount; qi++ {
-		bytesRead, q, err := ReadQuestionFrom(buf[rlen:])
-		rlen += bytesRead
+	var respEDNS *EDNS
+	maxSize := maxDatagramSize
+	if overUDP {
+		maxSize = maxUDPMessageSize
+	}
+
+	var reqEDNS *EDNS
+	if strictMsg != nil {
+		reqEDNS = strictMsg.EDNS
+	} else if headers.AnswersCount == 0 && headers.NameserversCount == 0 && headers.AdditionalRecordsCount > 0 {
+		// queries carry no answer or authority records, so the OPT record
+		// is found among the additional records right after the questions
+		reqEDNS, err = ReadEDNSFrom(buf[rlen:], int(headers.AdditionalRecordsCount))
 		if err != nil {
-			log.Printf("error while reading question %d: %v", qi+1, err)
-			return
+			srv.log.Debugf("error while reading additional records: %v", err)
+		}
+	}
+
+	if reqEDNS != nil {
+		if overUDP {
+			maxSize = srv.udpResponseSize(reqEDNS)
 		}
+		respEDNS = srv.responseEDNS(reqEDNS)
+	}
 
-		questions = append(questions, q)
+	if srv.refusingQueries(time.Now()) {
+		headers.ResponseCode = Refused
+		return encodeResponse(&headers, questions, nil, nil, nil, respEDNS, maxSize)
+	}
+
+	if len(questions) == 1 && questions[0].Class == &ClassCH {
+		return srv.answerChaos(&headers, questions[0], respEDNS, maxSize)
+	}
+
+	if srv.policy != nil && len(questions) == 1 {
+		resp, decided, err := srv.applyPolicy(&headers, questions[0], from, overUDP, respEDNS, maxSize)
+		if decided {
+			return resp, err
+		}
+	}
+
+	if len(questions) == 1 {
+		if backend, ok := srv.backendFor(questions[0].Name); ok {
+			return srv.answerFromBackend(backend, &headers, questions[0], respEDNS, maxSize)
+		}
+	}
+
+	if srv.forwarder != nil && len(questions) == 1 && !srv.isAuthoritativeFor(questions[0].Name) {
+		return srv.forward(srv.forwarder, &headers, questions[0], from, maxSize)
+	}
+
+	for _, q := range questions {
+		if (!isKnownQtype(q.Type) || q.Class != &ClassIN) && srv.isAuthoritativeFor(q.Name) {
+			// records of types and classes without a definition can't be
+			// stored, so there's no telling whether a name has them
+			srv.log.Debugf("not implemented: %s", q)
+
+			headers.ResponseCode = NotImplemented
+			return encodeResponse(&headers, questions, nil, nil, nil, respEDNS, maxSize)
+		}
 
 		answersi, nameserversi, additionalsi, isAuthoritative := srv.GetAnswers(q)
 		headers.IsAuthoritative = isAuthoritative
@@ -400,43 +769,155 @@ func (srv *DNSServer) handleUDPPacket(conn *net.UDPConn, buf []byte, returnAddr
 		additionals = append(additionals, additionalsi...)
 	}
 
-	srv.RespondToUDP(conn, returnAddr, &headers, questions, answers, nameservers, additionals)
+	return encodeResponse(&headers, questions, answers, nameservers, additionals, respEDNS, maxSize)
+}
 
-	return
+// zonesOf returns the owner names of the SOA records among records
+func zonesOf(records []*ResourceRecord) []string {
+	zones := []string{}
+	for _, r := range records {
+		if r.Type == &TypeSOA {
+			zones = append(zones, strings.ToLower(r.Name))
+		}
+	}
+
+	return zones
 }
 
-func (srv *DNSServer) GetAnswers(q *Question) ([]*ResourceRecord, []*ResourceRecord, []*ResourceRecord, bool) {
-	log.Printf("getting answer for question: %s", q.String())
+func (srv *DNSServer) isAuthoritativeFor(name string) bool {
+	_, ok := srv.zoneFor(name)
+	return ok
+}
 
-	isAuthoritative := strings.HasSuffix(strings.ToLower(q.Name), "kausm.in")
-	answer := srv.LookupRecords(q.Type, q.Class, q.Name)
+// zoneFor returns the closest enclosing zone of name that the server is
+// authoritative for
+func (srv *DNSServer) zoneFor(name string) (string, bool) {
+	return closestZone(srv.snapshot().zones, name)
+}
+
+func closestZone(zones []string, name string) (string, bool) {
+	name = strings.ToLower(name)
+
+	closest, found := "", false
+	for _, zone := range zones {
+		if name == zone || strings.HasSuffix(name, "."+zone) || zone == "" {
+			if !found || len(zone) > len(closest) {
+				closest, found = zone, true
+			}
+		}
+	}
+
+	return closest, found
+}
 
-	var answers []*ResourceRecord
-	if answer != nil {
-		answers = append(answers, answer)
+// forward relays the query of the client at from to forwarder f and returns
+// its response under the client's query ID
+func (srv *DNSServer) forward(f *Forwarder, headers *DNSHeader, q *Question, from net.Addr, maxSize int) ([]byte, error) {
+	client := ""
+	if ip := addrIP(from); ip != nil {
+		client = ip.String()
+	}
+
+	resp, err := f.ExchangeFor(client, q, headers.RecursionDesired)
+	if err != nil {
+		srv.log.Warnf("error while forwarding question %s: %v", q.String(), err)
+
+		headers.ResponseCode = ServerFailure
+		return encodeResponse(headers, []*Question{q}, nil, nil, nil, nil, maxSize)
+	}
+
+	binary.BigEndian.PutUint16(resp[:2], headers.ID)
+
+	// responses retried over TCP upstream may not fit in the client's datagram
+	resp, err = truncateResponse(resp, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("error while truncating forwarded response: %v", err)
 	}
 
+	return resp, nil
+}
+
+func (srv *DNSServer) GetAnswers(q *Question) ([]*ResourceRecord, []*ResourceRecord, []*ResourceRecord, bool) {
+	srv.log.Debugf("getting answer for question: %s", q.String())
+
+	isAuthoritative := srv.isAuthoritativeFor(q.Name)
+	answers := srv.rotateRecords(srv.lookupAllRecords(q.Type, q.Class, q.Name))
+
 	return answers, nil, nil, isAuthoritative
 }
 
 func (srv *DNSServer) RespondToUDP(conn *net.UDPConn, returnAddr *net.UDPAddr, headers *DNSHeader, questions []*Question, answers []*ResourceRecord, nameservers []*ResourceRecord, additionalRecords []*ResourceRecord) error {
+	msg, err := encodeResponse(headers, questions, answers, nameservers, additionalRecords, nil, maxUDPMessageSize)
+	if err != nil {
+		return err
+	}
+
+	return srv.writeUDPResponse(conn, returnAddr, msg)
+}
+
+func (srv *DNSServer) writeUDPResponse(conn *net.UDPConn, returnAddr *net.UDPAddr, msg []byte) error {
+	srv.log.Debugf("writing to return addr: %s, bytes: %d", returnAddr.String(), len(msg))
+	_, err := conn.WriteTo(msg, returnAddr)
+	if err != nil {
+		return fmt.Errorf("error while writing to conn: %v", err)
+	}
+
+	return nil
+}
+
+// encodeResponse encodes a response message with an optional OPT record that
+// fits in maxSize. Sizes are worked out before encoding: additional records
+// are left out first, as they are optional, and if the answers and
+// authority records still don't fit, all records but the OPT are left out
+// and the TC bit is set, so that the client retries over TCP
+func encodeResponse(headers *DNSHeader, questions []*Question, answers []*ResourceRecord, nameservers []*ResourceRecord, additionalRecords []*ResourceRecord, edns *EDNS, maxSize int) ([]byte, error) {
+	m := Message{
+		Questions:   questions,
+		Answers:     answers,
+		Nameservers: nameservers,
+		Additionals: additionalRecords,
+		EDNS:        edns,
+	}
+
+	if m.EstimateSize(false) > maxSize {
+		m.Additionals = nil
+	}
+
+	if m.EstimateSize(false) > maxSize {
+		headers.IsTruncated = true
+		m.Answers = nil
+		m.Nameservers = nil
+	}
+
+	if size := m.EstimateSize(false); size > maxSize {
+		return nil, fmt.Errorf("response of %d bytes does not fit in %d bytes even when truncated", size, maxSize)
+	}
+
+	return encodeMessage(headers, m.Questions, m.Answers, m.Nameservers, m.Additionals, m.EDNS)
+}
+
+func encodeMessage(headers *DNSHeader, questions []*Question, answers []*ResourceRecord, nameservers []*ResourceRecord, additionalRecords []*ResourceRecord, edns *EDNS) ([]byte, error) {
 	headers.Type = QRResponse
 	headers.QuestionsCount = uint16(len(questions))
 	headers.AnswersCount = uint16(len(answers))
 	headers.NameserversCount = uint16(len(nameservers))
 	headers.AdditionalRecordsCount = uint16(len(additionalRecords))
 
-	buf := make([]byte, 512)
+	if edns != nil {
+		headers.AdditionalRecordsCount++
+	}
+
+	buf := make([]byte, maxDatagramSize)
 
 	bytesWritten, err := headers.Encode(buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	for _, q := range questions {
 		n, err := q.Encode(buf[bytesWritten:])
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		bytesWritten += n
@@ -445,7 +926,7 @@ func (srv *DNSServer) RespondToUDP(conn *net.UDPConn, returnAddr *net.UDPAddr, h
 	for _, rr := range answers {
 		n, err := rr.Encode(buf[bytesWritten:])
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		bytesWritten += n
@@ -454,7 +935,7 @@ func (srv *DNSServer) RespondToUDP(conn *net.UDPConn, returnAddr *net.UDPAddr, h
 	for _, rr := range nameservers {
 		n, err := rr.Encode(buf[bytesWritten:])
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		bytesWritten += n
@@ -463,17 +944,20 @@ func (srv *DNSServer) RespondToUDP(conn *net.UDPConn, returnAddr *net.UDPAddr, h
 	for _, rr := range additionalRecords {
 		n, err := rr.Encode(buf[bytesWritten:])
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		bytesWritten += n
 	}
 
-	log.Printf("writing to return addr: %s, bytes: %d", returnAddr.String(), bytesWritten)
-	_, err = conn.WriteTo(buf[:bytesWritten], returnAddr)
-	if err != nil {
-		return fmt.Errorf("error while writing to conn: %v", err)
+	if edns != nil {
+		n, err := edns.Encode(buf[bytesWritten:])
+		if err != nil {
+			return nil, err
+		}
+
+		bytesWritten += n
 	}
 
-	return nil
+	return buf[:bytesWritten], nil
 }
@@ -1,6 +1,11 @@
 package server
 
-import "testing"
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
 
 func TestDNSHeaderEncodeQuery(t *testing.T) {
 	h := DNSHeader{
@@ -112,3 +117,134 @@ func TestDNSHeaderEncodeResponseNotImplemented(t *testing.T) {
 		}
 	}
 }
+
+func TestRotateRecordsDeterministicWithSeed(t *testing.T) {
+	records := []*ResourceRecord{
+		{Name: "a.kausm.in", Type: &TypeA, Class: &ClassIN, Value: []byte{10, 0, 0, 1}},
+		{Name: "a.kausm.in", Type: &TypeA, Class: &ClassIN, Value: []byte{10, 0, 0, 2}},
+		{Name: "a.kausm.in", Type: &TypeA, Class: &ClassIN, Value: []byte{10, 0, 0, 3}},
+	}
+
+	srv1, _ := NewDNSServer("", "", WithSeed(42))
+	srv2, _ := NewDNSServer("", "", WithSeed(42))
+
+	for i := 0; i < 10; i++ {
+		rotated1 := srv1.rotateRecords(records)
+		rotated2 := srv2.rotateRecords(records)
+
+		if len(rotated1) != len(records) {
+			t.Fatalf("rotation lost records: %d != %d", len(rotated1), len(records))
+		}
+
+		for j := range rotated1 {
+			if rotated1[j] != rotated2[j] {
+				t.Fatalf("rotations with the same seed differ at round %d", i)
+			}
+		}
+	}
+}
+
+// slowBackend counts its lookups, each of which takes delay
+type slowBackend struct {
+	delay   time.Duration
+	lookups int32
+}
+
+func (b *slowBackend) Zones() []string {
+	return []string{"slow.example"}
+}
+
+func (b *slowBackend) Lookup(q *Question) ([]*ResourceRecord, error) {
+	atomic.AddInt32(&b.lookups, 1)
+	time.Sleep(b.delay)
+
+	rr, err := NewA(q.Name, 60, net.IPv4(192, 0, 2, 1))
+	return []*ResourceRecord{rr}, err
+}
+
+func TestUDPRetransmissionsAreAnsweredOnce(t *testing.T) {
+	backend := slowBackend{delay: 200 * time.Millisecond}
+	srv := startTestServer(t, WithBackend(&backend))
+	addr, _ := srv.loopbackAddr()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("error while dialing: %v", err)
+	}
+	defer conn.Close()
+
+	q := Question{Name: "db.slow.example", Type: &TypeA, Class: &ClassIN}
+	query := encodeTestQuery(t, 7, &q)
+
+	// the retransmission arrives while the original is being looked up
+	for i := 0; i < 2; i++ {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatalf("error while writing query: %v", err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxUDPMessageSize)
+	for i := 0; i < 2; i++ {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("error while reading response %d: %v", i+1, err)
+		}
+
+		msg, err := DecodeMessage(buf[:n])
+		if err != nil || msg.Header.ID != 7 || len(msg.Answers) != 1 {
+			t.Fatalf("expected an answer to query 7, got %v, %v", msg, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(&backend.lookups); n != 1 {
+		t.Errorf("expected 1 lookup for a query and its retransmission, got %d", n)
+	}
+
+	// once answered, the same query is looked up again
+	if _, err := conn.Write(query); err != nil {
+		t.Fatalf("error while writing query: %v", err)
+	}
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("error while reading response: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&backend.lookups); n != 2 {
+		t.Errorf("expected a later query to be looked up again, got %d lookups", n)
+	}
+}
+
+func TestCheckListen(t *testing.T) {
+	srv, err := NewDNSServer("127.0.0.1:0", "")
+	if err != nil {
+		t.Fatalf("error while creating server: %v", err)
+	}
+
+	if err := srv.CheckListen(); err != nil {
+		t.Errorf("error while checking free listen address: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	defer l.Close()
+
+	srv, err = NewDNSServer(l.Addr().String(), "")
+	if err != nil {
+		t.Fatalf("error while creating server: %v", err)
+	}
+
+	if err := srv.CheckListen(); err == nil {
+		t.Errorf("no error for a listen address in use")
+	}
+
+	srv, err = NewDNSServer("127.0.0.1:0", "", WithTLSListener(TLSListener{Addr: "127.0.0.1:0"}))
+	if err != nil {
+		t.Fatalf("error while creating server: %v", err)
+	}
+
+	if err := srv.CheckListen(); err == nil {
+		t.Errorf("no error for a tls listener without a certificate")
+	}
+}
@@ -0,0 +1,308 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// defaultSnapshotHistory is how many versions of the records are kept around
+// for rollbacks by default
+const defaultSnapshotHistory = 10
+
+// zoneSnapshot is one version of the records the server answers from. It is
+// never modified once published: changes build a new snapshot and swap it in,
+// so queries always see a whole version and never a half applied change
+type zoneSnapshot struct {
+	version   uint64
+	createdAt time.Time
+	reason    string
+
+	// count is how many records there are
+	count int
+
+	// zones are the apexes (names with an SOA record) the server is
+	// authoritative for in this version
+	zones []string
+
+	// index holds the records by name, so that they are found and changed
+	// without scanning them all
+	index *recordIndex
+
+	// expiring are the records with an ExpiresAt time, which are all the
+	// sweeper needs to look at
+	expiring []*ResourceRecord
+}
+
+// SnapshotInfo describes a version of the records kept for rollbacks
+type SnapshotInfo struct {
+	Version   uint64    `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Reason    string    `json:"reason"`
+	Records   int       `json:"records"`
+	Current   bool      `json:"current"`
+}
+
+// WithSnapshotHistory sets how many versions of the records, the current one
+// included, are kept so that changes can be rolled back
+func WithSnapshotHistory(n int) Option {
+	return func(srv *DNSServer) {
+		if n < 1 {
+			n = 1
+		}
+
+		srv.snapshotHistory = n
+	}
+}
+
+// snapshot returns the current version of the records
+func (srv *DNSServer) snapshot() *zoneSnapshot {
+	return srv.current.Load().(*zoneSnapshot)
+}
+
+// recordDelta is what a change did to the records: the records it added, and
+// those it removed
+type recordDelta struct {
+	added   []*ResourceRecord
+	removed []*ResourceRecord
+}
+
+// recordUpdate is a change being made to the current records. It finds the
+// records of a name as the change left them so far, and notes what it adds
+// and removes in delta, for the new version and the audit log
+type recordUpdate struct {
+	current *zoneSnapshot
+	delta   recordDelta
+}
+
+// recordsNamed returns the records of name as the update left them so far
+func (u *recordUpdate) recordsNamed(name string) []*ResourceRecord {
+	records := u.current.recordsNamed(name)
+	if len(u.delta.added) == 0 && len(u.delta.removed) == 0 {
+		return records
+	}
+
+	named := []*ResourceRecord{}
+	for _, rr := range records {
+		if !containsRecord(u.delta.removed, rr) {
+			named = append(named, rr)
+		}
+	}
+
+	for _, rr := range u.delta.added {
+		if strings.EqualFold(rr.Name, name) {
+			named = append(named, rr)
+		}
+	}
+
+	return named
+}
+
+// add adds rr to the records
+func (u *recordUpdate) add(rr *ResourceRecord) {
+	u.delta.added = append(u.delta.added, rr)
+}
+
+// remove removes rr, one of the records recordsNamed returned
+func (u *recordUpdate) remove(rr *ResourceRecord) {
+	for i, added := range u.delta.added {
+		if added == rr {
+			// rr was added by this update, which then never added it
+			u.delta.added = append(u.delta.added[:i:i], u.delta.added[i+1:]...)
+			return
+		}
+	}
+
+	u.delta.removed = append(u.delta.removed, rr)
+}
+
+// containsRecord reports whether rr is one of records
+func containsRecord(records []*ResourceRecord, rr *ResourceRecord) bool {
+	for _, r := range records {
+		if r == rr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateRecords lets update change the current records, and publishes the
+// result as a new version unless update reports that nothing changed. Only
+// the names the change touches are copied, the rest of the records are shared
+// with the current version
+func (srv *DNSServer) updateRecords(change recordChange, update func(u *recordUpdate) bool) {
+	defer srv.flushAudit()
+
+	srv.recordsMu.Lock()
+	defer srv.recordsMu.Unlock()
+
+	u := recordUpdate{current: srv.snapshot()}
+	if !update(&u) || len(u.delta.added)+len(u.delta.removed) == 0 {
+		return
+	}
+
+	srv.publishLocked(u.current.apply(u.delta), u.delta, change)
+}
+
+// loadedSnapshot returns the unpublished version of the loaded records
+func loadedSnapshot(records []*ResourceRecord) *zoneSnapshot {
+	snap := zoneSnapshot{
+		count: len(records),
+		zones: zonesOf(records),
+		index: newRecordIndex(records, len(records) >= backgroundIndexThreshold),
+	}
+
+	for _, rr := range records {
+		if !rr.ExpiresAt.IsZero() {
+			snap.expiring = append(snap.expiring, rr)
+		}
+	}
+
+	return &snap
+}
+
+// apply returns the unpublished version of the records delta makes of s's
+func (s *zoneSnapshot) apply(delta recordDelta) *zoneSnapshot {
+	return &zoneSnapshot{
+		count:    s.count + len(delta.added) - len(delta.removed),
+		zones:    s.zonesAfter(delta),
+		index:    s.index.apply(delta),
+		expiring: s.expiringAfter(delta),
+	}
+}
+
+// expiringAfter returns the expiring records of the records delta makes of
+// s's. s's own list is returned when delta doesn't change it
+func (s *zoneSnapshot) expiringAfter(delta recordDelta) []*ResourceRecord {
+	expiring := s.expiring
+	copied := false
+	for _, rr := range delta.removed {
+		if rr.ExpiresAt.IsZero() {
+			continue
+		}
+
+		for i, existing := range expiring {
+			if existing == rr {
+				expiring = append(append(make([]*ResourceRecord, 0, len(expiring)), expiring[:i]...), expiring[i+1:]...)
+				copied = true
+				break
+			}
+		}
+	}
+
+	for _, rr := range delta.added {
+		if rr.ExpiresAt.IsZero() {
+			continue
+		}
+
+		if !copied {
+			expiring = append([]*ResourceRecord(nil), expiring...)
+			copied = true
+		}
+		expiring = append(expiring, rr)
+	}
+
+	return expiring
+}
+
+// records returns all records of s, in no particular order
+func (s *zoneSnapshot) records() []*ResourceRecord {
+	records := make([]*ResourceRecord, 0, s.count)
+	s.index.each(func(rr *ResourceRecord) {
+		records = append(records, rr)
+	})
+
+	return records
+}
+
+// publishLocked swaps in snap, which differs from the current version by
+// delta, as the next version, and queues the audit entry of the change.
+// Callers must hold recordsMu, and flush the audit log once they released it
+func (srv *DNSServer) publishLocked(snap *zoneSnapshot, delta recordDelta, change recordChange) *zoneSnapshot {
+	version := uint64(1)
+	if n := len(srv.history); n > 0 {
+		version = srv.history[n-1].version + 1
+	}
+
+	previous, _ := srv.current.Load().(*zoneSnapshot)
+
+	snap.version = version
+	snap.createdAt = time.Now()
+	snap.reason = change.reason
+
+	srv.current.Store(snap)
+	srv.queueAudit(previous, snap, delta, change)
+
+	srv.history = append(srv.history, snap)
+	if len(srv.history) > srv.snapshotHistory {
+		srv.history = append([]*zoneSnapshot(nil), srv.history[len(srv.history)-srv.snapshotHistory:]...)
+	}
+
+	return snap
+}
+
+// Snapshots lists the versions of the records that can be rolled back to,
+// oldest first
+func (srv *DNSServer) Snapshots() []SnapshotInfo {
+	srv.recordsMu.Lock()
+	defer srv.recordsMu.Unlock()
+
+	current := srv.snapshot()
+
+	infos := make([]SnapshotInfo, 0, len(srv.history))
+	for _, snap := range srv.history {
+		infos = append(infos, SnapshotInfo{
+			Version:   snap.version,
+			CreatedAt: snap.createdAt,
+			Reason:    snap.reason,
+			Records:   snap.count,
+			Current:   snap == current,
+		})
+	}
+
+	return infos
+}
+
+// Rollback makes the records of an earlier version current again. The
+// rollback is published as a new version itself, so it can be undone the
+// same way
+func (srv *DNSServer) Rollback(version uint64) (SnapshotInfo, error) {
+	return srv.rollback(version, "")
+}
+
+// rollback rolls back to version on behalf of actor
+func (srv *DNSServer) rollback(version uint64, actor string) (SnapshotInfo, error) {
+	defer srv.flushAudit()
+
+	srv.recordsMu.Lock()
+	defer srv.recordsMu.Unlock()
+
+	for _, snap := range srv.history {
+		if snap.version != version {
+			continue
+		}
+
+		// the version rolled back to is immutable, so its records are
+		// shared rather than copied
+		restored := zoneSnapshot{count: snap.count, zones: snap.zones, index: snap.index, expiring: snap.expiring}
+		next := srv.publishLocked(&restored, srv.snapshot().index.diff(snap.index), recordChange{
+			source: ChangeSourceRollback,
+			actor:  actor,
+			reason: fmt.Sprintf("rollback to version %d", version),
+		})
+		srv.log.Infof("rolled back records to version %d as version %d", version, next.version)
+
+		info := SnapshotInfo{
+			Version:   next.version,
+			CreatedAt: next.createdAt,
+			Reason:    next.reason,
+			Records:   next.count,
+			Current:   true,
+		}
+
+		return info, nil
+	}
+
+	return SnapshotInfo{}, fmt.Errorf("version %d is not kept", version)
+}
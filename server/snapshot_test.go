@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSnapshotsKeepLastVersions(t *testing.T) {
+	srv, _ := NewDNSServer("", "", WithSnapshotHistory(3))
+
+	for i := 0; i < 4; i++ {
+		rr := ResourceRecord{Name: "new.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 60, Value: []byte{10, 0, 0, byte(i)}}
+		if err := srv.AddRecord(&rr); err != nil {
+			t.Fatalf("error while adding record: %v", err)
+		}
+	}
+
+	snapshots := srv.Snapshots()
+	if len(snapshots) != 3 {
+		t.Fatalf("expected 3 versions to be kept, got %d", len(snapshots))
+	}
+
+	if snapshots[0].Version != 3 || snapshots[2].Version != 5 || !snapshots[2].Current {
+		t.Errorf("expected versions 3 to 5 with 5 current, got %+v", snapshots)
+	}
+
+	if snapshots[2].Records != 6 {
+		t.Errorf("expected 6 records in the current version, got %d", snapshots[2].Records)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	srv.RemoveRecords("kausm.in", &TypeSOA, nil)
+	if srv.isAuthoritativeFor("test.kausm.in") {
+		t.Fatalf("expected the zone to be gone with its SOA record")
+	}
+
+	info, err := srv.Rollback(1)
+	if err != nil {
+		t.Fatalf("error while rolling back: %v", err)
+	}
+
+	if info.Version != 3 || !info.Current {
+		t.Errorf("expected the rollback to be published as version 3, got %+v", info)
+	}
+
+	if !srv.isAuthoritativeFor("test.kausm.in") || srv.LookupRecords(&TypeSOA, &ClassIN, "kausm.in") == nil {
+		t.Errorf("expected the zone to be back after the rollback")
+	}
+
+	if _, err := srv.Rollback(42); err == nil {
+		t.Errorf("expected rolling back to an unknown version to fail")
+	}
+}
+
+func TestSnapshotsAreNotModified(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	before := srv.snapshot()
+	srv.RemoveRecords("test.kausm.in", &TypeA, nil)
+
+	if named := before.recordsNamed("test.kausm.in"); before.count != 2 || len(named) != 1 || named[0].Type != &TypeA {
+		t.Errorf("expected the earlier version to keep its records, got %v", before.records())
+	}
+}
+
+func TestChangesShareUntouchedRecords(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	before := srv.snapshot()
+	rr, _ := NewA("www.kausm.in", 300, net.IPv4(192, 0, 2, 1))
+	srv.AddRecord(rr)
+	after := srv.snapshot()
+
+	touched := indexShard("www.kausm.in")
+	for i := range after.index.shards {
+		if i != touched && after.index.shards[i] != before.index.shards[i] {
+			t.Errorf("shard %d was copied by a change not touching it", i)
+		}
+	}
+
+	if after.count != 3 || len(after.expiring) != 0 {
+		t.Errorf("unexpected count %d and expiring records %v", after.count, after.expiring)
+	}
+
+	// a rollback only compares the shards that differ
+	info, err := srv.Rollback(before.version)
+	if err != nil {
+		t.Fatalf("error while rolling back: %v", err)
+	}
+	if info.Records != 2 || srv.snapshot().index != before.index {
+		t.Errorf("expected the rollback to reuse the records of version %d, got %+v", before.version, info)
+	}
+	if audit := srv.AuditLog(AuditQuery{}); len(audit) == 0 || len(audit[len(audit)-1].Removed) != 1 {
+		t.Errorf("expected the rollback to remove the added record, got %+v", audit)
+	}
+}
+
+func TestSweeperOnlyLooksAtExpiringRecords(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	now := time.Now()
+	token := &ResourceRecord{Name: "_acme-challenge.kausm.in", Type: &TypeTXT, Class: &ClassIN, TTL: 300,
+		Value: []byte("\x05token"), ExpiresAt: now.Add(time.Minute)}
+	srv.AddRecord(token)
+
+	expiring := srv.snapshot().expiring
+	if len(expiring) != 1 || expiring[0] != token {
+		t.Fatalf("expected the token to be tracked as expiring, got %v", expiring)
+	}
+
+	rr, _ := NewA("www.kausm.in", 300, net.IPv4(192, 0, 2, 1))
+	srv.AddRecord(rr)
+	if next := srv.snapshot().expiring; len(next) != 1 || &next[0] != &expiring[0] {
+		t.Errorf("expected a change without expiring records to share the list, got %v", next)
+	}
+
+	if removed := srv.sweepExpiredRecords(now.Add(2 * time.Minute)); removed != 1 {
+		t.Errorf("expected the token to be swept, removed %d", removed)
+	}
+	if snap := srv.snapshot(); len(snap.expiring) != 0 || snap.count != 3 {
+		t.Errorf("unexpected records after the sweep: %v", snap.records())
+	}
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// stampPrefix marks upstreams given as DNS stamps
+const stampPrefix = "sdns://"
+
+// StampProtocol is the protocol a DNS stamp is for
+type StampProtocol uint8
+
+const (
+	StampPlain    StampProtocol = 0x00
+	StampDNSCrypt StampProtocol = 0x01
+	StampDoH      StampProtocol = 0x02
+	StampDoT      StampProtocol = 0x03
+	StampDoQ      StampProtocol = 0x04
+)
+
+func (p StampProtocol) String() string {
+	switch p {
+	case StampPlain:
+		return "plain DNS"
+	case StampDNSCrypt:
+		return "DNSCrypt"
+	case StampDoH:
+		return "DNS over HTTPS"
+	case StampDoT:
+		return "DNS over TLS"
+	case StampDoQ:
+		return "DNS over QUIC"
+	}
+
+	return fmt.Sprintf("protocol 0x%02x", uint8(p))
+}
+
+// StampProps are the informal properties a DNS stamp claims its server has
+type StampProps uint64
+
+const (
+	StampDNSSEC   StampProps = 1 << 0
+	StampNoLog    StampProps = 1 << 1
+	StampNoFilter StampProps = 1 << 2
+)
+
+// Stamp is a DNS stamp, which packs everything needed to reach a resolver
+// into a single sdns:// URI, as specified on https://dnscrypt.info/stamps-specifications
+type Stamp struct {
+	Protocol StampProtocol
+	Props    StampProps
+
+	// Addr is the server's IP address, with an optional port. DoH and DoT
+	// stamps may leave it empty, for ProviderName to be resolved instead
+	Addr string
+
+	// Hashes pin DoH and DoT servers: every one is the SHA256 digest of the
+	// TBS certificate of a certificate the server's chain may contain
+	Hashes [][]byte
+
+	// ProviderName is the host name of DoH and DoT servers, which is sent
+	// as the TLS server name and may carry a port, or the provider name of
+	// DNSCrypt servers
+	ProviderName string
+
+	// Path is the path DoH servers take queries on
+	Path string
+
+	// PublicKey is the provider public key of DNSCrypt servers
+	PublicKey []byte
+
+	// Bootstrap are resolvers ProviderName may be resolved with
+	Bootstrap []string
+}
+
+// ParseStamp parses an sdns:// DNS stamp
+func ParseStamp(s string) (Stamp, error) {
+	if !strings.HasPrefix(s, stampPrefix) {
+		return Stamp{}, fmt.Errorf("DNS stamp %q doesn't start with %s", s, stampPrefix)
+	}
+
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimPrefix(s, stampPrefix), "="))
+	if err != nil {
+		return Stamp{}, fmt.Errorf("error while decoding DNS stamp: %v", err)
+	}
+
+	if len(bin) == 0 {
+		return Stamp{}, errors.New("empty DNS stamp")
+	}
+
+	stamp := Stamp{Protocol: StampProtocol(bin[0])}
+	r := stampReader{buf: bin[1:]}
+
+	switch stamp.Protocol {
+	case StampPlain:
+		stamp.Props = StampProps(r.uint64())
+		stamp.Addr = string(r.lp())
+	case StampDNSCrypt:
+		stamp.Props = StampProps(r.uint64())
+		stamp.Addr = string(r.lp())
+		stamp.PublicKey = r.lp()
+		stamp.ProviderName = string(r.lp())
+	case StampDoH, StampDoT, StampDoQ:
+		stamp.Props = StampProps(r.uint64())
+		stamp.Addr = string(r.lp())
+		for _, hash := range r.vlp() {
+			if len(hash) == 0 {
+				continue
+			}
+			if len(hash) != sha256.Size {
+				return Stamp{}, fmt.Errorf("DNS stamp has a certificate hash of %d bytes, expected %d", len(hash), sha256.Size)
+			}
+			stamp.Hashes = append(stamp.Hashes, hash)
+		}
+		stamp.ProviderName = string(r.lp())
+		if stamp.Protocol == StampDoH {
+			stamp.Path = string(r.lp())
+		}
+		if len(r.buf) > 0 {
+			for _, addr := range r.vlp() {
+				stamp.Bootstrap = append(stamp.Bootstrap, string(addr))
+			}
+		}
+	default:
+		return Stamp{}, fmt.Errorf("DNS stamp for unsupported %s", stamp.Protocol)
+	}
+
+	if r.err != nil {
+		return Stamp{}, fmt.Errorf("error while reading DNS stamp: %v", r.err)
+	}
+	if len(r.buf) > 0 {
+		return Stamp{}, fmt.Errorf("DNS stamp has %d trailing bytes", len(r.buf))
+	}
+
+	return stamp, nil
+}
+
+// String returns s as an sdns:// URI
+func (s Stamp) String() string {
+	bin := []byte{byte(s.Protocol)}
+	bin = append(bin, make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(bin[1:], uint64(s.Props))
+	bin = appendLP(bin, []byte(s.Addr))
+
+	switch s.Protocol {
+	case StampDNSCrypt:
+		bin = appendLP(bin, s.PublicKey)
+		bin = appendLP(bin, []byte(s.ProviderName))
+	case StampDoH, StampDoT, StampDoQ:
+		bin = appendVLP(bin, s.Hashes)
+		bin = appendLP(bin, []byte(s.ProviderName))
+		if s.Protocol == StampDoH {
+			bin = appendLP(bin, []byte(s.Path))
+		}
+		if len(s.Bootstrap) > 0 {
+			addrs := make([][]byte, 0, len(s.Bootstrap))
+			for _, addr := range s.Bootstrap {
+				addrs = append(addrs, []byte(addr))
+			}
+			bin = appendVLP(bin, addrs)
+		}
+	}
+
+	return stampPrefix + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// upstream returns the upstream a forwarder asks s's server as, and the
+// server name and pins to check its certificate with, if it's spoken to
+// over TLS. Only plain DNS and DNS over TLS stamps can be forwarded to
+func (s Stamp) upstream() (string, stampTLS, error) {
+	switch s.Protocol {
+	case StampPlain:
+		if s.Addr == "" {
+			return "", stampTLS{}, errors.New("plain DNS stamp without an address")
+		}
+
+		return withDefaultPort(s.Addr, "53"), stampTLS{}, nil
+	case StampDoT:
+		name, port := s.ProviderName, "853"
+		if host, p, err := net.SplitHostPort(s.ProviderName); err == nil {
+			name, port = host, p
+		}
+
+		addr := name
+		if s.Addr != "" {
+			addr = s.Addr
+		}
+		if addr == "" {
+			return "", stampTLS{}, errors.New("DNS over TLS stamp without an address or host name")
+		}
+
+		return tlsUpstreamPrefix + withDefaultPort(addr, port), stampTLS{serverName: name, hashes: s.Hashes}, nil
+	}
+
+	return "", stampTLS{}, fmt.Errorf("%s upstreams are not supported, only plain DNS and DNS over TLS ones", s.Protocol)
+}
+
+// stampTLS is how the certificate of a DNS over TLS upstream given by a
+// stamp is checked
+type stampTLS struct {
+	serverName string
+	hashes     [][]byte
+}
+
+// apply sets the server name and pins of t on config
+func (t stampTLS) apply(config *tls.Config) {
+	if t.serverName != "" {
+		config.ServerName = t.serverName
+	}
+
+	if len(t.hashes) == 0 {
+		return
+	}
+
+	hashes := t.hashes
+	config.VerifyConnection = func(cs tls.ConnectionState) error {
+		certs := cs.PeerCertificates
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+
+		for _, cert := range certs {
+			digest := sha256.Sum256(cert.RawTBSCertificate)
+			for _, hash := range hashes {
+				if bytes.Equal(digest[:], hash) {
+					return nil
+				}
+			}
+		}
+
+		return errors.New("no certificate of the upstream's chain matches the DNS stamp's hashes")
+	}
+}
+
+// stampReader reads the fields of a stamp, remembering the first error
+type stampReader struct {
+	buf []byte
+	err error
+}
+
+func (r *stampReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errors.New("stamp is too short")
+		return nil
+	}
+
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *stampReader) uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(b)
+}
+
+// lp reads a length prefixed field
+func (r *stampReader) lp() []byte {
+	n := r.next(1)
+	if n == nil {
+		return nil
+	}
+
+	return r.next(int(n[0]))
+}
+
+// vlp reads a set of length prefixed fields, the length of all but the last
+// of which has its high bit set
+func (r *stampReader) vlp() [][]byte {
+	fields := [][]byte{}
+	for r.err == nil {
+		n := r.next(1)
+		if n == nil {
+			break
+		}
+
+		fields = append(fields, r.next(int(n[0]&0x7f)))
+		if n[0]&0x80 == 0 {
+			break
+		}
+	}
+
+	return fields
+}
+
+func appendLP(buf, field []byte) []byte {
+	return append(append(buf, byte(len(field))), field...)
+}
+
+func appendVLP(buf []byte, fields [][]byte) []byte {
+	if len(fields) == 0 {
+		return append(buf, 0)
+	}
+
+	for i, field := range fields {
+		n := byte(len(field))
+		if i < len(fields)-1 {
+			n |= 0x80
+		}
+		buf = append(append(buf, n), field...)
+	}
+
+	return buf
+}
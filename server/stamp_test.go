@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStamp(t *testing.T) {
+	stamp, err := ParseStamp("sdns://AAcAAAAAAAAABzguOC44Ljg")
+	if err != nil {
+		t.Fatalf("error while parsing stamp: %v", err)
+	}
+
+	expected := Stamp{Protocol: StampPlain, Props: StampDNSSEC | StampNoLog | StampNoFilter, Addr: "8.8.8.8"}
+	if !reflect.DeepEqual(stamp, expected) {
+		t.Errorf("parsed %+v, expected %+v", stamp, expected)
+	}
+
+	hash := sha256.Sum256([]byte("certificate"))
+	for _, s := range []Stamp{
+		{Protocol: StampDoT, Addr: "192.0.2.53", Hashes: [][]byte{hash[:], hash[:]}, ProviderName: "dns.example.com"},
+		{Protocol: StampDoH, ProviderName: "dns.example.com", Path: "/dns-query", Bootstrap: []string{"192.0.2.1", "192.0.2.2"}},
+		{Protocol: StampDNSCrypt, Addr: "192.0.2.53:8443", PublicKey: hash[:], ProviderName: "2.dnscrypt-cert.example.com"},
+	} {
+		parsed, err := ParseStamp(s.String())
+		if err != nil {
+			t.Errorf("error while parsing %s stamp: %v", s.Protocol, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(parsed, s) {
+			t.Errorf("%s stamp parsed as %+v, expected %+v", s.Protocol, parsed, s)
+		}
+	}
+
+	for _, invalid := range []string{"tls://192.0.2.53", "sdns://", "sdns://AAcAAAAAAAAABzguOC44", "sdns://gQc"} {
+		if _, err := ParseStamp(invalid); err == nil {
+			t.Errorf("no error for %q", invalid)
+		}
+	}
+}
+
+func TestNewForwarderWithStamps(t *testing.T) {
+	dot := Stamp{Protocol: StampDoT, Addr: "192.0.2.53", ProviderName: "dns.example.com:8853"}
+	f, err := NewForwarder([]string{"sdns://AAcAAAAAAAAABzguOC44Ljg", dot.String()})
+	if err != nil {
+		t.Fatalf("error while creating forwarder: %v", err)
+	}
+	t.Cleanup(f.Close)
+
+	expected := []string{"8.8.8.8:53", "tls://192.0.2.53:8853"}
+	if !reflect.DeepEqual(f.upstreams, expected) {
+		t.Errorf("got upstreams %v, expected %v", f.upstreams, expected)
+	}
+
+	doh := Stamp{Protocol: StampDoH, ProviderName: "dns.example.com", Path: "/dns-query"}
+	if _, err := NewForwarder([]string{doh.String()}); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Errorf("got error %v for a DNS over HTTPS stamp, expected it to be unsupported", err)
+	}
+}
+
+func TestForwarderChecksStampPins(t *testing.T) {
+	// borrow httptest's certificate, which is valid for example.com
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var accepted int32
+	go serveFakeStreamUpstream(t, l, &accepted)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	pin := sha256.Sum256(ts.Certificate().RawTBSCertificate)
+	wrongPin := sha256.Sum256([]byte("another certificate"))
+
+	q := Question{Name: "example.com", Type: &TypeA, Class: &ClassIN}
+	for _, test := range []struct {
+		hash []byte
+		ok   bool
+	}{{pin[:], true}, {wrongPin[:], false}} {
+		stamp := Stamp{Protocol: StampDoT, Addr: l.Addr().String(), Hashes: [][]byte{test.hash}, ProviderName: "example.com"}
+
+		f, err := NewForwarder([]string{stamp.String()}, WithForwarderTLSConfig(&tls.Config{RootCAs: roots}))
+		if err != nil {
+			t.Fatalf("error while creating forwarder: %v", err)
+		}
+		t.Cleanup(f.Close)
+
+		_, err = f.Exchange(&q, true)
+		if test.ok && err != nil {
+			t.Errorf("error while exchanging with the pinned upstream: %v", err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("exchanged with an upstream whose certificate doesn't match the pin")
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ZoneStats reports the health of a zone served by the server
+type ZoneStats struct {
+	Zone    string `json:"zone"`
+	Serial  uint32 `json:"serial"`
+	Records int    `json:"records"`
+
+	// Backend is set for the zones of backends, whose records and serial
+	// aren't known to the server
+	Backend bool `json:"backend,omitempty"`
+
+	// Queries counts the queries for names in the zone, whichever way they
+	// were answered, and RCodes how many got each response code. Names that
+	// exist without records of the asked type are answered with NXDOMAIN
+	// for now, so NODATA answers are counted as NXDOMAIN
+	Queries uint64            `json:"queries"`
+	RCodes  map[string]uint64 `json:"rcodes"`
+}
+
+type zoneCounters struct {
+	queries uint64
+	rcodes  map[ResponseCode]uint64
+}
+
+// zoneStatsRecorder counts the queries answered from each zone
+type zoneStatsRecorder struct {
+	mu    sync.Mutex
+	zones map[string]*zoneCounters
+}
+
+// recordQuery counts a query answered with rcode against the zones of its
+// questions, the server's own and those of its backends
+func (r *zoneStatsRecorder) recordQuery(srv *DNSServer, questions []*Question, rcode ResponseCode) {
+	for _, q := range questions {
+		zone, ok := srv.zoneFor(q.Name)
+		if _, backendZone, found := srv.closestBackend(q.Name); found && (!ok || len(backendZone) > len(zone)) {
+			zone, ok = backendZone, true
+		}
+		if !ok {
+			continue
+		}
+
+		r.mu.Lock()
+		if r.zones == nil {
+			r.zones = map[string]*zoneCounters{}
+		}
+
+		counters, ok := r.zones[zone]
+		if !ok {
+			counters = &zoneCounters{rcodes: map[ResponseCode]uint64{}}
+			r.zones[zone] = counters
+		}
+
+		counters.queries++
+		counters.rcodes[rcode]++
+		r.mu.Unlock()
+	}
+}
+
+// ZoneStats returns query counts, response codes and the SOA serial of every
+// zone the server is authoritative for, its backends' zones included
+func (srv *DNSServer) ZoneStats() []ZoneStats {
+	snap := srv.snapshot()
+
+	stats := map[string]*ZoneStats{}
+	for _, b := range srv.backends {
+		for _, zone := range normalizedZones(b.Zones()) {
+			stats[zone] = &ZoneStats{Zone: zone, Backend: true, RCodes: map[string]uint64{}}
+		}
+	}
+
+	for _, zone := range snap.zones {
+		stats[zone] = &ZoneStats{Zone: zone, RCodes: map[string]uint64{}}
+	}
+
+	snap.index.each(func(rr *ResourceRecord) {
+		zone, ok := closestZone(snap.zones, rr.Name)
+		if !ok {
+			return
+		}
+
+		stats[zone].Records++
+		if rr.Type == &TypeSOA && strings.EqualFold(rr.Name, zone) {
+			if serial, err := soaSerial(rr.Value); err == nil {
+				stats[zone].Serial = serial
+			}
+		}
+	})
+
+	srv.stats.mu.Lock()
+	for zone, counters := range srv.stats.zones {
+		zs, ok := stats[zone]
+		if !ok {
+			// the zone was removed since
+			continue
+		}
+
+		zs.Queries = counters.queries
+		for rcode, n := range counters.rcodes {
+			zs.RCodes[rcode.String()] = n
+		}
+	}
+	srv.stats.mu.Unlock()
+
+	result := make([]ZoneStats, 0, len(stats))
+	for _, zs := range stats {
+		result = append(result, *zs)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Zone < result[j].Zone
+	})
+
+	return result
+}
+
+// soaSerial reads the serial from the RDATA of an SOA record
+func soaSerial(rdata []byte) (uint32, error) {
+	mnameLen, _, err := DecodeDomainName(rdata)
+	if err != nil {
+		return 0, err
+	}
+
+	rnameLen, _, err := DecodeDomainName(rdata[mnameLen:])
+	if err != nil {
+		return 0, err
+	}
+
+	offset := mnameLen + rnameLen
+	if len(rdata) < offset+4 {
+		return 0, errors.New("SOA record too short")
+	}
+
+	return binary.BigEndian.Uint32(rdata[offset:]), nil
+}
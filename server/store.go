@@ -0,0 +1,167 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sweepInterval is how often expired records are removed from the server
+const sweepInterval = 30 * time.Second
+
+// AddRecord adds rr to the records the server answers from. If rr has an
+// ExpiresAt time, it stops being served at that time and is removed by the
+// background sweeper, which suits temporary records like ACME challenges
+func (srv *DNSServer) AddRecord(rr *ResourceRecord) error {
+	return srv.addRecord(rr, recordChange{source: ChangeSourceLibrary, reason: fmt.Sprintf("added %s record for %s", rr.Type, rr.Name)})
+}
+
+// addRecord adds rr as a new version of the records made by change
+func (srv *DNSServer) addRecord(rr *ResourceRecord, change recordChange) error {
+	if rr.Name == "" || rr.Type == nil || rr.Class == nil {
+		return errors.New("record needs a name, type and class")
+	}
+
+	if rr.expired(time.Now()) {
+		return errors.New("record has already expired")
+	}
+
+	var err error
+	srv.updateRecords(change, func(u *recordUpdate) bool {
+		u.add(rr)
+		if rr.Type == &TypeCNAME {
+			// a CNAME record may close a chain of them into a cycle
+			if err = checkCNAMEChainFrom(rr.Name, u.recordsNamed); err != nil {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return err
+}
+
+// RemoveRecords removes the records with the given name and type, and returns
+// how many were removed. A nil value removes all of them, otherwise only
+// records with that exact value are removed
+func (srv *DNSServer) RemoveRecords(name string, qtype *QTYPE, value []byte) int {
+	return srv.removeRecordsFor(name, qtype, value, recordChange{source: ChangeSourceLibrary, reason: fmt.Sprintf("removed %s records for %s", qtype, name)})
+}
+
+// removeRecordsFor removes records like RemoveRecords, as a new version of
+// the records made by change
+func (srv *DNSServer) removeRecordsFor(name string, qtype *QTYPE, value []byte, change recordChange) int {
+	removed := 0
+	srv.updateRecords(change, func(u *recordUpdate) bool {
+		for _, rr := range u.recordsNamed(name) {
+			if rr.Type == qtype && (value == nil || string(rr.Value) == string(value)) {
+				u.remove(rr)
+				removed++
+			}
+		}
+
+		return removed > 0
+	})
+
+	return removed
+}
+
+// ReplaceRRset replaces the records with the given name and type, their
+// RRset, by rrset as a single new version of the records, so that queries see
+// either the old RRset or the new one and never a mix of both. An empty rrset
+// removes the RRset. It returns how many records were replaced
+func (srv *DNSServer) ReplaceRRset(name string, qtype *QTYPE, rrset []*ResourceRecord) (int, error) {
+	return srv.replaceRRset(name, qtype, rrset, recordChange{source: ChangeSourceLibrary, reason: fmt.Sprintf("replaced %s records for %s", qtype, name)})
+}
+
+// replaceRRset replaces an RRset like ReplaceRRset, as a new version of the
+// records made by change
+func (srv *DNSServer) replaceRRset(name string, qtype *QTYPE, rrset []*ResourceRecord, change recordChange) (int, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || qtype == nil {
+		return 0, errors.New("RRset needs a name and type")
+	}
+
+	now := time.Now()
+	for _, rr := range rrset {
+		if !strings.EqualFold(strings.TrimSuffix(rr.Name, "."), name) || rr.Type != qtype {
+			return 0, fmt.Errorf("%s record for %s is not in the %s RRset of %s", rr.Type, rr.Name, qtype, name)
+		}
+
+		if rr.Class == nil {
+			return 0, errors.New("record needs a class")
+		}
+
+		if rr.expired(now) {
+			return 0, errors.New("record has already expired")
+		}
+	}
+
+	replaced := 0
+	var err error
+	srv.updateRecords(change, func(u *recordUpdate) bool {
+		for _, rr := range u.recordsNamed(name) {
+			if rr.Type == qtype {
+				u.remove(rr)
+				replaced++
+			}
+		}
+
+		if replaced == 0 && len(rrset) == 0 {
+			return false
+		}
+
+		for _, rr := range rrset {
+			u.add(rr)
+		}
+
+		if qtype == &TypeCNAME {
+			if err = checkCNAMEChainFrom(name, u.recordsNamed); err != nil {
+				replaced = 0
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return replaced, err
+}
+
+// Records returns a copy of the list of records the server answers from, in
+// no particular order
+func (srv *DNSServer) Records() []*ResourceRecord {
+	return srv.snapshot().records()
+}
+
+// sweepExpiredRecords removes the records that have expired by now. Only the
+// records with an expiry are looked at, so sweeping costs nothing while there
+// are none
+func (srv *DNSServer) sweepExpiredRecords(now time.Time) int {
+	removed := 0
+	srv.updateRecords(recordChange{source: ChangeSourceExpiry, reason: "removed expired records"}, func(u *recordUpdate) bool {
+		for _, rr := range u.current.expiring {
+			if rr.expired(now) {
+				u.remove(rr)
+				removed++
+			}
+		}
+
+		return removed > 0
+	})
+
+	return removed
+}
+
+func (srv *DNSServer) sweepExpiredRecordsEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if removed := srv.sweepExpiredRecords(now); removed > 0 {
+			srv.log.Infof("removed %d expired records", removed)
+		}
+	}
+}
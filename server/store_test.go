@@ -0,0 +1,106 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringRecords(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	now := time.Now()
+	rr := ResourceRecord{
+		Name:      "_acme-challenge.kausm.in",
+		Type:      &TypeTXT,
+		Class:     &ClassIN,
+		TTL:       600,
+		Value:     []byte("\x05token"),
+		ExpiresAt: now.Add(2 * time.Minute),
+	}
+
+	if err := srv.AddRecord(&rr); err != nil {
+		t.Fatalf("error while adding record: %v", err)
+	}
+
+	answers := srv.lookupAllRecords(&TypeTXT, &ClassIN, "_acme-challenge.kausm.in")
+	if len(answers) != 1 {
+		t.Fatalf("expected the added record to be served, got %d records", len(answers))
+	}
+
+	if answers[0].TTL > 120 {
+		t.Errorf("expected TTL capped to the remaining 120s, got %d", answers[0].TTL)
+	}
+
+	if removed := srv.sweepExpiredRecords(now.Add(time.Minute)); removed != 0 {
+		t.Errorf("sweeper removed %d records before expiry", removed)
+	}
+
+	if removed := srv.sweepExpiredRecords(now.Add(3 * time.Minute)); removed != 1 {
+		t.Errorf("expected sweeper to remove the expired record, removed %d", removed)
+	}
+
+	if answers := srv.lookupAllRecords(&TypeTXT, &ClassIN, "_acme-challenge.kausm.in"); len(answers) != 0 {
+		t.Errorf("expired record is still served")
+	}
+
+	if answers := srv.lookupAllRecords(&TypeA, &ClassIN, "test.kausm.in"); len(answers) != 1 {
+		t.Errorf("sweeper removed a record without expiry")
+	}
+}
+
+func TestRemoveRecords(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	srv.AddRecord(&ResourceRecord{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 60, Value: []byte{10, 0, 0, 1}})
+
+	if removed := srv.RemoveRecords("TEST.kausm.in", &TypeA, []byte{10, 0, 0, 1}); removed != 1 {
+		t.Errorf("expected to remove 1 record by value, removed %d", removed)
+	}
+
+	if removed := srv.RemoveRecords("test.kausm.in", &TypeA, nil); removed != 1 {
+		t.Errorf("expected to remove the remaining record, removed %d", removed)
+	}
+
+	if srv.isAuthoritativeFor("test.kausm.in") != true {
+		t.Errorf("removing A records changed authority")
+	}
+}
+
+func TestReplaceRRset(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+	srv.AddRecord(&ResourceRecord{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 60, Value: []byte{10, 0, 0, 1}})
+	versions := len(srv.Snapshots())
+
+	rrset := []*ResourceRecord{
+		{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 300, Value: []byte{10, 0, 0, 2}},
+		{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN, TTL: 300, Value: []byte{10, 0, 0, 3}},
+	}
+	replaced, err := srv.ReplaceRRset("TEST.kausm.in.", &TypeA, rrset)
+	if err != nil {
+		t.Fatalf("error while replacing RRset: %v", err)
+	}
+	if replaced != 2 {
+		t.Errorf("expected to replace 2 records, replaced %d", replaced)
+	}
+
+	answers := srv.lookupAllRecords(&TypeA, &ClassIN, "test.kausm.in")
+	if len(answers) != 2 || answers[0].Value[3] != 2 || answers[1].Value[3] != 3 {
+		t.Errorf("unexpected records after replacing the RRset: %v", answers)
+	}
+
+	if n := len(srv.Snapshots()); n != versions+1 {
+		t.Errorf("expected the RRset to be replaced in 1 version, got %d", n-versions)
+	}
+
+	mixed := append(rrset, &ResourceRecord{Name: "test.kausm.in", Type: &TypeTXT, Class: &ClassIN, TTL: 300, Value: []byte("\x02hi")})
+	if _, err := srv.ReplaceRRset("test.kausm.in", &TypeA, mixed); err == nil {
+		t.Errorf("no error for a record of another type")
+	}
+
+	if replaced, err := srv.ReplaceRRset("test.kausm.in", &TypeA, nil); err != nil || replaced != 2 {
+		t.Errorf("expected to remove the 2 records of the RRset, removed %d: %v", replaced, err)
+	}
+	if answers := srv.lookupAllRecords(&TypeA, &ClassIN, "test.kausm.in"); len(answers) != 0 {
+		t.Errorf("removed RRset is still served")
+	}
+}
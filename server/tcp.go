@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tcpIdleTimeout is how long a connection may sit without a new query
+	// before it's closed, see RFC 7766 section 6.2.3
+	tcpIdleTimeout = 10 * time.Second
+
+	// tcpWriteTimeout bounds how long writing a single response may take
+	tcpWriteTimeout = 5 * time.Second
+
+	// maxPipelinedQueries bounds how many queries of a single connection are
+	// processed concurrently
+	maxPipelinedQueries = 32
+)
+
+func (srv *DNSServer) serveTCP(l net.Listener) {
+	srv.serveStream(l, 0)
+}
+
+// serveStream serves the connections of a TCP or TLS listener, padding
+// responses to a multiple of padding octets if it's set
+func (srv *DNSServer) serveStream(l net.Listener, padding int) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			srv.log.Errorf("error while accepting tcp connection: %v", err)
+			continue
+		}
+
+		go srv.handleTCPConn(conn, padding)
+	}
+}
+
+// handleTCPConn serves the queries on a connection. Queries can be pipelined,
+// and are processed concurrently with responses written as soon as they are
+// ready, possibly out of order, as RFC 7766 recommends. Clients match them to
+// their queries by ID
+func (srv *DNSServer) handleTCPConn(conn net.Conn, padding int) {
+	defer conn.Close()
+
+	srv.log.Debugf("got connection from %s", conn.RemoteAddr().String())
+
+	var writeMu sync.Mutex
+	var wg sync.WaitGroup
+	pipeline := make(chan struct{}, maxPipelinedQueries)
+
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout)); err != nil {
+			break
+		}
+
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				srv.log.Debugf("error while reading from %s: %v", conn.RemoteAddr().String(), err)
+			}
+			break
+		}
+
+		pipeline <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer func() { <-pipeline }()
+
+			msg, err := srv.handleQuerySafely(query, conn.RemoteAddr(), false)
+			if err != nil {
+				srv.log.Warnf("error while handling query from %s: %v", conn.RemoteAddr().String(), err)
+				return
+			}
+
+			msg, ok := srv.chaos.apply(msg, false)
+			if !ok {
+				srv.log.Debugf("chaos dropped response to %s", conn.RemoteAddr().String())
+				return
+			}
+
+			msg = padResponse(msg, padding)
+
+			writeMu.Lock()
+			defer writeMu.Unlock()
+
+			err = writeTCPMessage(conn, msg)
+			if err != nil {
+				srv.log.Warnf("error while responding: %v", err)
+			}
+		}()
+	}
+
+	// let queries that are still being processed finish before closing
+	wg.Wait()
+}
+
+// readTCPMessage reads a message prefixed with its two byte length
+func readTCPMessage(conn net.Conn) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, fmt.Errorf("error while reading message: %v", err)
+	}
+
+	return msg, nil
+}
+
+// writeTCPMessage writes msg prefixed with its two byte length
+func writeTCPMessage(conn net.Conn, msg []byte) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := conn.Write(buf)
+	if err != nil {
+		return fmt.Errorf("error while writing to conn: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func encodeTestQuery(t *testing.T, id uint16, q *Question) []byte {
+	t.Helper()
+
+	headers := DNSHeader{
+		ID:               id,
+		Type:             QRQuery,
+		OpCode:           QueryOp,
+		RecursionDesired: true,
+		QuestionsCount:   1,
+	}
+
+	buf := make([]byte, 512)
+	n, _ := headers.Encode(buf)
+	qlen, err := q.Encode(buf[n:])
+	if err != nil {
+		t.Fatalf("error while encoding question: %v", err)
+	}
+
+	return buf[:n+qlen]
+}
+
+func TestTCPPipelinedQueries(t *testing.T) {
+	srv, _ := NewDNSServer("", "")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	defer l.Close()
+
+	go srv.serveTCP(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("error while dialing: %v", err)
+	}
+	defer conn.Close()
+
+	// send all queries before reading any response
+	q := Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}
+	pending := map[uint16]bool{}
+	pipelined := []byte{}
+	for id := uint16(1); id <= 5; id++ {
+		query := encodeTestQuery(t, id, &q)
+		lenBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBuf, uint16(len(query)))
+
+		pipelined = append(pipelined, lenBuf...)
+		pipelined = append(pipelined, query...)
+		pending[id] = true
+	}
+
+	if _, err := conn.Write(pipelined); err != nil {
+		t.Fatalf("error while writing queries: %v", err)
+	}
+
+	for len(pending) > 0 {
+		resp, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("error while reading response: %v", err)
+		}
+
+		headers := DNSHeader{}
+		if err := headers.ReadFrom(resp); err != nil {
+			t.Fatalf("error while reading response header: %v", err)
+		}
+
+		if !pending[headers.ID] {
+			t.Fatalf("unexpected response ID %d", headers.ID)
+		}
+
+		if headers.AnswersCount != 1 {
+			t.Errorf("expected 1 answer for query %d, got %d", headers.ID, headers.AnswersCount)
+		}
+
+		delete(pending, headers.ID)
+	}
+}
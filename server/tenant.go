@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// APIToken grants access to the admin API, so that teams sharing a server
+// can each manage their own zones:
+//
+//	[
+//	    {"name": "ops", "token": "<secret>"},
+//	    {"name": "team-a", "token": "<secret>", "zones": ["a.example.com"]}
+//	]
+//
+// A token without zones is an operator token, with access to all of the
+// API. A token with zones can only read and change the records of those
+// zones, and has no access to server wide endpoints like rollbacks or
+// draining
+type APIToken struct {
+	// Name identifies who uses the token in logs and in the reasons of
+	// the versions of the records
+	Name  string   `json:"name"`
+	Token string   `json:"token"`
+	Zones []string `json:"zones,omitempty"`
+}
+
+// LoadAPITokens reads a JSON list of API tokens from the file at path
+func LoadAPITokens(path string) ([]APIToken, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading api tokens: %v", err)
+	}
+
+	tokens := []APIToken{}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("error while decoding api tokens: %v", err)
+	}
+
+	for i, t := range tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("api token %d needs a name and a token", i+1)
+		}
+	}
+
+	return tokens, nil
+}
+
+// AdminOption configures optional behaviour of an AdminHandler
+type AdminOption func(*AdminHandler)
+
+// WithAPITokens makes the admin API require one of tokens as a bearer token
+// in the Authorization header of every request
+func WithAPITokens(tokens []APIToken) AdminOption {
+	return func(h *AdminHandler) {
+		for _, t := range tokens {
+			zones := make([]string, 0, len(t.Zones))
+			for _, zone := range t.Zones {
+				zones = append(zones, strings.ToLower(strings.TrimSuffix(zone, ".")))
+			}
+
+			t.Zones = zones
+			h.tokens = append(h.tokens, t)
+		}
+	}
+}
+
+type adminTokenKey struct{}
+
+// authenticate returns the token of the request, nil if the API has no
+// tokens
+func (h *AdminHandler) authenticate(r *http.Request) (*APIToken, error) {
+	if len(h.tokens) == 0 {
+		return nil, nil
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, errors.New("missing bearer token")
+	}
+	secret := []byte(strings.TrimPrefix(auth, "Bearer "))
+
+	var found *APIToken
+	for i := range h.tokens {
+		// every token is compared, so that timing doesn't tell which
+		// one came close
+		if subtle.ConstantTimeCompare(secret, []byte(h.tokens[i].Token)) == 1 {
+			found = &h.tokens[i]
+		}
+	}
+
+	if found == nil {
+		return nil, errors.New("invalid bearer token")
+	}
+
+	return found, nil
+}
+
+// requestToken returns the token a request was made with, nil if the API
+// has no tokens
+func requestToken(r *http.Request) *APIToken {
+	t, _ := r.Context().Value(adminTokenKey{}).(*APIToken)
+	return t
+}
+
+func withRequestToken(r *http.Request, t *APIToken) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminTokenKey{}, t))
+}
+
+// operator reports whether t has access to all of the API
+func (t *APIToken) operator() bool {
+	return t == nil || len(t.Zones) == 0
+}
+
+// ownsZone reports whether t may manage zone
+func (t *APIToken) ownsZone(zone string) bool {
+	if t.operator() {
+		return true
+	}
+
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	for _, z := range t.Zones {
+		if z == zone {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ownsRecord reports whether t may manage rr of srv: the zone rr is in, or
+// is the apex of if it's an SOA record, must be one of t's zones
+func (t *APIToken) ownsRecord(srv *DNSServer, rr *ResourceRecord) bool {
+	if t.operator() {
+		return true
+	}
+
+	if rr.Type == &TypeSOA {
+		return t.ownsZone(rr.Name)
+	}
+
+	zone, ok := srv.zoneFor(rr.Name)
+	return ok && t.ownsZone(zone)
+}
+
+// actor names who makes a request, for logs and the reasons of versions of
+// the records
+func actor(r *http.Request) string {
+	if t := requestToken(r); t != nil {
+		return t.Name
+	}
+
+	return "admin"
+}
+
+// operatorOnly wraps an endpoint that only operator tokens may use
+func operatorOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requestToken(r).operator() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTenantTestHandler(t *testing.T) (*DNSServer, *AdminHandler) {
+	t.Helper()
+
+	srv, _ := NewDNSServer("", "")
+	for _, zone := range []string{"a.example.com", "b.example.com"} {
+		soa, _ := NewSOA(zone, 3600, "ns1."+zone, "hostmaster."+zone, 1, 3600, 600, 86400, 300)
+		if err := srv.AddRecord(soa); err != nil {
+			t.Fatalf("error while adding zone %s: %v", zone, err)
+		}
+	}
+
+	h := NewAdminHandler(srv, WithAPITokens([]APIToken{
+		{Name: "ops", Token: "ops-secret"},
+		{Name: "team-a", Token: "a-secret", Zones: []string{"A.example.com."}},
+	}))
+
+	return srv, h
+}
+
+func serveAdmin(h *AdminHandler, token, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	return resp
+}
+
+func TestAPITokensAreRequired(t *testing.T) {
+	_, h := newTenantTestHandler(t)
+
+	for _, token := range []string{"", "wrong"} {
+		if resp := serveAdmin(h, token, http.MethodGet, "/zones", ""); resp.Code != http.StatusUnauthorized {
+			t.Errorf("expected unauthorized with token %q, got %d", token, resp.Code)
+		}
+	}
+
+	if resp := serveAdmin(h, "ops-secret", http.MethodGet, "/zones", ""); resp.Code != http.StatusOK {
+		t.Errorf("expected OK with a valid token, got %d", resp.Code)
+	}
+}
+
+func TestZoneScopedTokens(t *testing.T) {
+	srv, h := newTenantTestHandler(t)
+
+	resp := serveAdmin(h, "a-secret", http.MethodGet, "/zones", "")
+	stats := []ZoneStats{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("error while decoding response: %v", err)
+	}
+
+	if len(stats) != 1 || stats[0].Zone != "a.example.com" {
+		t.Errorf("expected only the stats of a.example.com, got %+v", stats)
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+		code                 int
+	}{
+		{http.MethodPost, "/records", `{"name": "www.a.example.com", "type": "A", "ttl": 300, "data": "192.0.2.1"}`, http.StatusCreated},
+		{http.MethodPost, "/records", `{"name": "www.b.example.com", "type": "A", "ttl": 300, "data": "192.0.2.2"}`, http.StatusForbidden},
+		{http.MethodPost, "/records", `{"name": "sub.a.example.com", "type": "SOA", "ttl": 300, "data": "ns1 hostmaster 1 3600 600 86400 300"}`, http.StatusForbidden},
+		{http.MethodGet, "/records?zone=a.example.com", "", http.StatusOK},
+		{http.MethodGet, "/records?zone=b.example.com", "", http.StatusForbidden},
+		{http.MethodGet, "/records", "", http.StatusForbidden},
+		{http.MethodGet, "/zone?name=b.example.com", "", http.StatusForbidden},
+		{http.MethodGet, "/snapshots", "", http.StatusForbidden},
+		{http.MethodDelete, "/drain", "", http.StatusForbidden},
+		{http.MethodDelete, "/records?name=b.example.com&type=SOA", "", http.StatusForbidden},
+	} {
+		if resp := serveAdmin(h, "a-secret", tc.method, tc.target, tc.body); resp.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", tc.method, tc.target, tc.code, resp.Code, resp.Body)
+		}
+	}
+
+	if rr := srv.LookupRecords(&TypeA, &ClassIN, "www.a.example.com"); rr == nil || !net.IP(rr.Value).Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("expected the added record to be served, got %v", rr)
+	}
+
+	if srv.LookupRecords(&TypeA, &ClassIN, "www.b.example.com") != nil {
+		t.Errorf("expected the forbidden record not to be added")
+	}
+
+	resp = serveAdmin(h, "a-secret", http.MethodDelete, "/records?name=www.a.example.com&type=A&data=192.0.2.1", "")
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), `"removed":1`) {
+		t.Errorf("expected the record to be removed, got %d: %s", resp.Code, resp.Body)
+	}
+
+	// versions of the records tell who made them
+	snapshots := srv.Snapshots()
+	if reason := snapshots[len(snapshots)-1].Reason; reason != "team-a removed A records for www.a.example.com" {
+		t.Errorf("unexpected reason %q", reason)
+	}
+
+	if resp := serveAdmin(h, "ops-secret", http.MethodGet, "/snapshots", ""); resp.Code != http.StatusOK {
+		t.Errorf("expected operators to see snapshots, got %d", resp.Code)
+	}
+}
+
+func TestLoadAPITokens(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "tokens.json")
+	ioutil.WriteFile(path, []byte(`[{"name": "team-a", "token": "secret", "zones": ["a.example.com"]}]`), 0600)
+
+	tokens, err := LoadAPITokens(path)
+	if err != nil {
+		t.Fatalf("error while loading tokens: %v", err)
+	}
+
+	if len(tokens) != 1 || tokens[0].Name != "team-a" || len(tokens[0].Zones) != 1 {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+
+	ioutil.WriteFile(path, []byte(`[{"name": "team-a"}]`), 0600)
+	if _, err := LoadAPITokens(path); err == nil {
+		t.Errorf("expected a token without a secret to be rejected")
+	}
+}
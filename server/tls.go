@@ -0,0 +1,68 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// TLSListener is an address the server serves DNS over TLS on (RFC 7858),
+// along with the padding of its responses
+type TLSListener struct {
+	Addr   string
+	Config *tls.Config
+
+	// PaddingBlockSize pads responses to clients using EDNS to a multiple of
+	// it, so that their size, which encryption doesn't hide, says little
+	// about what they answer. DefaultPaddingBlockSize is the recommended
+	// size, 0 turns padding off
+	PaddingBlockSize int
+}
+
+// WithTLSListener makes the server also serve DNS over TLS when it listens
+func WithTLSListener(l TLSListener) Option {
+	return func(srv *DNSServer) {
+		srv.tlsListeners = append(srv.tlsListeners, l)
+	}
+}
+
+// listenTLS starts serving the server's DNS over TLS listeners
+func (srv *DNSServer) listenTLS() error {
+	listeners := []net.Listener{}
+	for _, tl := range srv.tlsListeners {
+		if err := tl.checkCertificate(); err != nil {
+			closeListeners(listeners)
+			return err
+		}
+
+		l, err := tls.Listen("tcp", withDefaultPort(tl.Addr, "853"), tl.Config)
+		if err != nil {
+			closeListeners(listeners)
+			return fmt.Errorf("error while listening for tls: %v", err)
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	for i, l := range listeners {
+		go srv.serveStream(l, srv.tlsListeners[i].PaddingBlockSize)
+	}
+
+	return nil
+}
+
+// checkCertificate checks that the listener has a certificate to serve
+func (tl TLSListener) checkCertificate() error {
+	if tl.Config == nil || (len(tl.Config.Certificates) == 0 && tl.Config.GetCertificate == nil) {
+		return errors.New("tls listener without a certificate")
+	}
+
+	return nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
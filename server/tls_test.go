@@ -0,0 +1,84 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSListenerPadsResponses(t *testing.T) {
+	// borrow httptest's certificate, which is valid for 127.0.0.1
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	srv, _ := NewDNSServer("", "")
+
+	for _, padding := range []int{0, 128, DefaultPaddingBlockSize} {
+		l, err := tls.Listen("tcp", "127.0.0.1:0", ts.TLS)
+		if err != nil {
+			t.Fatalf("error while listening: %v", err)
+		}
+		defer l.Close()
+
+		go srv.serveStream(l, padding)
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ts.Certificate())
+
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatalf("error while dialing: %v", err)
+		}
+		defer conn.Close()
+
+		query := Message{
+			Header:    DNSHeader{ID: 1, OpCode: QueryOp, RecursionDesired: true},
+			Questions: []*Question{{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}},
+			EDNS:      &EDNS{UDPSize: 1232, Options: []EDNSOption{{Code: EDNSOptionPadding, Data: []byte{0, 0, 0}}}},
+		}
+		buf, err := query.Encode()
+		if err != nil {
+			t.Fatalf("error while encoding query: %v", err)
+		}
+
+		lenBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBuf, uint16(len(buf)))
+		if _, err := conn.Write(append(lenBuf, buf...)); err != nil {
+			t.Fatalf("error while writing query: %v", err)
+		}
+
+		resp, err := readTCPMessage(conn)
+		if err != nil {
+			t.Fatalf("error while reading response: %v", err)
+		}
+
+		msg, err := DecodeMessage(resp)
+		if err != nil {
+			t.Fatalf("error while decoding response: %v", err)
+		}
+
+		if len(msg.Answers) != 1 {
+			t.Errorf("expected 1 answer with padding %d, got %d", padding, len(msg.Answers))
+		}
+
+		padded := msg.EDNS != nil && msg.EDNS.HasOption(EDNSOptionPadding)
+		if padded != (padding > 0) {
+			t.Errorf("expected padding %d to pad: %v, got %v", padding, padding > 0, padded)
+		}
+
+		if padding > 0 && len(resp)%padding != 0 {
+			t.Errorf("expected a multiple of %d bytes, got %d", padding, len(resp))
+		}
+	}
+}
+
+func TestTLSListenerNeedsCertificate(t *testing.T) {
+	srv, _ := NewDNSServer("127.0.0.1:0", "", WithTLSListener(TLSListener{Addr: "127.0.0.1:0", Config: &tls.Config{}}))
+
+	if err := srv.Listen(); err == nil {
+		t.Errorf("expected listening without a certificate to fail")
+	}
+}
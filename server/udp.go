@@ -0,0 +1,151 @@
+package server
+
+import (
+	"net"
+)
+
+// defaultUDPBatchSize is how many datagrams are read and written per system
+// call where batching is supported
+const defaultUDPBatchSize = 32
+
+// WithUDPBatchSize sets how many datagrams the server reads and writes per
+// system call, with recvmmsg and sendmmsg on Linux. On other systems, or with
+// a size of 1, datagrams are read and written one at a time
+func WithUDPBatchSize(n int) Option {
+	return func(srv *DNSServer) {
+		srv.udpBatchSize = n
+	}
+}
+
+// udpPacket is a datagram read from or to be written to a UDP socket, of the
+// first n bytes of buf
+type udpPacket struct {
+	buf  []byte
+	n    int
+	addr *net.UDPAddr
+}
+
+// udpBatchConn reads and writes the datagrams of a UDP socket in batches.
+// Reads and writes may happen concurrently, but not several of either
+type udpBatchConn interface {
+	// readBatch reads datagrams into the bufs of packets, blocking until
+	// there is at least one, and returns how many were read
+	readBatch(packets []udpPacket) (int, error)
+
+	// writeBatch writes packets, and returns how many were written. An
+	// error is about the first packet that wasn't written
+	writeBatch(packets []udpPacket) (int, error)
+}
+
+// udpResponder sends the response msg to the client at addr
+type udpResponder func(msg []byte, addr *net.UDPAddr) error
+
+// serveUDP answers the queries coming in on conn, in batches if the system
+// supports it
+func (srv *DNSServer) serveUDP(conn *net.UDPConn) {
+	size := srv.udpBatchSize
+	if size == 0 {
+		size = defaultUDPBatchSize
+	}
+
+	batch, ok := newUDPBatchConn(conn, size)
+	if !ok {
+		srv.serveUDPPackets(conn)
+		return
+	}
+
+	srv.log.Debugf("reading and writing udp in batches of %d", size)
+
+	w := udpBatchWriter{conn: batch, queue: make(chan udpPacket, 4*size), size: size, log: srv.log}
+	go w.run()
+
+	// the buffers are reused, each query being copied out of them, as they
+	// are large enough for any datagram
+	packets := make([]udpPacket, size)
+	for i := range packets {
+		packets[i].buf = make([]byte, maxDatagramSize)
+	}
+
+	for {
+		n, err := batch.readBatch(packets)
+		if err != nil {
+			srv.log.Errorf("error while reading from udp: %v", err)
+			continue
+		}
+
+		for _, p := range packets[:n] {
+			if p.addr == nil {
+				continue
+			}
+
+			go srv.handleUDPPacket(w.writeTo, append([]byte(nil), p.buf[:p.n]...), p.addr)
+		}
+	}
+}
+
+// serveUDPPackets answers the queries coming in on conn, reading and writing
+// one datagram at a time
+func (srv *DNSServer) serveUDPPackets(conn *net.UDPConn) {
+	respond := func(msg []byte, addr *net.UDPAddr) error {
+		return srv.writeUDPResponse(conn, addr, msg)
+	}
+
+	// EDNS(0) queries can be larger than 512 bytes, so whole datagrams are
+	// read into a buffer that is reused, each query being copied out of it
+	input := make([]byte, maxDatagramSize)
+	for {
+		rlen, returnAddr, err := conn.ReadFromUDP(input)
+		if err != nil {
+			srv.log.Errorf("error while reading from udp: %v", err)
+			continue
+		}
+
+		go srv.handleUDPPacket(respond, append([]byte(nil), input[:rlen]...), returnAddr)
+	}
+}
+
+// udpBatchWriter writes the responses queued by concurrent queries in
+// batches, taking whatever is queued by the time the last batch was written
+// as the next one. Batching doesn't delay responses: a lone response is
+// written right away
+type udpBatchWriter struct {
+	conn  udpBatchConn
+	queue chan udpPacket
+	size  int
+	log   Logger
+}
+
+func (w *udpBatchWriter) writeTo(msg []byte, addr *net.UDPAddr) error {
+	w.queue <- udpPacket{buf: msg, n: len(msg), addr: addr}
+	return nil
+}
+
+func (w *udpBatchWriter) run() {
+	packets := make([]udpPacket, 0, w.size)
+	for p := range w.queue {
+		packets = append(packets[:0], p)
+
+	fill:
+		for len(packets) < w.size {
+			select {
+			case p := <-w.queue:
+				packets = append(packets, p)
+			default:
+				break fill
+			}
+		}
+
+		for sent := 0; sent < len(packets); {
+			n, err := w.conn.writeBatch(packets[sent:])
+			sent += n
+			if err != nil {
+				// the response that failed is dropped, the client
+				// retries as it would for a lost datagram
+				w.log.Warnf("error while responding to %s: %v", packets[sent].addr.String(), err)
+				sent++
+			} else if n == 0 {
+				break
+			}
+		}
+	}
+}
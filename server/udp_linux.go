@@ -0,0 +1,244 @@
+//go:build (linux && amd64) || (linux && arm64)
+// +build linux,amd64 linux,arm64
+
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr of recvmmsg(2) and sendmmsg(2)
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgConn reads datagrams with recvmmsg and writes them with sendmmsg. UDP
+// GSO isn't used, as it only batches datagrams of the same size to the same
+// address, which responses to different clients hardly ever are
+type mmsgConn struct {
+	raw   syscall.RawConn
+	inet6 bool
+
+	// reads and writes each have buffers of their own, so that they can
+	// happen concurrently
+	rmsgs  []mmsghdr
+	riovs  []syscall.Iovec
+	rnames []syscall.RawSockaddrAny
+
+	wmsgs  []mmsghdr
+	wiovs  []syscall.Iovec
+	wnames []syscall.RawSockaddrAny
+}
+
+// newUDPBatchConn returns conn reading and writing size datagrams per system
+// call, if size is larger than 1
+func newUDPBatchConn(conn *net.UDPConn, size int) (udpBatchConn, bool) {
+	if size <= 1 {
+		return nil, false
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+
+	// the addresses of an IPv6 socket are IPv6 ones, IPv4 clients of a
+	// dual stack socket having IPv4-mapped addresses
+	var sa syscall.Sockaddr
+	raw.Control(func(fd uintptr) {
+		sa, err = syscall.Getsockname(int(fd))
+	})
+	if err != nil {
+		return nil, false
+	}
+	_, inet6 := sa.(*syscall.SockaddrInet6)
+
+	return &mmsgConn{
+		raw:    raw,
+		inet6:  inet6,
+		rmsgs:  make([]mmsghdr, size),
+		riovs:  make([]syscall.Iovec, size),
+		rnames: make([]syscall.RawSockaddrAny, size),
+		wmsgs:  make([]mmsghdr, size),
+		wiovs:  make([]syscall.Iovec, size),
+		wnames: make([]syscall.RawSockaddrAny, size),
+	}, true
+}
+
+func (c *mmsgConn) readBatch(packets []udpPacket) (int, error) {
+	n := len(packets)
+	if n > len(c.rmsgs) {
+		n = len(c.rmsgs)
+	}
+
+	for i := 0; i < n; i++ {
+		c.riovs[i].Base = &packets[i].buf[0]
+		c.riovs[i].SetLen(len(packets[i].buf))
+		c.rmsgs[i] = mmsghdr{hdr: syscall.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&c.rnames[i])),
+			Namelen: syscall.SizeofSockaddrAny,
+			Iov:     &c.riovs[i],
+			Iovlen:  1,
+		}}
+	}
+
+	read, err := c.mmsg(sysRecvmmsg, c.rmsgs[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < read; i++ {
+		packets[i].n = int(c.rmsgs[i].len)
+		packets[i].addr = udpAddrOf(&c.rnames[i])
+	}
+
+	return read, nil
+}
+
+func (c *mmsgConn) writeBatch(packets []udpPacket) (int, error) {
+	n := len(packets)
+	if n > len(c.wmsgs) {
+		n = len(c.wmsgs)
+	}
+
+	for i := 0; i < n; i++ {
+		namelen, err := c.putSockaddr(&c.wnames[i], packets[i].addr)
+		if err != nil {
+			if i == 0 {
+				return 0, err
+			}
+
+			// the packets before it are written, it fails next time
+			n = i
+			break
+		}
+
+		c.wiovs[i].Base = &packets[i].buf[0]
+		c.wiovs[i].SetLen(packets[i].n)
+		c.wmsgs[i] = mmsghdr{hdr: syscall.Msghdr{
+			Name:    (*byte)(unsafe.Pointer(&c.wnames[i])),
+			Namelen: namelen,
+			Iov:     &c.wiovs[i],
+			Iovlen:  1,
+		}}
+	}
+
+	return c.mmsg(sysSendmmsg, c.wmsgs[:n])
+}
+
+// mmsg makes the recvmmsg or sendmmsg system call for msgs, waiting for the
+// socket to be ready as the net package does
+func (c *mmsgConn) mmsg(trap uintptr, msgs []mmsghdr) (int, error) {
+	var n int
+	var errno syscall.Errno
+
+	call := func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(trap, fd, uintptr(unsafe.Pointer(&msgs[0])), uintptr(len(msgs)), 0, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+
+		n, errno = int(r), e
+		return true
+	}
+
+	var err error
+	if trap == sysRecvmmsg {
+		err = c.raw.Read(call)
+	} else {
+		err = c.raw.Write(call)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return n, nil
+}
+
+// putSockaddr writes addr to rsa in the family of the socket, and returns
+// its length
+func (c *mmsgConn) putSockaddr(rsa *syscall.RawSockaddrAny, addr *net.UDPAddr) (uint32, error) {
+	if addr == nil {
+		return 0, errors.New("no address to write to")
+	}
+
+	if !c.inet6 {
+		ip4 := addr.IP.To4()
+		if ip4 == nil {
+			return 0, errors.New("not an IPv4 address: " + addr.String())
+		}
+
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		*sa = syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+		copy(sa.Addr[:], ip4)
+		putPort(&sa.Port, addr.Port)
+
+		return syscall.SizeofSockaddrInet4, nil
+	}
+
+	ip16 := addr.IP.To16()
+	if ip16 == nil {
+		return 0, errors.New("not an IP address: " + addr.String())
+	}
+
+	sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+	*sa = syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(sa.Addr[:], ip16)
+	putPort(&sa.Port, addr.Port)
+
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.Scope_id = uint32(ifi.Index)
+		} else if index, err := strconv.Atoi(addr.Zone); err == nil {
+			sa.Scope_id = uint32(index)
+		}
+	}
+
+	return syscall.SizeofSockaddrInet6, nil
+}
+
+// udpAddrOf returns the address in rsa, nil if it's not an IP one
+func udpAddrOf(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		return &net.UDPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: getPort(&sa.Port)}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		addr := net.UDPAddr{IP: make(net.IP, net.IPv6len), Port: getPort(&sa.Port)}
+		copy(addr.IP, sa.Addr[:])
+
+		if sa.Scope_id != 0 {
+			if ifi, err := net.InterfaceByIndex(int(sa.Scope_id)); err == nil {
+				addr.Zone = ifi.Name
+			} else {
+				addr.Zone = strconv.Itoa(int(sa.Scope_id))
+			}
+		}
+
+		return &addr
+	}
+
+	return nil
+}
+
+// ports are in network byte order in socket addresses
+func putPort(port *uint16, value int) {
+	p := (*[2]byte)(unsafe.Pointer(port))
+	p[0], p[1] = byte(value>>8), byte(value)
+}
+
+func getPort(port *uint16) int {
+	p := (*[2]byte)(unsafe.Pointer(port))
+	return int(p[0])<<8 | int(p[1])
+}
@@ -0,0 +1,10 @@
+package server
+
+import "syscall"
+
+const (
+	sysRecvmmsg = syscall.SYS_RECVMMSG
+
+	// the syscall package predates sendmmsg on amd64
+	sysSendmmsg = 307
+)
@@ -0,0 +1,80 @@
+//go:build (linux && amd64) || (linux && arm64)
+// +build linux,amd64 linux,arm64
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMMsgConnReadsAndWritesBatches(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	defer conn.Close()
+
+	batch, ok := newUDPBatchConn(conn, 4)
+	if !ok {
+		t.Fatalf("no batching on linux")
+	}
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("error while dialing: %v", err)
+	}
+	defer client.Close()
+
+	for _, msg := range []string{"one", "two", "three"} {
+		client.Write([]byte(msg))
+	}
+
+	// the datagrams may not all be there for the first read
+	packets := make([]udpPacket, 4)
+	for i := range packets {
+		packets[i].buf = make([]byte, 512)
+	}
+
+	got := []string{}
+	for len(got) < 3 {
+		n, err := batch.readBatch(packets)
+		if err != nil {
+			t.Fatalf("error while reading batch: %v", err)
+		}
+
+		for _, p := range packets[:n] {
+			got = append(got, string(p.buf[:p.n]))
+			if p.addr.String() != client.LocalAddr().String() {
+				t.Errorf("read datagram from %s, expected %s", p.addr, client.LocalAddr())
+			}
+		}
+	}
+
+	if got[0] != "one" || got[1] != "two" || got[2] != "three" {
+		t.Errorf("read %q", got)
+	}
+
+	replies := []udpPacket{}
+	for _, msg := range []string{"a", "bb"} {
+		replies = append(replies, udpPacket{buf: []byte(msg), n: len(msg), addr: client.LocalAddr().(*net.UDPAddr)})
+	}
+
+	if n, err := batch.writeBatch(replies); err != nil || n != 2 {
+		t.Fatalf("wrote %d of 2 datagrams: %v", n, err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 512)
+	for _, expected := range []string{"a", "bb"} {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("error while reading reply: %v", err)
+		}
+
+		if string(buf[:n]) != expected {
+			t.Errorf("got reply %q, expected %q", buf[:n], expected)
+		}
+	}
+}
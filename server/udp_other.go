@@ -0,0 +1,11 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package server
+
+import "net"
+
+// newUDPBatchConn reports that batching isn't supported on this system
+func newUDPBatchConn(conn *net.UDPConn, size int) (udpBatchConn, bool) {
+	return nil, false
+}
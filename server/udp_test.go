@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServeUDPAnswersConcurrentClients(t *testing.T) {
+	for _, size := range []int{1, defaultUDPBatchSize} {
+		srv := startTestServer(t, WithUDPBatchSize(size))
+		addr, _ := srv.loopbackAddr()
+
+		// more clients than fit in a batch, each with a socket of its own
+		clients := 3 * defaultUDPBatchSize
+		errs := make(chan error, clients)
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < clients; i++ {
+			wg.Add(1)
+			go func(id uint16) {
+				defer wg.Done()
+				errs <- exchangeTestUDP(t, addr, id)
+			}(uint16(i + 1))
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Errorf("batch size %d: %v", size, err)
+			}
+		}
+	}
+}
+
+// exchangeTestUDP asks addr for test.kausm.in and checks the response echoes
+// the query ID
+func exchangeTestUDP(t *testing.T, addr string, id uint16) error {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	q := Question{Name: "test.kausm.in", Type: &TypeA, Class: &ClassIN}
+	if _, err := conn.Write(encodeTestQuery(t, id, &q)); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+
+	if n < 12 || binary.BigEndian.Uint16(buf) != id {
+		return errUnanswerable
+	}
+
+	return nil
+}
@@ -0,0 +1,816 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultZoneTTL is used for records before any $TTL or explicit TTL is seen
+const defaultZoneTTL = 3600
+
+// genericRDataMarker starts RDATA in the generic syntax of RFC 3597
+const genericRDataMarker = `\#`
+
+// maxGenerateRecords caps how many records a single $GENERATE may create
+const maxGenerateRecords = 65536
+
+var nameToQtypeMap = map[string]*QTYPE{}
+
+func init() {
+	for _, qtype := range uintToQtypeMap {
+		nameToQtypeMap[qtype.Type] = qtype
+	}
+}
+
+// ParseQType returns the record type named s, like "A" or "mx", or given by
+// its code in the generic "TYPEnnn" syntax of RFC 3597
+func ParseQType(s string) (*QTYPE, error) {
+	name := strings.ToUpper(s)
+	if qtype, ok := nameToQtypeMap[name]; ok {
+		return qtype, nil
+	}
+
+	if strings.HasPrefix(name, "TYPE") {
+		if code, err := strconv.ParseUint(name[len("TYPE"):], 10, 16); err == nil {
+			return qtypeForCode(uint16(code)), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported record type %q", s)
+}
+
+// LoadZoneFile reads the records of the master file at path
+func LoadZoneFile(path string) ([]*ResourceRecord, error) {
+	records := []*ResourceRecord{}
+	if _, err := (zoneFile{path: path}).load(nil, func(rr *ResourceRecord) {
+		records = append(records, rr)
+	}); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// zoneFile is a master file to load, with the origin of its relative names
+type zoneFile struct {
+	origin string
+	path   string
+}
+
+// load parses the zone file, handing every record to emit as soon as it's
+// parsed, and returns how many there were. With a logger, how far parsing got
+// is logged as it goes, which matters for zones of millions of records
+func (zf zoneFile) load(log Logger, emit func(rr *ResourceRecord)) (int, error) {
+	f, err := os.Open(zf.path)
+	if err != nil {
+		return 0, fmt.Errorf("error while opening zone file: %v", err)
+	}
+	defer f.Close()
+
+	p := newZoneParser(zf.origin, emit)
+	if log == nil {
+		err := p.parse(f)
+		return p.count, err
+	}
+
+	var size int64
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	r := &countingReader{r: f}
+	p.progress = func(records int) {
+		if size > 0 {
+			log.Infof("loading %s: %d records, %d%% read", zf.path, records, r.n*100/size)
+		} else {
+			log.Infof("loading %s: %d records", zf.path, records)
+		}
+	}
+
+	err = p.parse(r)
+	return p.count, err
+}
+
+// WithZoneFile makes the server load the records of the master file at path,
+// whose relative names are relative to origin, besides its records file
+func WithZoneFile(origin, path string) Option {
+	return func(srv *DNSServer) {
+		srv.zoneFiles = append(srv.zoneFiles, zoneFile{origin: strings.TrimSuffix(origin, "."), path: path})
+	}
+}
+
+// ParseZoneFile reads records in RFC 1035 master file format from r. Names
+// that are not fully qualified are relative to origin, which the file can
+// change with $ORIGIN. Besides $ORIGIN and $TTL, BIND's $GENERATE directive is
+// supported to create ranges of records from a template, e.g.
+//
+//	$GENERATE 1-254 host-$ A 10.0.0.$
+//	$GENERATE 1-254 $ PTR host-$.example.com.
+//
+// The comment of a record's line is kept with the record, with words of the
+// form key=value in it as metadata tags, see ResourceRecord.Comment:
+//
+//	www  300  IN  A  192.0.2.10  ; canary box owner=team-a ticket=OPS-12
+//
+// Comments on lines of their own or on directives are dropped
+func ParseZoneFile(r io.Reader, origin string) ([]*ResourceRecord, error) {
+	records := []*ResourceRecord{}
+	p := newZoneParser(origin, func(rr *ResourceRecord) {
+		records = append(records, rr)
+	})
+	if err := p.parse(r); err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// parse reads the records of a master file from r, one entry at a time
+func (p *zoneParser) parse(r io.Reader) error {
+	scanner := newZoneScanner(r)
+	for {
+		entry, err := scanner.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := p.parseEntry(entry); err != nil {
+			return fmt.Errorf("line %d: %v", entry.line, err)
+		}
+	}
+
+	return nil
+}
+
+// zoneEntry is a single logical line of a master file, which may span several
+// physical lines when parentheses are used
+type zoneEntry struct {
+	line       int
+	tokens     []string
+	blankOwner bool // entry started with whitespace, so it reuses the last owner
+
+	// comment holds the comments of the entry's lines, joined by spaces
+	comment string
+}
+
+type zoneScanner struct {
+	lines *bufio.Scanner
+	line  int
+}
+
+func newZoneScanner(r io.Reader) *zoneScanner {
+	return &zoneScanner{lines: bufio.NewScanner(r)}
+}
+
+// next returns the next non-empty entry, or io.EOF
+func (s *zoneScanner) next() (zoneEntry, error) {
+	entry := zoneEntry{}
+	depth := 0
+
+	for s.lines.Scan() {
+		s.line++
+		text := s.lines.Text()
+
+		if len(entry.tokens) == 0 && depth == 0 {
+			entry.line = s.line
+			entry.blankOwner = len(text) > 0 && (text[0] == ' ' || text[0] == '\t')
+		}
+
+		tokens, comment, delta, err := tokenizeZoneLine(text)
+		if err != nil {
+			return entry, fmt.Errorf("line %d: %v", s.line, err)
+		}
+
+		if len(entry.tokens) == 0 && depth == 0 {
+			// comments before the entry are on lines of their own
+			entry.comment = ""
+		}
+		if comment != "" {
+			entry.comment = strings.TrimSpace(entry.comment + " " + comment)
+		}
+
+		entry.tokens = append(entry.tokens, tokens...)
+		depth += delta
+		if depth < 0 {
+			return entry, fmt.Errorf("line %d: unbalanced parentheses", s.line)
+		}
+
+		if depth == 0 && len(entry.tokens) > 0 {
+			return entry, nil
+		}
+	}
+
+	if err := s.lines.Err(); err != nil {
+		return entry, err
+	}
+
+	if depth != 0 {
+		return entry, fmt.Errorf("line %d: unbalanced parentheses", entry.line)
+	}
+
+	return entry, io.EOF
+}
+
+// tokenizeZoneLine splits a line into tokens, dropping parentheses. It
+// returns the line's comment apart, without the semicolon and surrounding
+// whitespace, and the change in parenthesis depth
+func tokenizeZoneLine(line string) ([]string, string, int, error) {
+	tokens := []string{}
+	depth := 0
+
+	var token strings.Builder
+	inToken, inQuotes := false, false
+
+	flush := func() {
+		if inToken {
+			tokens = append(tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case c == '\\' && !inToken && isGenericRDataMarker(line[i:]):
+			// kept escaped, so that it's told apart from a quoted "#"
+			tokens = append(tokens, genericRDataMarker)
+			i++
+		case c == '\\' && i+3 < len(line) && isDecimalEscape(line[i+1:i+4]):
+			// \DDD is the octet with decimal value DDD
+			value, _ := strconv.Atoi(line[i+1 : i+4])
+			token.WriteByte(byte(value))
+			i += 3
+			inToken = true
+		case c == '\\' && i+1 < len(line):
+			i++
+			token.WriteByte(line[i])
+			inToken = true
+		case inQuotes && c == '"':
+			inQuotes = false
+			flush()
+		case inQuotes:
+			token.WriteByte(c)
+		case c == '"':
+			flush()
+			inQuotes, inToken = true, true
+		case c == ';':
+			flush()
+			return tokens, strings.TrimSpace(line[i+1:]), depth, nil
+		case c == '(':
+			flush()
+			depth++
+		case c == ')':
+			flush()
+			depth--
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+
+	if inQuotes {
+		return nil, "", 0, errors.New("unterminated quoted string")
+	}
+
+	flush()
+
+	return tokens, "", depth, nil
+}
+
+// isGenericRDataMarker reports whether s starts with the \# token that
+// introduces RDATA in the generic syntax of RFC 3597
+func isGenericRDataMarker(s string) bool {
+	if !strings.HasPrefix(s, genericRDataMarker) {
+		return false
+	}
+
+	return len(s) == len(genericRDataMarker) || strings.IndexByte(" \t\r;()", s[len(genericRDataMarker)]) >= 0
+}
+
+func isDecimalEscape(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	value, _ := strconv.Atoi(s)
+	return value <= 255
+}
+
+type zoneParser struct {
+	origin string
+
+	// ttl is the TTL of records without an explicit one, set by $TTL or
+	// otherwise by the last explicit TTL as in RFC 1035
+	ttl       uint32
+	ttlIsSet  bool
+	lastOwner string
+	hasOwner  bool
+
+	// emit is handed every parsed record, and count is how many it was
+	emit  func(rr *ResourceRecord)
+	count int
+
+	// names and rdata hold the interned owner names and the current block
+	// of packed RDATA of the parsed records, see intern and pack
+	names map[string]string
+	rdata []byte
+
+	// progress, when set, is called with the number of records parsed so
+	// far every progressInterval records
+	progress         func(records int)
+	progressInterval int
+}
+
+func newZoneParser(origin string, emit func(rr *ResourceRecord)) *zoneParser {
+	return &zoneParser{
+		origin:           strings.TrimSuffix(origin, "."),
+		emit:             emit,
+		ttl:              defaultZoneTTL,
+		progressInterval: defaultZoneProgressInterval,
+	}
+}
+
+func (p *zoneParser) parseEntry(entry zoneEntry) error {
+	tokens := entry.tokens
+
+	if strings.HasPrefix(tokens[0], "$") && !entry.blankOwner {
+		return p.parseDirective(tokens, entry.comment)
+	}
+
+	owner := p.lastOwner
+	if !entry.blankOwner {
+		owner = absoluteName(tokens[0], p.origin)
+		tokens = tokens[1:]
+	} else if !p.hasOwner {
+		return errors.New("record without owner name")
+	}
+
+	rr, err := p.parseRecord(owner, tokens)
+	if err != nil {
+		return err
+	}
+	rr.Comment, rr.Meta = parseRecordComment(entry.comment)
+
+	p.lastOwner, p.hasOwner = owner, true
+	p.add(rr)
+
+	return nil
+}
+
+// parseDirective parses a $ directive. The comment of a $GENERATE directive
+// is kept with every record it creates
+func (p *zoneParser) parseDirective(tokens []string, comment string) error {
+	switch strings.ToUpper(tokens[0]) {
+	case "$ORIGIN":
+		if len(tokens) != 2 {
+			return errors.New("$ORIGIN takes exactly one domain name")
+		}
+
+		p.origin = absoluteName(tokens[1], p.origin)
+	case "$TTL":
+		if len(tokens) != 2 {
+			return errors.New("$TTL takes exactly one TTL")
+		}
+
+		ttl, err := parseTTL(tokens[1])
+		if err != nil {
+			return err
+		}
+
+		p.ttl, p.ttlIsSet = ttl, true
+	case "$GENERATE":
+		return p.parseGenerate(tokens[1:], comment)
+	default:
+		return fmt.Errorf("unsupported directive %s", tokens[0])
+	}
+
+	return nil
+}
+
+// parseGenerate expands "$GENERATE range lhs [ttl] [class] type rhs"
+func (p *zoneParser) parseGenerate(tokens []string, comment string) error {
+	if len(tokens) < 4 {
+		return errors.New("$GENERATE needs a range, owner, type and rdata")
+	}
+
+	start, stop, step, err := parseGenerateRange(tokens[0])
+	if err != nil {
+		return err
+	}
+
+	if (stop-start)/step+1 > maxGenerateRecords {
+		return fmt.Errorf("$GENERATE range creates more than %d records", maxGenerateRecords)
+	}
+
+	for i := start; i <= stop; i += step {
+		expanded := make([]string, 0, len(tokens)-1)
+		for _, token := range tokens[1:] {
+			substituted, err := substituteGenerate(token, i)
+			if err != nil {
+				return err
+			}
+
+			expanded = append(expanded, substituted)
+		}
+
+		owner := absoluteName(expanded[0], p.origin)
+		rr, err := p.parseRecord(owner, expanded[1:])
+		if err != nil {
+			return err
+		}
+		rr.Comment, rr.Meta = parseRecordComment(comment)
+
+		p.add(rr)
+	}
+
+	return nil
+}
+
+// parseGenerateRange parses "start-stop" or "start-stop/step"
+func parseGenerateRange(s string) (int, int, int, error) {
+	step := 1
+
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 1 {
+			return 0, 0, 0, fmt.Errorf("invalid $GENERATE step %q", s[i+1:])
+		}
+
+		step = n
+		s = s[:i]
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, 0, fmt.Errorf("invalid $GENERATE range %q", s)
+	}
+
+	start, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid $GENERATE range start %q", bounds[0])
+	}
+
+	stop, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid $GENERATE range stop %q", bounds[1])
+	}
+
+	if start < 0 || stop < start {
+		return 0, 0, 0, fmt.Errorf("invalid $GENERATE range %q", s)
+	}
+
+	return start, stop, step, nil
+}
+
+// substituteGenerate replaces each $ in template by i. A ${offset,width,base}
+// modifier adds offset to i and formats it zero padded to width in base d, o,
+// x or X
+func substituteGenerate(template string, i int) (string, error) {
+	var out strings.Builder
+
+	for j := 0; j < len(template); j++ {
+		c := template[j]
+		if c != '$' {
+			out.WriteByte(c)
+			continue
+		}
+
+		if j+1 >= len(template) || template[j+1] != '{' {
+			out.WriteString(strconv.Itoa(i))
+			continue
+		}
+
+		end := strings.IndexByte(template[j:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated $GENERATE modifier in %q", template)
+		}
+
+		formatted, err := formatGenerateModifier(template[j+2:j+end], i)
+		if err != nil {
+			return "", err
+		}
+
+		out.WriteString(formatted)
+		j += end
+	}
+
+	return out.String(), nil
+}
+
+func formatGenerateModifier(modifier string, i int) (string, error) {
+	parts := strings.Split(modifier, ",")
+	if len(parts) > 3 {
+		return "", fmt.Errorf("invalid $GENERATE modifier %q", modifier)
+	}
+
+	offset, width, base := 0, 0, "d"
+
+	var err error
+	if len(parts) > 0 && parts[0] != "" {
+		if offset, err = strconv.Atoi(parts[0]); err != nil {
+			return "", fmt.Errorf("invalid $GENERATE offset %q", parts[0])
+		}
+	}
+
+	if len(parts) > 1 && parts[1] != "" {
+		if width, err = strconv.Atoi(parts[1]); err != nil || width < 0 {
+			return "", fmt.Errorf("invalid $GENERATE width %q", parts[1])
+		}
+	}
+
+	if len(parts) > 2 {
+		base = parts[2]
+	}
+
+	switch base {
+	case "d", "o", "x", "X":
+	default:
+		return "", fmt.Errorf("unsupported $GENERATE base %q", base)
+	}
+
+	return fmt.Sprintf("%0*"+base, width, i+offset), nil
+}
+
+// parseRecord parses "[ttl] [class] type rdata..." for a record owned by owner
+func (p *zoneParser) parseRecord(owner string, tokens []string) (*ResourceRecord, error) {
+	rr := ResourceRecord{
+		Name:  p.intern(owner),
+		Class: &ClassIN,
+		TTL:   p.ttl,
+	}
+
+	// TTL and class may come in either order, and both are optional
+	for i := 0; i < 2 && len(tokens) > 0; i++ {
+		if strings.EqualFold(tokens[0], ClassIN.Class) {
+			tokens = tokens[1:]
+			continue
+		}
+
+		ttl, err := parseTTL(tokens[0])
+		if err != nil {
+			break
+		}
+
+		rr.TTL = ttl
+		if !p.ttlIsSet {
+			p.ttl = ttl
+		}
+		tokens = tokens[1:]
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("missing record type")
+	}
+
+	qtype, err := ParseQType(tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	rr.Type = qtype
+
+	var value []byte
+	if len(tokens) > 1 && tokens[1] == genericRDataMarker {
+		value, err = decodeGenericRData(qtype, tokens[2:])
+	} else {
+		value, err = encodeRData(qtype, tokens[1:], p.origin)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s record: %v", qtype, err)
+	}
+	rr.Value = p.pack(value)
+
+	return &rr, nil
+}
+
+// absoluteName resolves a name from a master file against origin. Names are
+// kept without the trailing dot
+func absoluteName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+
+	if origin == "" {
+		return name
+	}
+
+	return name + "." + origin
+}
+
+// parseTTL parses a TTL in seconds, or with BIND style units like 1h30m
+func parseTTL(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+
+	units := map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+
+	total, current, seenDigit := uint64(0), uint64(0), false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			current = current*10 + uint64(c-'0')
+			seenDigit = true
+			continue
+		}
+
+		unit, ok := units[c|0x20]
+		if !ok || !seenDigit {
+			return 0, fmt.Errorf("invalid TTL %q", s)
+		}
+
+		total += current * unit
+		current, seenDigit = 0, false
+	}
+
+	if seenDigit || total > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("invalid TTL %q", s)
+	}
+
+	return uint32(total), nil
+}
+
+// decodeGenericRData decodes RDATA given as "\# length hex..." in the generic
+// syntax of RFC 3597, which records of any type may use. The RDATA of types
+// with a presentation format of their own must still be well formed
+func decodeGenericRData(qtype *QTYPE, fields []string) ([]byte, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("missing RDATA length")
+	}
+
+	length, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDATA length %q", fields[0])
+	}
+
+	value, err := hex.DecodeString(strings.Join(fields[1:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RDATA: %v", err)
+	}
+
+	if len(value) != int(length) {
+		return nil, fmt.Errorf("RDATA is %d octets long, expected %d", len(value), length)
+	}
+
+	if presentedTypes[qtype] && strings.HasPrefix(rdataString(qtype, value), genericRDataMarker) {
+		return nil, fmt.Errorf("RDATA is not a valid %s record", qtype)
+	}
+
+	return value, nil
+}
+
+// presentedTypes are the types whose RDATA encodeRData reads in a
+// presentation format of their own
+var presentedTypes = map[*QTYPE]bool{
+	&TypeA: true, &TypeAAAA: true, &TypeNS: true, &TypeCNAME: true, &TypePTR: true, &TypeMD: true,
+	&TypeMF: true, &TypeMX: true, &TypeSRV: true, &TypeTXT: true, &TypeSOA: true,
+}
+
+// encodeRData encodes the presentation format rdata of a record of type qtype
+func encodeRData(qtype *QTYPE, rdata []string, origin string) ([]byte, error) {
+	expectArgs := func(n int) error {
+		if len(rdata) != n {
+			return fmt.Errorf("expected %d fields, got %d", n, len(rdata))
+		}
+
+		return nil
+	}
+
+	switch qtype {
+	case &TypeA:
+		if err := expectArgs(1); err != nil {
+			return nil, err
+		}
+
+		ip := net.ParseIP(rdata[0]).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", rdata[0])
+		}
+
+		return []byte(ip), nil
+	case &TypeAAAA:
+		if err := expectArgs(1); err != nil {
+			return nil, err
+		}
+
+		ip := net.ParseIP(rdata[0])
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid IPv6 address %q", rdata[0])
+		}
+
+		return []byte(ip.To16()), nil
+	case &TypeNS, &TypeCNAME, &TypePTR, &TypeMD, &TypeMF:
+		if err := expectArgs(1); err != nil {
+			return nil, err
+		}
+
+		return encodeName(absoluteName(rdata[0], origin))
+	case &TypeMX:
+		if err := expectArgs(2); err != nil {
+			return nil, err
+		}
+
+		preference, err := strconv.ParseUint(rdata[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preference %q", rdata[0])
+		}
+
+		exchange, err := encodeName(absoluteName(rdata[1], origin))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 2, 2+len(exchange))
+		binary.BigEndian.PutUint16(buf, uint16(preference))
+
+		return append(buf, exchange...), nil
+	case &TypeSRV:
+		if err := expectArgs(4); err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, 6)
+		for i, field := range rdata[:3] {
+			value, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q", field)
+			}
+
+			binary.BigEndian.PutUint16(buf[2*i:], uint16(value))
+		}
+
+		target, err := encodeName(absoluteName(rdata[3], origin))
+		if err != nil {
+			return nil, err
+		}
+
+		return append(buf, target...), nil
+	case &TypeTXT:
+		if len(rdata) == 0 {
+			return nil, errors.New("expected at least one string")
+		}
+
+		buf := []byte{}
+		for _, s := range rdata {
+			if len(s) > 255 {
+				return nil, errors.New("strings cannot be longer than 255 characters")
+			}
+
+			buf = append(buf, byte(len(s)))
+			buf = append(buf, s...)
+		}
+
+		return buf, nil
+	case &TypeSOA:
+		if err := expectArgs(7); err != nil {
+			return nil, err
+		}
+
+		values := make([]uint32, 5)
+		for i, field := range rdata[2:] {
+			// only the serial is a plain number, the rest are TTL-like
+			value, err := parseTTL(field)
+			if err != nil {
+				return nil, err
+			}
+
+			values[i] = value
+		}
+
+		return EncodeSOA(absoluteName(rdata[0], origin), absoluteName(rdata[1], origin), values[0], values[1], values[2], values[3], values[4])
+	}
+
+	return nil, fmt.Errorf("record type %s is not supported in zone files", qtype)
+}
+
+// encodeName returns the wire format of a domain name
+func encodeName(name string) ([]byte, error) {
+	buf := make([]byte, len(name)+2)
+
+	n, err := EncodeDomainName(buf, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
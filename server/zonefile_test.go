@@ -0,0 +1,158 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+const testZoneFile = `$ORIGIN kausm.in.
+$TTL 600
+@       IN  SOA  ns1 hostmaster (
+                 2021061501 ; serial
+                 1h         ; refresh
+                 600        ; retry
+                 1w         ; expire
+                 300 )      ; minimum
+        IN  NS   ns1
+ns1         A    10.0.0.53
+www  300    A    10.0.0.1
+            A    10.0.0.2
+mail        MX   10 mx.example.com.
+txt         TXT  "hello world" "v=spf1 -all"
+$GENERATE 1-3 host-$ A 10.0.1.$
+$GENERATE 8-10/2 ${10,3,x} PTR host-$.kausm.in.
+`
+
+func TestParseZoneFile(t *testing.T) {
+	records, err := ParseZoneFile(strings.NewReader(testZoneFile), "")
+	if err != nil {
+		t.Fatalf("error while parsing zone file: %v", err)
+	}
+
+	expected := []struct {
+		name  string
+		qtype *QTYPE
+		ttl   uint32
+		value string
+	}{
+		{"kausm.in", &TypeSOA, 600, "\x03ns1\x05kausm\x02in\x00\x0ahostmaster\x05kausm\x02in\x00\x78\x76\xf3\x7d\x00\x00\x0e\x10\x00\x00\x02\x58\x00\x09\x3a\x80\x00\x00\x01\x2c"},
+		{"kausm.in", &TypeNS, 600, "\x03ns1\x05kausm\x02in\x00"},
+		{"ns1.kausm.in", &TypeA, 600, "\x0a\x00\x00\x35"},
+		{"www.kausm.in", &TypeA, 300, "\x0a\x00\x00\x01"},
+		{"www.kausm.in", &TypeA, 600, "\x0a\x00\x00\x02"},
+		{"mail.kausm.in", &TypeMX, 600, "\x00\x0a\x02mx\x07example\x03com\x00"},
+		{"txt.kausm.in", &TypeTXT, 600, "\x0bhello world\x0bv=spf1 -all"},
+		{"host-1.kausm.in", &TypeA, 600, "\x0a\x00\x01\x01"},
+		{"host-2.kausm.in", &TypeA, 600, "\x0a\x00\x01\x02"},
+		{"host-3.kausm.in", &TypeA, 600, "\x0a\x00\x01\x03"},
+		{"012.kausm.in", &TypePTR, 600, "\x06host-8\x05kausm\x02in\x00"},
+		{"014.kausm.in", &TypePTR, 600, "\x07host-10\x05kausm\x02in\x00"},
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(records))
+	}
+
+	for i, e := range expected {
+		rr := records[i]
+		if rr.Name != e.name || rr.Type != e.qtype || rr.TTL != e.ttl || string(rr.Value) != e.value {
+			t.Errorf("record %d: gotten %s %d %s %q, expected %s %d %s %q", i, rr.Name, rr.TTL, rr.Type, rr.Value, e.name, e.ttl, e.qtype, e.value)
+		}
+	}
+}
+
+func TestParseZoneFileGenericRData(t *testing.T) {
+	zone := `$ORIGIN kausm.in.
+svc    IN TYPE65 \# 3 ( 0001
+                         00 )
+www    IN A      \# 4 0A000001
+empty     TYPE260 \# 0
+hash      TXT    "#"
+`
+	records, err := ParseZoneFile(strings.NewReader(zone), "")
+	if err != nil {
+		t.Fatalf("error while parsing zone file: %v", err)
+	}
+
+	expected := []struct {
+		qtype string
+		value string
+	}{
+		{"TYPE65", "\x00\x01\x00"},
+		{"A", "\x0a\x00\x00\x01"},
+		{"TYPE260", ""},
+		{"TXT", "\x01#"},
+	}
+
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(records))
+	}
+
+	for i, e := range expected {
+		if rr := records[i]; rr.Type.Type != e.qtype || string(rr.Value) != e.value {
+			t.Errorf("record %d: gotten %s %q, expected %s %q", i, rr.Type, rr.Value, e.qtype, e.value)
+		}
+	}
+
+	if records[1].Type != &TypeA {
+		t.Errorf("expected the A record given in the generic syntax to have type A")
+	}
+
+	for _, c := range []string{
+		"www A \\# 3 0a0000\n",
+		"www TYPE65 \\# 4 0001\n",
+		"www TYPE65 \\# 2 zz\n",
+		"www TYPE65 \\#\n",
+		"www TYPE70000 \\# 0\n",
+	} {
+		if _, err := ParseZoneFile(strings.NewReader(c), "kausm.in"); err == nil {
+			t.Errorf("expected error while parsing %q", c)
+		}
+	}
+}
+
+func TestParseZoneFileErrors(t *testing.T) {
+	cases := []string{
+		"www A 10.0.0.256\n",
+		"www A (10.0.0.1\n",
+		"  A 10.0.0.1\n",
+		"www BOGUS foo\n",
+		"$GENERATE 10-1 host-$ A 10.0.0.$\n",
+		"$INCLUDE other.zone\n",
+		"txt TXT \"unterminated\n",
+	}
+
+	for _, c := range cases {
+		if _, err := ParseZoneFile(strings.NewReader(c), "kausm.in"); err == nil {
+			t.Errorf("expected error while parsing %q", c)
+		}
+	}
+}
+
+func TestSubstituteGenerate(t *testing.T) {
+	cases := []struct {
+		template string
+		i        int
+		expected string
+	}{
+		{"host-$", 7, "host-7"},
+		{"$.$", 7, "7.7"},
+		{"${0,3,d}", 7, "007"},
+		{"${-1,0,d}", 7, "6"},
+		{"${0,2,x}", 255, "ff"},
+		{"${0,4,X}", 255, "00FF"},
+		{"${0,0,o}", 8, "10"},
+	}
+
+	for _, c := range cases {
+		gotten, err := substituteGenerate(c.template, c.i)
+		if err != nil {
+			t.Errorf("error while substituting %q: %v", c.template, err)
+			continue
+		}
+
+		if gotten != c.expected {
+			t.Errorf("substituteGenerate(%q, %d) = %q, expected %q", c.template, c.i, gotten, c.expected)
+		}
+	}
+}
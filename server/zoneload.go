@@ -0,0 +1,73 @@
+package server
+
+import "io"
+
+const (
+	// defaultZoneProgressInterval is how many records are parsed from a zone
+	// file between reports of how far loading it got
+	defaultZoneProgressInterval = 100000
+
+	// rdataBlockSize is the size of the blocks the RDATA of parsed records is
+	// packed into
+	rdataBlockSize = 64 << 10
+)
+
+// intern returns name as the string earlier records with the same name have,
+// so that the records of a name share a single copy of it
+func (p *zoneParser) intern(name string) string {
+	if p.names == nil {
+		p.names = map[string]string{}
+	}
+
+	if interned, ok := p.names[name]; ok {
+		return interned
+	}
+
+	p.names[name] = name
+	return name
+}
+
+// pack copies value into the parser's current block of RDATA, so that parsed
+// records share a few large allocations instead of having one each. A block is
+// kept in memory as long as any record packed into it
+func (p *zoneParser) pack(value []byte) []byte {
+	if len(value) > rdataBlockSize/4 {
+		return value
+	}
+
+	if len(p.rdata)+len(value) > cap(p.rdata) {
+		p.rdata = make([]byte, 0, rdataBlockSize)
+	}
+
+	start := len(p.rdata)
+	p.rdata = append(p.rdata, value...)
+
+	// the capacity is capped, so appending to a record's value copies it
+	// rather than overwriting the next record's
+	return p.rdata[start:len(p.rdata):len(p.rdata)]
+}
+
+// add hands rr on to the parser's emit, and reports progress every
+// progressInterval records
+func (p *zoneParser) add(rr *ResourceRecord) {
+	p.emit(rr)
+	p.count++
+
+	if p.progress != nil && p.progressInterval > 0 && p.count%p.progressInterval == 0 {
+		p.progress(p.count)
+	}
+}
+
+// countingReader counts the bytes read through it, to tell how much of a zone
+// file was loaded
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	return n, err
+}
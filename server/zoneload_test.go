@@ -0,0 +1,63 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestZoneParserReportsProgress(t *testing.T) {
+	emitted := 0
+	p := newZoneParser("example.com", func(rr *ResourceRecord) {
+		emitted++
+	})
+	p.progressInterval = 100
+
+	// records are handed on as they're parsed, not collected until the end
+	reports := []int{}
+	p.progress = func(records int) {
+		if emitted != records {
+			t.Errorf("%d records emitted by the report of %d", emitted, records)
+		}
+		reports = append(reports, records)
+	}
+
+	if err := p.parse(strings.NewReader("$GENERATE 1-250 host-$ A 10.0.0.$\n")); err != nil {
+		t.Fatalf("error while parsing zone: %v", err)
+	}
+
+	if emitted != 250 || p.count != 250 {
+		t.Fatalf("expected 250 records, got %d", emitted)
+	}
+
+	if len(reports) != 2 || reports[0] != 100 || reports[1] != 200 {
+		t.Errorf("unexpected progress reports %v", reports)
+	}
+}
+
+func TestZoneParserPacksRecords(t *testing.T) {
+	records, err := ParseZoneFile(strings.NewReader(`$ORIGIN example.com.
+www  300  IN  A    192.0.2.1
+www  300  IN  A    192.0.2.2
+www  300  IN  TXT  "hello"
+`), "")
+	if err != nil {
+		t.Fatalf("error while parsing zone: %v", err)
+	}
+
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+
+	// appending to a packed value must not overwrite the next record's
+	grown := append(records[0].Value, 0xff)
+	if !bytes.Equal(records[1].Value, []byte{192, 0, 2, 2}) || len(grown) != 5 {
+		t.Errorf("appending to a record's value changed the next record to %v", records[1].Value)
+	}
+
+	for _, rr := range records {
+		if rr.Name != "www.example.com" {
+			t.Errorf("unexpected name %q", rr.Name)
+		}
+	}
+}
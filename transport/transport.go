@@ -0,0 +1,127 @@
+// Package transport frames DNS messages for the wire, so that programs other
+// than the server can reuse its message codec. Over streams like TCP and TLS
+// every message is prefixed with its two byte length (RFC 1035 section
+// 4.2.2, RFC 7766), over UDP every datagram is a message of its own:
+//
+//	msg, err := transport.ReadMsg(conn)
+//	...
+//	err = transport.WriteMsg(conn, resp)
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/nikochiko/dns-server/server"
+)
+
+// MaxMsgSize is the largest message that fits behind a two byte length
+// prefix, and in a UDP datagram
+const MaxMsgSize = 65535
+
+// ReadFrame reads a length prefixed message from r, in wire format
+func ReadFrame(r io.Reader) ([]byte, error) {
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, lenBuf); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("error while reading message: %v", err)
+	}
+
+	return msg, nil
+}
+
+// WriteFrame writes msg, in wire format, prefixed with its length to w. The
+// prefix and the message go out in a single write, so they aren't split into
+// separate TCP segments
+func WriteFrame(w io.Writer, msg []byte) error {
+	if len(msg) > MaxMsgSize {
+		return fmt.Errorf("message of %d bytes is too large, the limit is %d", len(msg), MaxMsgSize)
+	}
+
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("error while writing message: %v", err)
+	}
+
+	return nil
+}
+
+// ReadMsg reads a length prefixed message from a stream like a TCP or TLS
+// connection and decodes it strictly, see server.DecodeMessage
+func ReadMsg(r io.Reader) (*server.Message, error) {
+	buf, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := server.DecodeMessage(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error while decoding message: %v", err)
+	}
+
+	return msg, nil
+}
+
+// WriteMsg encodes msg and writes it length prefixed to a stream like a TCP
+// or TLS connection
+func WriteMsg(w io.Writer, msg *server.Message) error {
+	buf, err := msg.Encode()
+	if err != nil {
+		return fmt.Errorf("error while encoding message: %v", err)
+	}
+
+	return WriteFrame(w, buf)
+}
+
+// ReadPacket reads a datagram from conn and decodes it as a message, and
+// returns it along with the address it came from. A datagram that isn't a
+// message is returned as an error with its address, so that a server can
+// carry on with the next one
+func ReadPacket(conn net.PacketConn) (*server.Message, net.Addr, error) {
+	buf := make([]byte, MaxMsgSize)
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, addr, err
+	}
+
+	msg, err := server.DecodeMessage(buf[:n])
+	if err != nil {
+		return nil, addr, fmt.Errorf("error while decoding message from %s: %v", addr, err)
+	}
+
+	return msg, addr, nil
+}
+
+// WritePacket encodes msg and sends it to addr as a single datagram. It
+// doesn't truncate: msg must fit the UDP payload size the peer takes, 512
+// bytes without EDNS
+func WritePacket(conn net.PacketConn, addr net.Addr, msg *server.Message) error {
+	if addr == nil {
+		return errors.New("packet needs an address to be sent to")
+	}
+
+	buf, err := msg.Encode()
+	if err != nil {
+		return fmt.Errorf("error while encoding message: %v", err)
+	}
+
+	if len(buf) > MaxMsgSize {
+		return fmt.Errorf("message of %d bytes is too large, the limit is %d", len(buf), MaxMsgSize)
+	}
+
+	if _, err := conn.WriteTo(buf, addr); err != nil {
+		return fmt.Errorf("error while writing message to %s: %v", addr, err)
+	}
+
+	return nil
+}
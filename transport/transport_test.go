@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nikochiko/dns-server/server"
+)
+
+func testQuery(id uint16) *server.Message {
+	return &server.Message{
+		Header:    server.DNSHeader{ID: id, OpCode: server.QueryOp, RecursionDesired: true},
+		Questions: []*server.Question{{Name: "example.com", Type: &server.TypeA, Class: &server.ClassIN}},
+		EDNS:      &server.EDNS{UDPSize: 1232},
+	}
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		for id := uint16(1); id <= 2; id++ {
+			if err := WriteMsg(client, testQuery(id)); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	for id := uint16(1); id <= 2; id++ {
+		msg, err := ReadMsg(srv)
+		if err != nil {
+			t.Fatalf("error while reading message %d: %v", id, err)
+		}
+
+		if msg.Header.ID != id || len(msg.Questions) != 1 || msg.Questions[0].Name != "example.com" || msg.EDNS == nil || msg.EDNS.UDPSize != 1232 {
+			t.Errorf("unexpected message %v", msg)
+		}
+	}
+
+	if err := <-errs; err != nil {
+		t.Errorf("error while writing: %v", err)
+	}
+}
+
+func TestReadFrameNeedsWholeMessage(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := WriteFrame(&buf, []byte{1, 2, 3, 4}); err != nil {
+		t.Fatalf("error while writing frame: %v", err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), []byte{0, 4, 1, 2, 3, 4}) {
+		t.Errorf("unexpected frame %v", buf.Bytes())
+	}
+
+	if _, err := ReadFrame(bytes.NewReader(buf.Bytes()[:4])); err == nil {
+		t.Errorf("no error for a frame cut short")
+	}
+
+	if err := WriteFrame(&buf, make([]byte, MaxMsgSize+1)); err == nil {
+		t.Errorf("no error for a message too large for its length prefix")
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	defer a.Close()
+
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error while listening: %v", err)
+	}
+	defer b.Close()
+
+	if err := WritePacket(a, b.LocalAddr(), testQuery(7)); err != nil {
+		t.Fatalf("error while writing packet: %v", err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(2 * time.Second))
+	msg, from, err := ReadPacket(b)
+	if err != nil {
+		t.Fatalf("error while reading packet: %v", err)
+	}
+
+	if msg.Header.ID != 7 || from.String() != a.LocalAddr().String() {
+		t.Errorf("unexpected message %v from %s", msg, from)
+	}
+
+	// a datagram that isn't a message is an error, but its sender is known
+	a.WriteTo([]byte{1, 2, 3}, b.LocalAddr())
+	if _, from, err := ReadPacket(b); err == nil || from == nil {
+		t.Errorf("expected an error with the sender for garbage, got %v from %v", err, from)
+	}
+}